@@ -0,0 +1,93 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cas contains the validation responses of the CAS protocol
+package cas
+
+import "encoding/xml"
+
+// Namespace is the namespace of CAS validation responses
+const Namespace = "http://www.yale.edu/tp/cas"
+
+// Codes of validation failures
+const (
+	InvalidRequest    = "INVALID_REQUEST"
+	InvalidTicketSpec = "INVALID_TICKET_SPEC"
+	InvalidTicket     = "INVALID_TICKET"
+	InvalidService    = "INVALID_SERVICE"
+	InternalError     = "INTERNAL_ERROR"
+)
+
+// ServiceResponse is written with an explicit cas prefix, which some clients expect
+type ServiceResponse struct {
+	XMLName               xml.Name `xml:"cas:serviceResponse"`
+	Namespace             string   `xml:"xmlns:cas,attr"`
+	AuthenticationSuccess *AuthenticationSuccess
+	AuthenticationFailure *AuthenticationFailure
+}
+
+// NewSuccess returns a response for a validated ticket
+func NewSuccess(user string, attributes *Attributes) *ServiceResponse {
+	return &ServiceResponse{
+		Namespace: Namespace,
+		AuthenticationSuccess: &AuthenticationSuccess{
+			User:       user,
+			Attributes: attributes,
+		},
+	}
+}
+
+// NewFailure returns a response for a ticket that could not be validated
+func NewFailure(code, message string) *ServiceResponse {
+	return &ServiceResponse{
+		Namespace: Namespace,
+		AuthenticationFailure: &AuthenticationFailure{
+			Code:    code,
+			Message: message,
+		},
+	}
+}
+
+type AuthenticationSuccess struct {
+	XMLName    xml.Name `xml:"cas:authenticationSuccess"`
+	User       string   `xml:"cas:user"`
+	Attributes *Attributes
+}
+
+type AuthenticationFailure struct {
+	XMLName xml.Name `xml:"cas:authenticationFailure"`
+	Code    string   `xml:"code,attr"`
+	Message string   `xml:",chardata"`
+}
+
+type Attributes struct {
+	XMLName   xml.Name `xml:"cas:attributes"`
+	Attribute []Attribute
+}
+
+// Add includes an attribute with one element per value
+func (a *Attributes) Add(name string, values ...string) {
+	for _, value := range values {
+		a.Attribute = append(a.Attribute, Attribute{
+			XMLName: xml.Name{Local: "cas:" + name},
+			Value:   value,
+		})
+	}
+}
+
+// Attribute is named after the released attribute
+type Attribute struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
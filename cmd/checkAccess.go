@@ -0,0 +1,110 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/cobra"
+)
+
+// CheckAccessCmd returns the check-access command. The user's attributes are read from the identity provider's
+// attribute sources, or the users in the configuration file when it doesn't have any.
+func CheckAccessCmd(identityProvider *idp.IDP) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check-access id user",
+		Short: "check whether a user may access a service provider or client",
+		Long: `Evaluates the access rules of a service provider in the configuration file
+	or from metadata aggregates and queries for a user without logging in. OpenID Connect
+	client IDs, WS-Federation realms, and CAS service URLs are accepted as well. The user's attributes come from the attribute
+	sources and can be added to with flags. The user's authentication context,
+	address, and the time are given with flags.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// The rules are found the same way as at login
+			sp, err := identityProvider.AccessControl(args[0])
+			if err == idp.ErrUnknownServiceProvider {
+				return fmt.Errorf("no service provider, client, relying party, or CAS service is configured for %s", args[0])
+			}
+			if err != nil {
+				return err
+			}
+			flags := cmd.Flags()
+			user := &model.User{Name: args[1]}
+			user.Context, _ = flags.GetString("context")
+			sources := identityProvider.AttributeSources
+			if sources == nil {
+				source, err := idp.NewAttributeSource()
+				if err != nil {
+					return err
+				}
+				sources = []idp.AttributeSource{source}
+			}
+			for _, source := range sources {
+				if err := source.AddAttributes(user, &model.AuthnRequest{Issuer: sp.EntityID}); err != nil {
+					return err
+				}
+			}
+			attributes, _ := flags.GetStringArray("attribute")
+			for _, attribute := range attributes {
+				parts := strings.SplitN(attribute, "=", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("attribute %s is not in name=value format", attribute)
+				}
+				addAttributeValue(user, parts[0], parts[1])
+			}
+			address, _ := flags.GetString("ip")
+			ip := net.ParseIP(address)
+			if address != "" && ip == nil {
+				return fmt.Errorf("%s is not an IP address", address)
+			}
+			now := time.Now()
+			if at, _ := flags.GetString("time"); at != "" {
+				if now, err = time.Parse(time.RFC3339, at); err != nil {
+					return err
+				}
+			}
+			err = sp.CheckAccess(user, ip, now)
+			if denied, ok := err.(*idp.AccessDeniedError); ok {
+				fmt.Fprintln(out, "Denied:", denied.Reason)
+				return nil
+			}
+			if err == nil {
+				fmt.Fprintf(out, "Allowed: %s may access %s\n", user.Name, sp.EntityID)
+			}
+			return err
+		},
+	}
+	cmd.Flags().StringArray("attribute", nil, "additional attribute value of the user in name=value format")
+	cmd.Flags().String("context", "", "authentication context class the user logged in with")
+	cmd.Flags().String("ip", "", "address the user connects from")
+	cmd.Flags().String("time", "", "time of the login in RFC 3339 format (default now)")
+	return cmd
+}
+
+func addAttributeValue(user *model.User, name, value string) {
+	for _, att := range user.Attributes {
+		if att.Name == name {
+			att.Value = append(att.Value, value)
+			return
+		}
+	}
+	user.Attributes = append(user.Attributes, &model.Attribute{Name: name, Value: []string{value}})
+}
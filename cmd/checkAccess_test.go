@@ -0,0 +1,138 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/amdonov/lite-idp/internal/testcert"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func checkAccess(args ...string) (output string, err error) {
+	return checkAccessWith(&idp.IDP{}, args...)
+}
+
+func checkAccessWith(identityProvider *idp.IDP, args ...string) (output string, err error) {
+	rootCmd := &cobra.Command{Use: "lite-idp", Args: cobra.NoArgs, Run: emptyRun}
+	rootCmd.AddCommand(CheckAccessCmd(identityProvider))
+	return executeCommand(rootCmd, append([]string{"check-access"}, args...)...)
+}
+
+// federationMetadata is a metadata provider with a single service provider
+type federationMetadata struct {
+	sp *idp.ServiceProvider
+}
+
+func (m federationMetadata) ServiceProvider(entityID string) (*idp.ServiceProvider, error) {
+	if entityID == m.sp.EntityID {
+		return m.sp, nil
+	}
+	return nil, idp.ErrUnknownServiceProvider
+}
+
+func TestCheckAccessCommand(t *testing.T) {
+	viper.Set("sps", []map[string]interface{}{{
+		"entityID":    "https://finance.example.com/",
+		"certificate": base64.StdEncoding.EncodeToString(testcert.Throwaway(t)),
+		"accessRules": []map[string]interface{}{{
+			"attributes": []map[string]interface{}{{"name": "groups", "values": []string{"finance"}}},
+			"networks":   []string{"10.0.0.0/8"},
+			"times":      []map[string]interface{}{{"days": []string{"Mon", "Tue", "Wed", "Thu", "Fri"}, "start": "08:00", "end": "18:00"}},
+		}},
+	}})
+	defer viper.Set("sps", nil)
+
+	output, err := checkAccess("https://finance.example.com/", "joe", "--attribute", "groups=users",
+		"--attribute", "groups=finance", "--ip", "10.1.2.3", "--time", "2019-06-03T09:00:00Z")
+	if assert.NoError(t, err) {
+		checkStringContains(t, output, "Allowed: joe may access https://finance.example.com/")
+	}
+	output, err = checkAccess("https://finance.example.com/", "joe", "--attribute", "groups=finance",
+		"--ip", "10.1.2.3", "--time", "2019-06-01T09:00:00Z")
+	if assert.NoError(t, err) {
+		checkStringContains(t, output, "Denied: joe is not allowed to access https://finance.example.com/")
+	}
+
+	// Attributes come from the attribute sources
+	viper.Set("users", []idp.UserAttributes{{Name: "jane", Attributes: map[string][]string{"groups": {"finance"}}}})
+	defer viper.Set("users", nil)
+	output, err = checkAccess("https://finance.example.com/", "jane", "--ip", "10.1.2.3",
+		"--time", "2019-06-03T09:00:00Z")
+	if assert.NoError(t, err) {
+		checkStringContains(t, output, "Allowed: jane may access https://finance.example.com/")
+	}
+
+	_, err = checkAccess("https://other.example.com/", "joe")
+	if assert.Error(t, err) {
+		checkStringContains(t, err.Error(), "no service provider, client, relying party, or CAS service is configured for https://other.example.com/")
+	}
+}
+
+func TestCheckAccessCommandClients(t *testing.T) {
+	rules := []map[string]interface{}{{"networks": []string{"10.0.0.0/8"}}}
+	viper.Set("oidc-clients", []map[string]interface{}{{
+		"clientID":     "payroll",
+		"redirectURIs": []string{"https://payroll.example.com/callback"},
+		"accessRules":  rules,
+	}})
+	defer viper.Set("oidc-clients", nil)
+	viper.Set("wsfed-relying-parties", []map[string]interface{}{{
+		"realm":       "urn:portal",
+		"replyURLs":   []string{"https://portal.example.com/"},
+		"accessRules": rules,
+	}})
+	defer viper.Set("wsfed-relying-parties", nil)
+	viper.Set("cas-services", []map[string]interface{}{{
+		"name":           "wiki",
+		"servicePattern": `https://wiki\.example\.com/.*`,
+		"accessRules":    rules,
+	}})
+	defer viper.Set("cas-services", nil)
+
+	for id, name := range map[string]string{
+		"payroll":                        "payroll",
+		"urn:portal":                     "urn:portal",
+		"https://wiki.example.com/login": "wiki",
+	} {
+		output, err := checkAccess(id, "joe", "--ip", "10.1.2.3")
+		if assert.NoError(t, err) {
+			checkStringContains(t, output, "Allowed: joe may access "+name)
+		}
+		output, err = checkAccess(id, "joe", "--ip", "192.168.1.1")
+		if assert.NoError(t, err) {
+			checkStringContains(t, output, "Denied: joe is not allowed to access "+name)
+		}
+	}
+}
+
+func TestCheckAccessCommandMetadataProviders(t *testing.T) {
+	identityProvider := &idp.IDP{MetadataProviders: []idp.MetadataProvider{federationMetadata{&idp.ServiceProvider{
+		EntityID:    "https://wiki.federation.example.org/",
+		AccessRules: []idp.AccessRule{{Networks: []string{"10.0.0.0/8"}}},
+	}}}}
+	output, err := checkAccessWith(identityProvider, "https://wiki.federation.example.org/", "joe", "--ip", "10.1.2.3")
+	if assert.NoError(t, err) {
+		checkStringContains(t, output, "Allowed: joe may access https://wiki.federation.example.org/")
+	}
+	output, err = checkAccessWith(identityProvider, "https://wiki.federation.example.org/", "joe", "--ip", "192.168.1.1")
+	if assert.NoError(t, err) {
+		checkStringContains(t, output, "Denied: joe is not allowed to access https://wiki.federation.example.org/")
+	}
+}
@@ -27,7 +27,8 @@ func ClusterCmd() *cobra.Command {
 		Use:   "cluster",
 		Short: "runs idp with shared state",
 		Long: `Support running multiple instances of idp. 
-Cache data is stored in Redis.`,
+Cache data, persistent name identifiers, and consent decisions
+are stored in Redis.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			tempCache, err := redis.New(viper.GetDuration("temp-cache-duration"))
 			if err != nil {
@@ -37,9 +38,36 @@ Cache data is stored in Redis.`,
 			if err != nil {
 				return err
 			}
+			replayCache, err := redis.New(idp.ReplayCacheDuration())
+			if err != nil {
+				return err
+			}
+			assertionCache, err := redis.New(viper.GetDuration("assertion-cache-duration"))
+			if err != nil {
+				return err
+			}
+			exchangeCache, err := redis.New(viper.GetDuration("exchange-cache-duration"))
+			if err != nil {
+				return err
+			}
+			// Persistent identifiers and consent decisions must be the same on every instance, so they aren't kept
+			// in files
+			nameIDStore, err := redis.NewNameIDStore()
+			if err != nil {
+				return err
+			}
+			consentStore, err := redis.NewConsentStore()
+			if err != nil {
+				return err
+			}
 			return ServeCmd(&idp.IDP{
-				TempCache: tempCache,
-				UserCache: userCache,
+				TempCache:      tempCache,
+				UserCache:      userCache,
+				ReplayCache:    replayCache,
+				AssertionCache: assertionCache,
+				ExchangeCache:  exchangeCache,
+				NameIDStore:    nameIDStore,
+				ConsentStore:   consentStore,
 			}).RunE(cmd, args)
 		},
 		Args: cobra.NoArgs,
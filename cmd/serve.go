@@ -56,7 +56,7 @@ func ServeCmd(indentityProvider *idp.IDP) *cobra.Command {
 				return err
 			}
 			log.Info("server shutdown cleanly")
-			return nil
+			return indentityProvider.Close()
 		},
 		Args: cobra.NoArgs,
 	}
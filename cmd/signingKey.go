@@ -0,0 +1,163 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// signingKeyCmd represents the signing-key command
+var signingKeyCmd = &cobra.Command{
+	Use:   "signing-key name",
+	Short: "generate and stage a new signing key",
+	Long: `Generates a new RSA key and self-signed certificate and adds them to the
+	signing keystore in the configuration file. The key is published in metadata
+	right away and becomes the active signing key at its activation time.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		keys := []idp.SigningKey{}
+		if err := viper.UnmarshalKey("signing-keys", &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key.Name == name {
+				return fmt.Errorf("signing key %s already exists", name)
+			}
+		}
+		flags := cmd.Flags()
+		dir, _ := flags.GetString("dir")
+		bits, _ := flags.GetInt("bits")
+		validFor, _ := flags.GetDuration("valid-for")
+		activateIn, _ := flags.GetDuration("activate-in")
+		if !flags.Changed("activate-in") {
+			activateIn = time.Duration(viper.GetInt("signing-key-publish-days")) * 24 * time.Hour
+		}
+		var password []byte
+		encrypt, _ := flags.GetBool("encrypt")
+		if encrypt {
+			fmt.Fprint(out, "Enter Password: ")
+			var err error
+			if password, err = terminal.ReadPassword(int(syscall.Stdin)); err != nil {
+				return err
+			}
+			fmt.Fprintln(out)
+		}
+		certPEM, keyPEM, err := generateSigningKey(bits, validFor, password)
+		if err != nil {
+			return err
+		}
+		key := idp.SigningKey{
+			Name:        name,
+			Certificate: filepath.Join(dir, fmt.Sprintf("%s-signing-cert.pem", name)),
+			PrivateKey:  filepath.Join(dir, fmt.Sprintf("%s-signing-key.pem", name)),
+			Activates:   time.Now().Add(activateIn).UTC().Format(time.RFC3339),
+		}
+		// The password is never written to the configuration file
+		if encrypt {
+			key.PasswordEnv, _ = flags.GetString("password-env")
+			if key.PasswordEnv == "" {
+				key.PasswordEnv = passwordEnvName(name)
+			}
+		}
+		if err = ioutil.WriteFile(key.Certificate, certPEM, 0644); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(key.PrivateKey, keyPEM, 0600); err != nil {
+			return err
+		}
+		viper.Set("signing-keys", append(keys, key))
+		if err = viper.WriteConfig(); err == nil {
+			fmt.Fprintf(out, "Staged signing key %s, which activates at %s\n", name, key.Activates)
+			if key.PasswordEnv != "" {
+				fmt.Fprintf(out, "Set %s to the key's password before starting the IdP\n", key.PasswordEnv)
+			}
+		}
+		return err
+	},
+}
+
+// passwordEnvName returns the default environment variable for the password of the named key
+func passwordEnvName(name string) string {
+	return "LITE_IDP_SIGNING_KEY_" + strings.ToUpper(strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)) + "_PASSWORD"
+}
+
+// generateSigningKey returns a PEM encoded self-signed certificate and RSA private key. The key is encrypted if a
+// password is provided.
+func generateSigningKey(bits int, validFor time.Duration, password []byte) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _, err := net.SplitHostPort(viper.GetString("server-name"))
+	if err != nil {
+		host = viper.GetString("server-name")
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now,
+		NotAfter:     now.Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if len(password) > 0 {
+		if block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, password, x509.PEMCipherAES256); err != nil {
+			return nil, nil, err
+		}
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(block), nil
+}
+
+func init() {
+	signingKeyCmd.Flags().String("dir", "/etc/lite-idp", "directory for the new key and certificate")
+	signingKeyCmd.Flags().Int("bits", 2048, "RSA key size")
+	signingKeyCmd.Flags().Duration("valid-for", 5*365*24*time.Hour, "certificate validity period")
+	signingKeyCmd.Flags().Duration("activate-in", 0, "time until the key becomes active (default signing-key-publish-days)")
+	signingKeyCmd.Flags().Bool("encrypt", false, "prompt for a password to encrypt the private key")
+	signingKeyCmd.Flags().String("password-env", "", "environment variable the IdP reads the password from (default LITE_IDP_SIGNING_KEY_<NAME>_PASSWORD)")
+	AddCmd.AddCommand(signingKeyCmd)
+}
@@ -0,0 +1,69 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func addSigningKey(args ...string) (output string, err error) {
+	// set a dummy config file for the command to write to
+	viper.SetConfigFile("config.yaml")
+
+	rootCmd := &cobra.Command{Use: "add", Args: cobra.NoArgs, Run: emptyRun}
+	rootCmd.AddCommand(signingKeyCmd)
+	return executeCommand(rootCmd, append([]string{"signing-key"}, args...)...)
+}
+
+func TestAddSigningKeyCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer viper.Set("signing-keys", nil)
+	output, err := addSigningKey("next", "--dir", dir, "--bits", "1024", "--activate-in", "48h")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkStringContains(t, output, "Staged signing key next")
+
+	keys := []idp.SigningKey{}
+	if err = viper.UnmarshalKey("signing-keys", &keys); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, keys, 1) {
+		activates, err := time.Parse(time.RFC3339, keys[0].Activates)
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(48*time.Hour), activates, time.Minute)
+		assert.FileExists(t, keys[0].Certificate)
+		assert.FileExists(t, keys[0].PrivateKey)
+	}
+
+	_, err = addSigningKey("next", "--dir", dir)
+	assert.Error(t, err, "names must be unique")
+}
+
+func Test_passwordEnvName(t *testing.T) {
+	assert.Equal(t, "LITE_IDP_SIGNING_KEY_NEXT_2020_PASSWORD", passwordEnvName("next-2020"))
+}
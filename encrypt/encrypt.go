@@ -0,0 +1,227 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encrypt implements the subset of XML Encryption needed to send encrypted SAML elements to service
+// providers. Elements are encrypted with AES-GCM under a random key that is transported with RSA-OAEP.
+package encrypt
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/amdonov/xmlsig"
+)
+
+const (
+	// TypeElement identifies encrypted data that replaces an entire element
+	TypeElement = "http://www.w3.org/2001/04/xmlenc#Element"
+	// AES256GCM is the only supported data encryption algorithm
+	AES256GCM = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+	// RSAOAEP is RSA-OAEP with the digest and mask generation function named in the encryption method
+	RSAOAEP = "http://www.w3.org/2009/xmlenc11#rsa-oaep"
+	// RSAOAEPMGF1P is RSA-OAEP with SHA-1 for mask generation and, by default, for the digest
+	RSAOAEPMGF1P = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+
+	digestSHA1   = "http://www.w3.org/2000/09/xmldsig#sha1"
+	digestSHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+	mgf1SHA256   = "http://www.w3.org/2009/xmlenc11#mgf1sha256"
+)
+
+type EncryptedData struct {
+	XMLName          xml.Name `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedData"`
+	Type             string   `xml:",attr,omitempty"`
+	EncryptionMethod EncryptionMethod
+	KeyInfo          *KeyInfo
+	CipherData       CipherData
+}
+
+type EncryptedKey struct {
+	XMLName          xml.Name `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedKey"`
+	Recipient        string   `xml:",attr,omitempty"`
+	EncryptionMethod EncryptionMethod
+	KeyInfo          *KeyInfo
+	CipherData       CipherData
+}
+
+type EncryptionMethod struct {
+	XMLName      xml.Name      `xml:"http://www.w3.org/2001/04/xmlenc# EncryptionMethod"`
+	Algorithm    string        `xml:",attr"`
+	DigestMethod *DigestMethod `xml:"http://www.w3.org/2000/09/xmldsig# DigestMethod"`
+	MGF          *MGF
+}
+
+type DigestMethod struct {
+	Algorithm string `xml:",attr"`
+}
+
+type MGF struct {
+	XMLName   xml.Name `xml:"http://www.w3.org/2009/xmlenc11# MGF"`
+	Algorithm string   `xml:",attr"`
+}
+
+// KeyInfo either carries the encrypted data key or identifies the certificate the key was encrypted for
+type KeyInfo struct {
+	XMLName      xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+	EncryptedKey *EncryptedKey
+	X509Data     *xmlsig.X509Data
+}
+
+type CipherData struct {
+	XMLName     xml.Name `xml:"http://www.w3.org/2001/04/xmlenc# CipherData"`
+	CipherValue string   `xml:"http://www.w3.org/2001/04/xmlenc# CipherValue"`
+}
+
+// Encrypt marshals the element and encrypts it for the owner of the certificate. Only RSA certificates are
+// supported because key agreement isn't implemented.
+func Encrypt(element interface{}, cert *x509.Certificate) (*EncryptedData, error) {
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("encryption requires an RSA certificate, not %T", cert.PublicKey)
+	}
+	plaintext, err := xml.Marshal(element)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The cipher value is the nonce followed by the ciphertext and tag
+	ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedData{
+		Type: TypeElement,
+		EncryptionMethod: EncryptionMethod{
+			Algorithm: AES256GCM,
+		},
+		KeyInfo: &KeyInfo{
+			EncryptedKey: &EncryptedKey{
+				EncryptionMethod: EncryptionMethod{
+					Algorithm:    RSAOAEP,
+					DigestMethod: &DigestMethod{Algorithm: digestSHA256},
+					MGF:          &MGF{Algorithm: mgf1SHA256},
+				},
+				KeyInfo: &KeyInfo{
+					X509Data: &xmlsig.X509Data{
+						X509Certificate: base64.StdEncoding.EncodeToString(cert.Raw),
+					},
+				},
+				CipherData: CipherData{
+					CipherValue: base64.StdEncoding.EncodeToString(encryptedKey),
+				},
+			},
+		},
+		CipherData: CipherData{
+			CipherValue: base64.StdEncoding.EncodeToString(ciphertext),
+		},
+	}, nil
+}
+
+// Decrypt returns the XML of the encrypted element. The data key must be carried in the encrypted data or passed
+// as one of the encrypted keys, which are often siblings of the encrypted data in SAML.
+func Decrypt(data *EncryptedData, key crypto.Decrypter, keys ...EncryptedKey) ([]byte, error) {
+	if data.EncryptionMethod.Algorithm != AES256GCM {
+		return nil, fmt.Errorf("unsupported data encryption algorithm %s", data.EncryptionMethod.Algorithm)
+	}
+	if data.KeyInfo != nil && data.KeyInfo.EncryptedKey != nil {
+		keys = append([]EncryptedKey{*data.KeyInfo.EncryptedKey}, keys...)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("encrypted data does not include a key")
+	}
+	var (
+		dataKey []byte
+		err     error
+	)
+	// Use the first key that can be decrypted since there may be one for each recipient
+	for _, encryptedKey := range keys {
+		if dataKey, err = decryptKey(&encryptedKey, key); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(data.CipherData.CipherValue)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func decryptKey(encryptedKey *EncryptedKey, key crypto.Decrypter) ([]byte, error) {
+	method := encryptedKey.EncryptionMethod
+	// Go uses the same hash for the digest and mask generation, both of which default to SHA-1
+	digest := crypto.SHA1
+	switch method.Algorithm {
+	case RSAOAEPMGF1P:
+	case RSAOAEP:
+		if method.MGF != nil {
+			if method.MGF.Algorithm != mgf1SHA256 {
+				return nil, fmt.Errorf("unsupported mask generation function %s", method.MGF.Algorithm)
+			}
+			digest = crypto.SHA256
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key transport algorithm %s", method.Algorithm)
+	}
+	expected := digestSHA1
+	if digest == crypto.SHA256 {
+		expected = digestSHA256
+	}
+	if method.DigestMethod != nil && method.DigestMethod.Algorithm != expected {
+		return nil, fmt.Errorf("unsupported key transport digest %s", method.DigestMethod.Algorithm)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encryptedKey.CipherData.CipherValue)
+	if err != nil {
+		return nil, err
+	}
+	return key.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{Hash: digest})
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,84 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/xml"
+	"testing"
+
+	"github.com/amdonov/lite-idp/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+type testElement struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	Format  string   `xml:",attr"`
+	Value   string   `xml:",chardata"`
+}
+
+func TestEncrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	element := testElement{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent", Value: "abc"}
+	data, err := Encrypt(element, testcert.New(t, key).Leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the encrypted data survives a round trip through XML
+	out, err := xml.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = &EncryptedData{}
+	if err = xml.Unmarshal(out, data); err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := Decrypt(data, key)
+	if assert.NoError(t, err) {
+		decrypted := testElement{}
+		if assert.NoError(t, xml.Unmarshal(plaintext, &decrypted)) {
+			assert.Equal(t, element.Value, decrypted.Value)
+			assert.Equal(t, element.Format, decrypted.Format)
+		}
+	}
+
+	// Keys can be passed separately from the data
+	encryptedKey := *data.KeyInfo.EncryptedKey
+	data.KeyInfo = nil
+	_, err = Decrypt(data, key, encryptedKey)
+	assert.NoError(t, err)
+	_, err = Decrypt(data, key)
+	assert.Error(t, err)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Decrypt(data, other, encryptedKey)
+	assert.Error(t, err, "expected decryption with another key to fail")
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Encrypt(element, testcert.New(t, ecKey).Leaf)
+	assert.Error(t, err, "expected ECDSA certificates to be rejected")
+}
@@ -0,0 +1,328 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// AccessRule describes users who are allowed to receive assertions for a service provider. Users must meet every
+// condition that's set.
+type AccessRule struct {
+	// Attribute values users must have. Users need one of the values of each attribute.
+	Attributes []AttributeRequirement
+	// Authentication context classes users must have logged in with
+	AuthnContexts []string
+	// Networks in CIDR notation users must connect from
+	Networks []string
+	// Periods users may log in during
+	Times []TimeWindow
+}
+
+// AttributeRequirement is an attribute users must have one of the values of
+type AttributeRequirement struct {
+	Name   string
+	Values []string
+}
+
+// TimeWindow is a daily period such as 08:00 to 18:00 on weekdays
+type TimeWindow struct {
+	// Days of the week such as Monday or Mon. Every day when empty.
+	Days []string
+	// Start and end in 24 hour HH:MM format. Windows that end before they start span midnight. The window covers
+	// whole days when both are empty.
+	Start string
+	End   string
+	// Time zone such as America/New_York. Defaults to UTC.
+	Location string
+}
+
+// AccessDeniedError reports why a user isn't allowed to access a service provider
+type AccessDeniedError struct {
+	Reason string
+}
+
+func (e *AccessDeniedError) Error() string {
+	return e.Reason
+}
+
+// CheckAccess evaluates the service provider's access rules for a user connecting from the address at a point in
+// time. Users who meet any rule are allowed. An AccessDeniedError is returned for other users.
+func (sp *ServiceProvider) CheckAccess(user *model.User, ip net.IP, now time.Time) error {
+	if len(sp.AccessRules) == 0 {
+		return nil
+	}
+	var reasons []string
+	for _, rule := range sp.AccessRules {
+		reason, err := rule.check(user, ip, now)
+		if err != nil {
+			return fmt.Errorf("invalid access rule for %s: %s", sp.EntityID, err)
+		}
+		if reason == "" {
+			return nil
+		}
+		reasons = append(reasons, reason)
+	}
+	return &AccessDeniedError{Reason: fmt.Sprintf("%s is not allowed to access %s: %s", user.Name, sp.EntityID,
+		strings.Join(reasons, "; "))}
+}
+
+// validateAccessRules makes sure the service provider's access rules can be evaluated
+func (sp *ServiceProvider) validateAccessRules() error {
+	for _, rule := range sp.AccessRules {
+		if _, err := parseNetworks(rule.Networks); err != nil {
+			return err
+		}
+		for _, window := range rule.Times {
+			if _, err := window.contains(time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// accessDeniedPage reports whether users who are denied access are shown a page rather than sent back to the
+// service provider
+func (sp *ServiceProvider) accessDeniedPage() bool {
+	if sp.AccessDeniedPage != nil {
+		return *sp.AccessDeniedPage
+	}
+	return viper.GetBool("access-denied-page")
+}
+
+// check returns why the user doesn't meet the rule or an empty string when they do
+func (rule AccessRule) check(user *model.User, ip net.IP, now time.Time) (string, error) {
+	for _, required := range rule.Attributes {
+		if !hasAttributeValue(user.Attributes, required) {
+			return fmt.Sprintf("missing required %s attribute value", required.Name), nil
+		}
+	}
+	if len(rule.AuthnContexts) > 0 && !contains(rule.AuthnContexts, user.Context) {
+		return fmt.Sprintf("authentication context %s is not allowed", user.Context), nil
+	}
+	networks, err := parseNetworks(rule.Networks)
+	if err != nil {
+		return "", err
+	}
+	if len(networks) > 0 {
+		allowed := false
+		for _, network := range networks {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Sprintf("address %s is not allowed", ip), nil
+		}
+	}
+	if len(rule.Times) > 0 {
+		allowed := false
+		for _, window := range rule.Times {
+			ok, err := window.contains(now)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Sprintf("access is not allowed at %s", now.UTC().Format(time.RFC3339)), nil
+		}
+	}
+	return "", nil
+}
+
+func hasAttributeValue(atts []*model.Attribute, required AttributeRequirement) bool {
+	for _, att := range atts {
+		if att.Name != required.Name {
+			continue
+		}
+		for _, value := range att.Value {
+			if contains(required.Values, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks[i] = network
+	}
+	return networks, nil
+}
+
+// contains reports whether the time falls in the window
+func (window TimeWindow) contains(now time.Time) (bool, error) {
+	loc := time.UTC
+	if window.Location != "" {
+		var err error
+		if loc, err = time.LoadLocation(window.Location); err != nil {
+			return false, err
+		}
+	}
+	start, err := minuteOfDay(window.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := minuteOfDay(window.End)
+	if err != nil {
+		return false, err
+	}
+	days := make(map[time.Weekday]bool, len(window.Days))
+	for _, name := range window.Days {
+		day, err := parseWeekday(name)
+		if err != nil {
+			return false, err
+		}
+		days[day] = true
+	}
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	if end <= start {
+		// The window spans midnight, so early times belong to the window that started the day before
+		if minute >= end && minute < start {
+			return false, nil
+		}
+		if minute < end {
+			day = (day + 6) % 7
+		}
+	} else if minute < start || minute >= end {
+		return false, nil
+	}
+	return len(days) == 0 || days[day], nil
+}
+
+func minuteOfDay(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("time %q is not in HH:MM format", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(name, day.String()) || strings.EqualFold(name, day.String()[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day of the week %s", name)
+}
+
+// accessControl returns the access rules that apply to the request as a service provider. OpenID Connect clients,
+// WS-Federation relying parties, and CAS services are checked the same way as SAML service providers.
+func (i *IDP) accessControl(authRequest *model.AuthnRequest) (*ServiceProvider, bool) {
+	switch authRequest.ProtocolBinding {
+	case oidcCodeBinding:
+		if client, ok := i.oidcClients[authRequest.Issuer]; ok {
+			return client.accessControl(), true
+		}
+		return nil, false
+	case wsfedBinding:
+		if rp, ok := i.relyingParties[authRequest.Issuer]; ok {
+			return rp.accessControl(), true
+		}
+		return nil, false
+	case casBinding:
+		if service := i.casService(authRequest.AssertionConsumerServiceURL); service != nil {
+			return service.accessControl(), true
+		}
+		return nil, false
+	default:
+		return i.getServiceProvider(authRequest.Issuer)
+	}
+}
+
+// AccessControl returns the access rules of the OpenID Connect client, WS-Federation realm, CAS service URL, or
+// service provider with the ID. They are found the same way as at login. The configuration is read the first time
+// when the handler hasn't been created yet.
+func (i *IDP) AccessControl(id string) (*ServiceProvider, error) {
+	if err := i.configureServices(); err != nil {
+		return nil, err
+	}
+	if client, ok := i.oidcClients[id]; ok {
+		return client.accessControl(), nil
+	}
+	if rp, ok := i.relyingParties[id]; ok {
+		return rp.accessControl(), nil
+	}
+	if sp, ok := i.getServiceProvider(id); ok {
+		return sp, nil
+	}
+	if service := i.casService(id); service != nil {
+		return service.accessControl(), nil
+	}
+	return nil, ErrUnknownServiceProvider
+}
+
+// denyAccess tells the service provider the user isn't allowed to access it or, when the service provider prefers,
+// shows the user a page saying so. ECP clients always receive a SAML response.
+func (i *IDP) denyAccess(authRequest *model.AuthnRequest, user *model.User, sp *ServiceProvider, reason string,
+	w http.ResponseWriter, r *http.Request) error {
+	i.auditDenied(user, authRequest, reason)
+	if authRequest.ProtocolBinding == "urn:oasis:names:tc:SAML:2.0:bindings:PAOS" || !sp.accessDeniedPage() {
+		return i.sendErrorResponse(authRequest, &requestError{
+			status:  statusRequestDenied,
+			message: "user is not allowed to access the service provider",
+		}, w, r)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	return accessDeniedTemplate.Execute(w, sp.displayName())
+}
+
+// auditDenied logs that the user was denied and passes the denial to the auditor when it captures them
+func (i *IDP) auditDenied(user *model.User, authRequest *model.AuthnRequest, reason string) {
+	log.Info(reason)
+	if auditor, ok := i.Auditor.(DenialAuditor); ok {
+		auditor.LogDenied(user, authRequest, reason)
+	}
+}
+
+var accessDeniedTemplate = template.Must(template.New("access-denied").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Access denied</title>
+</head>
+<body>
+<h1>Access denied</h1>
+<p>You are not allowed to access {{ . }}. Contact your administrator if you believe you should have access.</p>
+</body>
+</html>`))
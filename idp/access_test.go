@@ -0,0 +1,250 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingAuditor struct {
+	auditor
+	denied []string
+}
+
+func (a *recordingAuditor) LogDenied(user *model.User, request *model.AuthnRequest, reason string) {
+	a.denied = append(a.denied, reason)
+}
+
+func TestServiceProvider_CheckAccess(t *testing.T) {
+	sp := &ServiceProvider{
+		EntityID: "https://finance.example.com/",
+		AccessRules: []AccessRule{
+			{
+				Attributes: []AttributeRequirement{{Name: "groups", Values: []string{"finance", "audit"}}},
+				Networks:   []string{"10.0.0.0/8"},
+				Times: []TimeWindow{{
+					Days:     []string{"Monday", "Tue", "wednesday", "Thu", "Fri"},
+					Start:    "08:00",
+					End:      "18:00",
+					Location: "America/New_York",
+				}},
+			},
+			// Administrators with certificates are always allowed
+			{
+				Attributes:    []AttributeRequirement{{Name: "groups", Values: []string{"admins"}}},
+				AuthnContexts: []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:X509"},
+			},
+		},
+	}
+	user := func(context string, groups ...string) *model.User {
+		return &model.User{Name: "joe", Context: context,
+			Attributes: []*model.Attribute{{Name: "groups", Value: groups}}}
+	}
+	password := "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	certificate := "urn:oasis:names:tc:SAML:2.0:ac:classes:X509"
+	office := net.ParseIP("10.1.2.3")
+	home := net.ParseIP("192.0.2.1")
+	// Monday at 9:00 in New York
+	workday := time.Date(2019, 6, 3, 13, 0, 0, 0, time.UTC)
+	saturday := workday.AddDate(0, 0, 5)
+	tests := []struct {
+		name    string
+		user    *model.User
+		ip      net.IP
+		now     time.Time
+		allowed bool
+	}{
+		{"finance at work", user(password, "users", "finance"), office, workday, true},
+		{"auditors", user(password, "audit"), office, workday, true},
+		{"wrong group", user(password, "users"), office, workday, false},
+		{"wrong network", user(password, "finance"), home, workday, false},
+		{"no address", user(password, "finance"), nil, workday, false},
+		{"weekend", user(password, "finance"), office, saturday, false},
+		{"evening", user(password, "finance"), office, workday.Add(9 * time.Hour), false},
+		{"admin with certificate", user(certificate, "admins"), home, saturday, true},
+		{"admin with password", user(password, "admins"), home, saturday, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sp.CheckAccess(tt.user, tt.ip, tt.now)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				_, denied := err.(*AccessDeniedError)
+				assert.True(t, denied, "expected access to be denied but got %v", err)
+			}
+		})
+	}
+
+	// Everyone is allowed without rules
+	assert.NoError(t, (&ServiceProvider{}).CheckAccess(user(password), home, saturday))
+}
+
+func TestTimeWindow_contains(t *testing.T) {
+	// Friday night shift
+	window := TimeWindow{Days: []string{"Fri"}, Start: "22:00", End: "06:00"}
+	friday := time.Date(2019, 6, 7, 0, 0, 0, 0, time.UTC)
+	for hour, want := range map[int]bool{21: false, 22: true, 23: true, 24: true, 29: true, 30: false, 46: false} {
+		ok, err := window.contains(friday.Add(time.Duration(hour) * time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, want, ok, "hour %d", hour)
+	}
+
+	// Whole days
+	window = TimeWindow{Days: []string{"Sat", "Sun"}}
+	ok, err := window.contains(friday.AddDate(0, 0, 1).Add(23 * time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = window.contains(friday.Add(23 * time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestServiceProvider_validateAccessRules(t *testing.T) {
+	for _, rule := range []AccessRule{
+		{Networks: []string{"10.0.0.0"}},
+		{Times: []TimeWindow{{Start: "8am"}}},
+		{Times: []TimeWindow{{Days: []string{"Someday"}}}},
+		{Times: []TimeWindow{{Location: "Nowhere/Special"}}},
+	} {
+		sp := &ServiceProvider{AccessRules: []AccessRule{rule}}
+		assert.Error(t, sp.validateAccessRules(), "%+v", rule)
+	}
+}
+
+func TestIDP_denyAccess(t *testing.T) {
+	auditor := &recordingAuditor{}
+	i := &IDP{Auditor: auditor}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	sp := &ServiceProvider{
+		EntityID:    "https://finance.example.com/",
+		DisplayName: "Finance",
+		AccessRules: []AccessRule{{
+			Attributes: []AttributeRequirement{{Name: "groups", Values: []string{"finance"}}},
+		}},
+	}
+	i.sps[sp.EntityID] = sp
+	defer delete(i.sps, sp.EntityID)
+	req := &model.AuthnRequest{
+		ID:                          "_123",
+		Issuer:                      sp.EntityID,
+		ProtocolBinding:             "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+		AssertionConsumerServiceURL: "https://finance.example.com/acs",
+	}
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{{Name: "groups", Value: []string{"users"}}}}
+	respond := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if err := i.respond(req, user, w, httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w := respond()
+	body := w.Body.String()
+	value := body[strings.Index(body, `name="SAMLResponse"`):]
+	value = value[strings.Index(value, `value="`)+7:]
+	data, err := base64.StdEncoding.DecodeString(value[:strings.Index(value, `"`)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), statusRequestDenied)
+	assert.NotContains(t, string(data), "joe")
+	if assert.Len(t, auditor.denied, 1) {
+		assert.Contains(t, auditor.denied[0], "missing required groups attribute value")
+	}
+
+	// Users can be shown a page instead
+	page := true
+	sp.AccessDeniedPage = &page
+	w = respond()
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "You are not allowed to access Finance")
+	assert.Len(t, auditor.denied, 2)
+
+	// Allowed users get their assertion
+	user.Attributes[0].Value = []string{"finance"}
+	w = respond()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "SAMLResponse")
+	assert.Len(t, auditor.denied, 2)
+}
+
+func TestIDP_denyAccessOtherProtocols(t *testing.T) {
+	auditor := &recordingAuditor{}
+	i := &IDP{Auditor: auditor}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	rules := []AccessRule{{Attributes: []AttributeRequirement{{Name: "groups", Values: []string{"finance"}}}}}
+	i.oidcClients["finance"] = &OIDCClient{ClientID: "finance",
+		RedirectURIs: []string{"https://finance.example.com/callback"}, AccessRules: rules}
+	i.relyingParties["urn:finance"] = &RelyingParty{Realm: "urn:finance",
+		ReplyURLs: []string{"https://finance.example.com/wsfed"}, AccessRules: rules}
+	service := &CASService{Name: "finance", ServicePattern: `https://finance\.example\.com/.*`, AccessRules: rules}
+	if err := service.compilePattern(); err != nil {
+		t.Fatal(err)
+	}
+	i.casServices = []*CASService{service}
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{{Name: "groups", Value: []string{"users"}}}}
+	respond := func(req *model.AuthnRequest) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if err := i.respond(req, user, w, httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	// OpenID Connect clients are told at their redirect URI
+	data, err := json.Marshal(&oidcAuthorization{ClientID: "finance",
+		RedirectURI: "https://finance.example.com/callback", State: "xyz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set(oidcAuthorizationKey("oidc"), data)
+	w := respond(&model.AuthnRequest{ID: "oidc", Issuer: "finance", ProtocolBinding: oidcCodeBinding,
+		AssertionConsumerServiceURL: "https://finance.example.com/callback"})
+	if assert.Equal(t, http.StatusFound, w.Code) {
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "access_denied", location.Query().Get("error"))
+		assert.Equal(t, "xyz", location.Query().Get("state"))
+		assert.Empty(t, location.Query().Get("code"))
+	}
+
+	// WS-Federation relying parties and CAS services can't be told, so users are shown the page
+	w = respond(&model.AuthnRequest{ID: "wsfed", Issuer: "urn:finance", ProtocolBinding: wsfedBinding,
+		AssertionConsumerServiceURL: "https://finance.example.com/wsfed"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "You are not allowed to access urn:finance")
+	w = respond(&model.AuthnRequest{ID: "cas", Issuer: "finance", ProtocolBinding: casBinding,
+		AssertionConsumerServiceURL: "https://finance.example.com/app"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "You are not allowed to access finance")
+	assert.Len(t, auditor.denied, 3)
+}
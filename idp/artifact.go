@@ -64,7 +64,19 @@ func (i *IDP) processArtifactResolutionRequest(w http.ResponseWriter, r *http.Re
 		return
 	}
 	now := time.Now().UTC()
-	response := i.makeAuthnResponse(artifactResponse.Request, artifactResponse.User)
+	var response *saml.Response
+	if artifactResponse.StatusCode != "" {
+		// the request was denied
+		response = i.makeErrorResponse(artifactResponse.Request, artifactResponse.StatusCode, artifactResponse.StatusMessage)
+	} else {
+		response = i.makeAuthnResponse(artifactResponse.Request, artifactResponse.User)
+	}
+	sp, _ := i.getServiceProvider(artifactResponse.Request.Issuer)
+	// The response or its assertion is signed the way the requesting service provider prefers
+	if err := i.signResponse(response, sp); err != nil {
+		i.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	artResponseEnv := saml.ArtifactResponseEnvelope{
 		Body: saml.ArtifactResponseBody{
 			ArtifactResponse: saml.ArtifactResponse{
@@ -85,13 +97,6 @@ func (i *IDP) processArtifactResolutionRequest(w http.ResponseWriter, r *http.Re
 		},
 	}
 
-	signature, err := i.signer.CreateSignature(response.Assertion)
-	// TODO confirm appropriate error response for this service
-	if err != nil {
-		i.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	response.Assertion.Signature = signature
 	// TODO handle these errors. Probably can't do anything besides log, as we've already started to write the
 	// response.
 	_, err = w.Write([]byte(xml.Header))
@@ -102,6 +107,14 @@ func (i *IDP) processArtifactResolutionRequest(w http.ResponseWriter, r *http.Re
 
 func (i *IDP) sendArtifactResponse(authRequest *model.AuthnRequest, user *model.User,
 	w http.ResponseWriter, r *http.Request) error {
+	return i.sendArtifact(&model.ArtifactResponse{
+		User:    user,
+		Request: authRequest,
+	}, w, r)
+}
+
+func (i *IDP) sendArtifact(response *model.ArtifactResponse, w http.ResponseWriter, r *http.Request) error {
+	authRequest := response.Request
 	target, err := url.Parse(authRequest.AssertionConsumerServiceURL)
 	if err != nil {
 		i.Error(w, err.Error(), http.StatusInternalServerError)
@@ -109,10 +122,6 @@ func (i *IDP) sendArtifactResponse(authRequest *model.AuthnRequest, user *model.
 	parameters := url.Values{}
 	artifact := getArtifact(i.entityID)
 	// Store required data in the cache
-	response := &model.ArtifactResponse{
-		User:    user,
-		Request: authRequest,
-	}
 	data, err := proto.Marshal(response)
 	if err != nil {
 		i.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,262 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	assertionIDRequestName = xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "AssertionIDRequest"}
+	authnQueryName         = xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "AuthnQuery"}
+)
+
+// signResponse signs the response's assertion, the response, or both as the service provider prefers. The
+// assertion is remembered, so it can be retrieved later with an AssertionIDRequest or AuthnQuery. The service
+// provider is nil when it isn't registered.
+func (i *IDP) signResponse(response *saml.Response, sp *ServiceProvider) error {
+	signer, err := i.signerFor(sp)
+	if err != nil {
+		return err
+	}
+	if assertion := response.Assertion; assertion != nil {
+		if sp.signAssertions() {
+			if assertion.Signature, err = signer.CreateSignature(assertion); err != nil {
+				return err
+			}
+		}
+		if err = i.rememberAssertion(assertion); err != nil {
+			return err
+		}
+	}
+	if sp.signResponses() {
+		if response.Signature, err = signer.CreateSignature(response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signerFor returns a signer using the service provider's signature and digest algorithms
+func (i *IDP) signerFor(sp *ServiceProvider) (sign.Signer, error) {
+	if sp == nil || (sp.SignatureAlgorithm == "" && sp.DigestAlgorithm == "") {
+		return i.signer, nil
+	}
+	options := sign.SignerOptions{
+		SignatureAlgorithm: viper.GetString("signature-algorithm"),
+		DigestAlgorithm:    viper.GetString("digest-algorithm"),
+	}
+	if sp.SignatureAlgorithm != "" {
+		options.SignatureAlgorithm = sp.SignatureAlgorithm
+	}
+	if sp.DigestAlgorithm != "" {
+		options.DigestAlgorithm = sp.DigestAlgorithm
+	}
+	return i.keystore.signerWith(options)
+}
+
+// rememberAssertion stores an issued assertion exactly as it will be sent
+func (i *IDP) rememberAssertion(assertion *saml.Assertion) error {
+	data, err := xml.Marshal(assertion)
+	if err != nil {
+		return err
+	}
+	// The assertion has already been issued, so failing to remember it shouldn't stop it from being sent
+	if err := i.AssertionCache.Set(assertionKey(assertion.ID), data); err != nil {
+		log.Errorf("failed to store assertion %s: %s", assertion.ID, err)
+		return nil
+	}
+	audience := assertionAudience(assertion)
+	if assertion.AuthnStatement == nil || assertion.Subject == nil || assertion.Subject.NameID == nil || audience == "" {
+		return nil
+	}
+	// Keep track of the authentication assertions issued for each subject. The IDs expire along with the
+	// assertions.
+	key := authnKey(audience, assertion.Subject.NameID.Value)
+	if err := i.AssertionCache.Append(key, []byte(assertion.ID)); err != nil {
+		log.Errorf("failed to store authentication assertion %s: %s", assertion.ID, err)
+	}
+	return nil
+}
+
+func assertionKey(id string) string {
+	return "assertion:" + id
+}
+
+func authnKey(audience, nameID string) string {
+	return "authn:" + audience + ":" + nameID
+}
+
+func assertionAudience(assertion *saml.Assertion) string {
+	if assertion.Conditions == nil || assertion.Conditions.AudienceRestriction == nil ||
+		len(assertion.Conditions.AudienceRestriction.Audience) == 0 {
+		return ""
+	}
+	// The service provider the assertion was issued to comes before any additional audiences
+	return assertion.Conditions.AudienceRestriction.Audience[0]
+}
+
+// storedAssertion returns a remembered assertion exactly as it was issued
+func (i *IDP) storedAssertion(id string) (string, *saml.Assertion, bool) {
+	data, err := i.AssertionCache.Get(assertionKey(id))
+	if err != nil {
+		return "", nil, false
+	}
+	assertion := &saml.Assertion{}
+	if err := xml.Unmarshal(data, assertion); err != nil {
+		log.Errorf("failed to read stored assertion %s: %s", id, err)
+		return "", nil, false
+	}
+	return string(data), assertion, true
+}
+
+// issuedAssertion returns a remembered assertion if it was issued to the service provider
+func (i *IDP) issuedAssertion(id, audience string) (string, *saml.Assertion, bool) {
+	data, assertion, ok := i.storedAssertion(id)
+	if !ok || assertionAudience(assertion) != audience {
+		return "", nil, false
+	}
+	return data, assertion, true
+}
+
+// makeAssertionsResponse creates a response containing assertions exactly as they were issued
+func (i *IDP) makeAssertionsResponse(id string, assertions []string) *saml.Response {
+	return &saml.Response{
+		StatusResponseType: saml.StatusResponseType{
+			Version:      "2.0",
+			ID:           saml.NewID(),
+			IssueInstant: time.Now().UTC(),
+			Status: &saml.Status{
+				StatusCode: saml.StatusCode{
+					Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
+				},
+			},
+			InResponseTo: id,
+			Issuer:       saml.NewIssuer(i.entityID),
+		},
+		RawAssertion: strings.Join(assertions, ""),
+	}
+}
+
+// DefaultAssertionIDRequestHandler is the default implementation for the AssertionIDRequest handler using the SOAP binding. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultAssertionIDRequestHandler() http.HandlerFunc {
+	return i.soapQueryHandler(func(body []byte, r *http.Request) (string, *saml.Response, error) {
+		env := &saml.AssertionIDRequestEnv{}
+		if err := xml.Unmarshal(body, env); err != nil {
+			return "", nil, err
+		}
+		response, err := i.answerAssertionIDRequest(string(body), env, r)
+		return env.Body.Request.ID, response, err
+	})
+}
+
+// answerAssertionIDRequest returns the requested assertions that were issued to the requester. Assertions that
+// can't be found are left out of the response.
+func (i *IDP) answerAssertionIDRequest(body string, env *saml.AssertionIDRequestEnv,
+	r *http.Request) (*saml.Response, error) {
+	request := env.Body.Request
+	sp, err := i.authenticateRequester(body, &request.RequestAbstractType, request.Signature != nil,
+		assertionIDRequestName, r, &request)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.AssertionIDRef) == 0 {
+		return nil, denyRequest("request does not contain an AssertionIDRef")
+	}
+	log.Infof("received assertion ID request from %s", sp.EntityID)
+	var assertions []string
+	for _, id := range request.AssertionIDRef {
+		if data, _, ok := i.issuedAssertion(id, sp.EntityID); ok {
+			assertions = append(assertions, data)
+		}
+	}
+	return i.makeAssertionsResponse(request.ID, assertions), nil
+}
+
+// DefaultAssertionIDURIHandler is the default implementation for the AssertionIDRequest handler using the URI binding. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultAssertionIDURIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The URI binding relies on transport authentication
+		tlsCert, err := getCertFromRequest(r)
+		if err != nil {
+			i.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		id := r.URL.Query().Get("ID")
+		data, assertion, ok := i.storedAssertion(id)
+		if ok {
+			// Only the service provider the assertion was issued to may retrieve it
+			sp, registered := i.getServiceProvider(assertionAudience(assertion))
+			ok = registered && sp.presentedCertificate(r)
+		}
+		if !ok {
+			log.Infof("assertion %s was not found for %s", id, getSubjectDN(tlsCert.Subject))
+			i.Error(w, "assertion not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/samlassertion+xml")
+		w.Write([]byte(data))
+	}
+}
+
+// DefaultAuthnQueryHandler is the default implementation for the AuthnQuery handler. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultAuthnQueryHandler() http.HandlerFunc {
+	return i.soapQueryHandler(func(body []byte, r *http.Request) (string, *saml.Response, error) {
+		env := &saml.AuthnQueryEnv{}
+		if err := xml.Unmarshal(body, env); err != nil {
+			return "", nil, err
+		}
+		response, err := i.answerAuthnQuery(string(body), env, r)
+		return env.Body.Query.ID, response, err
+	})
+}
+
+// answerAuthnQuery returns the authentication assertions issued to the querier for the subject. The query's
+// SessionIndex limits them to a single session.
+func (i *IDP) answerAuthnQuery(body string, env *saml.AuthnQueryEnv, r *http.Request) (*saml.Response, error) {
+	query := env.Body.Query
+	sp, err := i.authenticateRequester(body, &query.RequestAbstractType, query.Signature != nil,
+		authnQueryName, r, &query)
+	if err != nil {
+		return nil, err
+	}
+	if query.Subject.NameID == nil || query.Subject.NameID.Value == "" {
+		return nil, denyRequest("query does not contain a subject")
+	}
+	log.Infof("received authentication query from %s", sp.EntityID)
+	var assertions []string
+	if ids, err := i.AssertionCache.List(authnKey(sp.EntityID, query.Subject.NameID.Value)); err == nil {
+		for _, id := range ids {
+			data, assertion, ok := i.issuedAssertion(string(id), sp.EntityID)
+			// Expired assertions are no longer available
+			if !ok || assertion.AuthnStatement == nil {
+				continue
+			}
+			if query.SessionIndex != "" && assertion.AuthnStatement.SessionIndex != query.SessionIndex {
+				continue
+			}
+			assertions = append(assertions, data)
+		}
+	}
+	return i.makeAssertionsResponse(query.ID, assertions), nil
+}
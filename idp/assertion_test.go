@@ -0,0 +1,147 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_assertionQueries(t *testing.T) {
+	signer := registerECPServiceProvider(t)
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	request := &model.AuthnRequest{
+		ID:                          "_123",
+		Issuer:                      "https://sp.example.com/",
+		AssertionConsumerServiceURL: "https://sp.example.com/acs",
+	}
+	response := i.makeAuthnResponse(request, &model.User{Name: "joe"})
+	if err := i.signResponse(response, i.sps[request.Issuer]); err != nil {
+		t.Fatal(err)
+	}
+	issued := response.Assertion
+	response = i.makeAuthnResponse(&model.AuthnRequest{Issuer: "https://other.example.com/"}, &model.User{Name: "joe"})
+	if err := i.signResponse(response, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := response.Assertion
+	abstract := func() saml.RequestAbstractType {
+		return saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now().UTC(),
+			Issuer:       "https://sp.example.com/",
+		}
+	}
+	send := func(handler http.HandlerFunc, body string) *saml.Response {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		var env saml.AttributeRespEnv
+		if err := xml.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		return &env.Body.Response
+	}
+	assertionIDRequest := func(ids ...string) *saml.Response {
+		req := saml.AssertionIDRequest{RequestAbstractType: abstract(), AssertionIDRef: ids}
+		signature, err := signer.CreateSignature(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Signature = signature
+		return send(i.DefaultAssertionIDRequestHandler(), ecpEnvelope(t, "", req))
+	}
+	authnQuery := func(sessionIndex string) *saml.Response {
+		query := saml.AuthnQuery{
+			RequestAbstractType: abstract(),
+			SessionIndex:        sessionIndex,
+			Subject:             saml.Subject{NameID: &saml.NameID{Value: "joe"}},
+		}
+		signature, err := signer.CreateSignature(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query.Signature = signature
+		return send(i.DefaultAuthnQueryHandler(), ecpEnvelope(t, "", query))
+	}
+
+	resp := assertionIDRequest(issued.ID, other.ID)
+	if assert.NotNil(t, resp.Assertion) {
+		assert.Equal(t, issued.ID, resp.Assertion.ID, "only assertions issued to the requester are returned")
+	}
+	resp = assertionIDRequest("_unknown")
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", resp.Status.StatusCode.Value)
+	assert.Nil(t, resp.Assertion)
+
+	resp = authnQuery("")
+	if assert.NotNil(t, resp.Assertion) {
+		assert.Equal(t, issued.AuthnStatement.SessionIndex, resp.Assertion.AuthnStatement.SessionIndex)
+	}
+	assert.NotNil(t, authnQuery(issued.AuthnStatement.SessionIndex).Assertion)
+	assert.Nil(t, authnQuery("_other").Assertion)
+
+	// Unsigned requests must be sent with the service provider's certificate
+	body := ecpEnvelope(t, "", saml.AssertionIDRequest{RequestAbstractType: abstract(), AssertionIDRef: []string{issued.ID}})
+	resp = send(i.DefaultAssertionIDRequestHandler(), body)
+	if assert.NotNil(t, resp.Status.StatusCode.StatusCode) {
+		assert.Equal(t, statusRequestDenied, resp.Status.StatusCode.StatusCode.Value)
+	}
+
+	// The URI binding only returns assertions to the service provider they were issued to
+	der, err := base64.StdEncoding.DecodeString(i.sps["https://sp.example.com/"].Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(id string, cert *x509.Certificate) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?ID="+id, nil)
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+		w := httptest.NewRecorder()
+		i.DefaultAssertionIDURIHandler()(w, req)
+		return w
+	}
+	w := get(issued.ID, spCert)
+	if assert.Equal(t, http.StatusOK, w.Code) {
+		assert.Equal(t, "application/samlassertion+xml", w.Header().Get("Content-Type"))
+		_, err := sign.NewValidator().Validate(w.Body.String())
+		assert.NoError(t, err, "expected the assertion to be returned as it was signed")
+	}
+	assert.Equal(t, http.StatusNotFound, get(other.ID, spCert).Code)
+	assert.Equal(t, http.StatusUnauthorized, get(issued.ID, nil).Code)
+}
@@ -24,6 +24,13 @@ type AttributeSource interface {
 	AddAttributes(*model.User, *model.AuthnRequest) error
 }
 
+// UserDirectory is implemented by attribute sources that can tell whether a user exists. Attribute queries about
+// users that no directory knows are answered with an UnknownPrincipal status.
+type UserDirectory interface {
+	// HasUser reports whether the source has an entry for the user, even one without attributes
+	HasUser(*model.User) (bool, error)
+}
+
 type simpleSource struct {
 	users map[string][]*model.Attribute
 }
@@ -41,6 +48,11 @@ func (ss *simpleSource) AddAttributes(user *model.User, _ *model.AuthnRequest) e
 	return nil
 }
 
+func (ss *simpleSource) HasUser(user *model.User) (bool, error) {
+	_, ok := ss.users[user.Name]
+	return ok, nil
+}
+
 // NewAttributeSource provides a default SAML attribute source that reads user information from the users key in the viper configuration
 func NewAttributeSource() (AttributeSource, error) {
 	userAttributes := []UserAttributes{}
@@ -12,6 +12,10 @@ const (
 	CertificateLogin LoginType = iota
 	// PasswordLogin user logged in via password
 	PasswordLogin
+	// UpstreamLogin user logged in with an AuthenticationSource
+	UpstreamLogin
+	// KerberosLogin user logged in with a Kerberos service ticket
+	KerberosLogin
 )
 
 // Auditor is responsible for capturing login events
@@ -19,6 +23,12 @@ type Auditor interface {
 	LogSuccess(*model.User, *model.AuthnRequest, LoginType)
 }
 
+// DenialAuditor is implemented by auditors that also capture users denied by access rules
+type DenialAuditor interface {
+	// LogDenied records that an authenticated user wasn't allowed to access the service provider
+	LogDenied(user *model.User, request *model.AuthnRequest, reason string)
+}
+
 type auditor struct{}
 
 func (a *auditor) LogSuccess(*model.User, *model.AuthnRequest, LoginType) {
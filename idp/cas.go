@@ -0,0 +1,344 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/cas"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// casBinding marks saved authentication requests that are answered with a CAS service ticket
+const casBinding = "urn:lite-idp:cas:service-ticket"
+
+// CAS attributes are elements, so their names must be usable as element names
+var casAttributeName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+// CASService is a service that logs users in with the CAS protocol
+type CASService struct {
+	// Name of the service used in logs. Defaults to the pattern.
+	Name string
+	// Regular expression matching the service URLs of the service. It must match the whole URL.
+	ServicePattern string
+	// Names of the attributes released to the service. All attributes are released when empty.
+	ReleaseAttributes []string
+	// Rules limiting who can use the service. Every user can when empty.
+	AccessRules []AccessRule
+	pattern     *regexp.Regexp
+}
+
+// accessControl returns a service provider with the service's access rules. CAS doesn't have a way to report
+// denials to the service, so users are shown the access denied page.
+func (s *CASService) accessControl() *ServiceProvider {
+	page := true
+	return &ServiceProvider{EntityID: s.Name, AccessRules: s.AccessRules, AccessDeniedPage: &page}
+}
+
+// releasedAttributes returns the attributes the service is allowed to receive
+func (s *CASService) releasedAttributes(atts []*model.Attribute) []*model.Attribute {
+	return (&ServiceProvider{ReleaseAttributes: s.ReleaseAttributes}).releasedAttributes(atts)
+}
+
+// casLogin is the part of a login request needed to issue a service ticket
+type casLogin struct {
+	Service string
+	// The user had to log in again rather than use their session
+	Renew bool
+}
+
+// casTicket is a service ticket waiting to be validated
+type casTicket struct {
+	casLogin
+	// Protocol buffer encoding of the authenticated user
+	User []byte
+}
+
+// casError is a validation failure returned to the service
+type casError struct {
+	code    string
+	message string
+}
+
+func (e *casError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+func newCASError(code, format string, args ...interface{}) *casError {
+	return &casError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func (i *IDP) configureCAS() error {
+	services := []*CASService{}
+	if err := viper.UnmarshalKey("cas-services", &services); err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err := service.compilePattern(); err != nil {
+			return err
+		}
+		if err := service.accessControl().validateAccessRules(); err != nil {
+			return fmt.Errorf("invalid access rule for %s: %s", service.Name, err)
+		}
+	}
+	i.casServices = services
+	return nil
+}
+
+// compilePattern prepares the service pattern to match whole service URLs
+func (s *CASService) compilePattern() error {
+	if s.ServicePattern == "" {
+		return errors.New("CAS service does not specify a service pattern")
+	}
+	if s.Name == "" {
+		s.Name = s.ServicePattern
+	}
+	pattern, err := regexp.Compile("^(?:" + s.ServicePattern + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid service pattern for CAS service %s: %s", s.Name, err)
+	}
+	s.pattern = pattern
+	return nil
+}
+
+// casService returns the first registered service whose pattern matches the service URL or nil
+func (i *IDP) casService(serviceURL string) *CASService {
+	for _, service := range i.casServices {
+		if service.pattern.MatchString(serviceURL) {
+			return service
+		}
+	}
+	return nil
+}
+
+// casFlag reports whether a flag parameter such as renew or gateway is set
+func casFlag(value string) bool {
+	return value != "" && value != "false"
+}
+
+func casLoginKey(id string) string {
+	return "cas:" + id
+}
+
+func casTicketKey(ticket string) string {
+	return "cas-ticket:" + ticket
+}
+
+// DefaultCASLoginHandler is the default implementation for the CAS login handler. Users share their session with SAML service providers. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultCASLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			serviceURL := r.Form.Get("service")
+			if serviceURL == "" {
+				return errors.New("CAS login request does not include a service")
+			}
+			service := i.casService(serviceURL)
+			if service == nil {
+				return fmt.Errorf("CAS login request from unregistered service %s", serviceURL)
+			}
+			log.Infof("received CAS login request from %s", service.Name)
+			timestamp, err := ptypes.TimestampProto(time.Now())
+			if err != nil {
+				return err
+			}
+			req := &model.AuthnRequest{
+				ID:                          uuid.New().String(),
+				IssueInstant:                timestamp,
+				Issuer:                      service.Name,
+				AssertionConsumerServiceURL: serviceURL,
+				ProtocolBinding:             casBinding,
+			}
+			// renew takes precedence over gateway
+			login := &casLogin{Service: serviceURL, Renew: casFlag(r.Form.Get("renew"))}
+			data, err := json.Marshal(login)
+			if err != nil {
+				return err
+			}
+			if err = i.TempCache.Set(casLoginKey(req.ID), data); err != nil {
+				return err
+			}
+			if !login.Renew {
+				if user := i.getUserFromSession(r); user != nil {
+					return i.respond(req, user, w, r)
+				}
+				if user, err := i.loginWithCert(r, req); user != nil {
+					return i.respond(req, user, w, r)
+				} else if err != nil {
+					return err
+				}
+				if casFlag(r.Form.Get("gateway")) {
+					// The service continues without a ticket
+					i.TempCache.Delete(casLoginKey(req.ID))
+					http.Redirect(w, r, serviceURL, http.StatusFound)
+					return nil
+				}
+			}
+			return i.showLoginForm(req, w, r)
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// sendServiceTicket redirects the user to the service with a ticket the service validates to learn who they are
+func (i *IDP) sendServiceTicket(authRequest *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) error {
+	data, err := i.TempCache.Get(casLoginKey(authRequest.ID))
+	if err != nil {
+		return errors.New("CAS login request has expired")
+	}
+	ticket := &casTicket{}
+	if err = json.Unmarshal(data, &ticket.casLogin); err != nil {
+		return err
+	}
+	if ticket.User, err = proto.Marshal(user); err != nil {
+		return err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	id := "ST-" + token
+	if data, err = json.Marshal(ticket); err != nil {
+		return err
+	}
+	if err = i.TempCache.Set(casTicketKey(id), data); err != nil {
+		return err
+	}
+	i.TempCache.Delete(casLoginKey(authRequest.ID))
+	http.Redirect(w, r, addQuery(ticket.Service, url.Values{"ticket": {id}}), http.StatusFound)
+	return nil
+}
+
+// DefaultCASValidateHandler is the default implementation for the CAS ticket validation handlers. Attributes are only released by the CAS 3 handlers. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultCASValidateHandler(attributes bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := i.validateServiceTicket(r.URL.Query(), attributes)
+		if cerr, ok := err.(*casError); ok {
+			log.Infof("CAS ticket was not validated: %s", cerr)
+			response = cas.NewFailure(cerr.code, cerr.message)
+		} else if err != nil {
+			log.Error(err)
+			response = cas.NewFailure(cas.InternalError, "the ticket could not be validated")
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		if _, err = w.Write([]byte(xml.Header)); err != nil {
+			log.Error(err)
+			return
+		}
+		if err = xml.NewEncoder(w).Encode(response); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// validateServiceTicket redeems a service ticket for the user it was issued to. Tickets that can't be validated
+// result in a casError.
+func (i *IDP) validateServiceTicket(params url.Values, attributes bool) (*cas.ServiceResponse, error) {
+	serviceURL, id := params.Get("service"), params.Get("ticket")
+	if serviceURL == "" || id == "" {
+		return nil, newCASError(cas.InvalidRequest, "ticket and service parameters are required")
+	}
+	if !strings.HasPrefix(id, "ST-") {
+		return nil, newCASError(cas.InvalidTicket, "ticket %s not recognized", id)
+	}
+	// Tickets can only be validated once, whether or not validation succeeds
+	data, err := i.TempCache.Take(casTicketKey(id))
+	if err != nil {
+		return nil, newCASError(cas.InvalidTicket, "ticket %s not recognized", id)
+	}
+	ticket := &casTicket{}
+	if err = json.Unmarshal(data, ticket); err != nil {
+		return nil, err
+	}
+	if ticket.Service != serviceURL {
+		return nil, newCASError(cas.InvalidService, "ticket %s was not issued to %s", id, serviceURL)
+	}
+	if casFlag(params.Get("renew")) && !ticket.Renew {
+		return nil, newCASError(cas.InvalidTicketSpec, "ticket %s was not issued after the user logged in again", id)
+	}
+	service := i.casService(serviceURL)
+	if service == nil {
+		return nil, newCASError(cas.InvalidService, "%s is no longer a registered service", serviceURL)
+	}
+	user := &model.User{}
+	if err = proto.Unmarshal(ticket.User, user); err != nil {
+		return nil, err
+	}
+	if params.Get("pgtUrl") != "" {
+		log.Infof("not issuing a proxy granting ticket to %s", service.Name)
+	}
+	var atts *cas.Attributes
+	if attributes {
+		atts = &cas.Attributes{}
+		for _, att := range service.releasedAttributes(user.Attributes) {
+			if !casAttributeName.MatchString(att.Name) {
+				log.Debugf("not releasing attribute %s to %s since its name is not a valid element name", att.Name,
+					service.Name)
+				continue
+			}
+			atts.Add(att.Name, att.Value...)
+		}
+	}
+	log.Infof("validated CAS ticket for %s to %s", user.Name, service.Name)
+	return cas.NewSuccess(user.Name, atts), nil
+}
+
+// DefaultCASLogoutHandler is the default implementation for the CAS logout handler. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultCASLogoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			i.endSession(w, r)
+			// CAS 3 services send service and CAS 2 services send url
+			target := r.Form.Get("service")
+			if target == "" {
+				target = r.Form.Get("url")
+			}
+			// Users are only sent on to registered services
+			if target != "" && i.casService(target) != nil {
+				http.Redirect(w, r, target, http.StatusFound)
+				return nil
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			_, err := w.Write([]byte("You have been logged out."))
+			return err
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
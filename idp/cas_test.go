@@ -0,0 +1,154 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_casLoginAndValidate(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	service := &CASService{
+		Name:              "portal",
+		ServicePattern:    `https://portal\.example\.com/.*`,
+		ReleaseAttributes: []string{"mail", "memberOf", "urn:oid:0.9.2342.19200300.100.1.3"},
+	}
+	if err := service.compilePattern(); err != nil {
+		t.Fatal(err)
+	}
+	i.casServices = []*CASService{service}
+
+	user := &model.User{Name: "joe", Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+		Attributes: []*model.Attribute{
+			{Name: "mail", Value: []string{"joe@example.com"}},
+			{Name: "memberOf", Value: []string{"a", "b"}},
+			{Name: "urn:oid:0.9.2342.19200300.100.1.3", Value: []string{"joe@example.com"}},
+			{Name: "secret", Value: []string{"hidden"}},
+		}}
+	data, err := proto.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.UserCache.Set("session", data)
+
+	login := func(params url.Values, session bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/cas/login?"+params.Encode(), nil)
+		if session {
+			r.AddCookie(&http.Cookie{Name: i.cookieName, Value: "session"})
+		}
+		w := httptest.NewRecorder()
+		i.DefaultCASLoginHandler()(w, r)
+		return w
+	}
+	ticket := func(w *httptest.ResponseRecorder) string {
+		if w.Code != http.StatusFound {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return location.Query().Get("ticket")
+	}
+	validate := func(path string, params url.Values, attributes bool) string {
+		r := httptest.NewRequest(http.MethodGet, path+"?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		i.DefaultCASValidateHandler(attributes)(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	// Only registered services are sent tickets and patterns match the whole URL
+	assert.Equal(t, http.StatusBadRequest, login(url.Values{"service": {"https://evil.example.com/?https://portal.example.com/"}}, true).Code)
+	assert.Equal(t, http.StatusBadRequest, login(url.Values{}, true).Code)
+
+	serviceURL := "https://portal.example.com/app?page=1"
+	st := ticket(login(url.Values{"service": {serviceURL}}, true))
+	if !assert.Regexp(t, "^ST-", st) {
+		t.FailNow()
+	}
+
+	// CAS 2 validation doesn't release attributes
+	response := validate("/cas/serviceValidate", url.Values{"service": {serviceURL}, "ticket": {st}}, false)
+	assert.Contains(t, response, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"><cas:authenticationSuccess><cas:user>joe</cas:user></cas:authenticationSuccess>`)
+
+	// Tickets can only be used once
+	response = validate("/cas/serviceValidate", url.Values{"service": {serviceURL}, "ticket": {st}}, false)
+	assert.Contains(t, response, `<cas:authenticationFailure code="INVALID_TICKET">`)
+
+	// Tickets are issued to one service and are gone after a failed validation
+	st = ticket(login(url.Values{"service": {serviceURL}}, true))
+	response = validate("/cas/serviceValidate", url.Values{"service": {"https://portal.example.com/other"}, "ticket": {st}}, false)
+	assert.Contains(t, response, `code="INVALID_SERVICE"`)
+	response = validate("/cas/serviceValidate", url.Values{"service": {serviceURL}, "ticket": {st}}, false)
+	assert.Contains(t, response, `code="INVALID_TICKET"`)
+
+	// Tickets from a session don't satisfy renew
+	st = ticket(login(url.Values{"service": {serviceURL}}, true))
+	response = validate("/cas/serviceValidate", url.Values{"service": {serviceURL}, "ticket": {st}, "renew": {"true"}}, false)
+	assert.Contains(t, response, `code="INVALID_TICKET_SPEC"`)
+
+	// CAS 3 validation releases the attributes allowed for the service
+	st = ticket(login(url.Values{"service": {serviceURL}}, true))
+	response = validate("/cas/p3/serviceValidate", url.Values{"service": {serviceURL}, "ticket": {st}}, true)
+	assert.Contains(t, response, "<cas:attributes><cas:mail>joe@example.com</cas:mail><cas:memberOf>a</cas:memberOf><cas:memberOf>b</cas:memberOf></cas:attributes>")
+	assert.NotContains(t, response, "hidden")
+
+	// Users without a session log in unless the service uses gateway
+	w := login(url.Values{"service": {serviceURL}}, false)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	w = login(url.Values{"service": {serviceURL}, "gateway": {"true"}}, false)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, serviceURL, w.Header().Get("Location"))
+	w = login(url.Values{"service": {serviceURL}, "renew": {"true"}}, true)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+}
+
+func TestIDP_casLogout(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	service := &CASService{ServicePattern: `https://portal\.example\.com/.*`}
+	if err := service.compilePattern(); err != nil {
+		t.Fatal(err)
+	}
+	i.casServices = []*CASService{service}
+	logout := func(params url.Values) *httptest.ResponseRecorder {
+		i.UserCache.Set("session", []byte{})
+		r := httptest.NewRequest(http.MethodGet, "/cas/logout?"+params.Encode(), nil)
+		r.AddCookie(&http.Cookie{Name: i.cookieName, Value: "session"})
+		w := httptest.NewRecorder()
+		i.DefaultCASLogoutHandler()(w, r)
+		_, err := i.UserCache.Get("session")
+		assert.Error(t, err)
+		return w
+	}
+	w := logout(url.Values{"service": {"https://portal.example.com/"}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://portal.example.com/", w.Header().Get("Location"))
+	w = logout(url.Values{"url": {"https://portal.example.com/bye"}})
+	assert.Equal(t, "https://portal.example.com/bye", w.Header().Get("Location"))
+	w = logout(url.Values{"service": {"https://evil.example.com/"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,290 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Choices users make on the consent page
+const (
+	consentOnce    = "once"
+	consentAlways  = "always"
+	consentDecline = "decline"
+)
+
+// ConsentDecision records that a user agreed to always release a set of attributes to a service provider
+type ConsentDecision struct {
+	SPEntityID string
+	UserName   string
+	// Hash of the attributes the user agreed to release. Users are asked again when the attributes change.
+	AttributesHash string
+	Time           time.Time
+}
+
+// ConsentStore persists the attribute release decisions users ask to be remembered
+type ConsentStore interface {
+	// Decision returns the user's decision for the service provider or nil if there isn't one
+	Decision(spEntityID, userName string) (*ConsentDecision, error)
+	// Save adds the decision or replaces the user's previous decision for the service provider
+	Save(decision *ConsentDecision) error
+}
+
+type fileConsentStore struct {
+	sync.RWMutex
+	path      string
+	decisions []ConsentDecision
+}
+
+// NewConsentStore returns a store that keeps decisions in the JSON file named by the consent-store-path setting.
+// Decisions are only kept in memory when the setting is empty.
+func NewConsentStore() (ConsentStore, error) {
+	s := &fileConsentStore{path: viper.GetString("consent-store-path")}
+	if s.path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &s.decisions); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileConsentStore) Decision(spEntityID, userName string) (*ConsentDecision, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, decision := range s.decisions {
+		if decision.SPEntityID == spEntityID && decision.UserName == userName {
+			return &decision, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *fileConsentStore) Save(decision *ConsentDecision) error {
+	s.Lock()
+	defer s.Unlock()
+	decisions := make([]ConsentDecision, 0, len(s.decisions)+1)
+	for _, existing := range s.decisions {
+		if existing.SPEntityID != decision.SPEntityID || existing.UserName != decision.UserName {
+			decisions = append(decisions, existing)
+		}
+	}
+	decisions = append(decisions, *decision)
+	if s.path != "" {
+		if err := writeJSONFile(s.path, decisions); err != nil {
+			return err
+		}
+	}
+	s.decisions = decisions
+	return nil
+}
+
+// pendingConsent is saved while the user decides whether to release their attributes
+type pendingConsent struct {
+	// Protocol buffer encodings of the request and the authenticated user
+	Request []byte
+	User    []byte
+}
+
+func consentKey(id string) string {
+	return "consent:" + id
+}
+
+// attributesHash identifies a set of attributes regardless of the order of the attributes and their values
+func attributesHash(atts []*model.Attribute) string {
+	type attribute struct {
+		Name   string
+		Values []string
+	}
+	sorted := make([]attribute, len(atts))
+	for i, att := range atts {
+		values := append([]string(nil), att.Value...)
+		sort.Strings(values)
+		sorted[i] = attribute{att.Name, values}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	data, _ := json.Marshal(sorted)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// needsConsent reports whether the user must agree to the attributes released to the service provider before the
+// assertion is sent. Users aren't asked when nothing is released or they already agreed to always release the same
+// attributes. Only requests from SAML service providers ask for consent.
+func (i *IDP) needsConsent(authRequest *model.AuthnRequest, user *model.User) (bool, error) {
+	switch authRequest.ProtocolBinding {
+	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+		"urn:oasis:names:tc:SAML:2.0:bindings:PAOS":
+	default:
+		return false, nil
+	}
+	sp, ok := i.getServiceProvider(authRequest.Issuer)
+	if !ok || !sp.requireConsent() {
+		return false, nil
+	}
+	atts := sp.releasedAttributes(user.Attributes)
+	if len(atts) == 0 {
+		return false, nil
+	}
+	decision, err := i.ConsentStore.Decision(sp.EntityID, user.Name)
+	if err != nil {
+		return false, err
+	}
+	return decision == nil || decision.AttributesHash != attributesHash(atts), nil
+}
+
+// askConsent shows the user the attributes released to the service provider. ECP clients can't show the page, so
+// their requests are denied.
+func (i *IDP) askConsent(authRequest *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) error {
+	if authRequest.ProtocolBinding == "urn:oasis:names:tc:SAML:2.0:bindings:PAOS" {
+		return i.sendErrorResponse(authRequest, &requestError{
+			status:  statusRequestDenied,
+			message: "user has not agreed to release attributes to the service provider",
+		}, w, r)
+	}
+	sp, _ := i.getServiceProvider(authRequest.Issuer)
+	var pending pendingConsent
+	var err error
+	if pending.Request, err = proto.Marshal(authRequest); err != nil {
+		return err
+	}
+	if pending.User, err = proto.Marshal(user); err != nil {
+		return err
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	id, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err = i.TempCache.Set(consentKey(id), data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return consentTemplate.Execute(w, struct {
+		Action      string
+		ID          string
+		DisplayName string
+		Attributes  []*model.Attribute
+	}{viper.GetString("consent-path"), id, sp.displayName(), sp.releasedAttributes(user.Attributes)})
+}
+
+// DefaultConsentHandler is the default implementation for the handler that receives the user's choice from the
+// consent page. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultConsentHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			id := r.PostForm.Get("id")
+			// Each page can only be answered once
+			data, err := i.TempCache.Take(consentKey(id))
+			if err != nil {
+				return errors.New("consent request has expired")
+			}
+			var pending pendingConsent
+			if err = json.Unmarshal(data, &pending); err != nil {
+				return err
+			}
+			authRequest := &model.AuthnRequest{}
+			if err = proto.Unmarshal(pending.Request, authRequest); err != nil {
+				return err
+			}
+			user := &model.User{}
+			if err = proto.Unmarshal(pending.User, user); err != nil {
+				return err
+			}
+			sp, ok := i.getServiceProvider(authRequest.Issuer)
+			if !ok {
+				return errors.New("service provider is no longer registered")
+			}
+			switch r.PostForm.Get("decision") {
+			case consentDecline:
+				log.Infof("%s declined to release attributes to %s", user.Name, sp.EntityID)
+				return i.sendErrorResponse(authRequest, &requestError{
+					status:  statusRequestDenied,
+					message: "user declined to release attributes to the service provider",
+				}, w, r)
+			case consentAlways:
+				if err = i.ConsentStore.Save(&ConsentDecision{
+					SPEntityID:     sp.EntityID,
+					UserName:       user.Name,
+					AttributesHash: attributesHash(sp.releasedAttributes(user.Attributes)),
+					Time:           time.Now().UTC(),
+				}); err != nil {
+					return err
+				}
+			case consentOnce:
+			default:
+				return errors.New("unknown consent decision")
+			}
+			log.Infof("%s agreed to release attributes to %s", user.Name, sp.EntityID)
+			return i.sendResponse(authRequest, user, w, r)
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Release information to {{ .DisplayName }}</title>
+</head>
+<body>
+<h1>{{ .DisplayName }} will receive the following information about you</h1>
+<dl>
+{{ range .Attributes }}<dt>{{ .Name }}</dt>
+{{ range .Value }}<dd>{{ . }}</dd>
+{{ end }}{{ end }}</dl>
+<form method="post" action="{{ .Action }}">
+<input type="hidden" name="id" value="{{ .ID }}">
+<button type="submit" name="decision" value="once">Accept this time</button>
+<button type="submit" name="decision" value="always">Always accept</button>
+<button type="submit" name="decision" value="decline">Decline</button>
+</form>
+</body>
+</html>`))
@@ -0,0 +1,178 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_consent(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	required := true
+	sp := &ServiceProvider{
+		EntityID:          "https://consent.example.com/",
+		DisplayName:       "Example Portal",
+		RequireConsent:    &required,
+		ReleaseAttributes: []string{"mail"},
+	}
+	i.sps[sp.EntityID] = sp
+	defer delete(i.sps, sp.EntityID)
+	req := &model.AuthnRequest{
+		ID:                          "_123",
+		Issuer:                      sp.EntityID,
+		ProtocolBinding:             "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+		AssertionConsumerServiceURL: "https://consent.example.com/acs",
+	}
+	user := func(mail string) *model.User {
+		return &model.User{Name: "joe", Attributes: []*model.Attribute{
+			{Name: "mail", Value: []string{mail}},
+			{Name: "ssn", Value: []string{"123-45-6789"}},
+		}}
+	}
+	respond := func(u *model.User) string {
+		w := httptest.NewRecorder()
+		if err := i.respond(req, u, w, httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		return w.Body.String()
+	}
+	consentID := regexp.MustCompile(`name="id" value="([^"]+)"`)
+	decide := func(page, decision string) *httptest.ResponseRecorder {
+		match := consentID.FindStringSubmatch(page)
+		if match == nil {
+			t.Fatalf("consent page was not shown: %s", page)
+		}
+		form := url.Values{"id": {match[1]}, "decision": {decision}}
+		r := httptest.NewRequest(http.MethodPost, "/consent", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		ts.Config.Handler.ServeHTTP(w, r)
+		return w
+	}
+	samlResponse := func(body string) string {
+		value := body[strings.Index(body, `name="SAMLResponse"`):]
+		value = value[strings.Index(value, `value="`)+7:]
+		data, err := base64.StdEncoding.DecodeString(value[:strings.Index(value, `"`)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Only released attributes are shown
+	page := respond(user("joe@example.com"))
+	assert.Contains(t, page, "Example Portal")
+	assert.Contains(t, page, "joe@example.com")
+	assert.NotContains(t, page, "123-45-6789")
+
+	w := decide(page, consentDecline)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, samlResponse(w.Body.String()), statusRequestDenied)
+
+	// Each page can only be answered once
+	w = decide(page, consentOnce)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Agreeing once isn't remembered
+	w = decide(respond(user("joe@example.com")), consentOnce)
+	assert.Contains(t, samlResponse(w.Body.String()), "joe@example.com")
+	page = respond(user("joe@example.com"))
+	assert.Contains(t, page, `name="decision"`)
+
+	w = decide(page, consentAlways)
+	assert.Contains(t, samlResponse(w.Body.String()), "joe@example.com")
+	assert.Contains(t, samlResponse(respond(user("joe@example.com"))), "joe@example.com")
+
+	// Users are asked again when the attributes change
+	assert.Contains(t, respond(user("joseph@example.com")), `name="decision"`)
+
+	// ECP clients can't be asked
+	ecp := *req
+	ecp.ProtocolBinding = "urn:oasis:names:tc:SAML:2.0:bindings:PAOS"
+	w = httptest.NewRecorder()
+	if err := i.respond(&ecp, user("joseph@example.com"), w, httptest.NewRequest(http.MethodPost, "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, w.Body.String(), statusRequestDenied)
+
+	// Service providers that don't require consent aren't affected
+	required = false
+	assert.Contains(t, samlResponse(respond(user("joseph@example.com"))), "joseph@example.com")
+}
+
+func Test_attributesHash(t *testing.T) {
+	a := []*model.Attribute{
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "groups", Value: []string{"admins", "users"}},
+	}
+	b := []*model.Attribute{
+		{Name: "groups", Value: []string{"users", "admins"}},
+		{Name: "mail", Value: []string{"joe@example.com"}},
+	}
+	assert.Equal(t, attributesHash(a), attributesHash(b), "order doesn't matter")
+	b[0].Value = []string{"users"}
+	assert.NotEqual(t, attributesHash(a), attributesHash(b))
+}
+
+func TestNewConsentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("consent-store-path", filepath.Join(dir, "consent.json"))
+	defer viper.Set("consent-store-path", "")
+
+	store, err := NewConsentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision := &ConsentDecision{SPEntityID: "https://sp.example.com/", UserName: "joe", AttributesHash: "abc"}
+	if err = store.Save(decision); err != nil {
+		t.Fatal(err)
+	}
+	decision.AttributesHash = "def"
+	if err = store.Save(decision); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decisions are read back from the file
+	store, err = NewConsentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := store.Decision("https://sp.example.com/", "joe")
+	if assert.NoError(t, err) && assert.NotNil(t, found) {
+		assert.Equal(t, "def", found.AttributesHash)
+	}
+	found, err = store.Decision("https://other.example.com/", "joe")
+	assert.NoError(t, err)
+	assert.Nil(t, found)
+}
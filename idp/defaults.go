@@ -26,13 +26,66 @@ func init() {
 	viper.SetDefault("listen-address", "127.0.0.1:9443")
 	viper.SetDefault("server-name", "idp.example.com:9443")
 	viper.SetDefault("metadata-path", "/metadata")
+	viper.SetDefault("mdq-path", "/entities")
 	viper.SetDefault("sso-service-path", "/SAML2/Redirect/SSO")
+	viper.SetDefault("post-sso-service-path", "/SAML2/POST/SSO")
 	viper.SetDefault("ecp-service-path", "/SAML2/SOAP/ECP")
 	viper.SetDefault("artifact-service-path", "/SAML2/SOAP/ArtifactResolution")
 	viper.SetDefault("attribute-service-path", "/SAML2/SOAP/AttributeQuery")
+	viper.SetDefault("assertion-id-request-service-path", "/SAML2/SOAP/AssertionIDRequest")
+	viper.SetDefault("assertion-id-uri-path", "/SAML2/AssertionID")
+	viper.SetDefault("authn-query-service-path", "/SAML2/SOAP/AuthnQuery")
+	viper.SetDefault("manage-nameid-service-path", "/SAML2/SOAP/ManageNameID")
+	viper.SetDefault("redirect-manage-nameid-service-path", "/SAML2/Redirect/ManageNameID")
+	viper.SetDefault("nameid-mapping-service-path", "/SAML2/SOAP/NameIDMapping")
+	viper.SetDefault("oidc-issuer", "")
+	viper.SetDefault("oidc-authorization-path", "/oidc/authorize")
+	viper.SetDefault("oidc-token-path", "/oidc/token")
+	viper.SetDefault("oidc-userinfo-path", "/oidc/userinfo")
+	viper.SetDefault("oidc-jwks-path", "/oidc/jwks")
+	viper.SetDefault("oidc-token-lifetime", "1h")
+	viper.SetDefault("wsfed-path", "/wsfed")
+	viper.SetDefault("wsfed-metadata-path", "/FederationMetadata/2007-06/FederationMetadata.xml")
+	viper.SetDefault("wsfed-attribute-namespace", "http://schemas.xmlsoap.org/claims")
+	viper.SetDefault("cas-path", "/cas")
+	viper.SetDefault("sts-path", "/SOAP/STS")
+	viper.SetDefault("discovery-path", "/discovery")
+	viper.SetDefault("discovery-local-login", true)
+	viper.SetDefault("upstream-path", "/upstream")
+	viper.SetDefault("upstream-timeout", "30s")
+	viper.SetDefault("kerberos-keytab", "")
+	viper.SetDefault("negotiate-path", "/negotiate")
+	viper.SetDefault("kerberos-strip-realms", []string{})
 	viper.SetDefault("temp-cache-duration", "5m")
 	viper.SetDefault("user-cache-duration", "8h")
+	viper.SetDefault("assertion-cache-duration", "1h")
+	viper.SetDefault("exchange-cache-duration", "1h")
+	viper.SetDefault("clock-skew", "3m")
+	viper.SetDefault("assertion-lifetime", "5m")
+	viper.SetDefault("assertion-clock-skew", "0s")
+	viper.SetDefault("request-lifetime", "5m")
+	viper.SetDefault("require-signed-requests", true)
+	viper.SetDefault("require-ecp-channel-bindings", false)
+	viper.SetDefault("ecp-require-client-certificate", false)
+	viper.SetDefault("metadata-refresh-interval", "1h")
+	viper.SetDefault("metadata-valid-duration", "0s")
+	viper.SetDefault("metadata-cache-duration", "0s")
+	viper.SetDefault("metadata-lang", "en")
+	viper.SetDefault("metadata-nameid-formats", []string{
+		"urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
+		"urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
+		"urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
+		"urn:oasis:names:tc:SAML:2.0:nameid-format:persistent",
+	})
+	viper.SetDefault("signing-key", "")
+	viper.SetDefault("signing-key-publish-days", 14)
 	viper.SetDefault("signature-algorithm", "")
 	viper.SetDefault("digest-algorithm", "http://www.w3.org/2001/04/xmlenc#sha256")
+	viper.SetDefault("persistent-id-secret", "")
+	viper.SetDefault("nameid-store-path", "")
+	viper.SetDefault("require-consent", false)
+	viper.SetDefault("consent-path", "/consent")
+	viper.SetDefault("consent-store-path", "")
+	viper.SetDefault("access-denied-page", false)
 	viper.SetDefault("saml-attribute-name-format", "urn:oasis:names:tc:SAML:2.0:attrname-format:basic")
 }
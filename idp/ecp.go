@@ -15,8 +15,14 @@
 package idp
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -24,34 +30,118 @@ import (
 
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/wstrust"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
+const (
+	soapNamespace            = "http://schemas.xmlsoap.org/soap/envelope/"
+	soapActorNext            = "http://schemas.xmlsoap.org/soap/actor/next"
+	ecpProfile               = "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"
+	tlsServerEndPointBinding = "tls-server-end-point"
+)
+
+// SOAP 1.1 fault codes
+const (
+	faultVersionMismatch = "SOAP-ENV:VersionMismatch"
+	faultMustUnderstand  = "SOAP-ENV:MustUnderstand"
+	faultClient          = "SOAP-ENV:Client"
+	faultServer          = "SOAP-ENV:Server"
+)
+
+// Namespaces of the prefixes used by fault codes from other specifications
+var faultNamespaces = map[string]string{
+	"wst": wstrust.Namespace,
+}
+
+// soapFault is an error that is reported to the ECP with a specific fault code
+type soapFault struct {
+	code    string
+	message string
+}
+
+func (f *soapFault) Error() string {
+	return f.message
+}
+
+func newSOAPFault(code, format string, a ...interface{}) error {
+	return &soapFault{
+		code:    code,
+		message: fmt.Sprintf(format, a...),
+	}
+}
+
+// errClientCertificateRequired is returned when a user logs in with a password to a service provider that requires
+// a client certificate
+var errClientCertificateRequired = errors.New("service provider requires a client certificate")
+
 func (i *IDP) DefaultECPHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// We require transport authentication rather than message authentication
-		tlsCert, err := getCertFromRequest(r)
-		if tlsCert == nil || err != nil {
+		// Users authenticate with a client certificate or HTTP Basic credentials rather than through the message
+		userName := ""
+		if tlsCert, err := getCertFromRequest(r); err == nil {
+			log.Infof("received ecp request from %s", getSubjectDN(tlsCert.Subject))
+		} else {
+			name, password, ok := r.BasicAuth()
+			if !ok {
+				i.requestBasicAuth(w)
+				return
+			}
+			// The password is checked before the request is processed so that the ECP can retry it
+			if err = i.validatePassword(name, password); err != nil {
+				log.Infof("failed ecp password login for %s: %s", name, err)
+				if err == ErrInvalidPassword {
+					i.requestBasicAuth(w)
+					return
+				}
+				if err == errPasswordLoginDisabled {
+					i.Error(w, "403 Forbidden", http.StatusForbidden)
+					return
+				}
+				sendSOAPFault(w, faultServer, err.Error())
+				return
+			}
+			log.Infof("received ecp request from %s", name)
+			userName = name
+		}
+
+		request, user, err := i.processECPRequest(w, r, userName)
+		if rerr, ok := err.(*requestError); ok {
+			log.Infof("denied ecp request from %s: %s", request.Issuer, rerr)
+			if err = i.sendErrorResponse(request, rerr, w, r); err == nil {
+				return
+			}
+		}
+		if err == errClientCertificateRequired {
+			log.Infof("denied ecp password login for %s: %s", userName, err)
 			i.Error(w, "403 Forbidden", http.StatusForbidden)
 			return
 		}
-		log.Infof("received ecp request from %s", getSubjectDN(tlsCert.Subject))
-
-		request, user, err := i.processECPRequest(w, r)
 		if err != nil {
-			sendSOAPFault(i, w, "SOAP-ENV:Client", err.Error())
+			code := faultClient
+			if fault, ok := err.(*soapFault); ok {
+				code = fault.code
+			}
+			sendSOAPFault(w, code, err.Error())
 			return
 		}
 
 		if err := i.respond(request, user, w, r); err != nil {
-			sendSOAPFault(i, w, "SOAP-ENV:Server", err.Error())
+			sendSOAPFault(w, faultServer, err.Error())
 			return
 		}
 	}
 }
 
-func sendSOAPFault(i *IDP, w http.ResponseWriter, code, fault string) {
+func (i *IDP) requestBasicAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", i.entityID))
+	i.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+}
+
+func sendSOAPFault(w http.ResponseWriter, code, fault string) {
 	envelope := saml.SOAPFaultEnvelope{
+		Namespace: soapNamespace,
 		Body: saml.SOAPFaultBody{
 			Fault: saml.SOAPFault{
 				Code:   code,
@@ -59,56 +149,228 @@ func sendSOAPFault(i *IDP, w http.ResponseWriter, code, fault string) {
 			},
 		},
 	}
+	if j := strings.Index(code, ":"); j > 0 {
+		if namespace, ok := faultNamespaces[code[:j]]; ok {
+			envelope.Namespaces = []xml.Attr{{Name: xml.Name{Local: "xmlns:" + code[:j]}, Value: namespace}}
+		}
+	}
 
-	var b strings.Builder
-	encoder := xml.NewEncoder(&b)
+	// SOAP 1.1 faults are sent with a 500 status code
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	_, _ = w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
 	_ = encoder.Encode(envelope)
 	_ = encoder.Flush()
-
-	i.Error(w, b.String(), http.StatusInternalServerError)
 }
 
-func (i *IDP) processECPRequest(w http.ResponseWriter, r *http.Request) (*model.AuthnRequest, *model.User, error) {
-	xml, err := ioutil.ReadAll(r.Body)
+// processECPRequest validates the request and logs in the user with their client certificate or, if userName isn't
+// empty, the password they've already provided
+func (i *IDP) processECPRequest(w http.ResponseWriter, r *http.Request,
+	userName string) (*model.AuthnRequest, *model.User, error) {
+	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	authnReq, err := i.validateECPRequest(string(xml))
+	envelope, err := readECPEnvelope(data)
 	if err != nil {
 		return nil, nil, err
 	}
+	header := envelope.Header
+	if header == nil {
+		header = &saml.ECPRequestHeader{}
+	}
+	if err = checkECPHeader(header, &envelope.Body.AuthnRequest); err != nil {
+		return nil, nil, err
+	}
+	// Make sure the ECP sent the request to us rather than to someone relaying it
+	if err = i.verifyChannelBindings(header.ChannelBindings, r); err != nil {
+		return nil, nil, err
+	}
 
-	request, err := model.NewAuthnRequest(authnReq, "")
-	if err != nil {
+	authnReq, sp, err := i.validateECPRequest(string(data), envelope)
+	rerr, denied := err.(*requestError)
+	if err != nil && !denied {
 		return nil, nil, err
 	}
 
-	user, err := i.loginWithCert(r, request)
+	relayState := ""
+	if header.RelayState != nil {
+		relayState = header.RelayState.Value
+	}
+	if len(relayState) > 80 {
+		return nil, nil, errors.New("RelayState cannot be longer than 80 characters")
+	}
+	request, err := model.NewAuthnRequest(authnReq, relayState)
 	if err != nil {
 		return nil, nil, err
 	}
+	if denied {
+		// the service provider is told why in the response
+		return request, nil, rerr
+	}
 
+	if userName == "" {
+		user, err := i.loginWithCert(r, request)
+		if err != nil {
+			return nil, nil, err
+		}
+		return request, user, nil
+	}
+	if sp.requireClientCertificate() {
+		return nil, nil, errClientCertificateRequired
+	}
+	user, err := i.loginWithValidatedPassword(r, request, userName)
+	if err != nil {
+		return nil, nil, err
+	}
 	return request, user, nil
 }
 
+// readECPEnvelope parses the SOAP envelope. The AuthnRequest in it isn't trusted until its signature is verified.
+func readECPEnvelope(data []byte) (*saml.AuthnRequestEnvelope, error) {
+	envelope := &saml.AuthnRequestEnvelope{}
+	if err := readSOAPEnvelope(data, envelope); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// readSOAPEnvelope parses a SOAP 1.1 envelope into v. Other messages result in a soapFault.
+func readSOAPEnvelope(data []byte, v interface{}) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return newSOAPFault(faultClient, "unable to read SOAP envelope: %s", err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			if start.Name.Local != "Envelope" {
+				return newSOAPFault(faultClient, "message is not a SOAP envelope")
+			}
+			if start.Name.Space != soapNamespace {
+				return newSOAPFault(faultVersionMismatch, "unsupported SOAP envelope namespace %s", start.Name.Space)
+			}
+			break
+		}
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return newSOAPFault(faultClient, "unable to read SOAP envelope: %s", err)
+	}
+	return nil
+}
+
+// checkECPHeader makes sure we understand every mandatory header block and that the ECP profile header blocks
+// agree with the request
+func checkECPHeader(header *saml.ECPRequestHeader, authnReq *saml.AuthnRequest) error {
+	for _, block := range header.Other {
+		if mustUnderstand(block.MustUnderstand) {
+			return newSOAPFault(faultMustUnderstand, "header block %s %s is not understood",
+				block.XMLName.Space, block.XMLName.Local)
+		}
+	}
+	if paos := header.PAOSRequest; paos != nil && paos.Service != ecpProfile {
+		return newSOAPFault(faultClient, "PAOS request is for unsupported service %s", paos.Service)
+	}
+	if ecp := header.ECPRequest; ecp != nil && ecp.Issuer != "" && ecp.Issuer != authnReq.Issuer {
+		return newSOAPFault(faultClient, "ECP request header issuer %s does not match the request", ecp.Issuer)
+	}
+	return nil
+}
+
+func mustUnderstand(value string) bool {
+	return value == "1" || value == "true"
+}
+
+// verifyChannelBindings compares tls-server-end-point channel bindings with our TLS certificates. The ECP includes
+// them to bind the request to the connection it opened with us.
+func (i *IDP) verifyChannelBindings(bindings []saml.ChannelBindings, r *http.Request) error {
+	verified := false
+	for _, binding := range bindings {
+		if binding.Type != tlsServerEndPointBinding {
+			if mustUnderstand(binding.MustUnderstand) {
+				return newSOAPFault(faultMustUnderstand, "channel binding type %s is not supported", binding.Type)
+			}
+			continue
+		}
+		if r.TLS == nil {
+			return newSOAPFault(faultClient, "channel bindings were sent without TLS")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(binding.Value), ""))
+		if err != nil {
+			return newSOAPFault(faultClient, "unable to decode channel bindings: %s", err)
+		}
+		if !i.matchesServerEndPoint(value) {
+			return newSOAPFault(faultClient, "channel bindings do not match the TLS connection")
+		}
+		verified = true
+	}
+	if !verified && viper.GetBool("require-ecp-channel-bindings") {
+		return newSOAPFault(faultClient, "request does not contain %s channel bindings", tlsServerEndPointBinding)
+	}
+	return nil
+}
+
+// matchesServerEndPoint reports whether the value is the tls-server-end-point channel binding for one of our
+// certificates. With several certificates, we don't know which one the connection used.
+func (i *IDP) matchesServerEndPoint(value []byte) bool {
+	for _, cert := range i.TLSConfig.Certificates {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		expected, err := tlsServerEndPoint(cert.Certificate[0])
+		if err != nil {
+			log.Warnf("unable to calculate channel bindings: %s", err)
+			continue
+		}
+		if subtle.ConstantTimeCompare(expected, value) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsServerEndPoint returns the RFC 5929 tls-server-end-point channel binding, the hash of the server certificate
+// using the hash from its signature algorithm, or SHA-256 if that's MD5 or SHA-1
+func tlsServerEndPoint(der []byte) ([]byte, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	var h crypto.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = crypto.SHA384
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = crypto.SHA512
+	default:
+		h = crypto.SHA256
+	}
+	digest := h.New()
+	digest.Write(der)
+	return digest.Sum(nil), nil
+}
+
 func (i *IDP) sendECPResponse(request *model.AuthnRequest, user *model.User, w io.Writer, r *http.Request) error {
 	response := i.makeAuthnResponse(request, user)
-	signature, err := i.signer.CreateSignature(response.Assertion)
-	if err != nil {
+	sp, _ := i.getServiceProvider(request.Issuer)
+	if err := i.signResponse(response, sp); err != nil {
 		return err
 	}
-	response.Assertion.Signature = signature
+	return i.ecpResponse(request, response, w)
+}
 
+func (i *IDP) ecpResponse(request *model.AuthnRequest, response *saml.Response, w io.Writer) error {
 	envelope := saml.ECPResponseEnvelope{
 		Header: saml.ECPResponseHeader{
 			ECPResponse: saml.ECPResponse{
-				Actor:                       "http://schemas.xmlsoap.org/soap/actor/next",
+				Actor:                       soapActorNext,
 				MustUnderstand:              1,
 				AssertionConsumerServiceURL: request.AssertionConsumerServiceURL,
 			},
 			ECPRequestAuthenticated: saml.ECPRequestAuthenticated{
-				Actor: "http://schemas.xmlsoap.org/soap/actor/next",
+				Actor: soapActorNext,
 			},
 		},
 		Body: saml.ECPResponseBody{
@@ -116,6 +378,15 @@ func (i *IDP) sendECPResponse(request *model.AuthnRequest, user *model.User, w i
 		},
 	}
 
+	// the ECP returns the relay state to the service provider along with the response
+	if request.RelayState != "" {
+		envelope.Header.RelayState = &saml.ECPRelayState{
+			Actor:          soapActorNext,
+			MustUnderstand: "1",
+			Value:          request.RelayState,
+		}
+	}
+
 	// start by writing the XML header
 	_, _ = w.Write([]byte(xml.Header))
 
@@ -127,28 +398,41 @@ func (i *IDP) sendECPResponse(request *model.AuthnRequest, user *model.User, w i
 	return nil
 }
 
-func (i *IDP) validateECPRequest(body string) (*saml.AuthnRequest, error) {
-	// TODO verify channel bindings
+var authnRequestName = xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "AuthnRequest"}
 
-	referenced, err := i.validator.Validate(body)
-	if err != nil {
-		return nil, err
+// validateECPRequest verifies the request's signature and returns the signed request and its issuer
+func (i *IDP) validateECPRequest(body string,
+	envelope *saml.AuthnRequestEnvelope) (*saml.AuthnRequest, *ServiceProvider, error) {
+	// Only the issuer is read before the signature is verified so that its registered certificate can be used
+	issuer := envelope.Body.AuthnRequest.Issuer
+	if issuer == "" {
+		return nil, nil, errors.New("request does not contain an issuer")
 	}
 
-	// we should have just one AuthnRequest
-	var authnReq saml.AuthnRequest
-	decoder := xml.NewDecoder(strings.NewReader(referenced[0]))
-	if err := decoder.Decode(&authnReq); err != nil {
-		return nil, err
+	sp, ok := i.getServiceProvider(issuer)
+	if !ok {
+		return nil, nil, errors.New("request from unregistered issuer")
 	}
 
-	if authnReq.Issuer == "" {
-		return nil, errors.New("request does not contain an issuer")
+	ref, err := i.validator.ValidateWithKeys(body, sp.publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Make sure the signature covers the AuthnRequest in the body rather than some other element
+	if ref.Name != authnRequestName || ref.ID == "" || ref.ID != envelope.Body.AuthnRequest.ID {
+		return nil, nil, errors.New("signature does not cover the authentication request")
+	}
+	if err = sp.checkSignatureAlgorithms(ref); err != nil {
+		return nil, nil, err
 	}
 
-	sp, ok := i.sps[authnReq.Issuer]
-	if !ok {
-		return nil, errors.New("request from unregistered issuer")
+	// Only use what was signed to avoid signature wrapping attacks
+	var authnReq saml.AuthnRequest
+	if err := xml.Unmarshal([]byte(ref.XML), &authnReq); err != nil {
+		return nil, nil, err
+	}
+	if authnReq.Issuer != sp.EntityID {
+		return nil, nil, errors.New("signed request was issued by another service provider")
 	}
 
 	// Determine the right assertion consumer service
@@ -164,11 +448,12 @@ func (i *IDP) validateECPRequest(body string) (*saml.AuthnRequest, error) {
 		}
 	}
 	if acs == nil {
-		return nil, errors.New("unable to determine assertion consumer service")
+		return nil, nil, errors.New("unable to determine assertion consumer service")
 	}
 	if authnReq.AssertionConsumerServiceURL != acs.Location {
-		return nil, errors.New("assertion consumer location in request does not match metadata")
+		return nil, nil, errors.New("assertion consumer location in request does not match metadata")
 	}
 
-	return &authnReq, nil
+	// The SOAP binding doesn't require a destination
+	return &authnReq, sp, i.checkAuthnRequest(&authnReq, i.ecpServiceLocation, false)
 }
@@ -16,13 +16,26 @@ package idp
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
 )
 
 func Test_sendECPResponse(t *testing.T) {
@@ -33,6 +46,7 @@ func Test_sendECPResponse(t *testing.T) {
 	var b bytes.Buffer
 	if err := i.sendECPResponse(&model.AuthnRequest{
 		AssertionConsumerServiceURL: "testsvc",
+		RelayState:                  "state",
 	}, &model.User{}, &b, nil); err != nil {
 		t.Fatal(err)
 	}
@@ -44,4 +58,227 @@ func Test_sendECPResponse(t *testing.T) {
 	}
 
 	assert.Equal(t, "testsvc", e.Header.ECPResponse.AssertionConsumerServiceURL, "assertion consumer service url doesn't match")
+	if assert.NotNil(t, e.Header.RelayState, "expected relay state to be returned") {
+		assert.Equal(t, "state", e.Header.RelayState.Value)
+	}
+}
+
+// registerECPServiceProvider registers a service provider with a PAOS consumer service and returns its signer
+func registerECPServiceProvider(t *testing.T) sign.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("sps", []ServiceProvider{
+		{
+			EntityID:    "https://sp.example.com/",
+			Certificate: base64.StdEncoding.EncodeToString(der),
+			AssertionConsumerServices: []AssertionConsumerService{
+				{
+					IsDefault: true,
+					Binding:   "urn:oasis:names:tc:SAML:2.0:bindings:PAOS",
+					Location:  "https://sp.example.com/acs",
+				},
+			},
+		},
+	})
+	signer, err := sign.NewSigner(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, sign.SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newECPRequest(t *testing.T, signer sign.Signer) *saml.AuthnRequest {
+	request := &saml.AuthnRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now().UTC(),
+			Issuer:       "https://sp.example.com/",
+		},
+		AssertionConsumerServiceURL: "https://sp.example.com/acs",
+		ProtocolBinding:             "urn:oasis:names:tc:SAML:2.0:bindings:PAOS",
+	}
+	signature, err := signer.CreateSignature(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Signature = signature
+	return request
+}
+
+// ecpEnvelope wraps the header blocks and body in a SOAP envelope
+func ecpEnvelope(t *testing.T, header string, body interface{}) string {
+	data, err := xml.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return `<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/"><S:Header>` + header +
+		`</S:Header><S:Body>` + string(data) + `</S:Body></S:Envelope>`
+}
+
+func Test_validateECPRequest(t *testing.T) {
+	signer := registerECPServiceProvider(t)
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	validate := func(body string) (*saml.AuthnRequest, error) {
+		envelope, err := readECPEnvelope([]byte(body))
+		if err != nil {
+			return nil, err
+		}
+		authnReq, _, err := i.validateECPRequest(body, envelope)
+		return authnReq, err
+	}
+
+	request := newECPRequest(t, signer)
+	authnReq, err := validate(ecpEnvelope(t, "", request))
+	if assert.NoError(t, err) {
+		assert.Equal(t, request.ID, authnReq.ID)
+	}
+
+	// The IdP's certificate is embedded in the signature but isn't registered for the service provider
+	_, err = validate(ecpEnvelope(t, "", newECPRequest(t, i.signer)))
+	assert.Error(t, err, "expected signature made by another key to be rejected")
+
+	// Move the signed request into the header and put a forged one in the body
+	forged := *newECPRequest(t, signer)
+	signed, err := xml.Marshal(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.ID = saml.NewID()
+	forged.AssertionConsumerServiceURL = "https://attacker.example.com/acs"
+	forged.Signature = nil
+	_, err = validate(ecpEnvelope(t, string(signed), forged))
+	assert.EqualError(t, err, "signature does not cover the authentication request")
+}
+
+func TestIDP_DefaultECPHandler(t *testing.T) {
+	signer := registerECPServiceProvider(t)
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	userCert, err := x509.ParseCertificate(i.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	endPoint, err := tlsServerEndPoint(i.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindings := func(value []byte) string {
+		return `<cb:ChannelBindings xmlns:cb="urn:oasis:names:tc:SAML:protocol:ext:channel-binding" ` +
+			`xmlns:S="http://schemas.xmlsoap.org/soap/envelope/" S:mustUnderstand="1" Type="tls-server-end-point">` +
+			base64.StdEncoding.EncodeToString(value) + `</cb:ChannelBindings>`
+	}
+	relayState := `<ecp:RelayState xmlns:ecp="urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp" ` +
+		`xmlns:S="http://schemas.xmlsoap.org/soap/envelope/" S:actor="http://schemas.xmlsoap.org/soap/actor/next" ` +
+		`S:mustUnderstand="1">ss:mem:1234</ecp:RelayState>`
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{userCert}}
+		w := httptest.NewRecorder()
+		i.DefaultECPHandler()(w, req)
+		return w
+	}
+	fault := func(w *httptest.ResponseRecorder) string {
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		var envelope struct {
+			Fault struct {
+				Code   string `xml:"faultcode"`
+				String string `xml:"faultstring"`
+			} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body>Fault"`
+		}
+		if err := xml.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+			t.Fatal(err)
+		}
+		return envelope.Fault.Code
+	}
+
+	w := post(ecpEnvelope(t, bindings(endPoint)+relayState, newECPRequest(t, signer)))
+	if assert.Equal(t, http.StatusOK, w.Code, w.Body.String()) {
+		var e saml.ECPResponseEnvelope
+		if err := xml.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if assert.NotNil(t, e.Header.RelayState) {
+			assert.Equal(t, "ss:mem:1234", e.Header.RelayState.Value)
+		}
+	}
+
+	// The request was sent over a connection to someone else
+	w = post(ecpEnvelope(t, bindings([]byte("another server")), newECPRequest(t, signer)))
+	assert.Equal(t, "SOAP-ENV:Client", fault(w))
+
+	unknown := `<x:Unknown xmlns:x="urn:example" xmlns:S="http://schemas.xmlsoap.org/soap/envelope/" S:mustUnderstand="1"/>`
+	w = post(ecpEnvelope(t, unknown, newECPRequest(t, signer)))
+	assert.Equal(t, "SOAP-ENV:MustUnderstand", fault(w))
+
+	w = post(`<S:Envelope xmlns:S="http://www.w3.org/2003/05/soap-envelope"><S:Body/></S:Envelope>`)
+	assert.Equal(t, "SOAP-ENV:VersionMismatch", fault(w))
+
+	viper.Set("require-ecp-channel-bindings", true)
+	defer viper.Set("require-ecp-channel-bindings", false)
+	w = post(ecpEnvelope(t, "", newECPRequest(t, signer)))
+	assert.Equal(t, "SOAP-ENV:Client", fault(w))
+}
+
+func TestIDP_DefaultECPHandlerBasicAuth(t *testing.T) {
+	signer := registerECPServiceProvider(t)
+	defer viper.Set("sps", nil)
+	i := &IDP{PasswordValidator: &simpleValidator{
+		map[string][]byte{"joe": []byte("$2a$10$FNvHN.0e5LcLUonmGX0CIOAAEKYYSrlZkyibHgq3sLo0SizPtRhEG")},
+	}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	post := func(user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(ecpEnvelope(t, "", newECPRequest(t, signer))))
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		i.DefaultECPHandler()(w, req)
+		return w
+	}
+
+	w := post("", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+	w = post("joe", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = post("joe", "password")
+	if assert.Equal(t, http.StatusOK, w.Code, w.Body.String()) {
+		var e saml.ECPResponseEnvelope
+		if err := xml.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, e.Body.Response.RawAssertion, "joe")
+	}
+
+	// Passwords are refused when the discovery page doesn't offer them
+	i.AuthenticationSources = []AuthenticationSource{fakeSource{}}
+	viper.Set("discovery-local-login", false)
+	w = post("joe", "password")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	viper.Set("discovery-local-login", true)
+	i.AuthenticationSources = nil
+
+	viper.Set("ecp-require-client-certificate", true)
+	defer viper.Set("ecp-require-client-certificate", false)
+	w = post("joe", "password")
+	assert.Equal(t, http.StatusForbidden, w.Code)
 }
@@ -0,0 +1,282 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const entityCategoryAttribute = "http://macedir.org/entity-category"
+
+// ErrUnknownServiceProvider should be returned by a MetadataProvider that doesn't have metadata for the requested entity.
+var ErrUnknownServiceProvider = errors.New("service provider metadata not found")
+
+// MetadataProvider supplies service provider metadata in addition to the sps listed in the configuration file.
+type MetadataProvider interface {
+	ServiceProvider(entityID string) (*ServiceProvider, error)
+}
+
+// MetadataAggregate describes a signed SAML metadata aggregate (EntitiesDescriptor) published by a federation
+type MetadataAggregate struct {
+	// File path or URL of the aggregate
+	Source string
+	// Path of the PEM encoded certificate that must have signed the aggregate
+	Certificate string
+	// How often the aggregate is reloaded. A shorter cacheDuration in the aggregate takes precedence.
+	RefreshInterval time.Duration
+	// Only accept entities with at least one of these entity categories
+	EntityCategories []string
+	// Only accept entities registered by one of these registration authorities
+	RegistrationAuthorities []string
+	// Names of the attributes released to the aggregate's service providers. Nothing is released when empty.
+	ReleaseAttributes []string
+}
+
+type aggregateProvider struct {
+	conf      MetadataAggregate
+	validator sign.Validator
+	client    *http.Client
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu         sync.RWMutex
+	sps        map[string]*ServiceProvider
+	validUntil time.Time
+}
+
+// NewAggregateProvider loads and verifies the aggregate and then refreshes it in the background until the provider
+// is closed
+func NewAggregateProvider(conf MetadataAggregate) (MetadataProvider, error) {
+	if conf.Source == "" {
+		return nil, errors.New("metadata aggregate does not specify a source")
+	}
+	if conf.Certificate == "" {
+		return nil, fmt.Errorf("metadata aggregate %s does not specify a signing certificate", conf.Source)
+	}
+	cert, err := loadCertificate(conf.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	if conf.RefreshInterval <= 0 {
+		conf.RefreshInterval = viper.GetDuration("metadata-refresh-interval")
+	}
+	p := &aggregateProvider{
+		conf:      conf,
+		validator: sign.NewCertificateValidator(cert),
+		client:    &http.Client{Timeout: 30 * time.Second},
+		done:      make(chan struct{}),
+	}
+	next, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	go p.refresh(next)
+	return p, nil
+}
+
+func (p *aggregateProvider) ServiceProvider(entityID string) (*ServiceProvider, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.validUntil.IsZero() && time.Now().After(p.validUntil) {
+		log.Warnf("metadata aggregate %s expired at %s", p.conf.Source, p.validUntil)
+		return nil, ErrUnknownServiceProvider
+	}
+	sp, ok := p.sps[entityID]
+	if !ok {
+		return nil, ErrUnknownServiceProvider
+	}
+	return sp, nil
+}
+
+func (p *aggregateProvider) refresh(next time.Duration) {
+	timer := time.NewTimer(next)
+	for {
+		select {
+		case <-p.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			var err error
+			if next, err = p.load(); err != nil {
+				// Keep the entities we have until they expire
+				log.Errorf("failed to refresh metadata aggregate %s: %s", p.conf.Source, err)
+				next = p.conf.RefreshInterval
+			}
+			timer.Reset(next)
+		}
+	}
+}
+
+// Close stops refreshing the aggregate. Calling it again does nothing.
+func (p *aggregateProvider) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+// load retrieves, verifies, and indexes the aggregate returning the time until the next refresh
+func (p *aggregateProvider) load() (time.Duration, error) {
+	data, err := p.fetch()
+	if err != nil {
+		return 0, err
+	}
+	referenced, err := p.validator.Validate(string(data))
+	if err != nil {
+		return 0, err
+	}
+	if len(referenced) != 1 {
+		return 0, errors.New("metadata aggregate signature must contain a single reference")
+	}
+	// Only use what was signed to avoid signature wrapping attacks
+	entities := &saml.EntitiesDescriptor{}
+	if err = xml.Unmarshal([]byte(referenced[0]), entities); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var validUntil time.Time
+	if entities.ValidUntil != nil {
+		validUntil = *entities.ValidUntil
+		if now.After(validUntil) {
+			return 0, fmt.Errorf("metadata aggregate expired at %s", validUntil)
+		}
+	}
+	next := p.conf.RefreshInterval
+	if entities.CacheDuration != "" {
+		cacheDuration, err := saml.ParseDuration(entities.CacheDuration)
+		if err != nil {
+			return 0, err
+		}
+		if cacheDuration > 0 && cacheDuration < next {
+			next = cacheDuration
+		}
+	}
+	sps := make(map[string]*ServiceProvider)
+	p.addEntities(sps, entities, "", now)
+	p.mu.Lock()
+	p.sps = sps
+	p.validUntil = validUntil
+	p.mu.Unlock()
+	log.Infof("loaded %d service providers from metadata aggregate %s", len(sps), p.conf.Source)
+	return next, nil
+}
+
+func (p *aggregateProvider) fetch() ([]byte, error) {
+	u, err := url.Parse(p.conf.Source)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		return ioutil.ReadFile(p.conf.Source)
+	}
+	resp, err := p.client.Get(p.conf.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code, %d, when requesting metadata aggregate", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (p *aggregateProvider) addEntities(sps map[string]*ServiceProvider, entities *saml.EntitiesDescriptor,
+	authority string, now time.Time) {
+	if entities.ValidUntil != nil && now.After(*entities.ValidUntil) {
+		return
+	}
+	// Registration information is inherited from enclosing descriptors
+	if entities.Extensions != nil && entities.Extensions.RegistrationInfo != nil {
+		authority = entities.Extensions.RegistrationInfo.RegistrationAuthority
+	}
+	for j := range entities.EntityDescriptors {
+		ed := &entities.EntityDescriptors[j]
+		if ed.ValidUntil != nil && now.After(*ed.ValidUntil) {
+			continue
+		}
+		if !p.accept(&ed.EntityDescriptor, authority) {
+			continue
+		}
+		sp, err := convertMetadata(ed)
+		if err != nil {
+			// Aggregates also contain identity providers and other entities we can't use
+			log.Debugf("skipping %s in metadata aggregate: %s", ed.EntityID, err)
+			continue
+		}
+		if err = sp.parseCertificate(); err != nil {
+			log.Debugf("skipping %s in metadata aggregate: %s", ed.EntityID, err)
+			continue
+		}
+		// Members of a federation only receive the attributes the aggregate's policy allows
+		sp.ReleaseAttributes = p.conf.ReleaseAttributes
+		sp.releaseOnlyListed = true
+		sps[sp.EntityID] = sp
+	}
+	for j := range entities.EntitiesDescriptors {
+		p.addEntities(sps, &entities.EntitiesDescriptors[j], authority, now)
+	}
+}
+
+func (p *aggregateProvider) accept(ed *saml.EntityDescriptor, authority string) bool {
+	var categories []string
+	if ed.Extensions != nil {
+		if ed.Extensions.RegistrationInfo != nil {
+			authority = ed.Extensions.RegistrationInfo.RegistrationAuthority
+		}
+		if ed.Extensions.EntityAttributes != nil {
+			for _, att := range ed.Extensions.EntityAttributes.Attribute {
+				if att.Name != entityCategoryAttribute {
+					continue
+				}
+				for _, val := range att.AttributeValue {
+					categories = append(categories, val.Value)
+				}
+			}
+		}
+	}
+	if len(p.conf.RegistrationAuthorities) > 0 && !contains(p.conf.RegistrationAuthorities, authority) {
+		return false
+	}
+	if len(p.conf.EntityCategories) > 0 {
+		for _, category := range categories {
+			if contains(p.conf.EntityCategories, category) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/xmlsig"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSPCertificate = "MIICzDCCAbQCCQCaJRU/CzFSGzANBgkqhkiG9w0BAQsFADAoMQswCQYDVQQGEwJVUzEMMAoGA1UECgwDZGV4MQswCQYDVQQDDAJzcDAeFw0xODA5MDQxODEwMzlaFw0yODA5MDExODEwMzlaMCgxCzAJBgNVBAYTAlVTMQwwCgYDVQQKDANkZXgxCzAJBgNVBAMMAnNwMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAzJZd8K9jxC6mxuR5dw08qicw0VsDN1bAvdInKGzugsJYRH/MfcgrKwLCTZHBGZZFmdHxhca84cG/Wn24Ys5eF1JWhehYocyYqZqY3ESPldDK4ohwCvKhSogpF9hVyi9LnujCgfGOv98atMWDeqTLletCPsHcXzLq3cN58oNl80HXIQKFM7n9ZgUKLqk6d2hT7LeYndZKg5aUQ4jyTfz/S1XgYBDr0utl41HtUsHSYwQDx3v0wMqZVorzk8HrXaXowvUwVct6HxT/c5QxtHCxmm6n6/Mwr8Xzk1yxQq9dLtEOmEtnYgIEhyiUP7CdFPWC37sn9YiGCSjRukE07CyG0wIDAQABMA0GCSqGSIb3DQEBCwUAA4IBAQAJFl+hHwS6xNRtWMgJsu943zv4U8ZksyWAM5bk94ERMwpJVPndJIW0+UAT3Pp/k9E3Lro/AbSIA364LBzLoONOqfeNTUK4YH7wQGfmusI8c28akY5ZfDx8Ixc4oxPkcExh47YkVECSUhMq9gDMI10ePsSkVB7fss1QibmOsGM8WQyQzdmqfHbd7ws0g7P2I+SiR5+FboyliKRdqqSvQ8dL2hEAGtc9mZCPnlriiNzawCYPprH3lA+QWq+SI+QmQqTou05pWl5q+KcWU7INf0wEsXa26qcizqMTMNPuuu8Lp0gmmpUeH1AKVqO8P9VYT+GnkAUdoD3z1GCkLUvPaFYP"
+
+func testEntity(entityID, category string) saml.SPEntityDescriptor {
+	ed := saml.SPEntityDescriptor{
+		EntityDescriptor: saml.EntityDescriptor{
+			ID:       saml.NewID(),
+			EntityID: entityID,
+		},
+		SPSSODescriptor: saml.SPSSODescriptor{
+			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+			AssertionConsumerService: []saml.AssertionConsumerService{
+				{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+						Location: "https://" + entityID + "/acs",
+					},
+					IsDefault: true,
+				},
+			},
+			KeyDescriptor: []saml.KeyDescriptor{
+				{
+					Use: "signing",
+					KeyInfo: xmlsig.KeyInfo{
+						X509Data: &xmlsig.X509Data{X509Certificate: testSPCertificate},
+					},
+				},
+			},
+		},
+	}
+	if category != "" {
+		ed.Extensions = &saml.Extensions{
+			EntityAttributes: &saml.EntityAttributes{
+				Attribute: []saml.Attribute{
+					{
+						Name:           entityCategoryAttribute,
+						AttributeValue: []saml.AttributeValue{{Value: category}},
+					},
+				},
+			},
+		}
+	}
+	return ed
+}
+
+func signedAggregate(t *testing.T, validUntil time.Time) []byte {
+	cert, err := tls.LoadX509KeyPair(filepath.Join("testdata", "certificate.pem"), filepath.Join("testdata", "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := xmlsig.NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entities := &saml.EntitiesDescriptor{
+		ID:            saml.NewID(),
+		Name:          "https://federation.example.com/",
+		ValidUntil:    &validUntil,
+		CacheDuration: "PT1H",
+		Extensions: &saml.Extensions{
+			RegistrationInfo: &saml.RegistrationInfo{RegistrationAuthority: "https://federation.example.com/"},
+		},
+		EntityDescriptors: []saml.SPEntityDescriptor{
+			testEntity("sp1.example.com", "http://refeds.org/category/research-and-scholarship"),
+			testEntity("sp2.example.com", ""),
+		},
+	}
+	sig, err := signer.CreateSignature(entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entities.Signature = sig
+	var b bytes.Buffer
+	if err = xml.NewEncoder(&b).Encode(entities); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func aggregateServer(data []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+}
+
+func TestNewAggregateProvider(t *testing.T) {
+	ts := aggregateServer(signedAggregate(t, time.Now().Add(time.Hour)))
+	defer ts.Close()
+	provider, err := NewAggregateProvider(MetadataAggregate{
+		Source:      ts.URL,
+		Certificate: filepath.Join("testdata", "certificate.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.(*aggregateProvider).Close()
+	sp, err := provider.ServiceProvider("sp1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://sp1.example.com/acs", sp.AssertionConsumerServices[0].Location)
+	_, err = provider.ServiceProvider("unknown.example.com")
+	assert.Equal(t, ErrUnknownServiceProvider, err)
+
+	// Federation members only receive the attributes the aggregate's policy allows
+	atts := []*model.Attribute{{Name: "mail", Value: []string{"joe@example.com"}}, {Name: "role", Value: []string{"admin"}}}
+	assert.Empty(t, sp.releasedAttributes(atts))
+	released, err := NewAggregateProvider(MetadataAggregate{
+		Source:            ts.URL,
+		Certificate:       filepath.Join("testdata", "certificate.pem"),
+		ReleaseAttributes: []string{"mail"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer released.(*aggregateProvider).Close()
+	if sp, err = released.ServiceProvider("sp1.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, atts[:1], sp.releasedAttributes(atts))
+}
+
+func TestAggregateProviderFilters(t *testing.T) {
+	ts := aggregateServer(signedAggregate(t, time.Now().Add(time.Hour)))
+	defer ts.Close()
+	provider, err := NewAggregateProvider(MetadataAggregate{
+		Source:                  ts.URL,
+		Certificate:             filepath.Join("testdata", "certificate.pem"),
+		EntityCategories:        []string{"http://refeds.org/category/research-and-scholarship"},
+		RegistrationAuthorities: []string{"https://federation.example.com/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.(*aggregateProvider).Close()
+	_, err = provider.ServiceProvider("sp1.example.com")
+	assert.NoError(t, err)
+	_, err = provider.ServiceProvider("sp2.example.com")
+	assert.Equal(t, ErrUnknownServiceProvider, err, "entity without the category should be filtered")
+
+	other, err := NewAggregateProvider(MetadataAggregate{
+		Source:                  ts.URL,
+		Certificate:             filepath.Join("testdata", "certificate.pem"),
+		RegistrationAuthorities: []string{"https://other.example.com/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.(*aggregateProvider).Close()
+	_, err = other.ServiceProvider("sp1.example.com")
+	assert.Equal(t, ErrUnknownServiceProvider, err, "entity from another authority should be filtered")
+}
+
+func TestAggregateProviderRejectsInvalidMetadata(t *testing.T) {
+	data := signedAggregate(t, time.Now().Add(time.Hour))
+	tampered := aggregateServer([]byte(strings.Replace(string(data), "sp2.example.com", "evil.example.com", -1)))
+	defer tampered.Close()
+	_, err := NewAggregateProvider(MetadataAggregate{
+		Source:      tampered.URL,
+		Certificate: filepath.Join("testdata", "certificate.pem"),
+	})
+	assert.Error(t, err, "modified aggregate should fail signature validation")
+
+	expired := aggregateServer(signedAggregate(t, time.Now().Add(-time.Hour)))
+	defer expired.Close()
+	_, err = NewAggregateProvider(MetadataAggregate{
+		Source:      expired.URL,
+		Certificate: filepath.Join("testdata", "certificate.pem"),
+	})
+	assert.Error(t, err, "expired aggregate should be rejected")
+}
+
+func TestIDP_getServiceProvider(t *testing.T) {
+	ts := aggregateServer(signedAggregate(t, time.Now().Add(time.Hour)))
+	defer ts.Close()
+	provider, err := NewAggregateProvider(MetadataAggregate{
+		Source:      ts.URL,
+		Certificate: filepath.Join("testdata", "certificate.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.(*aggregateProvider).Close()
+	i := &IDP{MetadataProviders: []MetadataProvider{provider}}
+	getTestIDP(t, i).Close()
+	_, ok := i.getServiceProvider("sp2.example.com")
+	assert.True(t, ok, "service provider from aggregate should be found")
+	_, ok = i.getServiceProvider("unknown.example.com")
+	assert.False(t, ok)
+}
+
+func TestIDP_Close(t *testing.T) {
+	ts := aggregateServer(signedAggregate(t, time.Now().Add(time.Hour)))
+	defer ts.Close()
+	provider, err := NewAggregateProvider(MetadataAggregate{
+		Source:      ts.URL,
+		Certificate: filepath.Join("testdata", "certificate.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &IDP{MetadataProviders: []MetadataProvider{provider}}
+	assert.NoError(t, i.Close())
+	assert.NoError(t, i.Close(), "closing twice should not panic")
+}
+
+// unavailableMetadata is a metadata provider that can't be reached
+type unavailableMetadata struct{}
+
+func (unavailableMetadata) ServiceProvider(entityID string) (*ServiceProvider, error) {
+	return nil, errors.New("metadata is unavailable")
+}
+
+func TestIDP_ServiceProvider(t *testing.T) {
+	ts := aggregateServer(signedAggregate(t, time.Now().Add(time.Hour)))
+	defer ts.Close()
+	provider, err := NewAggregateProvider(MetadataAggregate{
+		Source:      ts.URL,
+		Certificate: filepath.Join("testdata", "certificate.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.(*aggregateProvider).Close()
+	// Providers that fail are skipped like they are at login
+	i := &IDP{MetadataProviders: []MetadataProvider{unavailableMetadata{}, provider}}
+	sp, err := i.ServiceProvider("sp2.example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "sp2.example.com", sp.EntityID)
+	}
+	_, err = i.ServiceProvider("unknown.example.com")
+	assert.Equal(t, ErrUnknownServiceProvider, err)
+}
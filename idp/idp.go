@@ -15,20 +15,24 @@
 package idp
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/sign"
+	"github.com/amdonov/lite-idp/spnego"
 	"github.com/amdonov/lite-idp/store"
 	"github.com/amdonov/lite-idp/ui"
-	"github.com/amdonov/xmlsig"
 	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
@@ -41,33 +45,100 @@ type IDP struct {
 	// Short term cache for saving state during authentication
 	TempCache store.Cache
 	// Longer term cache of authenticated users
-	UserCache              store.Cache
-	TLSConfig              *tls.Config
-	PasswordValidator      PasswordValidator
-	AttributeSources       []AttributeSource
+	UserCache store.Cache
+	// Cache of received request IDs used to detect replayed requests
+	ReplayCache store.Cache
+	// Cache of issued assertions that can be retrieved with AssertionIDRequest and AuthnQuery
+	AssertionCache store.Cache
+	// Cache of assertions exchanged for access tokens, which must remember them until they expire
+	ExchangeCache store.Cache
+	// Links between users and the persistent name identifiers issued to service providers
+	NameIDStore NameIDStore
+	// Attribute release decisions users asked to be remembered
+	ConsentStore      ConsentStore
+	TLSConfig         *tls.Config
+	PasswordValidator PasswordValidator
+	// Accepts Kerberos service tickets from browsers before users are shown the login form
+	Kerberos *spnego.Acceptor
+	// Other places users can log in, such as upstream identity providers, offered on the discovery page
+	AuthenticationSources []AuthenticationSource
+	AttributeSources      []AttributeSource
+	// Sources of service provider metadata beyond the configuration file
+	MetadataProviders      []MetadataProvider
 	MetadataHandler        http.HandlerFunc
+	MDQHandler             http.HandlerFunc
 	ArtifactResolveHandler http.HandlerFunc
 	RedirectSSOHandler     http.HandlerFunc
+	PostSSOHandler         http.HandlerFunc
 	ECPHandler             http.HandlerFunc
 	PasswordLoginHandler   http.HandlerFunc
+	DiscoveryHandler       http.HandlerFunc
+	NegotiateHandler       http.HandlerFunc
+	ConsentHandler         http.HandlerFunc
 	QueryHandler           http.HandlerFunc
-	Error                  func(w http.ResponseWriter, error string, code int)
-	UIHandler              http.Handler
-	Auditor                Auditor
-	handler                http.Handler
-	signer                 sign.Signer
-	validator              sign.Validator
+	// Handlers for the AssertionIDRequest SOAP and URI bindings and AuthnQuery
+	AssertionIDRequestHandler http.HandlerFunc
+	AssertionIDURIHandler     http.HandlerFunc
+	AuthnQueryHandler         http.HandlerFunc
+	// Handlers for ManageNameIDRequests sent with the SOAP and redirect bindings and for NameIDMappingRequests
+	ManageNameIDHandler         http.HandlerFunc
+	RedirectManageNameIDHandler http.HandlerFunc
+	NameIDMappingHandler        http.HandlerFunc
+	// Handlers for the OpenID Connect provider
+	OIDCDiscoveryHandler     http.HandlerFunc
+	OIDCJWKSHandler          http.HandlerFunc
+	OIDCAuthorizationHandler http.HandlerFunc
+	OIDCTokenHandler         http.HandlerFunc
+	OIDCUserInfoHandler      http.HandlerFunc
+	// Handlers for WS-Federation passive requestors and their metadata
+	WSFedHandler         http.HandlerFunc
+	WSFedMetadataHandler http.HandlerFunc
+	// Handlers for the CAS protocol. The validate handlers answer CAS 2 and CAS 3 (p3) validation requests.
+	CASLoginHandler      http.HandlerFunc
+	CASValidateHandler   http.HandlerFunc
+	CASP3ValidateHandler http.HandlerFunc
+	CASLogoutHandler     http.HandlerFunc
+	// Handler for WS-Trust requests for security tokens
+	STSHandler http.HandlerFunc
+	Error      func(w http.ResponseWriter, error string, code int)
+	UIHandler  http.Handler
+	Auditor    Auditor
+	handler    http.Handler
+	signer     sign.Signer
+	keystore   *keystore
+	validator  sign.Validator
 
 	// properties set or derived from configuration settings
-	cookieName                        string
-	serverName                        string
-	entityID                          string
-	artifactResolutionServiceLocation string
-	attributeServiceLocation          string
-	singleSignOnServiceLocation       string
-	ecpServiceLocation                string
-	postTemplate                      *template.Template
-	sps                               map[string]*ServiceProvider
+	cookieName                          string
+	serverName                          string
+	entityID                            string
+	artifactResolutionServiceLocation   string
+	attributeServiceLocation            string
+	assertionIDRequestServiceLocation   string
+	assertionIDURIServiceLocation       string
+	authnQueryServiceLocation           string
+	manageNameIDServiceLocation         string
+	redirectManageNameIDServiceLocation string
+	nameIDMappingServiceLocation        string
+	singleSignOnServiceLocation         string
+	postSingleSignOnServiceLocation     string
+	ecpServiceLocation                  string
+	postTemplate                        *template.Template
+	sps                                 map[string]*ServiceProvider
+	metadata                            metadataSettings
+	persistentIDKey                     []byte
+	oidcIssuer                          string
+	oidcAuthorizationLocation           string
+	oidcTokenLocation                   string
+	oidcUserInfoLocation                string
+	oidcJWKSLocation                    string
+	oidcClients                         map[string]*OIDCClient
+	oidcClaims                          []ClaimMapping
+	wsfedLocation                       string
+	stsLocation                         string
+	wsfedTemplate                       *template.Template
+	relyingParties                      map[string]*RelyingParty
+	casServices                         []*CASService
 }
 
 // Handler returns the IDP's http.Handler including all sub routes or an error
@@ -85,18 +156,36 @@ func (i *IDP) Handler() (http.Handler, error) {
 		if err := i.configureSPs(); err != nil {
 			return nil, err
 		}
+		if err := i.configureOIDC(); err != nil {
+			return nil, err
+		}
+		if err := i.configureWSFed(); err != nil {
+			return nil, err
+		}
+		if err := i.configureCAS(); err != nil {
+			return nil, err
+		}
 		if err := i.configureCrypto(); err != nil {
 			return nil, err
 		}
+		if err := i.configureMetadata(); err != nil {
+			return nil, err
+		}
 		if err := i.configureStores(); err != nil {
 			return nil, err
 		}
 		if err := i.configureValidator(); err != nil {
 			return nil, err
 		}
+		if err := i.configureKerberos(); err != nil {
+			return nil, err
+		}
 		if err := i.configureAttributeSources(); err != nil {
 			return nil, err
 		}
+		if err := i.configureAuthenticationSources(); err != nil {
+			return nil, err
+		}
 		if err := i.buildRoutes(); err != nil {
 			return nil, err
 		}
@@ -120,8 +209,20 @@ func (i *IDP) configureConstants() error {
 	i.serverName = serverName
 	i.artifactResolutionServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("artifact-service-path"))
 	i.attributeServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("attribute-service-path"))
+	i.assertionIDRequestServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("assertion-id-request-service-path"))
+	i.assertionIDURIServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("assertion-id-uri-path"))
+	i.authnQueryServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("authn-query-service-path"))
+	i.manageNameIDServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("manage-nameid-service-path"))
+	i.redirectManageNameIDServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("redirect-manage-nameid-service-path"))
+	i.nameIDMappingServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("nameid-mapping-service-path"))
 	i.singleSignOnServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("sso-service-path"))
+	i.postSingleSignOnServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("post-sso-service-path"))
 	i.ecpServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("ecp-service-path"))
+	i.stsLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("sts-path"))
+	if secret := viper.GetString("persistent-id-secret"); secret != "" {
+		key := sha256.Sum256([]byte(secret))
+		i.persistentIDKey = key[:]
+	}
 	return nil
 }
 
@@ -135,12 +236,108 @@ func (i *IDP) configureSPs() error {
 		if err := sp.parseCertificate(); err != nil {
 			return err
 		}
+		switch sp.NameIDFormat {
+		case "", nameIDTransient, nameIDPersistent:
+		default:
+			return fmt.Errorf("unsupported name identifier format %s for %s", sp.NameIDFormat, sp.EntityID)
+		}
+		switch sp.Sign {
+		case "", signingAssertion, signingResponse, signingBoth:
+		default:
+			return fmt.Errorf("unsupported sign setting %s for %s", sp.Sign, sp.EntityID)
+		}
+		if err := sp.validateAccessRules(); err != nil {
+			return fmt.Errorf("invalid access rule for %s: %s", sp.EntityID, err)
+		}
 		i.sps[sp.EntityID] = sps[j]
 	}
 
+	if i.MetadataProviders == nil {
+		aggregates := []MetadataAggregate{}
+		if err := viper.UnmarshalKey("metadata-aggregates", &aggregates); err != nil {
+			return err
+		}
+		for _, aggregate := range aggregates {
+			provider, err := NewAggregateProvider(aggregate)
+			if err != nil {
+				return err
+			}
+			i.MetadataProviders = append(i.MetadataProviders, provider)
+		}
+		queries := []MetadataQuery{}
+		if err := viper.UnmarshalKey("metadata-queries", &queries); err != nil {
+			return err
+		}
+		for _, query := range queries {
+			provider, err := NewMDQProvider(query)
+			if err != nil {
+				return err
+			}
+			i.MetadataProviders = append(i.MetadataProviders, provider)
+		}
+	}
+	return nil
+}
+
+// ServiceProvider returns the registered service provider or looks it up with the metadata providers like requests
+// do. Service providers are read from the configuration the first time when the handler hasn't been created yet.
+func (i *IDP) ServiceProvider(entityID string) (*ServiceProvider, error) {
+	if err := i.configureServices(); err != nil {
+		return nil, err
+	}
+	if sp, ok := i.getServiceProvider(entityID); ok {
+		return sp, nil
+	}
+	return nil, ErrUnknownServiceProvider
+}
+
+// configureServices reads the service providers, clients, relying parties, and CAS services from the configuration
+// unless the handler already has
+func (i *IDP) configureServices() error {
+	if i.sps != nil {
+		return nil
+	}
+	if err := i.configureOIDC(); err != nil {
+		return err
+	}
+	if err := i.configureWSFed(); err != nil {
+		return err
+	}
+	if err := i.configureCAS(); err != nil {
+		return err
+	}
+	return i.configureSPs()
+}
+
+// Close stops the background work of metadata providers, such as refreshing aggregates
+func (i *IDP) Close() error {
+	for _, provider := range i.MetadataProviders {
+		if closer, ok := provider.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// getServiceProvider returns the registered service provider or looks it up with the metadata providers
+func (i *IDP) getServiceProvider(entityID string) (*ServiceProvider, bool) {
+	if sp, ok := i.sps[entityID]; ok {
+		return sp, true
+	}
+	for _, provider := range i.MetadataProviders {
+		sp, err := provider.ServiceProvider(entityID)
+		if err == nil {
+			return sp, true
+		}
+		if err != ErrUnknownServiceProvider {
+			log.Errorf("failed to retrieve metadata for %s: %s", entityID, err)
+		}
+	}
+	return nil, false
+}
+
 func (i *IDP) configureCrypto() error {
 	if i.TLSConfig == nil {
 		tlsConfig, err := ConfigureTLS()
@@ -152,15 +349,51 @@ func (i *IDP) configureCrypto() error {
 	if len(i.TLSConfig.Certificates) == 0 {
 		return errors.New("tlsConfig does not contain a certificate")
 	}
-	cert := i.TLSConfig.Certificates[0]
-	signer, err := xmlsig.NewSignerWithOptions(cert, xmlsig.SignerOptions{
+	options := sign.SignerOptions{
 		SignatureAlgorithm: viper.GetString("signature-algorithm"),
 		DigestAlgorithm:    viper.GetString("digest-algorithm"),
-	})
-	i.signer = signer
+	}
+	confs := []SigningKey{}
+	if err := viper.UnmarshalKey("signing-keys", &confs); err != nil {
+		return err
+	}
+	keys := make([]*keystoreKey, 0, len(confs)+1)
+	for _, conf := range confs {
+		key, err := loadSigningKey(conf, options)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	active := viper.GetString("signing-key")
+	// An explicitly named key takes precedence over keys that were activated before the IdP started
+	pinned := time.Now()
+	if active == "" {
+		pinned = time.Time{}
+		// keep signing with the TLS certificate until a scheduled key is activated
+		key, err := newKeystoreKey(tlsSigningKey, i.TLSConfig.Certificates[0], options)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		active = tlsSigningKey
+	}
+	publish := time.Duration(viper.GetInt("signing-key-publish-days")) * 24 * time.Hour
+	keystore, err := newKeystore(keys, active, publish, pinned)
+	if err != nil {
+		return err
+	}
+	i.keystore = keystore
+	i.signer = keystore
+	// Make sure the algorithms chosen for service providers can be used with the signing key
+	for _, sp := range i.sps {
+		if _, err := i.signerFor(sp); err != nil {
+			return fmt.Errorf("invalid signing algorithms for %s: %s", sp.EntityID, err)
+		}
+	}
 
 	i.validator = sign.NewValidator()
-	return err
+	return nil
 }
 
 func (i *IDP) configureStores() error {
@@ -178,6 +411,49 @@ func (i *IDP) configureStores() error {
 		}
 		i.UserCache = cache
 	}
+	if i.ReplayCache == nil {
+		cache, err := store.New(ReplayCacheDuration())
+		if err != nil {
+			return err
+		}
+		i.ReplayCache = cache
+	}
+	if i.AssertionCache == nil {
+		cache, err := store.New(viper.GetDuration("assertion-cache-duration"))
+		if err != nil {
+			return err
+		}
+		i.AssertionCache = cache
+	}
+	if i.ExchangeCache == nil {
+		cache, err := store.New(viper.GetDuration("exchange-cache-duration"))
+		if err != nil {
+			return err
+		}
+		i.ExchangeCache = cache
+	}
+	if i.NameIDStore == nil {
+		nameIDStore, err := NewNameIDStore()
+		if err != nil {
+			return err
+		}
+		i.NameIDStore = nameIDStore
+		if viper.GetString("nameid-store-path") == "" {
+			for _, sp := range i.sps {
+				if sp.NameIDFormat == nameIDPersistent || len(sp.ManageNameIDServices) > 0 {
+					log.Warnf("persistent identifiers for %s will be lost on restart because nameid-store-path isn't set",
+						sp.EntityID)
+				}
+			}
+		}
+	}
+	if i.ConsentStore == nil {
+		consentStore, err := NewConsentStore()
+		if err != nil {
+			return err
+		}
+		i.ConsentStore = consentStore
+	}
 	return nil
 }
 
@@ -219,6 +495,18 @@ func (i *IDP) buildRoutes() error {
 	}
 	r.HandlerFunc("GET", viper.GetString("metadata-path"), i.MetadataHandler)
 
+	// Handle metadata queries
+	if i.MDQHandler == nil {
+		mdq, err := i.DefaultMDQHandler()
+		if err != nil {
+			return err
+		}
+		i.MDQHandler = mdq
+	}
+	mdqPath := viper.GetString("mdq-path")
+	r.HandlerFunc("GET", mdqPath, i.MDQHandler)
+	r.HandlerFunc("GET", mdqPath+"/*id", i.MDQHandler)
+
 	// Handle artifact resolution
 	if i.ArtifactResolveHandler == nil {
 		i.ArtifactResolveHandler = i.DefaultArtifactResolveHandler()
@@ -230,6 +518,10 @@ func (i *IDP) buildRoutes() error {
 		i.RedirectSSOHandler = i.DefaultRedirectSSOHandler()
 	}
 	r.HandlerFunc("GET", viper.GetString("sso-service-path"), i.RedirectSSOHandler)
+	if i.PostSSOHandler == nil {
+		i.PostSSOHandler = i.DefaultPostSSOHandler()
+	}
+	r.HandlerFunc("POST", viper.GetString("post-sso-service-path"), i.PostSSOHandler)
 
 	// Handle ECP requests
 	if i.ECPHandler == nil {
@@ -242,6 +534,10 @@ func (i *IDP) buildRoutes() error {
 		i.PasswordLoginHandler = i.DefaultPasswordLoginHandler()
 	}
 	r.HandlerFunc("POST", "/ui/login.html", i.PasswordLoginHandler)
+	if i.NegotiateHandler == nil {
+		i.NegotiateHandler = i.DefaultNegotiateHandler()
+	}
+	r.HandlerFunc("GET", viper.GetString("negotiate-path"), i.NegotiateHandler)
 
 	// Handle attribute query
 	if i.QueryHandler == nil {
@@ -249,6 +545,129 @@ func (i *IDP) buildRoutes() error {
 	}
 	r.HandlerFunc("POST", viper.GetString("attribute-service-path"), i.QueryHandler)
 
+	// Handle requests for issued assertions
+	if i.AssertionIDRequestHandler == nil {
+		i.AssertionIDRequestHandler = i.DefaultAssertionIDRequestHandler()
+	}
+	r.HandlerFunc("POST", viper.GetString("assertion-id-request-service-path"), i.AssertionIDRequestHandler)
+	if i.AssertionIDURIHandler == nil {
+		i.AssertionIDURIHandler = i.DefaultAssertionIDURIHandler()
+	}
+	r.HandlerFunc("GET", viper.GetString("assertion-id-uri-path"), i.AssertionIDURIHandler)
+
+	// Handle authentication queries
+	if i.AuthnQueryHandler == nil {
+		i.AuthnQueryHandler = i.DefaultAuthnQueryHandler()
+	}
+	r.HandlerFunc("POST", viper.GetString("authn-query-service-path"), i.AuthnQueryHandler)
+
+	// Handle name identifier management and mapping
+	if i.ManageNameIDHandler == nil {
+		i.ManageNameIDHandler = i.DefaultManageNameIDHandler()
+	}
+	r.HandlerFunc("POST", viper.GetString("manage-nameid-service-path"), i.ManageNameIDHandler)
+	if i.RedirectManageNameIDHandler == nil {
+		i.RedirectManageNameIDHandler = i.DefaultRedirectManageNameIDHandler()
+	}
+	r.HandlerFunc("GET", viper.GetString("redirect-manage-nameid-service-path"), i.RedirectManageNameIDHandler)
+	if i.NameIDMappingHandler == nil {
+		i.NameIDMappingHandler = i.DefaultNameIDMappingHandler()
+	}
+	r.HandlerFunc("POST", viper.GetString("nameid-mapping-service-path"), i.NameIDMappingHandler)
+
+	// Handle OpenID Connect
+	if i.OIDCDiscoveryHandler == nil {
+		i.OIDCDiscoveryHandler = i.DefaultOIDCDiscoveryHandler()
+	}
+	r.HandlerFunc("GET", i.oidcDiscoveryPath(), i.OIDCDiscoveryHandler)
+	if i.OIDCJWKSHandler == nil {
+		i.OIDCJWKSHandler = i.DefaultOIDCJWKSHandler()
+	}
+	r.HandlerFunc("GET", viper.GetString("oidc-jwks-path"), i.OIDCJWKSHandler)
+	if i.OIDCAuthorizationHandler == nil {
+		i.OIDCAuthorizationHandler = i.DefaultOIDCAuthorizationHandler()
+	}
+	r.HandlerFunc("GET", viper.GetString("oidc-authorization-path"), i.OIDCAuthorizationHandler)
+	r.HandlerFunc("POST", viper.GetString("oidc-authorization-path"), i.OIDCAuthorizationHandler)
+	if i.OIDCTokenHandler == nil {
+		i.OIDCTokenHandler = i.DefaultOIDCTokenHandler()
+	}
+	r.HandlerFunc("POST", viper.GetString("oidc-token-path"), i.OIDCTokenHandler)
+	if i.OIDCUserInfoHandler == nil {
+		i.OIDCUserInfoHandler = i.DefaultOIDCUserInfoHandler()
+	}
+	r.HandlerFunc("GET", viper.GetString("oidc-userinfo-path"), i.OIDCUserInfoHandler)
+	r.HandlerFunc("POST", viper.GetString("oidc-userinfo-path"), i.OIDCUserInfoHandler)
+
+	// Handle WS-Federation sign in and sign out
+	if i.WSFedHandler == nil {
+		i.WSFedHandler = i.DefaultWSFedHandler()
+	}
+	r.HandlerFunc("GET", viper.GetString("wsfed-path"), i.WSFedHandler)
+	r.HandlerFunc("POST", viper.GetString("wsfed-path"), i.WSFedHandler)
+	if i.WSFedMetadataHandler == nil {
+		metadata, err := i.DefaultWSFedMetadataHandler()
+		if err != nil {
+			return err
+		}
+		i.WSFedMetadataHandler = metadata
+	}
+	r.HandlerFunc("GET", viper.GetString("wsfed-metadata-path"), i.WSFedMetadataHandler)
+
+	// Handle the CAS protocol
+	casPath := strings.TrimSuffix(viper.GetString("cas-path"), "/")
+	if i.CASLoginHandler == nil {
+		i.CASLoginHandler = i.DefaultCASLoginHandler()
+	}
+	r.HandlerFunc("GET", casPath+"/login", i.CASLoginHandler)
+	if i.CASValidateHandler == nil {
+		i.CASValidateHandler = i.DefaultCASValidateHandler(false)
+	}
+	r.HandlerFunc("GET", casPath+"/serviceValidate", i.CASValidateHandler)
+	r.HandlerFunc("GET", casPath+"/proxyValidate", i.CASValidateHandler)
+	if i.CASP3ValidateHandler == nil {
+		i.CASP3ValidateHandler = i.DefaultCASValidateHandler(true)
+	}
+	r.HandlerFunc("GET", casPath+"/p3/serviceValidate", i.CASP3ValidateHandler)
+	r.HandlerFunc("GET", casPath+"/p3/proxyValidate", i.CASP3ValidateHandler)
+	if i.CASLogoutHandler == nil {
+		i.CASLogoutHandler = i.DefaultCASLogoutHandler()
+	}
+	r.HandlerFunc("GET", casPath+"/logout", i.CASLogoutHandler)
+
+	// Handle WS-Trust requests for security tokens
+	if i.STSHandler == nil {
+		i.STSHandler = i.DefaultSTSHandler()
+	}
+	r.HandlerFunc("POST", viper.GetString("sts-path"), i.STSHandler)
+
+	// Let users decide whether their attributes are released
+	if i.ConsentHandler == nil {
+		i.ConsentHandler = i.DefaultConsentHandler()
+	}
+	r.HandlerFunc("POST", viper.GetString("consent-path"), i.ConsentHandler)
+
+	// Let users log in with authentication sources
+	if i.DiscoveryHandler == nil {
+		discovery, err := i.DefaultDiscoveryHandler()
+		if err != nil {
+			return err
+		}
+		i.DiscoveryHandler = discovery
+	}
+	r.HandlerFunc("GET", viper.GetString("discovery-path"), i.DiscoveryHandler)
+	upstreamPath := strings.TrimSuffix(viper.GetString("upstream-path"), "/")
+	for _, source := range i.AuthenticationSources {
+		handler, err := source.Handler(i.finishUpstreamLogin(source))
+		if err != nil {
+			return err
+		}
+		prefix := upstreamPath + "/" + source.Name()
+		handler = http.StripPrefix(prefix, handler)
+		r.Handler("GET", prefix+"/*path", handler)
+		r.Handler("POST", prefix+"/*path", handler)
+	}
+
 	// Handle UI rendering
 	if i.UIHandler == nil {
 		i.UIHandler = ui.UI()
@@ -261,8 +680,9 @@ func (i *IDP) buildRoutes() error {
 
 func getIP(request *http.Request) net.IP {
 	addr := request.RemoteAddr
-	if strings.Contains(addr, ":") {
-		addr = strings.Split(addr, ":")[0]
+	// IPv6 addresses contain colons too, so the port has to be split off carefully
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
 	}
 	return net.ParseIP(addr)
 }
@@ -15,20 +15,56 @@
 package idp
 
 import (
+	"net/http"
 	"net/http/httptest"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/amdonov/lite-idp/store"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 )
 
+// The test IdPs share caches to keep memory use down. Every cache preallocates a lot of memory.
+var testAssertionCache, testTempCache, testUserCache store.Cache
+
+// sharedTestCache returns the shared cache, creating it the first time
+func sharedTestCache(t *testing.T, cache *store.Cache) store.Cache {
+	if *cache == nil {
+		c, err := store.New(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*cache = c
+	}
+	return *cache
+}
+
 func getTestIDP(t *testing.T, i *IDP) *httptest.Server {
 	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
 	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
 	viper.Set("tls-ca", filepath.Join("testdata", "certificate.pem"))
+	if i.AssertionCache == nil {
+		i.AssertionCache = sharedTestCache(t, &testAssertionCache)
+	}
+	if i.TempCache == nil {
+		i.TempCache = sharedTestCache(t, &testTempCache)
+	}
+	if i.UserCache == nil {
+		i.UserCache = sharedTestCache(t, &testUserCache)
+	}
 	handler, err := i.Handler()
 	if err != nil {
 		t.Fatal(err)
 	}
 	return httptest.NewTLSServer(handler)
 }
+
+func Test_getIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "192.0.2.1", getIP(r).String())
+	r.RemoteAddr = "[2001:db8::1]:1234"
+	assert.Equal(t, "2001:db8::1", getIP(r).String())
+}
@@ -0,0 +1,156 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/spnego"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func (i *IDP) configureKerberos() error {
+	keytabPath := viper.GetString("kerberos-keytab")
+	if i.Kerberos != nil || keytabPath == "" {
+		return nil
+	}
+	keytab, err := spnego.LoadKeytab(keytabPath)
+	if err != nil {
+		return err
+	}
+	i.Kerberos = spnego.NewAcceptor(keytab, i.ReplayCache, viper.GetDuration("clock-skew"))
+	return nil
+}
+
+// negotiateToken returns the token sent with the Negotiate authorization scheme
+func negotiateToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 10 || !strings.EqualFold(authorization[:10], "Negotiate ") {
+		return "", false
+	}
+	return strings.TrimSpace(authorization[10:]), true
+}
+
+// loginWithKerberos logs in users whose browsers sent a Kerberos service ticket. Tokens that aren't accepted are
+// logged and the user is left to log in some other way.
+func (i *IDP) loginWithKerberos(w http.ResponseWriter, r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
+	token, ok := negotiateToken(r)
+	if !ok {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		log.Infof("Kerberos login failed: malformed token: %s", err)
+		return nil, nil
+	}
+	principal, err := i.Kerberos.Accept(data)
+	if err != nil {
+		log.Infof("Kerberos login failed: %s", err)
+		return nil, nil
+	}
+	user := &model.User{
+		Name:    kerberosUserName(*principal, viper.GetStringSlice("kerberos-strip-realms")),
+		Format:  "urn:oasis:names:tc:SAML:2.0:nameid-format:kerberos",
+		Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:Kerberos",
+		IP:      getIP(r).String(),
+	}
+	// Add attributes
+	if err := i.setUserAttributes(user, authnReq); err != nil {
+		return nil, err
+	}
+	i.Auditor.LogSuccess(user, authnReq, KerberosLogin)
+	log.Infof("successful Kerberos login for %s", user.Name)
+	w.Header().Set("WWW-Authenticate", "Negotiate "+spnego.AcceptCompleted)
+	return user, nil
+}
+
+// kerberosUserName returns the user's name without the realm when it's one of the realms to strip. Principals of other
+// realms, such as those trusted across realms, keep the realm so they can't be mistaken for local users.
+func kerberosUserName(principal spnego.Principal, stripRealms []string) string {
+	if contains(stripRealms, principal.Realm) {
+		return strings.Join(principal.Components, "/")
+	}
+	return principal.String()
+}
+
+// DefaultNegotiateHandler is the default implementation for the handler that asks browsers for a Kerberos service ticket for a request saved by the login form. Browsers answer the challenge by requesting the same URL with the ticket. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultNegotiateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			requestID := r.URL.Query().Get("requestId")
+			data, err := i.TempCache.Get(requestID)
+			if err != nil {
+				return errors.New("login request has expired")
+			}
+			authnReq := &model.AuthnRequest{}
+			if err = proto.Unmarshal(data, authnReq); err != nil {
+				return err
+			}
+			if i.Kerberos == nil {
+				http.Redirect(w, r, i.loginURL(requestID), http.StatusFound)
+				return nil
+			}
+			user, err := i.loginWithKerberos(w, r, authnReq)
+			if err != nil {
+				return err
+			}
+			if user != nil {
+				// The request can only be answered once
+				if _, err = i.TempCache.Take(requestID); err != nil {
+					return errors.New("login request has expired")
+				}
+				return i.respond(authnReq, user, w, r)
+			}
+			// Browsers that already sent a ticket that wasn't accepted aren't asked again
+			if _, sent := negotiateToken(r); sent {
+				http.Redirect(w, r, i.loginURL(requestID), http.StatusFound)
+				return nil
+			}
+			return sendNegotiateChallenge(w, i.loginURL(requestID))
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// sendNegotiateChallenge asks the browser for a Kerberos service ticket. Browsers that can't get one show the
+// challenge's page, which continues to the login page.
+func sendNegotiateChallenge(w http.ResponseWriter, loginURL string) error {
+	w.Header().Set("WWW-Authenticate", "Negotiate")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	return negotiateTemplate.Execute(w, loginURL)
+}
+
+var negotiateTemplate = template.Must(template.New("negotiate").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="0;url={{ . }}">
+<title>Log in</title>
+</head>
+<body>
+<p><a href="{{ . }}">Continue to the login page</a></p>
+</body>
+</html>`))
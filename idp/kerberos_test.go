@@ -0,0 +1,166 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/internal/testcert"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/spnego"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_kerberosLogin(t *testing.T) {
+	service := spnego.Principal{NameType: spnego.NameTypeServiceHost, Components: []string{"HTTP", "idp.example.com"},
+		Realm: "EXAMPLE.COM"}
+	key, err := spnego.NewEncryptionKey(spnego.AES256CTSHMACSHA196)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keytab := &spnego.Keytab{Entries: []spnego.KeytabEntry{{Principal: service, KVNO: 1, Key: key}}}
+	f, err := ioutil.TempFile("", "keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(keytab.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	viper.Set("kerberos-keytab", f.Name())
+	defer viper.Set("kerberos-keytab", "")
+	required := false
+	viper.Set("sps", []ServiceProvider{
+		{
+			EntityID:    "https://sp.example.com/",
+			Certificate: base64.StdEncoding.EncodeToString(testcert.Throwaway(t)),
+			AssertionConsumerServices: []AssertionConsumerService{
+				{
+					IsDefault: true,
+					Binding:   "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+					Location:  "https://sp.example.com/acs",
+				},
+			},
+			RequireSignedRequests: &required,
+		},
+	})
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+
+	get := func(target, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		ts.Config.Handler.ServeHTTP(w, r)
+		return w
+	}
+	// login sends a new request and returns where the browser is sent to be asked for a ticket
+	login := func() string {
+		query := encodeRedirectRequest(t, &saml.AuthnRequest{
+			RequestAbstractType: saml.RequestAbstractType{
+				ID:           saml.NewID(),
+				Version:      "2.0",
+				IssueInstant: time.Now().UTC(),
+				Issuer:       "https://sp.example.com/",
+			},
+			ProtocolBinding: "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+		})
+		sso := viper.GetString("sso-service-path") + "?" + query
+		w := get(sso, "")
+		if !assert.Equal(t, http.StatusFound, w.Code, w.Body.String()) {
+			t.FailNow()
+		}
+		negotiate := w.Header().Get("Location")
+		assert.True(t, strings.HasPrefix(negotiate, "/negotiate?requestId="), negotiate)
+		// The SSO request itself can't be sent again, with or without a ticket
+		for _, authorization := range []string{"", "Negotiate TlRMTVNTUAABAAAAB4IIAAAAAAAAAAAAAAAAAAAAAAA="} {
+			w = get(sso, authorization)
+			// The service provider is sent an error rather than a challenge or login page
+			assert.True(t, strings.HasPrefix(w.Header().Get("Location"), "https://sp.example.com/acs?"),
+				"replayed request was accepted")
+			assert.Empty(t, w.Result().Cookies())
+		}
+		return negotiate
+	}
+
+	// Browsers are challenged before they're sent to the login form
+	negotiate := login()
+	w := get(negotiate, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Negotiate", w.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, w.Body.String(), `content="0;url=/ui/login.html?requestId=`)
+
+	// Browsers answer the challenge by requesting the identical URL with a service ticket
+	token, err := spnego.NewToken(spnego.Principal{NameType: spnego.NameTypePrincipal, Components: []string{"jdoe"},
+		Realm: "EXAMPLE.COM"}, service, key, 1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = get(negotiate, "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	if !assert.Equal(t, http.StatusFound, w.Code, w.Body.String()) {
+		t.FailNow()
+	}
+	assert.Equal(t, "Negotiate "+spnego.AcceptCompleted, w.Header().Get("WWW-Authenticate"))
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sp.example.com", location.Host)
+	assert.NotEmpty(t, location.Query().Get("SAMLart"))
+	var session string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == i.cookieName {
+			session = cookie.Value
+		}
+	}
+	user := i.getUserFromSession(&http.Request{Header: http.Header{"Cookie": {i.cookieName + "=" + session}}})
+	if assert.NotNil(t, user) {
+		assert.Equal(t, "jdoe@EXAMPLE.COM", user.Name)
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:ac:classes:Kerberos", user.Context)
+	}
+	// The saved request was answered
+	assert.Equal(t, http.StatusBadRequest, get(negotiate, "").Code)
+
+	// Replayed and malformed tokens fall back to the login form without another challenge
+	negotiate = login()
+	w = get(negotiate, "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Location"), "/ui/login.html?requestId="))
+	w = get(negotiate, "Negotiate TlRMTVNTUAABAAAAB4IIAAAAAAAAAAAAAAAAAAAAAAA=")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+}
+
+func Test_kerberosUserName(t *testing.T) {
+	local := spnego.Principal{NameType: spnego.NameTypePrincipal, Components: []string{"jdoe"}, Realm: "EXAMPLE.COM"}
+	partner := spnego.Principal{NameType: spnego.NameTypePrincipal, Components: []string{"jdoe"}, Realm: "PARTNER.COM"}
+	assert.Equal(t, "jdoe@EXAMPLE.COM", kerberosUserName(local, nil))
+	assert.Equal(t, "jdoe", kerberosUserName(local, []string{"EXAMPLE.COM"}))
+	assert.Equal(t, "jdoe@PARTNER.COM", kerberosUserName(partner, []string{"EXAMPLE.COM"}),
+		"principals of other realms lost their realm")
+}
@@ -0,0 +1,247 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/sign"
+	"github.com/amdonov/xmlsig"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// tlsSigningKey is the name of the key taken from the TLS certificate when no active signing key is configured
+const tlsSigningKey = "tls"
+
+// SigningKey is a named key in the signing keystore
+type SigningKey struct {
+	Name string
+	// Path of the PEM encoded certificate. Not needed when the private key is a PKCS#12 file.
+	Certificate string
+	// Path of the PEM, encrypted PEM, or PKCS#12 encoded private key
+	PrivateKey string
+	// Password for an encrypted PEM or PKCS#12 private key. Use PasswordEnv or PasswordFile to keep it out of the
+	// configuration file.
+	Password string
+	// Environment variable holding the password
+	PasswordEnv string
+	// File holding the password, such as a mounted secret. Trailing whitespace is ignored.
+	PasswordFile string
+	// Optional RFC 3339 time when the key replaces the active key
+	Activates string
+}
+
+type keystoreKey struct {
+	name        string
+	certificate tls.Certificate
+	activates   time.Time
+	signer      sign.Signer
+}
+
+// keystore holds the named signing keys. The active key is the one selected by name unless a key with a later
+// activation time has come due. Keys scheduled for activation are published in metadata ahead of time, so service
+// providers can trust them before they are used.
+type keystore struct {
+	keys    []*keystoreKey
+	active  *keystoreKey
+	publish time.Duration
+	// Keys activated by this time don't replace the key selected by name, so naming a key rolls back to it
+	pinned time.Time
+}
+
+// newKeystore creates a keystore with the named active key. Keys activated by the pinned time don't replace it.
+func newKeystore(keys []*keystoreKey, active string, publish time.Duration, pinned time.Time) (*keystore, error) {
+	k := &keystore{
+		keys:    keys,
+		publish: publish,
+		pinned:  pinned,
+	}
+	for _, key := range keys {
+		if key.name == active {
+			k.active = key
+		}
+	}
+	if active != "" && k.active == nil {
+		return nil, fmt.Errorf("active signing key %s is not in the keystore", active)
+	}
+	if k.activeKey(time.Now()) == nil {
+		return nil, errors.New("keystore does not contain an active signing key")
+	}
+	return k, nil
+}
+
+func loadSigningKey(conf SigningKey, options sign.SignerOptions) (*keystoreKey, error) {
+	if conf.Name == "" {
+		return nil, errors.New("signing key does not specify a name")
+	}
+	password, err := conf.password()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password for signing key %s: %s", conf.Name, err)
+	}
+	conf.Password = password
+	cert, err := loadKeyPair(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key %s: %s", conf.Name, err)
+	}
+	key, err := newKeystoreKey(conf.Name, cert, options)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Activates != "" {
+		if key.activates, err = time.Parse(time.RFC3339, conf.Activates); err != nil {
+			return nil, fmt.Errorf("invalid activation time for signing key %s: %s", conf.Name, err)
+		}
+	}
+	return key, nil
+}
+
+// password returns the key's password from the environment, a file, or the configuration
+func (conf SigningKey) password() (string, error) {
+	switch {
+	case conf.PasswordEnv != "":
+		password, ok := os.LookupEnv(conf.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", conf.PasswordEnv)
+		}
+		return password, nil
+	case conf.PasswordFile != "":
+		data, err := ioutil.ReadFile(conf.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), " \r\n\t"), nil
+	default:
+		return conf.Password, nil
+	}
+}
+
+func newKeystoreKey(name string, cert tls.Certificate, options sign.SignerOptions) (*keystoreKey, error) {
+	signer, err := sign.NewSigner(cert, options)
+	if err != nil {
+		return nil, err
+	}
+	return &keystoreKey{
+		name:        name,
+		certificate: cert,
+		signer:      signer,
+	}, nil
+}
+
+// loadKeyPair reads the certificate and private key. Private keys that aren't PEM encoded are treated as PKCS#12.
+func loadKeyPair(conf SigningKey) (tls.Certificate, error) {
+	keyData, err := ioutil.ReadFile(conf.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		key, cert, err := pkcs12.Decode(keyData, conf.Password)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.Certificate{
+			Certificate: [][]byte{cert.Raw},
+			PrivateKey:  key,
+			Leaf:        cert,
+		}, nil
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		der, err := x509.DecryptPEMBlock(block, []byte(conf.Password))
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		keyData = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+	certData, err := ioutil.ReadFile(conf.Certificate)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certData, keyData)
+}
+
+// activeKey returns the key used for signing at the time given
+func (k *keystore) activeKey(now time.Time) *keystoreKey {
+	active := k.active
+	for _, key := range k.keys {
+		if key.activates.IsZero() || key.activates.After(now) || !key.activates.After(k.pinned) {
+			continue
+		}
+		if active == nil || key.activates.After(active.activates) {
+			active = key
+		}
+	}
+	return active
+}
+
+// published returns the keys to include in metadata at the time given, the active key first followed by the keys
+// whose activation is within the publication period
+func (k *keystore) published(now time.Time) []*keystoreKey {
+	active := k.activeKey(now)
+	keys := []*keystoreKey{active}
+	var next []*keystoreKey
+	for _, key := range k.keys {
+		if key != active && key.activates.After(now) && !key.activates.Add(-k.publish).After(now) {
+			next = append(next, key)
+		}
+	}
+	sort.Slice(next, func(a, b int) bool {
+		return next[a].activates.Before(next[b].activates)
+	})
+	return append(keys, next...)
+}
+
+// changed reports whether a key was activated or first published after from and no later than to
+func (k *keystore) changed(from, to time.Time) bool {
+	for _, key := range k.keys {
+		if key.activates.IsZero() {
+			continue
+		}
+		for _, t := range []time.Time{key.activates.Add(-k.publish), key.activates} {
+			if t.After(from) && !t.After(to) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sign signs data with the active key
+func (k *keystore) Sign(data []byte) (string, error) {
+	return k.activeKey(time.Now()).signer.Sign(data)
+}
+
+// CreateSignature creates a signature for the data structure with the active key
+func (k *keystore) CreateSignature(data interface{}) (*xmlsig.Signature, error) {
+	return k.activeKey(time.Now()).signer.CreateSignature(data)
+}
+
+// signerWith returns a signer for the active key that uses other algorithms
+func (k *keystore) signerWith(options sign.SignerOptions) (sign.Signer, error) {
+	return sign.NewSigner(k.activeKey(time.Now()).certificate, options)
+}
+
+// Algorithm returns the signature algorithm of the active key
+func (k *keystore) Algorithm() string {
+	return k.activeKey(time.Now()).signer.Algorithm()
+}
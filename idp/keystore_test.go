@@ -0,0 +1,144 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/sign"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSigningKey(t *testing.T) {
+	cert := filepath.Join("testdata", "certificate.pem")
+	// encrypt the test key
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte("changeit"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	encryptedKey := filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(encryptedKey, pem.EncodeToMemory(encrypted), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passwordFile := filepath.Join(dir, "password")
+	if err = ioutil.WriteFile(passwordFile, []byte("changeit\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TEST_SIGNING_KEY_PASSWORD", "changeit")
+	defer os.Unsetenv("TEST_SIGNING_KEY_PASSWORD")
+
+	tests := []struct {
+		name    string
+		conf    SigningKey
+		wantErr bool
+	}{
+		{"pem", SigningKey{Name: "pem", Certificate: cert, PrivateKey: filepath.Join("testdata", "key.pem")}, false},
+		{"encrypted pem", SigningKey{Name: "enc", Certificate: cert, PrivateKey: encryptedKey, Password: "changeit"}, false},
+		{"password from environment", SigningKey{Name: "enc", Certificate: cert, PrivateKey: encryptedKey, PasswordEnv: "TEST_SIGNING_KEY_PASSWORD"}, false},
+		{"unset environment variable", SigningKey{Name: "enc", Certificate: cert, PrivateKey: encryptedKey, PasswordEnv: "TEST_SIGNING_KEY_MISSING"}, true},
+		{"password from file", SigningKey{Name: "enc", Certificate: cert, PrivateKey: encryptedKey, PasswordFile: passwordFile}, false},
+		{"wrong password", SigningKey{Name: "enc", Certificate: cert, PrivateKey: encryptedKey, Password: "wrong"}, true},
+		{"pkcs12", SigningKey{Name: "p12", PrivateKey: filepath.Join("testdata", "keystore.p12"), Password: "changeit"}, false},
+		{"pkcs12 wrong password", SigningKey{Name: "p12", PrivateKey: filepath.Join("testdata", "keystore.p12")}, true},
+		{"bad activation", SigningKey{Name: "pem", Certificate: cert, PrivateKey: filepath.Join("testdata", "key.pem"), Activates: "tomorrow"}, true},
+		{"no name", SigningKey{Certificate: cert, PrivateKey: filepath.Join("testdata", "key.pem")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := loadSigningKey(tt.conf, sign.SignerOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadSigningKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				assert.Equal(t, tt.conf.Name, key.name)
+				assert.NotNil(t, key.signer)
+			}
+		})
+	}
+}
+
+func TestKeystoreRotation(t *testing.T) {
+	conf := SigningKey{
+		Certificate: filepath.Join("testdata", "certificate.pem"),
+		PrivateKey:  filepath.Join("testdata", "key.pem"),
+	}
+	now := time.Now()
+	load := func(name string, activates time.Time) *keystoreKey {
+		conf.Name = name
+		conf.Activates = ""
+		if !activates.IsZero() {
+			conf.Activates = activates.Format(time.RFC3339)
+		}
+		key, err := loadSigningKey(conf, sign.SignerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	current := load("current", time.Time{})
+	next := load("next", now.Add(10*24*time.Hour))
+	later := load("later", now.Add(60*24*time.Hour))
+	_, err := newKeystore([]*keystoreKey{current, next, later}, "missing", 14*24*time.Hour, now)
+	assert.Error(t, err)
+	_, err = newKeystore([]*keystoreKey{next, later}, "", 14*24*time.Hour, time.Time{})
+	assert.Error(t, err, "no key is active yet")
+	ks, err := newKeystore([]*keystoreKey{current, next, later}, "current", 14*24*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the next key is published ahead of its activation
+	assert.Equal(t, current, ks.activeKey(now))
+	assert.Equal(t, []*keystoreKey{current, next}, ks.published(now))
+
+	// then replaces the current key
+	afterActivation := now.Add(11 * 24 * time.Hour)
+	assert.Equal(t, next, ks.activeKey(afterActivation))
+	assert.Equal(t, []*keystoreKey{next}, ks.published(afterActivation))
+	assert.True(t, ks.changed(now, afterActivation))
+	assert.False(t, ks.changed(now, now.Add(24*time.Hour)))
+	assert.True(t, ks.changed(now, now.Add(47*24*time.Hour)), "later key is published")
+
+	// Naming a key rolls back to it even though another key was activated before
+	previous := load("previous", now.Add(-24*time.Hour))
+	ks, err = newKeystore([]*keystoreKey{current, previous, next}, "current", 14*24*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, current, ks.activeKey(now))
+	assert.Equal(t, next, ks.activeKey(afterActivation), "scheduled keys still replace it")
+	ks, err = newKeystore([]*keystoreKey{current, previous, next}, "current", 14*24*time.Hour, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, previous, ks.activeKey(now))
+}
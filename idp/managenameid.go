@@ -0,0 +1,348 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/encrypt"
+	"github.com/amdonov/lite-idp/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	manageNameIDRequestName  = xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "ManageNameIDRequest"}
+	nameIDMappingRequestName = xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "NameIDMappingRequest"}
+)
+
+const nameIDUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+// DefaultManageNameIDHandler is the default implementation for the handler of ManageNameIDRequests sent with the
+// SOAP binding. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultManageNameIDHandler() http.HandlerFunc {
+	envelope := func(response saml.StatusResponseType) interface{} {
+		return &saml.ManageNameIDResponseEnv{
+			Body: saml.ManageNameIDResponseBody{
+				Response: saml.ManageNameIDResponse{StatusResponseType: response},
+			},
+		}
+	}
+	return i.soapHandler(func(body []byte, r *http.Request) (string, interface{}, error) {
+		env := &saml.ManageNameIDRequestEnv{}
+		if err := xml.Unmarshal(body, env); err != nil {
+			return "", nil, err
+		}
+		request := env.Body.Request
+		sp, err := i.authenticateRequester(string(body), &request.RequestAbstractType,
+			request.Signature != nil, manageNameIDRequestName, r, &request)
+		if err != nil {
+			return request.ID, nil, err
+		}
+		if err = i.manageNameID(&request, sp); err != nil {
+			return request.ID, nil, err
+		}
+		return request.ID, envelope(i.makeStatusResponse(request.ID, "", nil)), nil
+	}, func(id string, rerr *requestError) interface{} {
+		return envelope(i.makeStatusResponse(id, "", rerr))
+	})
+}
+
+// DefaultRedirectManageNameIDHandler is the default implementation for the handler of ManageNameIDRequests sent with
+// the redirect binding. Requests must be signed, and the response is redirected to the service provider's
+// ManageNameIDService. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultRedirectManageNameIDHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			request := &saml.ManageNameIDRequest{}
+			if err := decodeRedirectMessage(r.Form.Get("SAMLRequest"), request); err != nil {
+				return err
+			}
+			if request.Issuer == "" {
+				return errors.New("request does not contain an issuer")
+			}
+			sp, ok := i.getServiceProvider(request.Issuer)
+			if !ok {
+				return errors.New("request from an unregistered issuer")
+			}
+			location := sp.redirectManageNameIDService()
+			if location == "" {
+				return fmt.Errorf("%s does not have a ManageNameIDService for the redirect binding", sp.EntityID)
+			}
+			var err error
+			if r.Form.Get("Signature") == "" {
+				err = denyRequest("ManageNameIDRequest from %s is not signed", sp.EntityID)
+			} else if err = verifySignature(r.URL.RawQuery, r.Form.Get("SigAlg"), r.Form.Get("Signature"), sp); err != nil {
+				err = denyRequest("ManageNameIDRequest signature is not valid: %s", err)
+			} else if err = i.checkRequest(&request.RequestAbstractType, "managenameidrequest",
+				i.redirectManageNameIDServiceLocation, true); err == nil {
+				err = i.manageNameID(request, sp)
+			}
+			rerr, denied := err.(*requestError)
+			if err != nil && !denied {
+				return err
+			}
+			if denied {
+				log.Infof("request %s was not answered: %s", request.ID, rerr.message)
+			}
+			response := &saml.ManageNameIDResponse{
+				StatusResponseType: i.makeStatusResponse(request.ID, location, rerr),
+			}
+			redirect, err := i.redirectMessage(location, "SAMLResponse", response, r.Form.Get("RelayState"))
+			if err != nil {
+				return err
+			}
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return nil
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// manageNameID terminates or records a new service provider identifier for the persistent identifier in the request
+func (i *IDP) manageNameID(request *saml.ManageNameIDRequest, sp *ServiceProvider) error {
+	if request.EncryptedID != nil || request.NewEncryptedID != nil {
+		return &requestError{status: statusRequestUnsupported, message: "encrypted identifiers are not supported"}
+	}
+	nameID := request.NameID
+	if nameID == nil || nameID.Value == "" {
+		return &requestError{status: statusUnknownPrincipal, message: errUnknownPrincipal.Error()}
+	}
+	if nameID.Format != nameIDPersistent {
+		return &requestError{status: statusRequestUnsupported, message: "only persistent identifiers can be managed"}
+	}
+	if nameID.SPNameQualifier != "" && nameID.SPNameQualifier != sp.EntityID {
+		return &requestError{status: statusUnknownPrincipal, message: errUnknownPrincipal.Error()}
+	}
+	link, err := i.resolvePersistentID(nameID.Value, sp.EntityID)
+	if err == errUnknownPrincipal {
+		return &requestError{status: statusUnknownPrincipal, message: err.Error()}
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case request.Terminate != nil:
+		log.Infof("%s terminated a persistent identifier for %s", sp.EntityID, link.UserName)
+		link.Terminated = true
+	case request.NewID != "":
+		// SAML limits identifiers to 256 characters
+		if len(request.NewID) > 256 {
+			return denyRequest("NewID is longer than 256 characters")
+		}
+		log.Infof("%s set a new identifier for %s", sp.EntityID, link.UserName)
+		link.SPProvidedID = request.NewID
+	default:
+		return denyRequest("ManageNameIDRequest does not contain NewID or Terminate")
+	}
+	return i.NameIDStore.Save(link)
+}
+
+// DefaultNameIDMappingHandler is the default implementation for the NameIDMappingRequest handler. Identifiers are
+// encrypted for the service provider they're mapped to. It can be used as is, wrapped in other handlers, or replaced
+// completely.
+func (i *IDP) DefaultNameIDMappingHandler() http.HandlerFunc {
+	envelope := func(response *saml.NameIDMappingResponse) interface{} {
+		return &saml.NameIDMappingResponseEnv{
+			Body: saml.NameIDMappingResponseBody{
+				Response: *response,
+			},
+		}
+	}
+	return i.soapHandler(func(body []byte, r *http.Request) (string, interface{}, error) {
+		env := &saml.NameIDMappingRequestEnv{}
+		if err := xml.Unmarshal(body, env); err != nil {
+			return "", nil, err
+		}
+		response, err := i.mapNameID(string(body), env, r)
+		if err != nil {
+			return env.Body.Request.ID, nil, err
+		}
+		return env.Body.Request.ID, envelope(response), nil
+	}, func(id string, rerr *requestError) interface{} {
+		return envelope(&saml.NameIDMappingResponse{StatusResponseType: i.makeStatusResponse(id, "", rerr)})
+	})
+}
+
+// mapNameID identifies the subject of the request to the service provider named by the request's NameIDPolicy.
+// Service providers can only map identifiers to the service providers they're allowed to.
+func (i *IDP) mapNameID(body string, env *saml.NameIDMappingRequestEnv, r *http.Request) (*saml.NameIDMappingResponse, error) {
+	request := env.Body.Request
+	sp, err := i.authenticateRequester(body, &request.RequestAbstractType, request.Signature != nil,
+		nameIDMappingRequestName, r, &request)
+	if err != nil {
+		return nil, err
+	}
+	if request.EncryptedID != nil {
+		return nil, &requestError{status: statusRequestUnsupported, message: "encrypted identifiers are not supported"}
+	}
+	policy := request.NameIDPolicy
+	if policy.SPNameQualifier == "" {
+		return nil, &requestError{status: statusInvalidNameIDPolicy,
+			message: "NameIDPolicy does not name the service provider to map to"}
+	}
+	if !sp.mayMapTo(policy.SPNameQualifier) {
+		return nil, denyRequest("%s is not allowed to map identifiers to %s", sp.EntityID, policy.SPNameQualifier)
+	}
+	target, ok := i.getServiceProvider(policy.SPNameQualifier)
+	if !ok {
+		return nil, &requestError{status: statusInvalidNameIDPolicy,
+			message: fmt.Sprintf("%s is not a registered service provider", policy.SPNameQualifier)}
+	}
+	user, err := i.resolveNameID(request.NameID, sp.EntityID)
+	if err == errUnknownPrincipal {
+		return nil, &requestError{status: statusUnknownPrincipal, message: err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	format := policy.Format
+	if format == "" || format == nameIDUnspecified {
+		format = target.NameIDFormat
+	}
+	// Service providers sent opaque identifiers never learn users' names
+	if target.NameIDFormat != "" && format != target.NameIDFormat {
+		return nil, &requestError{status: statusInvalidNameIDPolicy,
+			message: fmt.Sprintf("%s only accepts %s identifiers", target.EntityID, target.NameIDFormat)}
+	}
+	nameID := &saml.NameID{
+		Format:          user.Format,
+		NameQualifier:   i.entityID,
+		SPNameQualifier: target.EntityID,
+		Value:           user.Name,
+	}
+	switch format {
+	case "", user.Format:
+	case nameIDTransient:
+		if nameID.Value, err = i.transientID(user, target.EntityID); err != nil {
+			return nil, err
+		}
+		nameID.Format = format
+	case nameIDPersistent:
+		if !policy.AllowCreate {
+			link, err := i.NameIDStore.LinkForUser(target.EntityID, user.Name)
+			if err != nil {
+				return nil, err
+			}
+			if link == nil {
+				return nil, &requestError{status: statusInvalidNameIDPolicy,
+					message: "subject does not have an identifier for " + target.EntityID}
+			}
+		}
+		link, err := i.persistentLink(user, target.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		nameID.Format, nameID.Value, nameID.SPProvidedID = format, link.Value, link.SPProvidedID
+	default:
+		return nil, &requestError{status: statusInvalidNameIDPolicy,
+			message: "unsupported name identifier format " + format}
+	}
+	cert, err := target.encryptionCertificate()
+	if err != nil {
+		return nil, err
+	}
+	data, err := encrypt.Encrypt(nameID, cert)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("%s mapped an identifier for %s to %s", sp.EntityID, user.Name, target.EntityID)
+	return &saml.NameIDMappingResponse{
+		StatusResponseType: i.makeStatusResponse(request.ID, "", nil),
+		EncryptedID:        &saml.EncryptedID{EncryptedData: *data},
+	}, nil
+}
+
+// makeStatusResponse answers a request that doesn't return anything besides its status. The request succeeded
+// unless there is an error.
+func (i *IDP) makeStatusResponse(id, destination string, rerr *requestError) saml.StatusResponseType {
+	status := &saml.Status{
+		StatusCode: saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
+		},
+	}
+	if rerr != nil {
+		status = &saml.Status{
+			StatusCode: saml.StatusCode{
+				Value: statusRequester,
+				StatusCode: &saml.StatusCode{
+					Value: rerr.status,
+				},
+			},
+			StatusMessage: rerr.message,
+		}
+	}
+	return saml.StatusResponseType{
+		Version:      "2.0",
+		ID:           saml.NewID(),
+		IssueInstant: time.Now().UTC(),
+		Destination:  destination,
+		InResponseTo: id,
+		Issuer:       saml.NewIssuer(i.entityID),
+		Status:       status,
+	}
+}
+
+// redirectMessage returns the URL that sends a signed message to the location with the redirect binding
+func (i *IDP) redirectMessage(location, param string, message interface{}, relayState string) (string, error) {
+	var b bytes.Buffer
+	writer, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if err = xml.NewEncoder(writer).Encode(message); err != nil {
+		return "", err
+	}
+	if err = writer.Close(); err != nil {
+		return "", err
+	}
+	query := param + "=" + url.QueryEscape(base64.StdEncoding.EncodeToString(b.Bytes()))
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(i.signer.Algorithm())
+	signature, err := i.signer.Sign([]byte(query))
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(signature)
+	if strings.Contains(location, "?") {
+		return location + "&" + query, nil
+	}
+	return location + "?" + query, nil
+}
+
+// decodeRedirectMessage reads a message sent with the redirect binding. URL decoding is already performed.
+func decodeRedirectMessage(encoded string, message interface{}) error {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	return xml.NewDecoder(flate.NewReader(bytes.NewReader(data))).Decode(message)
+}
@@ -0,0 +1,248 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/encrypt"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_manageAndMapNameIDs(t *testing.T) {
+	signer := registerECPServiceProvider(t)
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	sp := i.sps["https://sp.example.com/"]
+	sp.NameIDFormat = nameIDPersistent
+	sp.ManageNameIDServices = []ManageNameIDService{
+		{Binding: "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect", Location: "https://sp.example.com/mni"},
+	}
+
+	// Register a service provider identifiers can be mapped to
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &ServiceProvider{
+		EntityID:     "https://target.example.com/",
+		Certificate:  base64.StdEncoding.EncodeToString(der),
+		NameIDFormat: nameIDPersistent,
+	}
+	i.sps[target.EntityID] = target
+
+	user := &model.User{Name: "joe", Format: nameIDUnspecified}
+	nameID := testNameID(t, i, user, sp.EntityID, sp)
+	newRequest := func() saml.RequestAbstractType {
+		return saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now().UTC(),
+			Issuer:       sp.EntityID,
+		}
+	}
+	status := func(s *saml.Status) string {
+		if s.StatusCode.StatusCode == nil {
+			return s.StatusCode.Value
+		}
+		return s.StatusCode.StatusCode.Value
+	}
+	send := func(handler http.HandlerFunc, body string) []byte {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.Bytes()
+	}
+	manage := func(request saml.ManageNameIDRequest) string {
+		request.RequestAbstractType = newRequest()
+		signature, err := signer.CreateSignature(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Signature = signature
+		var env saml.ManageNameIDResponseEnv
+		if err := xml.Unmarshal(send(i.DefaultManageNameIDHandler(), ecpEnvelope(t, "", request)), &env); err != nil {
+			t.Fatal(err)
+		}
+		return status(env.Body.Response.Status)
+	}
+	mapNameID := func(policy saml.NameIDPolicy) *saml.NameIDMappingResponse {
+		request := saml.NameIDMappingRequest{
+			RequestAbstractType: newRequest(),
+			NameID:              nameID,
+			NameIDPolicy:        policy,
+		}
+		signature, err := signer.CreateSignature(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Signature = signature
+		var env saml.NameIDMappingResponseEnv
+		if err := xml.Unmarshal(send(i.DefaultNameIDMappingHandler(), ecpEnvelope(t, "", request)), &env); err != nil {
+			t.Fatal(err)
+		}
+		return &env.Body.Response
+	}
+
+	// The service provider sets its own identifier
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", manage(saml.ManageNameIDRequest{
+		NameID: nameID,
+		NewID:  "joe@sp",
+	}))
+	assert.Equal(t, "joe@sp", testNameID(t, i, user, sp.EntityID, sp).SPProvidedID)
+
+	// Mapping requires authorization
+	policy := saml.NameIDPolicy{Format: nameIDPersistent, SPNameQualifier: target.EntityID}
+	assert.Equal(t, statusRequestDenied, status(mapNameID(policy).Status))
+	sp.NameIDMappingTargets = []string{target.EntityID}
+	assert.Equal(t, statusInvalidNameIDPolicy, status(mapNameID(policy).Status),
+		"identifiers can't be created without AllowCreate")
+	// Targets sent opaque identifiers can't be given the user's name in its own format or another format
+	certUser := &model.User{Name: "CN=Joe", Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName"}
+	userNameID := nameID
+	nameID = testNameID(t, i, certUser, sp.EntityID, sp)
+	for _, format := range []string{certUser.Format, nameIDTransient} {
+		resp := mapNameID(saml.NameIDPolicy{Format: format, SPNameQualifier: target.EntityID, AllowCreate: true})
+		assert.Equal(t, statusInvalidNameIDPolicy, status(resp.Status), format)
+		assert.Nil(t, resp.EncryptedID, format)
+	}
+	nameID = userNameID
+	policy.AllowCreate = true
+	resp := mapNameID(policy)
+	if assert.NotNil(t, resp.EncryptedID, "expected an encrypted identifier") {
+		plaintext, err := encrypt.Decrypt(&resp.EncryptedID.EncryptedData, key, resp.EncryptedID.EncryptedKey...)
+		if assert.NoError(t, err) {
+			mapped := saml.NameID{}
+			if assert.NoError(t, xml.Unmarshal(plaintext, &mapped)) {
+				assert.Equal(t, nameIDPersistent, mapped.Format)
+				assert.Equal(t, target.EntityID, mapped.SPNameQualifier)
+				assert.Equal(t, testNameID(t, i, user, target.EntityID, target).Value, mapped.Value)
+			}
+		}
+	}
+
+	// Terminated identifiers are forgotten
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", manage(saml.ManageNameIDRequest{
+		NameID:    nameID,
+		Terminate: &saml.Terminate{},
+	}))
+	_, err = i.resolveNameID(nameID, sp.EntityID)
+	assert.Equal(t, errUnknownPrincipal, err)
+	assert.Equal(t, statusUnknownPrincipal, manage(saml.ManageNameIDRequest{
+		NameID:    nameID,
+		Terminate: &saml.Terminate{},
+	}))
+
+	// The redirect binding requires a signature and sends the response back to the service provider
+	nameID = testNameID(t, i, user, sp.EntityID, sp)
+	newRedirectRequest := func() saml.ManageNameIDRequest {
+		request := saml.ManageNameIDRequest{
+			RequestAbstractType: newRequest(),
+			NameID:              nameID,
+			NewID:               "joseph@sp",
+		}
+		request.Destination = i.redirectManageNameIDServiceLocation
+		return request
+	}
+	redirect := func(request saml.ManageNameIDRequest, signed bool) (*saml.ManageNameIDResponse, url.Values) {
+		var b bytes.Buffer
+		writer, err := flate.NewWriter(&b, flate.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = xml.NewEncoder(writer).Encode(request); err != nil {
+			t.Fatal(err)
+		}
+		if err = writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(b.Bytes())) +
+			"&RelayState=state&SigAlg=" + url.QueryEscape(signer.Algorithm())
+		if signed {
+			signature, err := signer.Sign([]byte(query))
+			if err != nil {
+				t.Fatal(err)
+			}
+			query += "&Signature=" + url.QueryEscape(signature)
+		}
+		w := httptest.NewRecorder()
+		i.DefaultRedirectManageNameIDHandler()(w, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "sp.example.com", location.Host)
+		assert.Equal(t, "/mni", location.Path)
+		params := location.Query()
+		response := &saml.ManageNameIDResponse{}
+		if err = decodeRedirectMessage(params.Get("SAMLResponse"), response); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, request.ID, response.InResponseTo)
+		return response, params
+	}
+	response, params := redirect(newRedirectRequest(), false)
+	assert.Equal(t, statusRequestDenied, status(response.Status))
+	request := newRedirectRequest()
+	response, params = redirect(request, true)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", status(response.Status))
+	assert.Equal(t, "state", params.Get("RelayState"))
+	assert.NotEmpty(t, params.Get("Signature"))
+	assert.Equal(t, "joseph@sp", testNameID(t, i, user, sp.EntityID, sp).SPProvidedID)
+
+	// Requests must be fresh, sent to this endpoint, and only received once
+	response, _ = redirect(request, true)
+	assert.Equal(t, statusRequestDenied, status(response.Status), "replayed request was accepted")
+	request = newRedirectRequest()
+	request.IssueInstant = time.Now().Add(-time.Hour).UTC()
+	response, _ = redirect(request, true)
+	assert.Equal(t, statusRequestDenied, status(response.Status), "expired request was accepted")
+	request = newRedirectRequest()
+	request.Destination = ""
+	response, _ = redirect(request, true)
+	assert.Equal(t, statusRequestDenied, status(response.Status), "request without a destination was accepted")
+}
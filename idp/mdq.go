@@ -0,0 +1,245 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/xmlsig"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const mdqContentType = "application/samlmetadata+xml"
+
+// MetadataQuery describes a Metadata Query Protocol (MDQ) service used to look up unknown service providers
+type MetadataQuery struct {
+	// Base URL of the service. Requests are sent to BaseURL/entities/{sha1}hash
+	BaseURL string
+	// Path of the PEM encoded certificate that must have signed responses
+	Certificate string
+	// How long retrieved metadata is cached
+	CacheDuration time.Duration
+	// Names of the attributes released to the service providers the service publishes. Nothing is released when
+	// empty.
+	ReleaseAttributes []string
+}
+
+type mdqProvider struct {
+	baseURL           string
+	validator         sign.Validator
+	client            *http.Client
+	cache             store.Cache
+	releaseAttributes []string
+}
+
+// NewMDQProvider returns a MetadataProvider that queries an MDQ service for service provider metadata on demand
+func NewMDQProvider(conf MetadataQuery) (MetadataProvider, error) {
+	if conf.BaseURL == "" {
+		return nil, errors.New("metadata query service does not specify a base URL")
+	}
+	if conf.Certificate == "" {
+		return nil, fmt.Errorf("metadata query service %s does not specify a signing certificate", conf.BaseURL)
+	}
+	cert, err := loadCertificate(conf.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	if conf.CacheDuration <= 0 {
+		conf.CacheDuration = viper.GetDuration("metadata-refresh-interval")
+	}
+	cache, err := store.New(conf.CacheDuration)
+	if err != nil {
+		return nil, err
+	}
+	return &mdqProvider{
+		baseURL:           strings.TrimSuffix(conf.BaseURL, "/"),
+		validator:         sign.NewCertificateValidator(cert),
+		client:            &http.Client{Timeout: 10 * time.Second},
+		cache:             cache,
+		releaseAttributes: conf.ReleaseAttributes,
+	}, nil
+}
+
+func (p *mdqProvider) ServiceProvider(entityID string) (*ServiceProvider, error) {
+	data, err := p.cache.Get(entityID)
+	if err != nil {
+		if data, err = p.query(entityID); err != nil {
+			return nil, err
+		}
+		// Also remember entities the service doesn't know to avoid repeated queries
+		if err = p.cache.Set(entityID, data); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 {
+		return nil, ErrUnknownServiceProvider
+	}
+	ed := &saml.SPEntityDescriptor{}
+	if err = xml.Unmarshal(data, ed); err != nil {
+		return nil, err
+	}
+	if ed.ValidUntil != nil && time.Now().After(*ed.ValidUntil) {
+		p.cache.Delete(entityID)
+		return nil, fmt.Errorf("metadata for %s expired at %s", entityID, ed.ValidUntil)
+	}
+	sp, err := convertMetadata(ed)
+	if err != nil {
+		return nil, err
+	}
+	if err = sp.parseCertificate(); err != nil {
+		return nil, err
+	}
+	// Entities published by the service only receive the attributes its policy allows
+	sp.ReleaseAttributes = p.releaseAttributes
+	sp.releaseOnlyListed = true
+	return sp, nil
+}
+
+// query retrieves and verifies the entity's metadata returning the signed XML
+func (p *mdqProvider) query(entityID string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet,
+		fmt.Sprintf("%s/entities/%s", p.baseURL, url.PathEscape(mdqIdentifier(entityID))), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", mdqContentType)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return []byte{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code, %d, from metadata query service", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := p.validator.Validate(string(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(referenced) != 1 {
+		return nil, errors.New("metadata signature must contain a single reference")
+	}
+	// Make sure the service answered the question we asked
+	ed := &saml.SPEntityDescriptor{}
+	if err = xml.Unmarshal([]byte(referenced[0]), ed); err != nil {
+		return nil, err
+	}
+	if ed.EntityID != entityID {
+		return nil, fmt.Errorf("metadata query for %s returned %s", entityID, ed.EntityID)
+	}
+	return []byte(referenced[0]), nil
+}
+
+// mdqIdentifier returns the transformed identifier of an entity
+func mdqIdentifier(entityID string) string {
+	sum := sha1.Sum([]byte(entityID))
+	return "{sha1}" + hex.EncodeToString(sum[:])
+}
+
+// mdqAggregate holds the IdP and service provider descriptors returned for a request for all entities
+type mdqAggregate struct {
+	XMLName       xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+	ID            string     `xml:",attr"`
+	Name          string     `xml:",attr"`
+	ValidUntil    *time.Time `xml:"validUntil,attr,omitempty"`
+	CacheDuration string     `xml:"cacheDuration,attr,omitempty"`
+	Signature     *xmlsig.Signature
+	Entities      []interface{}
+}
+
+// DefaultMDQHandler is the default implementation for the Metadata Query Protocol handler. It serves signed metadata
+// for the IdP and the registered service providers. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultMDQHandler() (http.HandlerFunc, error) {
+	docs, err := i.newMetadataDocuments(func(now time.Time) (map[string][]byte, error) {
+		validUntil, cacheDuration := i.metadataValidity(now)
+		entities := make(map[string][]byte, 2*len(i.sps)+3)
+		aggregate := &mdqAggregate{
+			ID:            saml.NewID(),
+			Name:          i.entityID,
+			ValidUntil:    validUntil,
+			CacheDuration: cacheDuration,
+		}
+		add := func(ed *saml.EntityDescriptor, v interface{}) error {
+			ed.ValidUntil, ed.CacheDuration = validUntil, cacheDuration
+			data, err := i.signMetadata(v, &ed.Signature)
+			if err != nil {
+				return err
+			}
+			entities[ed.EntityID] = data
+			entities[mdqIdentifier(ed.EntityID)] = data
+			// the aggregate's validity applies to its members
+			ed.ValidUntil, ed.CacheDuration = nil, ""
+			aggregate.Entities = append(aggregate.Entities, v)
+			return nil
+		}
+		idp := i.entityDescriptor(now)
+		if err := add(&idp.EntityDescriptor, idp); err != nil {
+			return nil, err
+		}
+		for _, sp := range i.sps {
+			ed := sp.entityDescriptor()
+			if err := add(&ed.EntityDescriptor, ed); err != nil {
+				return nil, err
+			}
+		}
+		all, err := i.signMetadata(aggregate, &aggregate.Signature)
+		if err != nil {
+			return nil, err
+		}
+		entities[""] = all
+		return entities, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The identifier is either URL encoded or the sha1 transformed entity ID
+		id := strings.TrimPrefix(httprouter.ParamsFromContext(r.Context()).ByName("id"), "/")
+		data, modified, ok, err := docs.get(id)
+		if err != nil {
+			log.Error(err)
+			i.Error(w, "failed to generate metadata", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			log.Infof("metadata query for unknown entity %s", id)
+			i.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", mdqContentType)
+		i.serveMetadata(w, r, data, modified)
+	}, nil
+}
@@ -0,0 +1,170 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_DefaultMDQHandler(t *testing.T) {
+	viper.Set("sps", []ServiceProvider{
+		{
+			EntityID:    "https://sp.example.com/shibboleth",
+			Certificate: testSPCertificate,
+			AssertionConsumerServices: []AssertionConsumerService{
+				{
+					IsDefault: true,
+					Binding:   "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+					Location:  "https://sp.example.com/acs",
+				},
+			},
+		},
+	})
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	mdqPath := ts.URL + viper.GetString("mdq-path")
+
+	// look up the service provider by its transformed identifier
+	resp, err := ts.Client().Get(mdqPath + "/" + url.PathEscape(mdqIdentifier("https://sp.example.com/shibboleth")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, mdqContentType, resp.Header.Get("Content-Type"))
+	ed := &saml.SPEntityDescriptor{}
+	if err = xml.NewDecoder(resp.Body).Decode(ed); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://sp.example.com/shibboleth", ed.EntityID)
+	assert.NotNil(t, ed.Signature, "metadata should be signed")
+
+	// the IdP is available by URL encoded entity ID
+	resp, err = ts.Client().Get(mdqPath + "/" + url.PathEscape(i.entityID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// all entities
+	resp, err = ts.Client().Get(mdqPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	entities := &saml.EntitiesDescriptor{}
+	if err = xml.NewDecoder(resp.Body).Decode(entities); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(entities.EntityDescriptors))
+
+	resp, err = ts.Client().Get(mdqPath + "/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestMDQProvider(t *testing.T) {
+	viper.Set("sps", []ServiceProvider{
+		{
+			EntityID:    "https://sp.example.com/shibboleth",
+			Certificate: testSPCertificate,
+			AssertionConsumerServices: []AssertionConsumerService{
+				{
+					IsDefault: true,
+					Binding:   "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+					Location:  "https://sp.example.com/acs",
+				},
+			},
+		},
+	})
+	defer viper.Set("sps", nil)
+	// Use another IdP as the metadata query service
+	server := getTestIDP(t, &IDP{})
+	defer server.Close()
+	provider, err := NewMDQProvider(MetadataQuery{
+		BaseURL:     server.URL,
+		Certificate: filepath.Join("testdata", "certificate.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.(*mdqProvider).client = server.Client()
+	sp, err := provider.ServiceProvider("https://sp.example.com/shibboleth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://sp.example.com/acs", sp.AssertionConsumerServices[0].Location)
+	// Nothing is released without a policy
+	atts := []*model.Attribute{{Name: "mail", Value: []string{"joe@example.com"}}, {Name: "role", Value: []string{"admin"}}}
+	assert.Empty(t, sp.releasedAttributes(atts))
+	provider.(*mdqProvider).releaseAttributes = []string{"mail"}
+	if sp, err = provider.ServiceProvider("https://sp.example.com/shibboleth"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, atts[:1], sp.releasedAttributes(atts))
+	// served from the cache the second time
+	data, err := provider.(*mdqProvider).cache.Get("https://sp.example.com/shibboleth")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, data)
+
+	_, err = provider.ServiceProvider("https://unknown.example.com")
+	assert.Equal(t, ErrUnknownServiceProvider, err)
+}
+
+func TestMDQProviderRequiresTrustedSignature(t *testing.T) {
+	viper.Set("sps", []ServiceProvider{
+		{
+			EntityID:    "https://sp.example.com/shibboleth",
+			Certificate: testSPCertificate,
+		},
+	})
+	defer viper.Set("sps", nil)
+	server := getTestIDP(t, &IDP{})
+	defer server.Close()
+	other, err := ioutil.TempFile("", "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(other.Name())
+	other.WriteString(certPEM)
+	other.Close()
+	provider, err := NewMDQProvider(MetadataQuery{
+		BaseURL:     server.URL,
+		Certificate: other.Name(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.(*mdqProvider).client = server.Client()
+	_, err = provider.ServiceProvider("https://sp.example.com/shibboleth")
+	assert.Error(t, err, "metadata signed by an untrusted key should be rejected")
+	assert.NotEqual(t, ErrUnknownServiceProvider, err)
+}
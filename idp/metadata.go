@@ -16,24 +16,272 @@ package idp
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/amdonov/lite-idp/saml"
 	"github.com/amdonov/xmlsig"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
+// MetadataEndpoint is an additional endpoint, such as a single logout service, published in the IdP's metadata
+type MetadataEndpoint struct {
+	Binding  string
+	Location string
+}
+
+// MetadataOrganization describes the organization responsible for the IdP
+type MetadataOrganization struct {
+	Name        string
+	DisplayName string
+	URL         string
+}
+
+// MetadataContact is a contact person published in the IdP's metadata
+type MetadataContact struct {
+	// One of technical, support, administrative, billing or other
+	Type             string
+	Company          string
+	GivenName        string
+	SurName          string
+	EmailAddresses   []string
+	TelephoneNumbers []string
+}
+
+// MetadataUIInfo is the user interface information displayed by discovery services and service providers
+type MetadataUIInfo struct {
+	DisplayName         string
+	Description         string
+	InformationURL      string
+	PrivacyStatementURL string
+	Logo                string
+	LogoHeight          uint
+	LogoWidth           uint
+}
+
+// MetadataAttribute is an entity attribute, such as an entity category, published in the IdP's metadata
+type MetadataAttribute struct {
+	Name       string
+	NameFormat string
+	Values     []string
+}
+
+// metadataSettings holds the optional metadata content read from the configuration
+type metadataSettings struct {
+	signingCertificates    []*x509.Certificate
+	encryptionCertificates []*x509.Certificate
+	nameIDFormats          []string
+	singleLogoutServices   []MetadataEndpoint
+	validDuration          time.Duration
+	cacheDuration          time.Duration
+	lang                   string
+	organization           MetadataOrganization
+	contacts               []MetadataContact
+	uiInfo                 MetadataUIInfo
+	entityAttributes       []MetadataAttribute
+	scopes                 []string
+}
+
+func (i *IDP) configureMetadata() error {
+	m := &i.metadata
+	var err error
+	if m.signingCertificates, err = loadCertificates(viper.GetStringSlice("metadata-signing-certificates")); err != nil {
+		return err
+	}
+	if m.encryptionCertificates, err = loadCertificates(viper.GetStringSlice("metadata-encryption-certificates")); err != nil {
+		return err
+	}
+	m.nameIDFormats = viper.GetStringSlice("metadata-nameid-formats")
+	m.validDuration = viper.GetDuration("metadata-valid-duration")
+	m.cacheDuration = viper.GetDuration("metadata-cache-duration")
+	m.lang = viper.GetString("metadata-lang")
+	m.scopes = viper.GetStringSlice("metadata-scopes")
+	for key, v := range map[string]interface{}{
+		"metadata-slo-services":      &m.singleLogoutServices,
+		"metadata-organization":      &m.organization,
+		"metadata-contacts":          &m.contacts,
+		"metadata-ui-info":           &m.uiInfo,
+		"metadata-entity-attributes": &m.entityAttributes,
+	} {
+		if err := viper.UnmarshalKey(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadCertificates(paths []string) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, len(paths))
+	for j, path := range paths {
+		cert, err := loadCertificate(path)
+		if err != nil {
+			return nil, err
+		}
+		certs[j] = cert
+	}
+	return certs, nil
+}
+
 // DefaultMetadataHandler is the default implementation for the metadata display handler. It can be used as is, wrapped in other handlers, or replaced completely.
 func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
-	certData := i.TLSConfig.Certificates[0].Certificate[0]
-	keyDescriptor := saml.KeyDescriptor{
-		Use: "signing",
-		KeyInfo: xmlsig.KeyInfo{
-			X509Data: &xmlsig.X509Data{
-				X509Certificate: base64.StdEncoding.EncodeToString(certData),
-			},
-		},
+	docs, err := i.newMetadataDocuments(func(now time.Time) (map[string][]byte, error) {
+		ed := i.entityDescriptor(now)
+		ed.ValidUntil, ed.CacheDuration = i.metadataValidity(now)
+		metadata, err := i.signMetadata(ed, &ed.Signature)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{"": metadata}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// return handler
+	return func(w http.ResponseWriter, r *http.Request) {
+		metadata, modified, _, err := docs.get("")
+		if err != nil {
+			log.Error(err)
+			i.Error(w, "failed to generate metadata", http.StatusInternalServerError)
+			return
+		}
+		i.serveMetadata(w, r, metadata, modified)
+	}, nil
+}
+
+// metadataDocuments holds signed metadata documents by identifier. When metadata carries a validUntil, the documents
+// are regenerated once half of the validity period has passed so that the published metadata never expires. They are
+// also regenerated when signing key rotation changes the published or active keys.
+type metadataDocuments struct {
+	generate  func(now time.Time) (map[string][]byte, error)
+	refresh   time.Duration
+	changed   func(from, to time.Time) bool
+	mu        sync.Mutex
+	documents map[string][]byte
+	generated time.Time
+}
+
+func (i *IDP) newMetadataDocuments(generate func(now time.Time) (map[string][]byte, error)) (*metadataDocuments, error) {
+	docs := &metadataDocuments{
+		generate: generate,
+		refresh:  i.metadata.validDuration / 2,
+		changed:  i.keystore.changed,
+	}
+	// generate immediately to report configuration problems at startup
+	if _, _, _, err := docs.get(""); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func (d *metadataDocuments) get(id string) ([]byte, time.Time, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.documents == nil || (d.refresh > 0 && now.Sub(d.generated) >= d.refresh) ||
+		(d.changed != nil && d.changed(d.generated, now)) {
+		documents, err := d.generate(now)
+		if err != nil {
+			return nil, time.Time{}, false, err
+		}
+		d.documents = documents
+		d.generated = now
+	}
+	data, ok := d.documents[id]
+	return data, d.generated, ok, nil
+}
+
+// serveMetadata writes metadata with caching headers. Conditional requests are answered with 304 Not Modified.
+func (i *IDP) serveMetadata(w http.ResponseWriter, r *http.Request, metadata []byte, modified time.Time) {
+	sum := sha256.Sum256(metadata)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum[:16]))
+	if i.metadata.cacheDuration > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(i.metadata.cacheDuration/time.Second)))
+	}
+	http.ServeContent(w, r, "", modified, bytes.NewReader(metadata))
+}
+
+// metadataValidity returns the validUntil and cacheDuration attribute values for metadata generated at now
+func (i *IDP) metadataValidity(now time.Time) (*time.Time, string) {
+	var validUntil *time.Time
+	if i.metadata.validDuration > 0 {
+		t := now.Add(i.metadata.validDuration).UTC()
+		validUntil = &t
+	}
+	var cacheDuration string
+	if i.metadata.cacheDuration > 0 {
+		cacheDuration = saml.FormatDuration(i.metadata.cacheDuration)
+	}
+	return validUntil, cacheDuration
+}
+
+// signMetadata signs and serializes a metadata document. The signature is cleared afterwards, so the document can be
+// included unsigned in an aggregate.
+func (i *IDP) signMetadata(v interface{}, signature **xmlsig.Signature) ([]byte, error) {
+	sig, err := i.signer.CreateSignature(v)
+	if err != nil {
+		return nil, err
+	}
+	*signature = sig
+	defer func() {
+		*signature = nil
+	}()
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err := xml.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (i *IDP) entityDescriptor(now time.Time) *saml.IDPEntityDescriptor {
+	m := i.metadata
+	var keyDescriptors []saml.KeyDescriptor
+	for _, key := range i.keystore.published(now) {
+		keyDescriptors = append(keyDescriptors, keyDescriptor("signing", key.certificate.Certificate[0]))
+	}
+	for _, cert := range m.signingCertificates {
+		keyDescriptors = append(keyDescriptors, keyDescriptor("signing", cert.Raw))
+	}
+	for _, cert := range m.encryptionCertificates {
+		keyDescriptors = append(keyDescriptors, keyDescriptor("encryption", cert.Raw))
+	}
+	var roleExtensions *saml.Extensions
+	if len(m.scopes) > 0 || m.uiInfo != (MetadataUIInfo{}) {
+		roleExtensions = &saml.Extensions{}
+		for _, scope := range m.scopes {
+			roleExtensions.Scope = append(roleExtensions.Scope, saml.Scope{Value: scope})
+		}
+	}
+	var ssoExtensions *saml.Extensions
+	if roleExtensions != nil {
+		ext := *roleExtensions
+		ssoExtensions = &ext
+		if ui := m.uiInfo; ui != (MetadataUIInfo{}) {
+			ssoExtensions.UIInfo = &saml.UIInfo{
+				DisplayName:         m.localized(ui.DisplayName),
+				Description:         m.localized(ui.Description),
+				InformationURL:      m.localized(ui.InformationURL),
+				PrivacyStatementURL: m.localized(ui.PrivacyStatementURL),
+			}
+			if ui.Logo != "" {
+				ssoExtensions.UIInfo.Logo = []saml.Logo{{Height: ui.LogoHeight, Width: ui.LogoWidth, Value: ui.Logo}}
+			}
+		}
+	}
+	var sloServices []saml.SingleLogoutService
+	for _, slo := range m.singleLogoutServices {
+		sloServices = append(sloServices, saml.SingleLogoutService{
+			Service: saml.Service{Binding: slo.Binding, Location: slo.Location},
+		})
 	}
 
 	// build EntityDescriptor
@@ -44,8 +292,9 @@ func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
 		},
 		IDPSSODescriptor: saml.IDPSSODescriptor{
 			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
-			KeyDescriptor:              keyDescriptor,
-			WantAuthnRequestsSigned:    true,
+			Extensions:                 ssoExtensions,
+			KeyDescriptor:              keyDescriptors,
+			WantAuthnRequestsSigned:    viper.GetBool("require-signed-requests"),
 			ArtifactResolutionService: saml.ArtifactResolutionService{
 				Service: saml.Service{
 					Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
@@ -53,7 +302,22 @@ func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
 				},
 				Index: 1,
 			},
-			NameIDFormat: "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
+			SingleLogoutService: sloServices,
+			ManageNameIDService: []saml.ManageNameIDService{
+				{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
+						Location: i.manageNameIDServiceLocation,
+					},
+				},
+				{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect",
+						Location: i.redirectManageNameIDServiceLocation,
+					},
+				},
+			},
+			NameIDFormat: m.nameIDFormats,
 			SingleSignOnService: []saml.SingleSignOnService{
 				saml.SingleSignOnService{
 					Service: saml.Service{
@@ -61,44 +325,151 @@ func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
 						Location: i.singleSignOnServiceLocation,
 					},
 				},
+				saml.SingleSignOnService{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+						Location: i.postSingleSignOnServiceLocation,
+					},
+				},
 				saml.SingleSignOnService{
 					Service: saml.Service{
 						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
 						Location: i.ecpServiceLocation,
 					},
 				},
+				saml.SingleSignOnService{
+					Service: saml.Service{
+						Binding:  saml.HoKSSOBrowser,
+						Location: i.singleSignOnServiceLocation,
+					},
+					ProtocolBinding: "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect",
+				},
 			},
+			NameIDMappingService: []saml.NameIDMappingService{
+				{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
+						Location: i.nameIDMappingServiceLocation,
+					},
+				},
+			},
+			AssertionIDRequestService: i.assertionIDRequestServices(),
 		},
 		AttributeAuthorityDescriptor: saml.AttributeAuthorityDescriptor{
 			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
-			KeyDescriptor:              keyDescriptor,
+			Extensions:                 roleExtensions,
+			KeyDescriptor:              keyDescriptors,
 			AttributeService: saml.AttributeService{
 				Service: saml.Service{
 					Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
 					Location: i.attributeServiceLocation,
 				},
 			},
-			NameIDFormat: "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
+			AssertionIDRequestService: i.assertionIDRequestServices(),
+			NameIDFormat:              m.nameIDFormats,
+		},
+		AuthnAuthorityDescriptor: &saml.AuthnAuthorityDescriptor{
+			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+			Extensions:                 roleExtensions,
+			KeyDescriptor:              keyDescriptors,
+			AuthnQueryService: []saml.AuthnQueryService{
+				{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
+						Location: i.authnQueryServiceLocation,
+					},
+				},
+			},
+			AssertionIDRequestService: i.assertionIDRequestServices(),
+			NameIDFormat:              m.nameIDFormats,
 		},
 	}
-	sig, err := i.signer.CreateSignature(ed)
-	if err != nil {
-		return nil, err
+	if len(m.entityAttributes) > 0 {
+		attributes := &saml.EntityAttributes{}
+		for _, attribute := range m.entityAttributes {
+			a := saml.Attribute{
+				Name:       attribute.Name,
+				NameFormat: attribute.NameFormat,
+			}
+			if a.NameFormat == "" {
+				a.NameFormat = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+			}
+			for _, value := range attribute.Values {
+				a.AttributeValue = append(a.AttributeValue, saml.AttributeValue{Value: value})
+			}
+			attributes.Attribute = append(attributes.Attribute, a)
+		}
+		ed.Extensions = &saml.Extensions{EntityAttributes: attributes}
+	}
+	if org := m.organization; org.Name != "" {
+		ed.Organization = &saml.Organization{
+			OrganizationName:        m.localized(org.Name),
+			OrganizationDisplayName: m.localized(org.DisplayName),
+			OrganizationURL:         m.localized(org.URL),
+		}
+		// display name and URL are required when an organization is published
+		if org.DisplayName == "" {
+			ed.Organization.OrganizationDisplayName = m.localized(org.Name)
+		}
+		if org.URL == "" {
+			ed.Organization.OrganizationURL = m.localized(fmt.Sprintf("https://%s/", i.serverName))
+		}
+	}
+	for _, contact := range m.contacts {
+		person := saml.ContactPerson{
+			ContactType:     "technical",
+			Company:         contact.Company,
+			GivenName:       contact.GivenName,
+			SurName:         contact.SurName,
+			TelephoneNumber: contact.TelephoneNumbers,
+		}
+		if contact.Type != "" {
+			person.ContactType = contact.Type
+		}
+		for _, email := range contact.EmailAddresses {
+			if !strings.HasPrefix(email, "mailto:") {
+				email = "mailto:" + email
+			}
+			person.EmailAddress = append(person.EmailAddress, email)
+		}
+		ed.ContactPerson = append(ed.ContactPerson, person)
 	}
-	ed.Signature = sig
+	return ed
+}
 
-	// save it into byte slice
-	var b bytes.Buffer
-	b.Write([]byte(xml.Header))
-	encoder := xml.NewEncoder(&b)
-	err = encoder.Encode(ed)
-	if err != nil {
-		return nil, err
+// assertionIDRequestServices lists the endpoints issued assertions can be retrieved from
+func (i *IDP) assertionIDRequestServices() []saml.AssertionIDRequestService {
+	return []saml.AssertionIDRequestService{
+		{
+			Service: saml.Service{
+				Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
+				Location: i.assertionIDRequestServiceLocation,
+			},
+		},
+		{
+			Service: saml.Service{
+				Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:URI",
+				Location: i.assertionIDURIServiceLocation,
+			},
+		},
 	}
-	metadata := b.Bytes()
+}
 
-	// return handler
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Write(metadata)
-	}, nil
+func keyDescriptor(use string, certData []byte) saml.KeyDescriptor {
+	return saml.KeyDescriptor{
+		Use: use,
+		KeyInfo: xmlsig.KeyInfo{
+			X509Data: &xmlsig.X509Data{
+				X509Certificate: base64.StdEncoding.EncodeToString(certData),
+			},
+		},
+	}
+}
+
+// localized returns the value as a single element list in the configured language or nil if value is empty
+func (m metadataSettings) localized(value string) []saml.LocalizedName {
+	if value == "" {
+		return nil
+	}
+	return []saml.LocalizedName{{Lang: m.lang, Value: value}}
 }
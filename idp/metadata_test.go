@@ -15,8 +15,16 @@
 package idp
 
 import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,3 +38,113 @@ func TestIDP_DefaultMetadataHandler(t *testing.T) {
 	defer resp.Body.Close()
 	assert.Equal(t, 200, resp.StatusCode, "metadata not found")
 }
+
+func TestIDP_DefaultMetadataHandlerConfiguration(t *testing.T) {
+	viper.Set("require-signed-requests", false)
+	defer viper.Set("require-signed-requests", true)
+	viper.Set("metadata-signing-certificates", []string{filepath.Join("testdata", "certificate.pem")})
+	viper.Set("metadata-encryption-certificates", []string{filepath.Join("testdata", "certificate.pem")})
+	viper.Set("metadata-valid-duration", "48h")
+	viper.Set("metadata-cache-duration", "6h")
+	viper.Set("metadata-scopes", []string{"example.com"})
+	viper.Set("metadata-slo-services", []MetadataEndpoint{{
+		Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect",
+		Location: "https://idp.example.com/SAML2/Redirect/SLO",
+	}})
+	viper.Set("metadata-organization", MetadataOrganization{Name: "Example", URL: "https://www.example.com/"})
+	viper.Set("metadata-contacts", []MetadataContact{{Type: "support", EmailAddresses: []string{"help@example.com"}}})
+	viper.Set("metadata-ui-info", MetadataUIInfo{DisplayName: "Example IdP"})
+	viper.Set("metadata-entity-attributes", []MetadataAttribute{{
+		Name:   "http://macedir.org/entity-category",
+		Values: []string{"http://refeds.org/category/research-and-scholarship"},
+	}})
+	defer func() {
+		for _, key := range []string{"metadata-signing-certificates", "metadata-encryption-certificates",
+			"metadata-valid-duration", "metadata-cache-duration", "metadata-scopes", "metadata-slo-services",
+			"metadata-organization", "metadata-contacts", "metadata-ui-info", "metadata-entity-attributes"} {
+			viper.Set(key, nil)
+		}
+	}()
+	ts := getTestIDP(t, &IDP{})
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "max-age=21600", resp.Header.Get("Cache-Control"))
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the signature must cover the localized names
+	cert, err := loadCertificate(filepath.Join("testdata", "certificate.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sign.NewCertificateValidator(cert).Validate(string(data))
+	assert.NoError(t, err)
+
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.Unmarshal(data, ed); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, ed.ValidUntil.After(time.Now().Add(47*time.Hour)))
+	assert.Equal(t, "PT6H", ed.CacheDuration)
+	sso := ed.IDPSSODescriptor
+	assert.False(t, sso.WantAuthnRequestsSigned, "unsigned requests are accepted")
+	assert.Len(t, sso.KeyDescriptor, 3)
+	assert.Equal(t, "encryption", sso.KeyDescriptor[2].Use)
+	assert.Len(t, sso.NameIDFormat, 4)
+	assert.Len(t, sso.SingleLogoutService, 1)
+	assert.Equal(t, "example.com", sso.Extensions.Scope[0].Value)
+	assert.Equal(t, "Example IdP", sso.Extensions.UIInfo.DisplayName[0].Value)
+	assert.Equal(t, "en", sso.Extensions.UIInfo.DisplayName[0].Lang)
+	assert.Equal(t, "http://macedir.org/entity-category", ed.Extensions.EntityAttributes.Attribute[0].Name)
+	assert.Equal(t, "Example", ed.Organization.OrganizationDisplayName[0].Value)
+	assert.Equal(t, "mailto:help@example.com", ed.ContactPerson[0].EmailAddress[0])
+
+	// unchanged metadata isn't sent again
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/metadata", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
+
+func Test_metadataDocuments_get(t *testing.T) {
+	generated := 0
+	docs := &metadataDocuments{
+		generate: func(now time.Time) (map[string][]byte, error) {
+			generated++
+			return map[string][]byte{"": []byte(now.String())}, nil
+		},
+		refresh: time.Hour,
+	}
+	first, modified, ok, err := docs.get("")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	second, _, _, _ := docs.get("")
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, generated)
+
+	// documents are regenerated once the refresh interval passes
+	docs.generated = modified.Add(-time.Hour)
+	third, _, _, _ := docs.get("")
+	assert.NotEqual(t, first, third)
+	assert.Equal(t, 2, generated)
+	_, _, ok, err = docs.get("unknown")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
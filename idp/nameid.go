@@ -0,0 +1,236 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	nameIDTransient  = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+	nameIDPersistent = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+)
+
+var errUnknownPrincipal = errors.New("subject is not known to the identity provider")
+
+// makeNameID identifies the user to a service provider in the format configured for it. The service provider is nil
+// when it isn't registered. Users are never identified by name when an opaque identifier can't be created.
+func (i *IDP) makeNameID(user *model.User, spEntityID string, sp *ServiceProvider) (*saml.NameID, error) {
+	nameID := &saml.NameID{
+		Format:          user.Format,
+		NameQualifier:   i.entityID,
+		SPNameQualifier: spEntityID,
+		Value:           user.Name,
+	}
+	if sp == nil || sp.NameIDFormat == "" {
+		return nameID, nil
+	}
+	var (
+		value, spProvidedID string
+		err                 error
+	)
+	switch sp.NameIDFormat {
+	case nameIDTransient:
+		value, err = i.transientID(user, spEntityID)
+	case nameIDPersistent:
+		var link *NameIDLink
+		if link, err = i.persistentLink(user, spEntityID); err == nil {
+			value, spProvidedID = link.Value, link.SPProvidedID
+		}
+	default:
+		err = errors.New("unsupported name identifier format " + sp.NameIDFormat)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create name identifier for %s: %s", spEntityID, err)
+	}
+	nameID.Format = sp.NameIDFormat
+	nameID.Value = value
+	nameID.SPProvidedID = spProvidedID
+	return nameID, nil
+}
+
+// transientID creates a random identifier that's remembered for as long as the user's session
+func (i *IDP) transientID(user *model.User, spEntityID string) (string, error) {
+	value := saml.NewID()
+	data, err := proto.Marshal(&model.User{Name: user.Name, Format: user.Format})
+	if err != nil {
+		return "", err
+	}
+	return value, i.UserCache.Set(transientKey(spEntityID, value), data)
+}
+
+func transientKey(spEntityID, value string) string {
+	return "transient:" + spEntityID + ":" + value
+}
+
+// persistentLink returns the link between the user and the service provider, creating one the first time the user
+// is identified to the service provider
+func (i *IDP) persistentLink(user *model.User, spEntityID string) (*NameIDLink, error) {
+	link, err := i.NameIDStore.LinkForUser(spEntityID, user.Name)
+	if err != nil || link != nil {
+		return link, err
+	}
+	link = &NameIDLink{SPEntityID: spEntityID, UserName: user.Name, UserFormat: user.Format}
+	if i.persistentIDKey != nil {
+		// Derived identifiers survive the loss of the store, but an identifier that was terminated can't come back
+		if link.Value, err = i.persistentID(user, spEntityID); err != nil {
+			return nil, err
+		}
+		existing, err := i.NameIDStore.LinkForValue(spEntityID, link.Value)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			link.Value = ""
+		}
+	}
+	if link.Value == "" {
+		link.Value = saml.NewID()
+	}
+	return link, i.NameIDStore.Save(link)
+}
+
+// persistentID deterministically encrypts the user's name for the service provider, so the same user always gets
+// the same opaque identifier and the identifier can be turned back into the user without storing it
+func (i *IDP) persistentID(user *model.User, spEntityID string) (string, error) {
+	if i.persistentIDKey == nil {
+		return "", errors.New("persistent-id-secret is not configured")
+	}
+	data, err := proto.Marshal(&model.User{Name: user.Name, Format: user.Format})
+	if err != nil {
+		return "", err
+	}
+	aead, err := i.persistentIDCipher()
+	if err != nil {
+		return "", err
+	}
+	// Deriving the nonce from the plaintext keeps identifiers stable without reusing a nonce for different users
+	mac := hmac.New(sha256.New, i.persistentIDKey)
+	mac.Write([]byte(spEntityID))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	sealed := aead.Seal(nonce, nonce, data, []byte(spEntityID))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (i *IDP) persistentIDCipher() (cipher.AEAD, error) {
+	// Use a different key for encryption than for deriving nonces
+	mac := hmac.New(sha256.New, i.persistentIDKey)
+	mac.Write([]byte("persistent-id-encryption"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// resolveNameID finds the user identified by a name identifier in a query from a service provider. Transient and
+// persistent identifiers can only be used by the service provider they were issued to. Service providers that are
+// sent opaque identifiers can't ask about users by name.
+func (i *IDP) resolveNameID(nameID *saml.NameID, querier string) (*model.User, error) {
+	if nameID == nil || nameID.Value == "" {
+		return nil, errUnknownPrincipal
+	}
+	if nameID.Format != nameIDTransient && nameID.Format != nameIDPersistent {
+		if sp, ok := i.getServiceProvider(querier); ok && sp.NameIDFormat != "" {
+			return nil, errUnknownPrincipal
+		}
+		return &model.User{Name: nameID.Value, Format: nameID.Format}, nil
+	}
+	if nameID.SPNameQualifier != "" && nameID.SPNameQualifier != querier {
+		return nil, errUnknownPrincipal
+	}
+	if nameID.Format == nameIDPersistent {
+		link, err := i.resolvePersistentID(nameID.Value, querier)
+		if err != nil {
+			return nil, err
+		}
+		return &model.User{Name: link.UserName, Format: link.UserFormat}, nil
+	}
+	data, err := i.UserCache.Get(transientKey(querier, nameID.Value))
+	if err != nil {
+		return nil, errUnknownPrincipal
+	}
+	user := &model.User{}
+	if err := proto.Unmarshal(data, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// resolvePersistentID returns the active link with a persistent identifier issued to the service provider
+func (i *IDP) resolvePersistentID(value, spEntityID string) (*NameIDLink, error) {
+	link, err := i.NameIDStore.LinkForValue(spEntityID, value)
+	if err != nil {
+		return nil, err
+	}
+	if link == nil {
+		// Identifiers issued before they were stored can still be decrypted. Store them unless the user has been
+		// given another identifier since.
+		user, err := i.decryptPersistentID(value, spEntityID)
+		if err != nil {
+			return nil, err
+		}
+		if link, err = i.persistentLink(user, spEntityID); err != nil {
+			return nil, err
+		}
+		if link.Value != value {
+			return nil, errUnknownPrincipal
+		}
+	}
+	if link.Terminated {
+		return nil, errUnknownPrincipal
+	}
+	return link, nil
+}
+
+// decryptPersistentID turns an identifier created by persistentID back into the user
+func (i *IDP) decryptPersistentID(value, spEntityID string) (*model.User, error) {
+	if i.persistentIDKey == nil {
+		return nil, errUnknownPrincipal
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errUnknownPrincipal
+	}
+	aead, err := i.persistentIDCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errUnknownPrincipal
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, []byte(spEntityID))
+	if err != nil {
+		return nil, errUnknownPrincipal
+	}
+	user := &model.User{}
+	if err := proto.Unmarshal(data, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,147 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"errors"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_makeNameID(t *testing.T) {
+	viper.Set("persistent-id-secret", "secret")
+	defer viper.Set("persistent-id-secret", "")
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	user := &model.User{Name: "joe", Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"}
+	sp := &ServiceProvider{EntityID: "https://sp.example.com/"}
+
+	nameID := testNameID(t, i, user, sp.EntityID, sp)
+	assert.Equal(t, "joe", nameID.Value)
+	assert.Equal(t, user.Format, nameID.Format)
+
+	sp.NameIDFormat = nameIDTransient
+	nameID = testNameID(t, i, user, sp.EntityID, sp)
+	assert.Equal(t, nameIDTransient, nameID.Format)
+	assert.NotEqual(t, nameID.Value, testNameID(t, i, user, sp.EntityID, sp).Value, "expected a new transient identifier")
+	resolved, err := i.resolveNameID(nameID, sp.EntityID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "joe", resolved.Name)
+		assert.Equal(t, user.Format, resolved.Format)
+	}
+	_, err = i.resolveNameID(nameID, "https://other.example.com/")
+	assert.Equal(t, errUnknownPrincipal, err, "transient identifiers are only known to their service provider")
+
+	sp.NameIDFormat = nameIDPersistent
+	nameID = testNameID(t, i, user, sp.EntityID, sp)
+	assert.Equal(t, nameIDPersistent, nameID.Format)
+	assert.NotContains(t, nameID.Value, "joe")
+	assert.Equal(t, nameID.Value, testNameID(t, i, user, sp.EntityID, sp).Value, "expected a stable persistent identifier")
+	other := &ServiceProvider{EntityID: "https://other.example.com/", NameIDFormat: nameIDPersistent}
+	assert.NotEqual(t, nameID.Value, testNameID(t, i, user, other.EntityID, other).Value, "expected pairwise identifiers")
+	resolved, err = i.resolveNameID(nameID, sp.EntityID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "joe", resolved.Name)
+	}
+	_, err = i.resolveNameID(nameID, other.EntityID)
+	assert.Equal(t, errUnknownPrincipal, err)
+
+	// Identifiers issued before they were stored are still recognized
+	i.NameIDStore, err = NewNameIDStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err = i.resolveNameID(nameID, sp.EntityID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "joe", resolved.Name)
+	}
+
+	// Terminated identifiers are replaced and no longer resolve
+	link, err := i.NameIDStore.LinkForValue(sp.EntityID, nameID.Value)
+	if err != nil || link == nil {
+		t.Fatal("expected the identifier to be stored")
+	}
+	link.Terminated = true
+	if err = i.NameIDStore.Save(link); err != nil {
+		t.Fatal(err)
+	}
+	_, err = i.resolveNameID(nameID, sp.EntityID)
+	assert.Equal(t, errUnknownPrincipal, err)
+	replaced := testNameID(t, i, user, sp.EntityID, sp)
+	assert.Equal(t, nameIDPersistent, replaced.Format)
+	assert.NotEqual(t, nameID.Value, replaced.Value, "expected a new persistent identifier")
+
+	// Random identifiers are stored without a secret
+	i.persistentIDKey = nil
+	third := &ServiceProvider{EntityID: "https://third.example.com/", NameIDFormat: nameIDPersistent}
+	nameID = testNameID(t, i, user, third.EntityID, third)
+	assert.Equal(t, nameIDPersistent, nameID.Format)
+	assert.Equal(t, nameID.Value, testNameID(t, i, user, third.EntityID, third).Value)
+	resolved, err = i.resolveNameID(nameID, third.EntityID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "joe", resolved.Name)
+	}
+}
+
+// brokenNameIDStore fails every operation
+type brokenNameIDStore struct{}
+
+func (brokenNameIDStore) LinkForUser(spEntityID, userName string) (*NameIDLink, error) {
+	return nil, errors.New("store is unavailable")
+}
+
+func (brokenNameIDStore) LinkForValue(spEntityID, value string) (*NameIDLink, error) {
+	return nil, errors.New("store is unavailable")
+}
+
+func (brokenNameIDStore) Save(link *NameIDLink) error {
+	return errors.New("store is unavailable")
+}
+
+func TestIDP_makeAuthnResponseNameIDFailure(t *testing.T) {
+	i := &IDP{NameIDStore: brokenNameIDStore{}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	sp := &ServiceProvider{EntityID: "https://opaque.example.com/", NameIDFormat: nameIDPersistent}
+	i.sps[sp.EntityID] = sp
+	defer delete(i.sps, sp.EntityID)
+
+	// The user's name must not be sent when the opaque identifier can't be created
+	resp := i.makeAuthnResponse(&model.AuthnRequest{ID: "_123", Issuer: sp.EntityID}, &model.User{Name: "joe"})
+	assert.Nil(t, resp.Assertion)
+	if assert.NotNil(t, resp.Status) && assert.NotNil(t, resp.Status.StatusCode.StatusCode) {
+		assert.Equal(t, statusInvalidNameIDPolicy, resp.Status.StatusCode.StatusCode.Value)
+	}
+	data, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), "joe")
+}
+
+// testNameID identifies the user to the service provider, failing the test when an identifier can't be created
+func testNameID(t *testing.T, i *IDP, user *model.User, spEntityID string, sp *ServiceProvider) *saml.NameID {
+	nameID, err := i.makeNameID(user, spEntityID, sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nameID
+}
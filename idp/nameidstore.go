@@ -0,0 +1,170 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// NameIDLink records the persistent name identifier a service provider knows a user by
+type NameIDLink struct {
+	SPEntityID string
+	UserName   string
+	UserFormat string
+	Value      string
+	// Identifier the service provider set with a ManageNameIDRequest
+	SPProvidedID string `json:",omitempty"`
+	// Terminated links are kept so their identifiers are never issued again
+	Terminated bool `json:",omitempty"`
+}
+
+// NameIDStore persists the links between users and the persistent name identifiers issued to service providers
+type NameIDStore interface {
+	// LinkForUser returns the active link between the user and the service provider or nil if there isn't one
+	LinkForUser(spEntityID, userName string) (*NameIDLink, error)
+	// LinkForValue returns the link with the identifier or nil if the identifier wasn't issued to the service
+	// provider
+	LinkForValue(spEntityID, value string) (*NameIDLink, error)
+	// Save adds the link or replaces the link with the same service provider and identifier
+	Save(link *NameIDLink) error
+}
+
+type fileNameIDStore struct {
+	sync.RWMutex
+	path  string
+	links []NameIDLink
+	// Positions of the links by service provider and identifier, and of the active links by service provider and user
+	byValue map[nameIDIndex]int
+	byUser  map[nameIDIndex]int
+}
+
+// nameIDIndex is a service provider and a user name or identifier
+type nameIDIndex struct {
+	spEntityID string
+	key        string
+}
+
+// NewNameIDStore returns a store that keeps links in the JSON file named by the nameid-store-path setting. Links are
+// only kept in memory when the setting is empty.
+func NewNameIDStore() (NameIDStore, error) {
+	s := &fileNameIDStore{
+		path:    viper.GetString("nameid-store-path"),
+		byValue: map[nameIDIndex]int{},
+		byUser:  map[nameIDIndex]int{},
+	}
+	if s.path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var links []NameIDLink
+	if err = json.Unmarshal(data, &links); err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		s.add(link)
+	}
+	return s, nil
+}
+
+// add adds the link to the index or replaces the link with the same service provider and identifier
+func (s *fileNameIDStore) add(link NameIDLink) {
+	value := nameIDIndex{link.SPEntityID, link.Value}
+	user := nameIDIndex{link.SPEntityID, link.UserName}
+	if j, ok := s.byValue[value]; ok {
+		if previous := s.links[j]; s.byUser[nameIDIndex{previous.SPEntityID, previous.UserName}] == j {
+			delete(s.byUser, nameIDIndex{previous.SPEntityID, previous.UserName})
+		}
+		s.links[j] = link
+	} else {
+		s.byValue[value] = len(s.links)
+		s.links = append(s.links, link)
+	}
+	if !link.Terminated {
+		s.byUser[user] = s.byValue[value]
+	}
+}
+
+func (s *fileNameIDStore) LinkForUser(spEntityID, userName string) (*NameIDLink, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if j, ok := s.byUser[nameIDIndex{spEntityID, userName}]; ok {
+		link := s.links[j]
+		return &link, nil
+	}
+	return nil, nil
+}
+
+func (s *fileNameIDStore) LinkForValue(spEntityID, value string) (*NameIDLink, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if j, ok := s.byValue[nameIDIndex{spEntityID, value}]; ok {
+		link := s.links[j]
+		return &link, nil
+	}
+	return nil, nil
+}
+
+func (s *fileNameIDStore) Save(link *NameIDLink) error {
+	s.Lock()
+	defer s.Unlock()
+	// The file is written before the link is added so that the store matches the file when writing fails
+	if s.path != "" {
+		links := append(make([]NameIDLink, 0, len(s.links)+1), s.links...)
+		if j, ok := s.byValue[nameIDIndex{link.SPEntityID, link.Value}]; ok {
+			links[j] = *link
+		} else {
+			links = append(links, *link)
+		}
+		if err := writeJSONFile(s.path, links); err != nil {
+			return err
+		}
+	}
+	s.add(*link)
+	return nil
+}
+
+// writeJSONFile replaces the file with the JSON encoding of v. The data is written to a temporary file first so a
+// failure can't leave a partially written file.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,91 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewNameIDStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nameids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("nameid-store-path", filepath.Join(dir, "nameids.json"))
+	defer viper.Set("nameid-store-path", "")
+
+	store, err := NewNameIDStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &NameIDLink{SPEntityID: "https://sp.example.com/", UserName: "joe", Value: "abc"}
+	if err = store.Save(link); err != nil {
+		t.Fatal(err)
+	}
+	link.SPProvidedID = "joe@sp"
+	if err = store.Save(link); err != nil {
+		t.Fatal(err)
+	}
+
+	// Links are read back from the file
+	store, err = NewNameIDStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := store.LinkForUser("https://sp.example.com/", "joe")
+	if assert.NoError(t, err) && assert.NotNil(t, found) {
+		assert.Equal(t, "abc", found.Value)
+		assert.Equal(t, "joe@sp", found.SPProvidedID)
+	}
+	found, err = store.LinkForValue("https://other.example.com/", "abc")
+	assert.NoError(t, err)
+	assert.Nil(t, found, "identifiers belong to a single service provider")
+
+	link.Terminated = true
+	if err = store.Save(link); err != nil {
+		t.Fatal(err)
+	}
+	found, err = store.LinkForUser("https://sp.example.com/", "joe")
+	assert.NoError(t, err)
+	assert.Nil(t, found, "terminated links aren't active")
+	found, err = store.LinkForValue("https://sp.example.com/", "abc")
+	if assert.NoError(t, err) && assert.NotNil(t, found) {
+		assert.True(t, found.Terminated)
+	}
+
+	// A new identifier replaces the terminated one
+	if err = store.Save(&NameIDLink{SPEntityID: "https://sp.example.com/", UserName: "joe", Value: "def"}); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewNameIDStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err = store.LinkForUser("https://sp.example.com/", "joe")
+	if assert.NoError(t, err) && assert.NotNil(t, found) {
+		assert.Equal(t, "def", found.Value)
+	}
+	found, err = store.LinkForValue("https://sp.example.com/", "abc")
+	if assert.NoError(t, err) && assert.NotNil(t, found) {
+		assert.True(t, found.Terminated)
+	}
+}
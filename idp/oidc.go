@@ -0,0 +1,770 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/jwt"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// oidcCodeBinding marks saved authentication requests that are answered with an OpenID Connect authorization code
+const oidcCodeBinding = "urn:lite-idp:oidc:authorization-code"
+
+// Token types set in the typ header of issued tokens
+const (
+	idTokenType     = "JWT"
+	accessTokenType = "at+jwt"
+)
+
+// OIDCClient is an OpenID Connect relying party registered with the IdP
+type OIDCClient struct {
+	ClientID string
+	// bcrypt hash of the client secret. Public clients don't have a secret and must use PKCE.
+	ClientSecret string
+	// Exact redirect URIs the client may receive authorization codes at
+	RedirectURIs []string
+	// Identify users with pairwise identifiers instead of their names
+	PairwiseSubject bool
+	// Claims released to the client. Defaults to the oidc-claims setting.
+	Claims []ClaimMapping
+	// Rules limiting who can use the client. Every user can when empty.
+	AccessRules []AccessRule
+}
+
+// accessControl returns a service provider with the client's access rules
+func (c *OIDCClient) accessControl() *ServiceProvider {
+	return &ServiceProvider{EntityID: c.ClientID, AccessRules: c.AccessRules}
+}
+
+// ClaimMapping releases an attribute as a claim
+type ClaimMapping struct {
+	Claim     string
+	Attribute string
+	// Scope the client must request to receive the claim. Claims without a scope are always released.
+	Scope string
+}
+
+// oidcError is an OAuth error returned to the client
+type oidcError struct {
+	code        string
+	description string
+}
+
+func (e *oidcError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.description)
+}
+
+func newOIDCError(code, format string, args ...interface{}) *oidcError {
+	return &oidcError{code: code, description: fmt.Sprintf(format, args...)}
+}
+
+// oidcAuthorization is the part of an authorization request needed to issue the code and tokens
+type oidcAuthorization struct {
+	ClientID      string
+	RedirectURI   string
+	Scope         string
+	State         string
+	Nonce         string
+	CodeChallenge string
+}
+
+// oidcGrant is saved for an authorization code until the client redeems it
+type oidcGrant struct {
+	oidcAuthorization
+	// Protocol buffer encoding of the authenticated user
+	User []byte
+}
+
+// accessTokenClaims are the claims of access tokens issued to clients
+type accessTokenClaims struct {
+	jwt.Claims
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// discoveryDocument is the OpenID Provider configuration
+type discoveryDocument struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported,omitempty"`
+}
+
+func (i *IDP) configureOIDC() error {
+	i.oidcIssuer = viper.GetString("oidc-issuer")
+	if i.oidcIssuer == "" {
+		i.oidcIssuer = fmt.Sprintf("https://%s", i.serverName)
+	}
+	i.oidcAuthorizationLocation = fmt.Sprintf("https://%s%s", i.serverName, viper.GetString("oidc-authorization-path"))
+	i.oidcTokenLocation = fmt.Sprintf("https://%s%s", i.serverName, viper.GetString("oidc-token-path"))
+	i.oidcUserInfoLocation = fmt.Sprintf("https://%s%s", i.serverName, viper.GetString("oidc-userinfo-path"))
+	i.oidcJWKSLocation = fmt.Sprintf("https://%s%s", i.serverName, viper.GetString("oidc-jwks-path"))
+	if err := viper.UnmarshalKey("oidc-claims", &i.oidcClaims); err != nil {
+		return err
+	}
+	clients := []*OIDCClient{}
+	if err := viper.UnmarshalKey("oidc-clients", &clients); err != nil {
+		return err
+	}
+	i.oidcClients = make(map[string]*OIDCClient, len(clients))
+	for _, client := range clients {
+		if client.ClientID == "" {
+			return errors.New("OpenID Connect client does not specify a client ID")
+		}
+		if len(client.RedirectURIs) == 0 {
+			return fmt.Errorf("OpenID Connect client %s does not have a redirect URI", client.ClientID)
+		}
+		if err := client.accessControl().validateAccessRules(); err != nil {
+			return fmt.Errorf("invalid access rule for %s: %s", client.ClientID, err)
+		}
+		i.oidcClients[client.ClientID] = client
+	}
+	return nil
+}
+
+// oidcDiscoveryPath returns the path of the discovery document, which is relative to the issuer
+func (i *IDP) oidcDiscoveryPath() string {
+	path := "/"
+	if u, err := url.Parse(i.oidcIssuer); err == nil {
+		path = strings.TrimSuffix(u.Path, "/") + "/"
+	}
+	return path + ".well-known/openid-configuration"
+}
+
+// allowsRedirect reports whether the URI is registered for the client
+func (c *OIDCClient) allowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// releasedClaims returns the claims the client receives for the attributes
+func (c *OIDCClient) releasedClaims(atts []*model.Attribute, defaults []ClaimMapping,
+	scope string) map[string]interface{} {
+	mappings := c.Claims
+	if len(mappings) == 0 {
+		mappings = defaults
+	}
+	return releaseClaims(atts, mappings, scope)
+}
+
+// releaseClaims maps attributes to claims. Every attribute is released under its own name when no claims are mapped.
+func releaseClaims(atts []*model.Attribute, mappings []ClaimMapping, scope string) map[string]interface{} {
+	claims := make(map[string]interface{})
+	if len(mappings) == 0 {
+		for _, att := range atts {
+			claims[att.Name] = claimValue(att.Value)
+		}
+		return claims
+	}
+	for _, mapping := range mappings {
+		if mapping.Scope != "" && !hasScope(scope, mapping.Scope) {
+			continue
+		}
+		for _, att := range atts {
+			if att.Name == mapping.Attribute {
+				claims[mapping.Claim] = claimValue(att.Value)
+				break
+			}
+		}
+	}
+	return claims
+}
+
+// claimValue returns single values as a string and multiple values as an array
+func claimValue(values []string) interface{} {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+func hasScope(scope, wanted string) bool {
+	for _, value := range strings.Fields(scope) {
+		if value == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultOIDCDiscoveryHandler is the default implementation for the OpenID Provider configuration handler. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultOIDCDiscoveryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc := discoveryDocument{
+			Issuer:                            i.oidcIssuer,
+			AuthorizationEndpoint:             i.oidcAuthorizationLocation,
+			TokenEndpoint:                     i.oidcTokenLocation,
+			UserInfoEndpoint:                  i.oidcUserInfoLocation,
+			JWKSURI:                           i.oidcJWKSLocation,
+			ResponseTypesSupported:            []string{"code"},
+			GrantTypesSupported:               []string{"authorization_code", samlBearerGrant},
+			SubjectTypesSupported:             []string{"public", "pairwise"},
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:     []string{"S256"},
+		}
+		scopes := map[string]bool{"openid": true}
+		claims := map[string]bool{"sub": true}
+		for _, mapping := range i.oidcClaims {
+			claims[mapping.Claim] = true
+			if mapping.Scope != "" {
+				scopes[mapping.Scope] = true
+			}
+		}
+		doc.ScopesSupported = sortedKeys(scopes)
+		// Without mappings the claims depend on the attributes users have
+		if len(i.oidcClaims) > 0 {
+			doc.ClaimsSupported = sortedKeys(claims)
+		}
+		if signer, err := i.tokenSigner(); err == nil {
+			doc.IDTokenSigningAlgValuesSupported = []string{signer.Algorithm()}
+		}
+		writeJSON(w, http.StatusOK, doc)
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DefaultOIDCJWKSHandler is the default implementation for the JSON Web Key Set handler. It publishes the same keys as the SAML metadata. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultOIDCJWKSHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		set := jwt.JWKSet{Keys: []jwt.JWK{}}
+		for _, key := range i.keystore.published(time.Now()) {
+			cert, err := x509.ParseCertificate(key.certificate.Certificate[0])
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			jwk, err := jwt.NewJWK(cert)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			set.Keys = append(set.Keys, jwk)
+		}
+		writeJSON(w, http.StatusOK, set)
+	}
+}
+
+// DefaultOIDCAuthorizationHandler is the default implementation for the OpenID Connect authorization handler. Users share their session with SAML service providers. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultOIDCAuthorizationHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			authz, err := i.validateAuthorization(r.Form)
+			if oerr, ok := err.(*oidcError); ok && authz != nil {
+				log.Infof("denied authorization request from %s: %s", authz.ClientID, oerr)
+				return redirectOIDCError(authz, oerr, w, r)
+			} else if err != nil {
+				return err
+			}
+			log.Infof("received authorization request from %s", authz.ClientID)
+			timestamp, err := ptypes.TimestampProto(time.Now())
+			if err != nil {
+				return err
+			}
+			req := &model.AuthnRequest{
+				ID:                          uuid.New().String(),
+				IssueInstant:                timestamp,
+				Issuer:                      authz.ClientID,
+				AssertionConsumerServiceURL: authz.RedirectURI,
+				ProtocolBinding:             oidcCodeBinding,
+			}
+			data, err := json.Marshal(authz)
+			if err != nil {
+				return err
+			}
+			if err = i.TempCache.Set(oidcAuthorizationKey(req.ID), data); err != nil {
+				return err
+			}
+			prompt := r.Form.Get("prompt")
+			if !hasScope(prompt, "login") {
+				if user := i.getUserFromSession(r); user != nil {
+					return i.respond(req, user, w, r)
+				}
+				if user, err := i.loginWithCert(r, req); user != nil {
+					return i.respond(req, user, w, r)
+				} else if err != nil {
+					return err
+				}
+			}
+			if hasScope(prompt, "none") {
+				return redirectOIDCError(authz, newOIDCError("login_required", "user is not logged in"), w, r)
+			}
+			return i.showLoginForm(req, w, r)
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// validateAuthorization checks an authorization request. Errors are only returned with the authorization once the
+// client and redirect URI are known to be valid, since it's not safe to redirect the user anywhere else.
+func (i *IDP) validateAuthorization(form url.Values) (*oidcAuthorization, error) {
+	client, ok := i.oidcClients[form.Get("client_id")]
+	if !ok {
+		return nil, errors.New("authorization request from an unregistered client")
+	}
+	if !client.allowsRedirect(form.Get("redirect_uri")) {
+		return nil, fmt.Errorf("redirect_uri is not registered for %s", client.ClientID)
+	}
+	authz := &oidcAuthorization{
+		ClientID:      client.ClientID,
+		RedirectURI:   form.Get("redirect_uri"),
+		Scope:         form.Get("scope"),
+		State:         form.Get("state"),
+		Nonce:         form.Get("nonce"),
+		CodeChallenge: form.Get("code_challenge"),
+	}
+	if form.Get("request") != "" || form.Get("request_uri") != "" {
+		return authz, newOIDCError("request_not_supported", "request objects are not supported")
+	}
+	if form.Get("response_type") != "code" {
+		return authz, newOIDCError("unsupported_response_type", "only the authorization code flow is supported")
+	}
+	if !hasScope(authz.Scope, "openid") {
+		return authz, newOIDCError("invalid_scope", "scope must include openid")
+	}
+	if hasScope(form.Get("prompt"), "none") && len(strings.Fields(form.Get("prompt"))) > 1 {
+		return authz, newOIDCError("invalid_request", "prompt none cannot be combined with other values")
+	}
+	if authz.CodeChallenge != "" && form.Get("code_challenge_method") != "S256" {
+		return authz, newOIDCError("invalid_request", "only S256 code challenges are supported")
+	}
+	if authz.CodeChallenge == "" && client.ClientSecret == "" {
+		return authz, newOIDCError("invalid_request", "public clients must send a code challenge")
+	}
+	return authz, nil
+}
+
+func oidcAuthorizationKey(id string) string {
+	return "oidc:" + id
+}
+
+func oidcCodeKey(code string) string {
+	return "oidc-code:" + code
+}
+
+func oidcAccessKey(id string) string {
+	return "oidc-access:" + id
+}
+
+// sendAuthorizationCode redirects the user back to the client with a code it can exchange for tokens
+func (i *IDP) sendAuthorizationCode(authRequest *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) error {
+	data, err := i.TempCache.Get(oidcAuthorizationKey(authRequest.ID))
+	if err != nil {
+		return errors.New("authorization request has expired")
+	}
+	grant := &oidcGrant{}
+	if err = json.Unmarshal(data, &grant.oidcAuthorization); err != nil {
+		return err
+	}
+	if grant.User, err = proto.Marshal(user); err != nil {
+		return err
+	}
+	code, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if data, err = json.Marshal(grant); err != nil {
+		return err
+	}
+	if err = i.TempCache.Set(oidcCodeKey(code), data); err != nil {
+		return err
+	}
+	i.TempCache.Delete(oidcAuthorizationKey(authRequest.ID))
+	params := url.Values{"code": {code}}
+	if grant.State != "" {
+		params.Set("state", grant.State)
+	}
+	http.Redirect(w, r, addQuery(grant.RedirectURI, params), http.StatusFound)
+	return nil
+}
+
+// redirectAuthorizationError returns a request error to the client at its redirect URI. Users who are denied access
+// are reported with access_denied.
+func (i *IDP) redirectAuthorizationError(authRequest *model.AuthnRequest, rerr *requestError,
+	w http.ResponseWriter, r *http.Request) error {
+	data, err := i.TempCache.Get(oidcAuthorizationKey(authRequest.ID))
+	if err != nil {
+		return errors.New("authorization request has expired")
+	}
+	authz := &oidcAuthorization{}
+	if err = json.Unmarshal(data, authz); err != nil {
+		return err
+	}
+	i.TempCache.Delete(oidcAuthorizationKey(authRequest.ID))
+	code := "invalid_request"
+	if rerr.status == statusRequestDenied {
+		code = "access_denied"
+	}
+	return redirectOIDCError(authz, newOIDCError(code, "%s", rerr.message), w, r)
+}
+
+// redirectOIDCError returns the error to the client at its redirect URI
+func redirectOIDCError(authz *oidcAuthorization, oerr *oidcError, w http.ResponseWriter, r *http.Request) error {
+	params := url.Values{
+		"error":             {oerr.code},
+		"error_description": {oerr.description},
+	}
+	if authz.State != "" {
+		params.Set("state", authz.State)
+	}
+	http.Redirect(w, r, addQuery(authz.RedirectURI, params), http.StatusFound)
+	return nil
+}
+
+// addQuery adds parameters to a URI that may already have a query
+func addQuery(uri string, params url.Values) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + params.Encode()
+	}
+	return uri + "?" + params.Encode()
+}
+
+func randomToken() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DefaultOIDCTokenHandler is the default implementation for the OpenID Connect token handler. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultOIDCTokenHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := func() (interface{}, error) {
+			if err := r.ParseForm(); err != nil {
+				return nil, newOIDCError("invalid_request", "%s", err)
+			}
+			switch grantType := r.PostForm.Get("grant_type"); grantType {
+			case "authorization_code":
+				return i.redeemAuthorizationCode(r)
+			case samlBearerGrant:
+				return i.exchangeAssertion(r)
+			default:
+				return nil, newOIDCError("unsupported_grant_type", "grant type %s is not supported", grantType)
+			}
+		}()
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		if err != nil {
+			writeOIDCError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// writeOIDCError returns an OAuth error response. Other errors are logged and hidden from the client.
+func writeOIDCError(w http.ResponseWriter, r *http.Request, err error) {
+	oerr, ok := err.(*oidcError)
+	if !ok {
+		log.Error(err)
+		oerr = newOIDCError("server_error", "the request could not be processed")
+	} else {
+		log.Infof("denied token request: %s", oerr)
+	}
+	status := http.StatusBadRequest
+	switch oerr.code {
+	case "invalid_client":
+		status = http.StatusUnauthorized
+		if _, _, basic := r.BasicAuth(); basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lite-idp"`)
+		}
+	case "server_error":
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]string{
+		"error":             oerr.code,
+		"error_description": oerr.description,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+// authenticateClient identifies the client with HTTP basic authentication or the client_id and client_secret
+// parameters. Public clients only send their client ID.
+func (i *IDP) authenticateClient(r *http.Request) (*OIDCClient, error) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// The credentials are form encoded before they're put in the header
+		var err error
+		if id, err = url.QueryUnescape(id); err != nil {
+			return nil, newOIDCError("invalid_client", "malformed client ID")
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, newOIDCError("invalid_client", "malformed client secret")
+		}
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, ok := i.oidcClients[id]
+	if !ok {
+		return nil, newOIDCError("invalid_client", "unknown client %s", id)
+	}
+	if client.ClientSecret == "" {
+		if secret != "" {
+			return nil, newOIDCError("invalid_client", "%s is a public client", id)
+		}
+		return client, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(client.ClientSecret), []byte(secret)) != nil {
+		return nil, newOIDCError("invalid_client", "invalid secret for %s", id)
+	}
+	return client, nil
+}
+
+// redeemAuthorizationCode exchanges a code for tokens. Codes can only be used once.
+func (i *IDP) redeemAuthorizationCode(r *http.Request) (interface{}, error) {
+	client, err := i.authenticateClient(r)
+	if err != nil {
+		return nil, err
+	}
+	code := r.PostForm.Get("code")
+	data, err := i.TempCache.Take(oidcCodeKey(code))
+	if err != nil {
+		return nil, newOIDCError("invalid_grant", "authorization code is not valid")
+	}
+	grant := &oidcGrant{}
+	if err = json.Unmarshal(data, grant); err != nil {
+		return nil, err
+	}
+	if grant.ClientID != client.ClientID {
+		return nil, newOIDCError("invalid_grant", "authorization code was issued to another client")
+	}
+	if grant.RedirectURI != r.PostForm.Get("redirect_uri") {
+		return nil, newOIDCError("invalid_grant", "redirect_uri does not match the authorization request")
+	}
+	if grant.CodeChallenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+		if subtle.ConstantTimeCompare([]byte(challenge), []byte(grant.CodeChallenge)) != 1 {
+			return nil, newOIDCError("invalid_grant", "code_verifier does not match the code challenge")
+		}
+	}
+	user := &model.User{}
+	if err = proto.Unmarshal(grant.User, user); err != nil {
+		return nil, err
+	}
+	return i.issueTokens(client, &grant.oidcAuthorization, user)
+}
+
+// tokenResponse is returned by the token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// tokenSigner returns a signer for the active signing key
+func (i *IDP) tokenSigner() (*jwt.Signer, error) {
+	return jwt.NewSigner(i.keystore.activeKey(time.Now()).certificate)
+}
+
+// publicKeys returns the public keys of the signing keystore, which tokens and assertions issued by the IdP may be
+// signed with
+func (i *IDP) publicKeys() []crypto.PublicKey {
+	keys := make([]crypto.PublicKey, 0, len(i.keystore.keys))
+	for _, key := range i.keystore.keys {
+		if signer, ok := key.certificate.PrivateKey.(crypto.Signer); ok {
+			keys = append(keys, signer.Public())
+		}
+	}
+	return keys
+}
+
+// oidcSubject returns the subject identifier of the user for the client
+func (i *IDP) oidcSubject(user *model.User, client *OIDCClient) (string, error) {
+	if !client.PairwiseSubject {
+		return user.Name, nil
+	}
+	link, err := i.persistentLink(user, client.ClientID)
+	if err != nil {
+		return "", err
+	}
+	return link.Value, nil
+}
+
+// issueTokens returns a signed ID token along with an access token for the userinfo endpoint
+func (i *IDP) issueTokens(client *OIDCClient, authz *oidcAuthorization, user *model.User) (*tokenResponse, error) {
+	signer, err := i.tokenSigner()
+	if err != nil {
+		return nil, err
+	}
+	subject, err := i.oidcSubject(user, client)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	lifetime := viper.GetDuration("oidc-token-lifetime")
+	access := accessTokenClaims{
+		Claims: jwt.Claims{
+			Issuer:   i.oidcIssuer,
+			Subject:  subject,
+			Audience: jwt.Audience{i.oidcUserInfoLocation},
+			Expires:  now.Add(lifetime).Unix(),
+			IssuedAt: now.Unix(),
+			ID:       uuid.New().String(),
+		},
+		ClientID: client.ClientID,
+		Scope:    authz.Scope,
+	}
+	// The userinfo endpoint answers with the attributes the user had when the token was issued
+	data, err := proto.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	if err = i.UserCache.Set(oidcAccessKey(access.ID), data); err != nil {
+		return nil, err
+	}
+	accessToken, err := signer.Sign(accessTokenType, access)
+	if err != nil {
+		return nil, err
+	}
+	// Attributes can't replace the registered claims
+	claims := client.releasedClaims(user.Attributes, i.oidcClaims, authz.Scope)
+	claims["iss"] = i.oidcIssuer
+	claims["sub"] = subject
+	claims["aud"] = client.ClientID
+	claims["exp"] = access.Expires
+	claims["iat"] = access.IssuedAt
+	claims["acr"] = user.Context
+	if authz.Nonce != "" {
+		claims["nonce"] = authz.Nonce
+	}
+	// at_hash is the left half of the access token's hash
+	hash := sha256.Sum256([]byte(accessToken))
+	claims["at_hash"] = base64.RawURLEncoding.EncodeToString(hash[:len(hash)/2])
+	idToken, err := signer.Sign(idTokenType, claims)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("issued tokens for %s to %s", user.Name, client.ClientID)
+	return &tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(lifetime / time.Second),
+		Scope:       authz.Scope,
+		IDToken:     idToken,
+	}, nil
+}
+
+// DefaultOIDCUserInfoHandler is the default implementation for the OpenID Connect userinfo handler. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultOIDCUserInfoHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := i.userInfo(r)
+		if err != nil {
+			log.Infof("denied userinfo request: %s", err)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`,
+				err.Error()))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, claims)
+	}
+}
+
+// userInfo returns the claims about the user the request's access token was issued for
+func (i *IDP) userInfo(r *http.Request) (map[string]interface{}, error) {
+	token := ""
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		token = auth[7:]
+	} else if r.Method == http.MethodPost {
+		token = r.PostFormValue("access_token")
+	}
+	if token == "" {
+		return nil, errors.New("request does not contain an access token")
+	}
+	access := &accessTokenClaims{}
+	header, err := jwt.Verify(token, access, i.publicKeys()...)
+	if err != nil {
+		return nil, err
+	}
+	if header.Type != accessTokenType {
+		return nil, errors.New("token is not an access token")
+	}
+	if err = access.Validate(i.oidcIssuer, i.oidcUserInfoLocation, time.Now(), 0); err != nil {
+		return nil, err
+	}
+	client, ok := i.oidcClients[access.ClientID]
+	if !ok {
+		return nil, fmt.Errorf("client %s is no longer registered", access.ClientID)
+	}
+	data, err := i.UserCache.Get(oidcAccessKey(access.ID))
+	if err != nil {
+		return nil, errors.New("access token has been revoked")
+	}
+	user := &model.User{}
+	if err = proto.Unmarshal(data, user); err != nil {
+		return nil, err
+	}
+	claims := client.releasedClaims(user.Attributes, i.oidcClaims, access.Scope)
+	claims["sub"] = access.Subject
+	return claims, nil
+}
@@ -0,0 +1,257 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/jwt"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_oidcCodeFlow(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	i.oidcClients["public"] = &OIDCClient{
+		ClientID:     "public",
+		RedirectURIs: []string{"https://app.example.com/callback"},
+	}
+	i.oidcClients["confidential"] = &OIDCClient{
+		ClientID: "confidential",
+		// password
+		ClientSecret:    "$2a$10$FNvHN.0e5LcLUonmGX0CIOAAEKYYSrlZkyibHgq3sLo0SizPtRhEG",
+		RedirectURIs:    []string{"https://other.example.com/callback?app=1"},
+		PairwiseSubject: true,
+	}
+	i.oidcClaims = []ClaimMapping{
+		{Claim: "email", Attribute: "mail", Scope: "email"},
+		{Claim: "groups", Attribute: "memberOf"},
+	}
+
+	// Log the user in
+	user := &model.User{Name: "joe", Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+		Attributes: []*model.Attribute{
+			{Name: "mail", Value: []string{"joe@example.com"}},
+			{Name: "memberOf", Value: []string{"a", "b"}},
+			{Name: "secret", Value: []string{"hidden"}},
+		}}
+	data, err := proto.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.UserCache.Set("session", data)
+
+	authorize := func(params url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/oidc/authorize?"+params.Encode(), nil)
+		r.AddCookie(&http.Cookie{Name: i.cookieName, Value: "session"})
+		w := httptest.NewRecorder()
+		i.DefaultOIDCAuthorizationHandler()(w, r)
+		return w
+	}
+	redirected := func(w *httptest.ResponseRecorder) url.Values {
+		if w.Code != http.StatusFound {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return location.Query()
+	}
+	token := func(params url.Values, username, password string) (int, map[string]interface{}) {
+		r := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(params.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		i.DefaultOIDCTokenHandler()(w, r)
+		response := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, response
+	}
+
+	// Errors about the client or redirect URI aren't sent to the redirect URI
+	params := url.Values{
+		"client_id":     {"public"},
+		"redirect_uri":  {"https://evil.example.com/callback"},
+		"response_type": {"code"},
+		"scope":         {"openid email"},
+	}
+	assert.Equal(t, http.StatusBadRequest, authorize(params).Code)
+
+	// Public clients must use PKCE
+	params.Set("redirect_uri", "https://app.example.com/callback")
+	params.Set("state", "xyz")
+	query := redirected(authorize(params))
+	assert.Equal(t, "invalid_request", query.Get("error"))
+	assert.Equal(t, "xyz", query.Get("state"))
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	params.Set("code_challenge_method", "S256")
+	params.Set("nonce", "n-0S6_WzA2Mj")
+	query = redirected(authorize(params))
+	assert.Equal(t, "xyz", query.Get("state"))
+	code := query.Get("code")
+	if !assert.NotEmpty(t, code) {
+		t.FailNow()
+	}
+
+	// The verifier must match the challenge
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"client_id":     {"public"},
+		"code_verifier": {"wrong"},
+	}
+	status, response := token(exchange, "", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", response["error"])
+
+	// Codes can only be used once, even after a failed attempt
+	query = redirected(authorize(params))
+	exchange.Set("code", query.Get("code"))
+	exchange.Set("code_verifier", verifier)
+	status, response = token(exchange, "", "")
+	if !assert.Equal(t, http.StatusOK, status, response) {
+		t.FailNow()
+	}
+	status, _ = token(exchange, "", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	var idToken struct {
+		jwt.Claims
+		Nonce  string   `json:"nonce"`
+		Email  string   `json:"email"`
+		Groups []string `json:"groups"`
+		Secret string   `json:"secret"`
+	}
+	header, err := jwt.Verify(response["id_token"].(string), &idToken, i.publicKeys()...)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "JWT", header.Type)
+		assert.NoError(t, idToken.Validate(i.oidcIssuer, "public", time.Now(), 0))
+		assert.Equal(t, "joe", idToken.Subject)
+		assert.Equal(t, "n-0S6_WzA2Mj", idToken.Nonce)
+		assert.Equal(t, "joe@example.com", idToken.Email)
+		assert.Equal(t, []string{"a", "b"}, idToken.Groups)
+		assert.Empty(t, idToken.Secret, "unmapped attributes aren't released")
+	}
+
+	// The access token gets the same claims from the userinfo endpoint
+	r := httptest.NewRequest(http.MethodGet, "/oidc/userinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+response["access_token"].(string))
+	w := httptest.NewRecorder()
+	i.DefaultOIDCUserInfoHandler()(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	info := map[string]interface{}{}
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info)) {
+		assert.Equal(t, "joe", info["sub"])
+		assert.Equal(t, "joe@example.com", info["email"])
+	}
+	r.Header.Set("Authorization", "Bearer "+response["id_token"].(string))
+	w = httptest.NewRecorder()
+	i.DefaultOIDCUserInfoHandler()(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "ID tokens aren't access tokens")
+
+	// Confidential clients authenticate with their secret and can get pairwise subjects
+	params = url.Values{
+		"client_id":     {"confidential"},
+		"redirect_uri":  {"https://other.example.com/callback?app=1"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}
+	query = redirected(authorize(params))
+	assert.Equal(t, "1", query.Get("app"))
+	exchange = url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {query.Get("code")},
+		"redirect_uri": {"https://other.example.com/callback?app=1"},
+	}
+	status, response = token(exchange, "confidential", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "invalid_client", response["error"])
+	query = redirected(authorize(params))
+	exchange.Set("code", query.Get("code"))
+	status, response = token(exchange, "confidential", "password")
+	if assert.Equal(t, http.StatusOK, status, response) {
+		idToken.Email = ""
+		if _, err := jwt.Verify(response["id_token"].(string), &idToken, i.publicKeys()...); assert.NoError(t, err) {
+			assert.NotEqual(t, "joe", idToken.Subject)
+			assert.Empty(t, idToken.Email, "email requires the email scope")
+			link, err := i.persistentLink(user, "confidential")
+			if assert.NoError(t, err) {
+				assert.Equal(t, link.Value, idToken.Subject)
+			}
+		}
+	}
+
+	// Users without a session have to log in unless the client asks not to prompt
+	r = httptest.NewRequest(http.MethodGet, "/oidc/authorize?"+params.Encode(), nil)
+	w = httptest.NewRecorder()
+	i.DefaultOIDCAuthorizationHandler()(w, r)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Location"), "/ui/login.html?requestId="))
+	params.Set("prompt", "none")
+	r = httptest.NewRequest(http.MethodGet, "/oidc/authorize?"+params.Encode(), nil)
+	w = httptest.NewRecorder()
+	i.DefaultOIDCAuthorizationHandler()(w, r)
+	assert.Equal(t, "login_required", redirected(w).Get("error"))
+}
+
+func TestIDP_oidcDiscovery(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	res, err := ts.Client().Get(ts.URL + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	doc := discoveryDocument{}
+	if err = json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, i.oidcIssuer, doc.Issuer)
+	assert.Equal(t, []string{"RS256"}, doc.IDTokenSigningAlgValuesSupported)
+
+	res, err = ts.Client().Get(ts.URL + "/oidc/jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	set := jwt.JWKSet{}
+	if err = json.NewDecoder(res.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, set.Keys, 1) {
+		assert.Equal(t, jwt.KeyID(i.TLSConfig.Certificates[0].Certificate[0]), set.Keys[0].KeyID)
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amdonov/lite-idp/jwt"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// UpstreamOIDCProvider is an OpenID Connect provider users can log in with. lite-idp is a relying party to it and uses
+// the authorization code flow with PKCE.
+type UpstreamOIDCProvider struct {
+	// Name of the provider used in URLs
+	Name string
+	// Name shown to users on the discovery page
+	DisplayName string
+	// Issuer identifier of the provider. Its endpoints are read from the issuer's discovery document.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes requested in addition to openid
+	Scopes []string
+	// Claim holding the user's name. Users are named by their sub claim qualified with the issuer when empty, so they
+	// can't be confused with local users or those of other providers.
+	NameClaim string
+	// Scopes the provider may name users in, such as contractor.example.com. Names from the NameClaim in a listed
+	// scope, such as jane@contractor.example.com, are used as they are. Other names are qualified with the issuer.
+	NameScopes []string
+	// Claims to keep as attributes. All claims other than those used by the protocol are kept when empty.
+	Attributes []AttributeMapping
+	// Local authentication context classes of the provider's acr values. Users have no authentication context when
+	// their acr isn't listed.
+	AuthnContexts []ContextMapping
+}
+
+// protocolClaims are ID token claims that describe the token rather than the user
+var protocolClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true, "nonce": true,
+	"acr": true, "amr": true, "azp": true, "auth_time": true, "at_hash": true, "c_hash": true, "sid": true,
+}
+
+// oidcLogin is saved while the user is away at the provider
+type oidcLogin struct {
+	// State passed to the AuthenticationCallback
+	State        []byte
+	CodeVerifier string
+	Nonce        string
+	// Value of the cookie that ties the login to the browser that started it
+	Browser string
+}
+
+// idTokenClaims are the claims of an upstream ID token checked before the user is trusted
+type idTokenClaims struct {
+	jwt.Claims
+	AuthorizedParty string `json:"azp"`
+	Nonce           string `json:"nonce"`
+	ACR             string `json:"acr"`
+}
+
+type oidcSource struct {
+	provider    UpstreamOIDCProvider
+	redirectURI string
+	client      *http.Client
+	cache       store.Cache
+	// The discovery document is read the first time it's needed
+	mutex     sync.Mutex
+	discovery *discoveryDocument
+}
+
+// NewOIDCAuthenticationSource returns a source logging users in with the OpenID Connect provider. The base URL is
+// where the source's handler is served. The client is used to talk to the provider, and the cache keeps track of
+// users while they're away.
+func NewOIDCAuthenticationSource(provider UpstreamOIDCProvider, baseURL string, client *http.Client,
+	cache store.Cache) (AuthenticationSource, error) {
+	if provider.Name == "" {
+		return nil, errors.New("upstream OpenID Connect provider does not specify a name")
+	}
+	if provider.Issuer == "" || provider.ClientID == "" {
+		return nil, fmt.Errorf("upstream OpenID Connect provider %s requires an issuer and client ID", provider.Name)
+	}
+	if provider.DisplayName == "" {
+		provider.DisplayName = provider.Name
+	}
+	return &oidcSource{
+		provider:    provider,
+		redirectURI: strings.TrimSuffix(baseURL, "/") + "/callback",
+		client:      client,
+		cache:       cache,
+	}, nil
+}
+
+func (s *oidcSource) Name() string {
+	return s.provider.Name
+}
+
+func (s *oidcSource) DisplayName() string {
+	return s.provider.DisplayName
+}
+
+func upstreamOIDCKey(state string) string {
+	return "oidc-login:" + state
+}
+
+// cookieName is the cookie that ties logins to the browser that started them
+func (s *oidcSource) cookieName() string {
+	return "lite-idp-oidc-" + s.provider.Name
+}
+
+func (s *oidcSource) Login(w http.ResponseWriter, r *http.Request, state []byte) error {
+	discovery, err := s.discover()
+	if err != nil {
+		return err
+	}
+	login := oidcLogin{State: state}
+	if login.CodeVerifier, err = randomToken(); err != nil {
+		return err
+	}
+	if login.Nonce, err = randomToken(); err != nil {
+		return err
+	}
+	if login.Browser, err = randomToken(); err != nil {
+		return err
+	}
+	id, err := randomToken()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+	if err = s.cache.Set(upstreamOIDCKey(id), data); err != nil {
+		return err
+	}
+	// Otherwise anyone could send a user a callback URL that logs them in as someone else
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookieName(),
+		Path:     "/",
+		Value:    login.Browser,
+		MaxAge:   int(viper.GetDuration("temp-cache-duration").Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(login.CodeVerifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {s.provider.ClientID},
+		"redirect_uri":          {s.redirectURI},
+		"scope":                 {strings.Join(append([]string{"openid"}, s.provider.Scopes...), " ")},
+		"state":                 {id},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, addQuery(discovery.AuthorizationEndpoint, params), http.StatusFound)
+	return nil
+}
+
+// Handler serves the redirect URI at /callback
+func (s *oidcSource) Handler(done AuthenticationCallback) (http.Handler, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		state, user, err := s.callback(r)
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.cookieName(),
+			Path:     "/",
+			MaxAge:   -1,
+			Secure:   true,
+			HttpOnly: true,
+		})
+		if err != nil {
+			log.Infof("login with %s failed: %s", s.provider.Issuer, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		done(w, r, state, user)
+	})
+	return mux, nil
+}
+
+// callback redeems the authorization code sent to the redirect URI and returns the user identified by the ID token
+func (s *oidcSource) callback(r *http.Request) ([]byte, *model.User, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, err
+	}
+	// Logins can only be finished once
+	key := upstreamOIDCKey(r.Form.Get("state"))
+	data, err := s.cache.Take(key)
+	if err != nil {
+		return nil, nil, errors.New("login has expired")
+	}
+	login := &oidcLogin{}
+	if err = json.Unmarshal(data, login); err != nil {
+		return nil, nil, err
+	}
+	cookie, err := r.Cookie(s.cookieName())
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(login.Browser)) != 1 {
+		return nil, nil, errors.New("login was started by another browser")
+	}
+	if code := r.Form.Get("error"); code != "" {
+		return nil, nil, fmt.Errorf("provider returned %s: %s", code, r.Form.Get("error_description"))
+	}
+	code := r.Form.Get("code")
+	if code == "" {
+		return nil, nil, errors.New("provider did not return an authorization code")
+	}
+	idToken, err := s.redeem(code, login.CodeVerifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := s.user(idToken, login.Nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return login.State, user, nil
+}
+
+// redeem exchanges the code for tokens and returns the ID token
+func (s *oidcSource) redeem(code, verifier string) (string, error) {
+	discovery, err := s.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.redirectURI},
+		"code_verifier": {verifier},
+	}
+	if s.provider.ClientSecret == "" {
+		form.Set("client_id", s.provider.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if s.provider.ClientSecret != "" {
+		// Credentials are form encoded before they're used for basic authentication
+		req.SetBasicAuth(url.QueryEscape(s.provider.ClientID), url.QueryEscape(s.provider.ClientSecret))
+	}
+	tokens := &tokenResponse{}
+	if err = s.getJSON(req, tokens); err != nil {
+		return "", fmt.Errorf("failed to redeem authorization code: %s", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("provider did not return an ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// user verifies the ID token and translates its claims into a local user
+func (s *oidcSource) user(idToken, nonce string) (*model.User, error) {
+	keys, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+	var payload json.RawMessage
+	if _, err = jwt.Verify(idToken, &payload, keys...); err != nil {
+		return nil, err
+	}
+	claims := &idTokenClaims{}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+	if err = claims.Validate(s.provider.Issuer, s.provider.ClientID, time.Now(),
+		viper.GetDuration("clock-skew")); err != nil {
+		return nil, err
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != s.provider.ClientID {
+		return nil, errors.New("token was authorized for another client")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("token nonce does not match the authorization request")
+	}
+	all := map[string]interface{}{}
+	if err = json.Unmarshal(payload, &all); err != nil {
+		return nil, err
+	}
+	name, err := s.userName(all)
+	if err != nil {
+		return nil, err
+	}
+	user := &model.User{Name: name, Format: nameIDUnspecified, Context: s.context(claims.ACR)}
+	// Attributes are added in a predictable order
+	claimNames := make([]string, 0, len(all))
+	for claim := range all {
+		claimNames = append(claimNames, claim)
+	}
+	sort.Strings(claimNames)
+	for _, claim := range claimNames {
+		attribute, ok := s.attributeName(claim)
+		if !ok {
+			continue
+		}
+		if values := claimStrings(all[claim]); len(values) > 0 {
+			user.AppendAttributes([]*model.Attribute{{Name: attribute, Value: values}})
+		}
+	}
+	return user, nil
+}
+
+// userName returns the local name of the user the claims describe
+func (s *oidcSource) userName(claims map[string]interface{}) (string, error) {
+	claim := s.provider.NameClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	name := claimStrings(claims[claim])
+	if len(name) != 1 || name[0] == "" {
+		return "", fmt.Errorf("token does not contain a %s claim", claim)
+	}
+	if s.provider.NameClaim == "" {
+		return fmt.Sprintf("%s@%s", name[0], s.provider.Issuer), nil
+	}
+	return scopedName(name[0], s.provider.Issuer, s.provider.NameScopes), nil
+}
+
+// context returns the local authentication context class of an acr value
+func (s *oidcSource) context(acr string) string {
+	return upstreamContext(s.provider.AuthnContexts, acr)
+}
+
+// attributeName returns the attribute a claim is kept as and whether it's kept
+func (s *oidcSource) attributeName(claim string) (string, bool) {
+	if len(s.provider.Attributes) == 0 {
+		return claim, !protocolClaims[claim]
+	}
+	for _, mapping := range s.provider.Attributes {
+		if mapping.Upstream == claim {
+			if mapping.Attribute == "" {
+				return claim, true
+			}
+			return mapping.Attribute, true
+		}
+	}
+	return "", false
+}
+
+// claimStrings returns the values of a string, number, or boolean claim or an array of them. Other claims don't
+// have values.
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if _, nested := item.([]interface{}); !nested {
+				values = append(values, claimStrings(item)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// discover returns the provider's discovery document
+func (s *oidcSource) discover() (*discoveryDocument, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.discovery != nil {
+		return s.discovery, nil
+	}
+	req, err := http.NewRequest(http.MethodGet,
+		strings.TrimSuffix(s.provider.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	discovery := &discoveryDocument{}
+	if err = s.getJSON(req, discovery); err != nil {
+		return nil, fmt.Errorf("failed to read discovery document for %s: %s", s.provider.Issuer, err)
+	}
+	if discovery.Issuer != s.provider.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %s instead of %s", discovery.Issuer,
+			s.provider.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document for %s is missing endpoints", s.provider.Issuer)
+	}
+	s.discovery = discovery
+	return discovery, nil
+}
+
+// keys returns the provider's signing keys. They're read for every login to pick up new keys.
+func (s *oidcSource) keys() ([]crypto.PublicKey, error) {
+	discovery, err := s.discover()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	set := &jwt.JWKSet{}
+	if err = s.getJSON(req, set); err != nil {
+		return nil, fmt.Errorf("failed to read keys for %s: %s", s.provider.Issuer, err)
+	}
+	var keys []crypto.PublicKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Warnf("ignoring key from %s: %s", s.provider.Issuer, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// getJSON sends the request and decodes the JSON response
+func (s *oidcSource) getJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s: %s", req.URL, resp.Status, body)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,272 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubOIDCProvider is a provider that issues ID tokens to a client for whatever claims the test chooses
+type stubOIDCProvider struct {
+	*httptest.Server
+	signer *jwt.Signer
+	jwk    jwt.JWK
+	// Authorization requests by code
+	authorizations map[string]url.Values
+	claims         map[string]interface{}
+}
+
+func newStubOIDCProvider(t *testing.T) *stubOIDCProvider {
+	cert, err := tls.LoadX509KeyPair(filepath.Join("testdata", "certificate.pem"), filepath.Join("testdata", "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jwt.NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &stubOIDCProvider{signer: signer, authorizations: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, discoveryDocument{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jwt.JWKSet{Keys: []jwt.JWK{p.jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		authz, ok := p.authorizations[r.PostFormValue("code")]
+		delete(p.authorizations, r.PostFormValue("code"))
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if id != "lite-idp" || secret != "s3cret" || !ok ||
+			authz.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) ||
+			authz.Get("redirect_uri") != r.PostFormValue("redirect_uri") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":   p.URL,
+			"aud":   id,
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": authz.Get("nonce"),
+		}
+		for claim, value := range p.claims {
+			claims[claim] = value
+		}
+		token, err := p.signer.Sign(idTokenType, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeJSON(w, http.StatusOK, tokenResponse{AccessToken: "access", TokenType: "Bearer", IDToken: token})
+	})
+	p.Server = httptest.NewTLSServer(mux)
+	if p.jwk, err = jwt.NewJWK(cert.Leaf); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// authorize approves the authorization request and returns the redirect URI with the code
+func (p *stubOIDCProvider) authorize(t *testing.T, location string) string {
+	authorization, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, p.URL+"/authorize", authorization.Scheme+"://"+authorization.Host+authorization.Path)
+	params := authorization.Query()
+	assert.Equal(t, "code", params.Get("response_type"))
+	assert.Equal(t, "S256", params.Get("code_challenge_method"))
+	assert.Equal(t, "openid email", params.Get("scope"))
+	code := "code-" + params.Get("state")
+	p.authorizations[code] = params
+	return addQuery(params.Get("redirect_uri"), url.Values{"code": {code}, "state": {params.Get("state")}})
+}
+
+func TestIDP_oidcUpstreamLogin(t *testing.T) {
+	provider := newStubOIDCProvider(t)
+	defer provider.Close()
+	source, err := NewOIDCAuthenticationSource(UpstreamOIDCProvider{
+		Name:         "contractor",
+		Issuer:       provider.URL,
+		ClientID:     "lite-idp",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"email"},
+		NameClaim:    "preferred_username",
+		Attributes:   []AttributeMapping{{Upstream: "email", Attribute: "mail"}, {Upstream: "groups"}},
+	}, "https://localhost/upstream/contractor", provider.Client(), sharedTestCache(t, &testTempCache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &IDP{AuthenticationSources: []AuthenticationSource{source}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	service := &CASService{ServicePattern: `https://portal\.example\.com/.*`}
+	if err := service.compilePattern(); err != nil {
+		t.Fatal(err)
+	}
+	i.casServices = []*CASService{service}
+	// The browser keeps the cookies tying it to its logins until they're removed. Sessions aren't kept, so every
+	// login goes to the provider.
+	cookies := map[string]*http.Cookie{}
+	get := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		ts.Config.Handler.ServeHTTP(w, r)
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == i.cookieName {
+				continue
+			}
+			if cookie.MaxAge < 0 {
+				delete(cookies, cookie.Name)
+			} else {
+				cookies[cookie.Name] = cookie
+			}
+		}
+		return w
+	}
+	serviceURL := "https://portal.example.com/app"
+	login := func() string {
+		w := get("/cas/login?" + url.Values{"service": {serviceURL}}.Encode())
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = get("/discovery?" + url.Values{"requestId": {location.Query().Get("requestId")},
+			"source": {"contractor"}}.Encode())
+		if !assert.Equal(t, http.StatusFound, w.Code, w.Body.String()) {
+			t.FailNow()
+		}
+		return provider.authorize(t, w.Header().Get("Location"))
+	}
+
+	provider.claims = map[string]interface{}{
+		"sub":                "248289761001",
+		"preferred_username": "jane",
+		"email":              "jane@contractor.example.com",
+		"groups":             []interface{}{"a", "b"},
+		"acr":                "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+	}
+	callback := login()
+	w := get(callback)
+	if !assert.Equal(t, http.StatusFound, w.Code, w.Body.String()) {
+		t.FailNow()
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "portal.example.com", location.Host)
+	w = get("/cas/p3/serviceValidate?" + url.Values{"service": {serviceURL},
+		"ticket": {location.Query().Get("ticket")}}.Encode())
+	assert.Contains(t, w.Body.String(), "<cas:user>jane@"+provider.URL+"</cas:user>")
+	assert.Contains(t, w.Body.String(), "<cas:mail>jane@contractor.example.com</cas:mail><cas:groups>a</cas:groups><cas:groups>b</cas:groups>")
+	assert.NotContains(t, w.Body.String(), "248289761001")
+
+	// Logins can't be finished twice
+	assert.Equal(t, http.StatusForbidden, get(callback).Code)
+
+	// Logins can't be finished by another browser, such as a victim sent the callback URL of an attacker's login
+	callback = login()
+	delete(cookies, "lite-idp-oidc-contractor")
+	w = get(callback)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "another browser")
+
+	// Tokens must contain the user's name
+	delete(provider.claims, "preferred_username")
+	assert.Equal(t, http.StatusForbidden, get(login()).Code)
+
+	// Tokens from other issuers are rejected
+	provider.claims["preferred_username"] = "jane"
+	provider.claims["iss"] = "https://evil.example.com"
+	assert.Equal(t, http.StatusForbidden, get(login()).Code)
+
+	// Nonces must match
+	provider.claims["iss"] = provider.URL
+	provider.claims["nonce"] = "replayed"
+	assert.Equal(t, http.StatusForbidden, get(login()).Code)
+
+	// Errors from the provider end the login
+	delete(provider.claims, "nonce")
+	target, err := url.Parse(login())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = get(target.Path + "?" + url.Values{"state": {target.Query().Get("state")}, "error": {"access_denied"}}.Encode())
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "access_denied")
+}
+
+func Test_oidcSource_userNameAndContext(t *testing.T) {
+	source := &oidcSource{provider: UpstreamOIDCProvider{
+		Issuer: "https://login.contractor.example.com",
+		AuthnContexts: []ContextMapping{{Upstream: "mfa",
+			Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:TimeSyncToken"}},
+	}}
+	claims := map[string]interface{}{"sub": "248289761001", "preferred_username": "jane",
+		"email": "jane@contractor.example.com"}
+	name, err := source.userName(claims)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "248289761001@https://login.contractor.example.com", name)
+	}
+	source.provider.NameClaim = "preferred_username"
+	name, err = source.userName(claims)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "jane@https://login.contractor.example.com", name, "unscoped names weren't qualified")
+	}
+	source.provider.NameClaim = "email"
+	name, err = source.userName(claims)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "jane@contractor.example.com@https://login.contractor.example.com", name)
+	}
+	source.provider.NameScopes = []string{"contractor.example.com"}
+	name, err = source.userName(claims)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "jane@contractor.example.com", name)
+	}
+	source.provider.NameClaim = "upn"
+	_, err = source.userName(claims)
+	assert.Error(t, err)
+
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:ac:classes:TimeSyncToken", source.context("mfa"))
+	assert.Empty(t, source.context("urn:oasis:names:tc:SAML:2.0:ac:classes:X509"), "unmapped acr values were trusted")
+}
+
+func Test_claimStrings(t *testing.T) {
+	assert.Equal(t, []string{"a"}, claimStrings("a"))
+	assert.Equal(t, []string{"42"}, claimStrings(float64(42)))
+	assert.Equal(t, []string{"true"}, claimStrings(true))
+	assert.Equal(t, []string{"a", "1"}, claimStrings([]interface{}{"a", float64(1), []interface{}{"b"}}))
+	assert.Nil(t, claimStrings(map[string]interface{}{"a": "b"}))
+}
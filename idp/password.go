@@ -30,6 +30,9 @@ import (
 // the account doesn't exist or the password is incorrect.
 var ErrInvalidPassword = errors.New("invalid login or password")
 
+// errPasswordLoginDisabled is returned when users must log in with an authentication source instead of a password
+var errPasswordLoginDisabled = errors.New("logging in with a password is not allowed")
+
 // PasswordValidator validates a user's password
 type PasswordValidator interface {
 	Validate(user, password string) error
@@ -92,6 +95,10 @@ func (i *IDP) DefaultPasswordLoginHandler() http.HandlerFunc {
 			if user != nil {
 				return i.respond(req, user, w, r)
 			}
+			if err == errPasswordLoginDisabled {
+				i.Error(w, err.Error(), http.StatusForbidden)
+				return nil
+			}
 			if err == ErrInvalidPassword {
 				http.Redirect(w, r, fmt.Sprintf("/ui/login.html?requestId=%s&error=%s",
 					url.QueryEscape(requestID), url.QueryEscape("Invalid login or password. Please try again.")),
@@ -105,3 +112,12 @@ func (i *IDP) DefaultPasswordLoginHandler() http.HandlerFunc {
 		}
 	}
 }
+
+// validatePassword checks a user's password with the PasswordValidator. Every way of logging in with a password uses
+// it, so passwords are refused everywhere when the discovery page doesn't offer them.
+func (i *IDP) validatePassword(user, password string) error {
+	if len(i.AuthenticationSources) > 0 && !viper.GetBool("discovery-local-login") {
+		return errPasswordLoginDisabled
+	}
+	return i.PasswordValidator.Validate(user, password)
+}
@@ -18,8 +18,10 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strings"
 
@@ -44,6 +46,18 @@ func getCertFromXML(cd *xmlsig.X509Data) (*x509.Certificate, error) {
 	return x509.ParseCertificate(certData)
 }
 
+func loadCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
 func getSubjectDN(subject pkix.Name) string {
 	rdns := []string{}
 	names := subject.Names
@@ -23,17 +23,21 @@ import (
 	"net/http"
 
 	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
 )
 
 func (i *IDP) sendPostResponse(authRequest *model.AuthnRequest, user *model.User,
 	w io.Writer, r *http.Request) error {
 	response := i.makeAuthnResponse(authRequest, user)
 	// Don't need to change the response. Go ahead and sign it
-	signature, err := i.signer.CreateSignature(response.Assertion)
-	if err != nil {
+	sp, _ := i.getServiceProvider(authRequest.Issuer)
+	if err := i.signResponse(response, sp); err != nil {
 		return err
 	}
-	response.Assertion.Signature = signature
+	return i.postResponse(authRequest, response, w)
+}
+
+func (i *IDP) postResponse(authRequest *model.AuthnRequest, response *saml.Response, w io.Writer) error {
 	var xmlbuff bytes.Buffer
 	memWriter := bufio.NewWriter(&xmlbuff)
 	memWriter.Write([]byte(xml.Header))
@@ -2,80 +2,69 @@ package idp
 
 import (
 	"encoding/xml"
+	"io/ioutil"
 	"net/http"
-	"time"
+	"reflect"
 
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
+var attributeQueryName = xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "AttributeQuery"}
+
 // DefaultQueryHandler is the default implementation for the attribute query handler. It can be used as is, wrapped in other handlers, or replaced completely.
 func (i *IDP) DefaultQueryHandler() http.HandlerFunc {
+	return i.soapQueryHandler(func(body []byte, r *http.Request) (string, *saml.Response, error) {
+		env := &saml.AttributeQueryEnv{}
+		if err := xml.Unmarshal(body, env); err != nil {
+			return "", nil, err
+		}
+		response, err := i.answerQuery(string(body), env, r)
+		return env.Body.Query.ID, response, err
+	})
+}
+
+// soapQueryHandler answers back-channel requests sent with the SOAP binding. The answer function returns the ID of
+// the request along with the response. Requests that are denied with a requestError receive an error response.
+func (i *IDP) soapQueryHandler(answer func(body []byte, r *http.Request) (string, *saml.Response, error)) http.HandlerFunc {
+	envelope := func(response *saml.Response) interface{} {
+		return &saml.AttributeRespEnv{
+			Body: saml.AttributeRespBody{
+				Response: *response,
+			},
+		}
+	}
+	return i.soapHandler(func(body []byte, r *http.Request) (string, interface{}, error) {
+		id, response, err := answer(body, r)
+		if err != nil {
+			return id, nil, err
+		}
+		return id, envelope(response), nil
+	}, func(id string, rerr *requestError) interface{} {
+		return envelope(i.makeErrorResponse(&model.AuthnRequest{ID: id}, rerr.status, rerr.message))
+	})
+}
+
+// soapHandler answers SOAP requests with the envelope returned by the answer function. The fail function creates
+// the envelope returned to requests that are denied with a requestError.
+func (i *IDP) soapHandler(answer func(body []byte, r *http.Request) (string, interface{}, error),
+	fail func(id string, rerr *requestError) interface{}) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := func() error {
-			decoder := xml.NewDecoder(r.Body)
-			attributeEnv := &saml.AttributeQueryEnv{}
-			if err := decoder.Decode(&attributeEnv); err != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
 				return err
 			}
-			query := attributeEnv.Body.Query
-			user := &model.User{
-				Name:   query.Subject.NameID.Value,
-				Format: query.Subject.NameID.Format,
-			}
-			if err := i.setUserAttributes(user, nil); err != nil {
+			id, env, err := answer(body, r)
+			if rerr, ok := err.(*requestError); ok {
+				log.Infof("request %s was not answered: %s", id, rerr.message)
+				env = fail(id, rerr)
+			} else if err != nil {
 				return err
 			}
-			response := i.makeResponse(query.ID, query.Issuer, user)
-			env := &saml.AttributeRespEnv{
-				Body: saml.AttributeRespBody{
-					Response: *response,
-				},
-			}
-			now := time.Now().UTC()
-			fiveMinutes, _ := time.ParseDuration("5m")
-			fiveFromNow := now.Add(fiveMinutes)
-			attrResp := &saml.AttributeRespEnv{
-				Body: saml.AttributeRespBody{
-					Response: saml.Response{
-						StatusResponseType: saml.StatusResponseType{
-							Version:      "2.0",
-							ID:           saml.NewID(),
-							IssueInstant: now,
-							Status: &saml.Status{
-								StatusCode: saml.StatusCode{
-									Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
-								},
-							},
-							InResponseTo: query.ID,
-							Issuer:       saml.NewIssuer(i.entityID),
-						},
-						Assertion: &saml.Assertion{
-							Issuer:       saml.NewIssuer(i.entityID),
-							IssueInstant: now,
-							ID:           saml.NewID(),
-							Version:      "2.0",
-							Subject: &saml.Subject{
-								NameID: query.Subject.NameID,
-							},
-							AttributeStatement: user.AttributeStatement(),
-							Conditions: &saml.Conditions{
-								NotBefore:           now,
-								NotOnOrAfter:        fiveFromNow,
-								AudienceRestriction: &saml.AudienceRestriction{Audience: query.Issuer},
-							},
-						},
-					},
-				},
-			}
-			resp := attrResp.Body.Response
-			signature, err := i.signer.CreateSignature(resp.Assertion)
-			// TODO confirm appropriate error response for this service
-			if err != nil {
-				return err
-			}
-			resp.Assertion.Signature = signature
+			w.Header().Set("Content-Type", "text/xml")
 			if _, err = w.Write([]byte(xml.Header)); err != nil {
 				return err
 			}
@@ -91,3 +80,146 @@ func (i *IDP) DefaultQueryHandler() http.HandlerFunc {
 		}
 	}
 }
+
+// answerQuery returns a signed response with the requested attributes the querier is allowed to receive. Queries
+// that can't be answered result in a requestError.
+func (i *IDP) answerQuery(body string, env *saml.AttributeQueryEnv, r *http.Request) (*saml.Response, error) {
+	query := env.Body.Query
+	sp, err := i.authenticateRequester(body, &query.RequestAbstractType, query.Signature != nil,
+		attributeQueryName, r, &query)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("received attribute query from %s", sp.EntityID)
+	user, err := i.resolveNameID(query.Subject.NameID, sp.EntityID)
+	if err == errUnknownPrincipal {
+		return nil, &requestError{status: statusUnknownPrincipal, message: err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Attribute sources see the querier as the issuer of the request
+	if err = i.setUserAttributes(user, &model.AuthnRequest{ID: query.ID, Issuer: sp.EntityID}); err != nil {
+		return nil, err
+	}
+	known, err := i.knownUser(user, query.Subject.NameID)
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		return nil, &requestError{status: statusUnknownPrincipal, message: errUnknownPrincipal.Error()}
+	}
+	atts := requestedAttributes(sp.releasedAttributes(user.Attributes), query.Attribute)
+	if len(atts) == 0 {
+		// Known users without attributes are sent an assertion without an attribute statement
+		atts = nil
+	}
+	// The assertion must be about the subject that was asked for
+	response := i.makeSubjectResponse(query.ID, sp.EntityID, sp, query.Subject.NameID, atts)
+	if err = i.signResponse(response, sp); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// knownUser reports whether the user a query is about exists. Transient and persistent identifiers were issued to
+// users who logged in. Other names must be known to a UserDirectory when any attribute source is one.
+func (i *IDP) knownUser(user *model.User, nameID *saml.NameID) (bool, error) {
+	if nameID.Format == nameIDTransient || nameID.Format == nameIDPersistent {
+		return true, nil
+	}
+	directories := false
+	for _, source := range i.AttributeSources {
+		directory, ok := source.(UserDirectory)
+		if !ok {
+			continue
+		}
+		directories = true
+		known, err := directory.HasUser(user)
+		if err != nil || known {
+			return known, err
+		}
+	}
+	return !directories, nil
+}
+
+// authenticateRequester makes sure a back-channel request came from a registered service provider by verifying its
+// signature or, for unsigned requests, the client certificate it was sent with. The request message, v, embeds
+// request. Signed messages are replaced with the XML covered by the signature to avoid signature wrapping attacks.
+func (i *IDP) authenticateRequester(body string, request *saml.RequestAbstractType, signed bool, name xml.Name,
+	r *http.Request, v interface{}) (*ServiceProvider, error) {
+	issuer := request.Issuer
+	if issuer == "" {
+		return nil, denyRequest("%s does not contain an issuer", name.Local)
+	}
+	sp, ok := i.getServiceProvider(issuer)
+	if !ok {
+		return nil, denyRequest("%s from unregistered issuer %s", name.Local, issuer)
+	}
+	if !signed {
+		if !sp.presentedCertificate(r) {
+			return nil, denyRequest("%s from %s is not signed or sent with its registered certificate", name.Local, issuer)
+		}
+		return sp, nil
+	}
+	ref, err := i.validator.ValidateWithKeys(body, sp.publicKey)
+	if err != nil {
+		return nil, denyRequest("%s signature is not valid: %s", name.Local, err)
+	}
+	// Make sure the signature covers the request in the body rather than some other element
+	if ref.Name != name || ref.ID == "" || ref.ID != request.ID {
+		return nil, denyRequest("signature does not cover the %s", name.Local)
+	}
+	if err = sp.checkSignatureAlgorithms(ref); err != nil {
+		return nil, denyRequest("%s", err)
+	}
+	// Only use what was signed
+	message := reflect.ValueOf(v).Elem()
+	message.Set(reflect.Zero(message.Type()))
+	if err := xml.Unmarshal([]byte(ref.XML), v); err != nil {
+		return nil, err
+	}
+	if request.Issuer != sp.EntityID {
+		return nil, denyRequest("signed %s was issued by another service provider", name.Local)
+	}
+	return sp, nil
+}
+
+// requestedAttributes limits the attributes to those named in a query. Values in the query further limit the
+// values that are returned.
+func requestedAttributes(atts []*model.Attribute, requested []saml.Attribute) []*model.Attribute {
+	if len(requested) == 0 {
+		return atts
+	}
+	nameFormat := viper.GetString("saml-attribute-name-format")
+	var result []*model.Attribute
+	for _, att := range atts {
+		for _, req := range requested {
+			if req.Name != att.Name {
+				continue
+			}
+			if req.NameFormat != "" && req.NameFormat != nameFormat &&
+				req.NameFormat != "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified" {
+				continue
+			}
+			if len(req.AttributeValue) == 0 {
+				result = append(result, att)
+				break
+			}
+			var values []string
+			for _, value := range att.Value {
+				for _, wanted := range req.AttributeValue {
+					if value == wanted.Value {
+						values = append(values, value)
+						break
+					}
+				}
+			}
+			if len(values) > 0 {
+				result = append(result, &model.Attribute{Name: att.Name, Value: values})
+			}
+			break
+		}
+	}
+	return result
+}
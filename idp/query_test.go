@@ -1,10 +1,19 @@
 package idp
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/amdonov/lite-idp/saml"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -24,3 +33,123 @@ func TestIDP_DefaultQueryHandler(t *testing.T) {
 	defer resp.Body.Close()
 	assert.Equal(t, 200, resp.StatusCode)
 }
+
+func TestIDP_answerQuery(t *testing.T) {
+	signer := registerECPServiceProvider(t)
+	defer viper.Set("sps", nil)
+	viper.Set("users", []UserAttributes{
+		{Name: "joe", Attributes: map[string][]string{"mail": {"joe@example.com"}, "role": {"admin", "user"}}},
+		{Name: "ann"},
+	})
+	defer viper.Set("users", nil)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	sp := i.sps["https://sp.example.com/"]
+	der, err := base64.StdEncoding.DecodeString(sp.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(req *http.Request) *saml.Response {
+		w := httptest.NewRecorder()
+		i.DefaultQueryHandler()(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		var env saml.AttributeRespEnv
+		if err := xml.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		return &env.Body.Response
+	}
+	newQuery := func(nameID *saml.NameID, attributes ...saml.Attribute) saml.AttributeQuery {
+		return saml.AttributeQuery{
+			RequestAbstractType: saml.RequestAbstractType{
+				ID:           saml.NewID(),
+				Version:      "2.0",
+				IssueInstant: time.Now().UTC(),
+				Issuer:       "https://sp.example.com/",
+			},
+			Subject:   saml.Subject{NameID: nameID},
+			Attribute: attributes,
+		}
+	}
+	query := func(nameID *saml.NameID, attributes ...saml.Attribute) *saml.Response {
+		q := newQuery(nameID, attributes...)
+		signature, err := signer.CreateSignature(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Signature = signature
+		return send(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(ecpEnvelope(t, "", q))))
+	}
+	joe := &saml.NameID{Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", Value: "joe"}
+	status := func(resp *saml.Response) string {
+		if resp.Status.StatusCode.StatusCode == nil {
+			return resp.Status.StatusCode.Value
+		}
+		return resp.Status.StatusCode.StatusCode.Value
+	}
+
+	resp := query(joe)
+	if assert.NotNil(t, resp.Assertion) {
+		assert.NotNil(t, resp.Assertion.Signature, "expected the returned assertion to be signed")
+		assert.Equal(t, "joe", resp.Assertion.Subject.NameID.Value)
+		assert.Len(t, resp.Assertion.AttributeStatement.Attribute, 2)
+	}
+
+	// Only the requested values are returned
+	resp = query(joe, saml.Attribute{Name: "role", AttributeValue: []saml.AttributeValue{{Value: "admin"}}})
+	if assert.NotNil(t, resp.Assertion) {
+		atts := resp.Assertion.AttributeStatement.Attribute
+		if assert.Len(t, atts, 1) {
+			assert.Equal(t, "role", atts[0].Name)
+			if assert.Len(t, atts[0].AttributeValue, 1) {
+				assert.Equal(t, "admin", atts[0].AttributeValue[0].Value)
+			}
+		}
+	}
+
+	// The release policy applies to requested attributes
+	sp.ReleaseAttributes = []string{"mail"}
+	resp = query(joe, saml.Attribute{Name: "mail"}, saml.Attribute{Name: "role"})
+	if assert.NotNil(t, resp.Assertion) {
+		atts := resp.Assertion.AttributeStatement.Attribute
+		if assert.Len(t, atts, 1) {
+			assert.Equal(t, "mail", atts[0].Name)
+		}
+	}
+	sp.ReleaseAttributes = nil
+
+	resp = query(&saml.NameID{Value: "bob"})
+	assert.Nil(t, resp.Assertion)
+	assert.Equal(t, statusUnknownPrincipal, status(resp))
+
+	// Known users without attributes aren't reported as unknown
+	resp = query(&saml.NameID{Value: "ann"})
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", status(resp))
+	if assert.NotNil(t, resp.Assertion) {
+		assert.Equal(t, "ann", resp.Assertion.Subject.NameID.Value)
+		assert.Nil(t, resp.Assertion.AttributeStatement)
+	}
+
+	// Service providers given opaque identifiers can't query by name
+	sp.NameIDFormat = nameIDTransient
+	resp = query(joe)
+	assert.Nil(t, resp.Assertion)
+	assert.Equal(t, statusUnknownPrincipal, status(resp))
+	sp.NameIDFormat = ""
+
+	// Unsigned queries must be sent with the service provider's certificate
+	body := ecpEnvelope(t, "", newQuery(joe))
+	resp = send(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	assert.Equal(t, statusRequestDenied, status(resp))
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{spCert}}
+	resp = send(req)
+	assert.NotNil(t, resp.Assertion)
+}
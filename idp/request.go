@@ -0,0 +1,99 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+)
+
+const (
+	statusRequester     = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	statusRequestDenied = "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"
+	statusAuthnFailed   = "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"
+	// The subject of a query isn't known
+	statusUnknownPrincipal = "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal"
+	// The request is understood but not supported
+	statusRequestUnsupported = "urn:oasis:names:tc:SAML:2.0:status:RequestUnsupported"
+	// An identifier can't be created in the requested format or for the requested service provider
+	statusInvalidNameIDPolicy = "urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy"
+)
+
+// requestError is an error that is reported to the service provider in a SAML response
+// rather than to the user, because the request came from a known service provider and consumer service
+type requestError struct {
+	// second-level status code
+	status  string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func denyRequest(format string, a ...interface{}) error {
+	return &requestError{
+		status:  statusRequestDenied,
+		message: fmt.Sprintf(format, a...),
+	}
+}
+
+// checkAuthnRequest makes sure the request is fresh, was sent to the endpoint it was received on, and
+// hasn't been seen before. It must only be called once the request's issuer has been authenticated.
+func (i *IDP) checkAuthnRequest(request *saml.AuthnRequest, destination string, requireDestination bool) error {
+	return i.checkRequest(&request.RequestAbstractType, "authnrequest", destination, requireDestination)
+}
+
+// checkRequest applies the checks of checkAuthnRequest to other front-channel requests. Request IDs are remembered
+// separately for each kind of request.
+func (i *IDP) checkRequest(request *saml.RequestAbstractType, kind, destination string, requireDestination bool) error {
+	if request.ID == "" {
+		return denyRequest("request does not contain an ID")
+	}
+	skew := viper.GetDuration("clock-skew")
+	now := time.Now()
+	if request.IssueInstant.After(now.Add(skew)) {
+		return denyRequest("request was issued in the future at %s", request.IssueInstant.Format(time.RFC3339))
+	}
+	if now.After(request.IssueInstant.Add(viper.GetDuration("request-lifetime") + skew)) {
+		return denyRequest("request issued at %s has expired", request.IssueInstant.Format(time.RFC3339))
+	}
+	if request.Destination == "" {
+		if requireDestination {
+			return denyRequest("signed request does not contain a destination")
+		}
+	} else if request.Destination != destination {
+		return denyRequest("request destination %s does not match %s", request.Destination, destination)
+	}
+	// IDs only need to be unique per issuer
+	key := fmt.Sprintf("%s:%s:%s", kind, request.Issuer, request.ID)
+	added, err := i.ReplayCache.Add(key, []byte{1})
+	if err != nil {
+		return err
+	}
+	if !added {
+		return denyRequest("request %s from %s has already been received", request.ID, request.Issuer)
+	}
+	return nil
+}
+
+// ReplayCacheDuration is how long request IDs must be remembered to reject every replay of a request that would
+// otherwise still be accepted
+func ReplayCacheDuration() time.Duration {
+	return viper.GetDuration("request-lifetime") + 2*viper.GetDuration("clock-skew")
+}
@@ -0,0 +1,285 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkAuthnRequest(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+
+	destination := "https://idp.example.com/SAML2/Redirect/SSO"
+	newRequest := func(issued time.Time, destination string) *saml.AuthnRequest {
+		return &saml.AuthnRequest{
+			RequestAbstractType: saml.RequestAbstractType{
+				ID:           saml.NewID(),
+				IssueInstant: issued,
+				Issuer:       "https://sp.example.com/",
+				Destination:  destination,
+			},
+		}
+	}
+	denied := func(err error) bool {
+		_, ok := err.(*requestError)
+		return ok
+	}
+
+	request := newRequest(time.Now(), destination)
+	assert.NoError(t, i.checkAuthnRequest(request, destination, true))
+	assert.True(t, denied(i.checkAuthnRequest(request, destination, true)), "replayed request was accepted")
+
+	// Clocks are allowed to differ a little
+	assert.NoError(t, i.checkAuthnRequest(newRequest(time.Now().Add(time.Minute), destination), destination, true))
+	assert.NoError(t, i.checkAuthnRequest(newRequest(time.Now().Add(-7*time.Minute), destination), destination, true))
+	assert.True(t, denied(i.checkAuthnRequest(newRequest(time.Now().Add(10*time.Minute), destination), destination, true)),
+		"request from the future was accepted")
+	assert.True(t, denied(i.checkAuthnRequest(newRequest(time.Now().Add(-10*time.Minute), destination), destination, true)),
+		"expired request was accepted")
+
+	assert.True(t, denied(i.checkAuthnRequest(newRequest(time.Now(), "https://other.example.com/"), destination, true)),
+		"request for another destination was accepted")
+	assert.True(t, denied(i.checkAuthnRequest(newRequest(time.Now(), ""), destination, true)),
+		"signed request without a destination was accepted")
+	assert.NoError(t, i.checkAuthnRequest(newRequest(time.Now(), ""), destination, false))
+}
+
+func TestIDP_sendErrorResponse(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+
+	rerr := denyRequest("request has expired").(*requestError)
+	request := &model.AuthnRequest{
+		ID:                          "_123",
+		AssertionConsumerServiceURL: "https://sp.example.com/acs",
+		ProtocolBinding:             "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+	}
+	w := httptest.NewRecorder()
+	if err := i.sendErrorResponse(request, rerr, w, httptest.NewRequest("GET", "/test", nil)); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	start := strings.Index(body, `name="SAMLResponse"`)
+	if start < 0 {
+		t.Fatal("post form does not contain a response")
+	}
+	value := body[start:]
+	value = value[strings.Index(value, `value="`)+7:]
+	data, err := base64.StdEncoding.DecodeString(value[:strings.Index(value, `"`)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &saml.Response{}
+	if err = xml.Unmarshal(data, response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "_123", response.InResponseTo)
+	assert.Nil(t, response.Assertion)
+	assert.Equal(t, statusRequester, response.Status.StatusCode.Value)
+	assert.Equal(t, statusRequestDenied, response.Status.StatusCode.StatusCode.Value)
+	assert.Equal(t, "request has expired", response.Status.StatusMessage)
+
+	// Without a binding the user is told instead
+	request.ProtocolBinding = ""
+	assert.Equal(t, rerr, i.sendErrorResponse(request, rerr, httptest.NewRecorder(), nil))
+}
+
+func TestIDP_RedirectSSOReplay(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("sps", []ServiceProvider{
+		{
+			EntityID:    "https://sp.example.com/",
+			Certificate: base64.StdEncoding.EncodeToString(der),
+			AssertionConsumerServices: []AssertionConsumerService{
+				{
+					IsDefault: true,
+					Binding:   "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+					Location:  "https://sp.example.com/acs",
+				},
+			},
+		},
+	})
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	signer, err := sign.NewSigner(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, sign.SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a signed redirect
+	query := encodeRedirectRequest(t, &saml.AuthnRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now().UTC(),
+			Issuer:       "https://sp.example.com/",
+			Destination:  i.singleSignOnServiceLocation,
+		},
+		ProtocolBinding: "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+	}) + "&SigAlg=" + url.QueryEscape(signer.Algorithm())
+	signature, err := signer.Sign([]byte(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := ts.URL + viper.GetString("sso-service-path") + "?" + query + "&Signature=" + url.QueryEscape(signature)
+
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "expected login page from sso")
+
+	// Sending the same request again is denied
+	resp, err = client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "expected error response to the service provider")
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sp.example.com", location.Host)
+	assert.NotEmpty(t, location.Query().Get("SAMLart"))
+}
+
+// encodeRedirectRequest returns the SAMLRequest query parameter for the request
+func encodeRedirectRequest(t *testing.T, request *saml.AuthnRequest) string {
+	data, err := xml.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	deflater, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deflater.Write(data)
+	deflater.Close()
+	return "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(b.Bytes()))
+}
+
+func TestIDP_DefaultPostSSOHandler(t *testing.T) {
+	signer := registerECPServiceProvider(t)
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	newRequest := func(issued time.Time, destination string, signer sign.Signer) string {
+		request := &saml.AuthnRequest{
+			RequestAbstractType: saml.RequestAbstractType{
+				ID:           saml.NewID(),
+				Version:      "2.0",
+				IssueInstant: issued.UTC(),
+				Issuer:       "https://sp.example.com/",
+				Destination:  destination,
+			},
+			AssertionConsumerServiceURL: "https://sp.example.com/acs",
+			ProtocolBinding:             "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+		}
+		if signer != nil {
+			signature, err := signer.CreateSignature(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Signature = signature
+		}
+		data, err := xml.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	post := func(message string) *httptest.ResponseRecorder {
+		form := url.Values{"SAMLRequest": {message}, "RelayState": {"state"}}
+		r := httptest.NewRequest(http.MethodPost, viper.GetString("post-sso-service-path"),
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		ts.Config.Handler.ServeHTTP(w, r)
+		return w
+	}
+	denied := func(w *httptest.ResponseRecorder) bool {
+		body := w.Body.String()
+		start := strings.Index(body, `name="SAMLResponse"`)
+		if start < 0 {
+			return false
+		}
+		value := body[start:]
+		value = value[strings.Index(value, `value="`)+7:]
+		data, err := base64.StdEncoding.DecodeString(value[:strings.Index(value, `"`)])
+		return err == nil && strings.Contains(string(data), statusRequestDenied)
+	}
+
+	message := newRequest(time.Now(), i.postSingleSignOnServiceLocation, signer)
+	w := post(message)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code, "expected login page from sso")
+
+	// Sending the same request again is denied
+	assert.True(t, denied(post(message)), "replayed request")
+	assert.True(t, denied(post(newRequest(time.Now().Add(-time.Hour), i.postSingleSignOnServiceLocation, signer))),
+		"stale request")
+	assert.True(t, denied(post(newRequest(time.Now(), i.singleSignOnServiceLocation, signer))),
+		"request sent to another endpoint")
+	assert.True(t, denied(post(newRequest(time.Now(), "", signer))), "signed request without a destination")
+
+	// Requests must be signed by the service provider's key
+	assert.Equal(t, http.StatusBadRequest, post(newRequest(time.Now(), i.postSingleSignOnServiceLocation, i.signer)).Code)
+	assert.Equal(t, http.StatusBadRequest, post(newRequest(time.Now(), "", nil)).Code,
+		"unsigned requests are rejected by default")
+}
@@ -24,12 +24,21 @@ import (
 
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/xmlsig"
 	"github.com/golang/protobuf/proto"
 	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
 )
 
 func (i *IDP) respond(authRequest *model.AuthnRequest, user *model.User,
 	w http.ResponseWriter, r *http.Request) error {
+	if authRequest.HolderOfKey && len(user.X509Certificate) == 0 {
+		// There's no key to confirm the subject with
+		return i.sendErrorResponse(authRequest, &requestError{
+			status:  statusAuthnFailed,
+			message: "holder-of-key assertions require client certificate authentication",
+		}, w, r)
+	}
 	// Save user information and set session cookie
 	data, err := proto.Marshal(user)
 	if err != nil {
@@ -47,6 +56,28 @@ func (i *IDP) respond(authRequest *model.AuthnRequest, user *model.User,
 		Secure:   true,
 		HttpOnly: true,
 	})
+	if sp, ok := i.accessControl(authRequest); ok {
+		err = sp.CheckAccess(user, getIP(r), time.Now())
+		if denied, ok := err.(*AccessDeniedError); ok {
+			return i.denyAccess(authRequest, user, sp, denied.Reason, w, r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	ask, err := i.needsConsent(authRequest, user)
+	if err != nil {
+		return err
+	}
+	if ask {
+		return i.askConsent(authRequest, user, w, r)
+	}
+	return i.sendResponse(authRequest, user, w, r)
+}
+
+// sendResponse sends the user to the service provider with the binding it asked for
+func (i *IDP) sendResponse(authRequest *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) error {
 	switch authRequest.ProtocolBinding {
 	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact":
 		return i.sendArtifactResponse(authRequest, user, w, r)
@@ -54,17 +85,85 @@ func (i *IDP) respond(authRequest *model.AuthnRequest, user *model.User,
 		return i.sendPostResponse(authRequest, user, w, r)
 	case "urn:oasis:names:tc:SAML:2.0:bindings:PAOS":
 		return i.sendECPResponse(authRequest, user, w, r)
+	case oidcCodeBinding:
+		return i.sendAuthorizationCode(authRequest, user, w, r)
+	case wsfedBinding:
+		return i.sendWSFedResponse(authRequest, user, w, r)
+	case casBinding:
+		return i.sendServiceTicket(authRequest, user, w, r)
 	default:
 		return errors.New("unsupported protocol binding")
 	}
 }
 
+// sendErrorResponse tells the service provider why its request was rejected using the binding it asked for
+func (i *IDP) sendErrorResponse(authRequest *model.AuthnRequest, rerr *requestError,
+	w http.ResponseWriter, r *http.Request) error {
+	switch authRequest.ProtocolBinding {
+	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact":
+		return i.sendArtifact(&model.ArtifactResponse{
+			Request:       authRequest,
+			StatusCode:    rerr.status,
+			StatusMessage: rerr.message,
+		}, w, r)
+	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST", "urn:oasis:names:tc:SAML:2.0:bindings:PAOS":
+		response := i.makeErrorResponse(authRequest, rerr.status, rerr.message)
+		// Service providers that want signed responses get signed errors too
+		sp, _ := i.getServiceProvider(authRequest.Issuer)
+		if err := i.signResponse(response, sp); err != nil {
+			return err
+		}
+		if authRequest.ProtocolBinding == "urn:oasis:names:tc:SAML:2.0:bindings:PAOS" {
+			return i.ecpResponse(authRequest, response, w)
+		}
+		return i.postResponse(authRequest, response, w)
+	case oidcCodeBinding:
+		return i.redirectAuthorizationError(authRequest, rerr, w, r)
+	default:
+		// no way to reach the service provider so let the user know
+		return rerr
+	}
+}
+
+// makeErrorResponse creates a response without an assertion for a request that was denied
+func (i *IDP) makeErrorResponse(request *model.AuthnRequest, status, message string) *saml.Response {
+	return &saml.Response{
+		StatusResponseType: saml.StatusResponseType{
+			Version:      "2.0",
+			ID:           saml.NewID(),
+			IssueInstant: time.Now().UTC(),
+			Destination:  request.AssertionConsumerServiceURL,
+			Status: &saml.Status{
+				StatusCode: saml.StatusCode{
+					Value: statusRequester,
+					StatusCode: &saml.StatusCode{
+						Value: status,
+					},
+				},
+				StatusMessage: message,
+			},
+			InResponseTo: request.ID,
+			Issuer:       saml.NewIssuer(i.entityID),
+		},
+	}
+}
+
+// makeAuthnResponse creates the response to an authentication request. Users who can't be identified to the service
+// provider get an error response rather than an assertion.
 func (i *IDP) makeAuthnResponse(request *model.AuthnRequest, user *model.User) *saml.Response {
-	now := time.Now().UTC()
-	fiveFromNow := now.Add(5 * time.Minute)
-	resp := i.makeResponse(request.ID, request.Issuer, user)
-	// Add subject confirmation data and authentication statement
-	resp.Assertion.AuthnStatement = &saml.AuthnStatement{
+	resp, err := i.makeResponse(request.ID, request.Issuer, user)
+	if err != nil {
+		log.Error(err)
+		return i.makeErrorResponse(request, statusInvalidNameIDPolicy, "unable to create a name identifier")
+	}
+	i.addAuthnStatement(resp.Assertion, request, user)
+	return resp
+}
+
+// addAuthnStatement adds the authentication statement and the confirmation of the subject by the request's recipient
+func (i *IDP) addAuthnStatement(assertion *saml.Assertion, request *model.AuthnRequest, user *model.User) {
+	now := assertion.IssueInstant
+	assertion.AuthnStatement = &saml.AuthnStatement{
 		AuthnInstant: now,
 		SessionIndex: saml.NewID(),
 		SubjectLocality: &saml.SubjectLocality{
@@ -74,21 +173,44 @@ func (i *IDP) makeAuthnResponse(request *model.AuthnRequest, user *model.User) *
 			AuthnContextClassRef: user.Context,
 		},
 	}
-	resp.Assertion.Subject.SubjectConfirmation = &saml.SubjectConfirmation{
+	assertion.Subject.SubjectConfirmation = &saml.SubjectConfirmation{
 		Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
 		SubjectConfirmationData: &saml.SubjectConfirmationData{
 			Address:      net.ParseIP(user.IP),
 			InResponseTo: request.ID,
 			Recipient:    request.AssertionConsumerServiceURL,
-			NotOnOrAfter: fiveFromNow,
+			NotOnOrAfter: assertion.Conditions.NotOnOrAfter,
 		},
 	}
-	return resp
+	if request.HolderOfKey {
+		// The service provider confirms the subject with the certificate the user presents to it
+		confirmation := assertion.Subject.SubjectConfirmation
+		confirmation.Method = "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"
+		confirmation.SubjectConfirmationData.Type = "KeyInfoConfirmationDataType"
+		confirmation.SubjectConfirmationData.KeyInfo = &xmlsig.KeyInfo{
+			X509Data: &xmlsig.X509Data{
+				X509Certificate: base64.StdEncoding.EncodeToString(user.X509Certificate),
+			},
+		}
+	}
+}
+
+func (i *IDP) makeResponse(id, issuer string, user *model.User) (*saml.Response, error) {
+	// Only include the attributes the service provider's release policy allows
+	sp, _ := i.getServiceProvider(issuer)
+	nameID, err := i.makeNameID(user, issuer, sp)
+	if err != nil {
+		return nil, err
+	}
+	return i.makeSubjectResponse(id, issuer, sp, nameID, sp.releasedAttributes(user.Attributes)), nil
 }
 
-func (i *IDP) makeResponse(id, issuer string, user *model.User) *saml.Response {
+// makeSubjectResponse creates a response with an assertion about the subject for the audience. The conditions are
+// set up for the service provider, which is nil when it isn't registered.
+func (i *IDP) makeSubjectResponse(id, audience string, sp *ServiceProvider, nameID *saml.NameID,
+	atts []*model.Attribute) *saml.Response {
 	now := time.Now().UTC()
-	fiveFromNow := now.Add(5 * time.Minute)
+	released := &model.User{Attributes: atts}
 	s := &saml.Response{
 		StatusResponseType: saml.StatusResponseType{
 			Version:      "2.0",
@@ -108,29 +230,44 @@ func (i *IDP) makeResponse(id, issuer string, user *model.User) *saml.Response {
 			Issuer:       saml.NewIssuer(i.entityID),
 			Version:      "2.0",
 			Subject: &saml.Subject{
-				NameID: &saml.NameID{
-					Format:          user.Format,
-					NameQualifier:   i.entityID,
-					SPNameQualifier: issuer,
-					Value:           user.Name,
-				},
+				NameID: nameID,
 				SubjectConfirmation: &saml.SubjectConfirmation{
 					Method: "urn:oasis:names:tc:SAML:2.0:cm:sender-vouches",
 				},
 			},
-			AttributeStatement: user.AttributeStatement(),
-			Conditions: &saml.Conditions{
-				NotOnOrAfter: fiveFromNow,
-				NotBefore:    now,
-				AudienceRestriction: &saml.AudienceRestriction{
-					Audience: issuer,
-				},
-			},
+			AttributeStatement: released.AttributeStatement(),
+			Conditions:         makeConditions(now, audience, sp),
 		},
 	}
 	return s
 }
 
+// makeConditions limits an assertion issued at the time given to its audience and the service provider's validity
+// period and restrictions
+func makeConditions(now time.Time, audience string, sp *ServiceProvider) *saml.Conditions {
+	conditions := &saml.Conditions{
+		NotBefore:    now.Add(-sp.clockSkew()),
+		NotOnOrAfter: now.Add(sp.assertionLifetime()),
+		AudienceRestriction: &saml.AudienceRestriction{
+			Audience: []string{audience},
+		},
+	}
+	if sp == nil {
+		return conditions
+	}
+	conditions.AudienceRestriction.Audience = append(conditions.AudienceRestriction.Audience, sp.Audiences...)
+	if sp.OneTimeUse {
+		conditions.OneTimeUse = &saml.OneTimeUse{}
+	}
+	if proxy := sp.ProxyRestriction; proxy != nil {
+		conditions.ProxyRestriction = &saml.ProxyRestriction{
+			Count:    proxy.Count,
+			Audience: proxy.Audiences,
+		}
+	}
+	return conditions
+}
+
 func getArtifact(entityID string) string {
 	// The artifact isn't just a random session id. It's a base64-encoded byte array
 	// that's 44 bytes in length. The first two bytes must be 04 for SAML 2. The second
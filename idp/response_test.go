@@ -15,10 +15,18 @@
 package idp
 
 import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/amdonov/lite-idp/internal/testcert"
 	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/sign"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestIDP_respond(t *testing.T) {
@@ -32,3 +40,123 @@ func TestIDP_respond(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIDP_makeAuthnResponseHolderOfKey(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	cert := testcert.Throwaway(t)
+	req := &model.AuthnRequest{
+		ID:              "_123",
+		ProtocolBinding: "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+		HolderOfKey:     true,
+	}
+	resp := i.makeAuthnResponse(req, &model.User{Name: "joe", X509Certificate: cert})
+	confirmation := resp.Assertion.Subject.SubjectConfirmation
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key", confirmation.Method)
+	if assert.NotNil(t, confirmation.SubjectConfirmationData.KeyInfo) {
+		assert.Equal(t, base64.StdEncoding.EncodeToString(cert),
+			confirmation.SubjectConfirmationData.KeyInfo.X509Data.X509Certificate)
+	}
+
+	// Users who logged in with a password don't have a key to confirm
+	w := httptest.NewRecorder()
+	if err := i.respond(req, &model.User{Name: "joe"}, w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	value := body[strings.Index(body, `name="SAMLResponse"`):]
+	value = value[strings.Index(value, `value="`)+7:]
+	data, err := base64.StdEncoding.DecodeString(value[:strings.Index(value, `"`)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), statusAuthnFailed)
+}
+
+func TestIDP_makeAuthnResponseConditions(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	req := &model.AuthnRequest{ID: "_123", Issuer: "https://sp.example.com/"}
+
+	// Unregistered service providers get the defaults
+	resp := i.makeAuthnResponse(req, &model.User{Name: "joe"})
+	conditions := resp.Assertion.Conditions
+	assert.Equal(t, resp.IssueInstant, conditions.NotBefore)
+	assert.Equal(t, resp.IssueInstant.Add(5*time.Minute), conditions.NotOnOrAfter)
+	assert.Equal(t, []string{req.Issuer}, conditions.AudienceRestriction.Audience)
+	assert.Nil(t, conditions.OneTimeUse)
+	assert.Nil(t, conditions.ProxyRestriction)
+
+	count := 0
+	i.sps[req.Issuer] = &ServiceProvider{
+		EntityID:          req.Issuer,
+		AssertionLifetime: time.Minute,
+		ClockSkew:         2 * time.Minute,
+		Audiences:         []string{"https://api.example.com/"},
+		OneTimeUse:        true,
+		ProxyRestriction:  &ProxyRestriction{Count: &count},
+	}
+	defer delete(i.sps, req.Issuer)
+	resp = i.makeAuthnResponse(req, &model.User{Name: "joe"})
+	conditions = resp.Assertion.Conditions
+	assert.Equal(t, resp.IssueInstant.Add(-2*time.Minute), conditions.NotBefore)
+	assert.Equal(t, resp.IssueInstant.Add(time.Minute), conditions.NotOnOrAfter)
+	assert.Equal(t, conditions.NotOnOrAfter, resp.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter)
+	assert.Equal(t, []string{req.Issuer, "https://api.example.com/"}, conditions.AudienceRestriction.Audience)
+	data, err := xml.Marshal(conditions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), "<OneTimeUse ")
+	assert.Contains(t, string(data), `Count="0"`, "a zero count forbids proxying")
+}
+
+func TestIDP_signResponse(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	req := &model.AuthnRequest{ID: "_123", Issuer: "https://sp.example.com/"}
+	sp := &ServiceProvider{EntityID: req.Issuer}
+
+	resp := i.makeAuthnResponse(req, &model.User{Name: "joe"})
+	if err := i.signResponse(resp, sp); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, resp.Assertion.Signature, "assertions are signed by default")
+	assert.Nil(t, resp.Signature)
+
+	sp.Sign = signingResponse
+	resp = i.makeAuthnResponse(req, &model.User{Name: "joe"})
+	if err := i.signResponse(resp, sp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, resp.Assertion.Signature)
+	assert.NotNil(t, resp.Signature)
+
+	sp.Sign = signingBoth
+	sp.SignatureAlgorithm = sign.RSASHA512
+	sp.DigestAlgorithm = sign.DigestSHA512
+	resp = i.makeAuthnResponse(req, &model.User{Name: "joe"})
+	if err := i.signResponse(resp, sp); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, resp.Assertion.Signature) && assert.NotNil(t, resp.Signature) {
+		assert.Equal(t, sign.RSASHA512, resp.Signature.SignedInfo.SignatureMethod.Algorithm)
+		assert.Equal(t, sign.DigestSHA512, resp.Signature.SignedInfo.Reference.DigestMethod.Algorithm)
+		assert.Equal(t, sign.RSASHA512, resp.Assertion.Signature.SignedInfo.SignatureMethod.Algorithm)
+	}
+	data, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(i.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := sign.NewValidator().ValidateWithKeys(string(data), cert.PublicKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Response", ref.Name.Local)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/jwt"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// samlBearerGrant is the RFC 7522 grant type for exchanging a SAML assertion for an access token
+const samlBearerGrant = "urn:ietf:params:oauth:grant-type:saml2-bearer"
+
+var assertionName = xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:assertion", Local: "Assertion"}
+
+// exchangeAssertion issues an access token for an assertion the IdP issued to a service provider. The assertion
+// authenticates the request, so it can only be exchanged once.
+func (i *IDP) exchangeAssertion(r *http.Request) (*tokenResponse, error) {
+	encoded := strings.TrimRight(r.PostForm.Get("assertion"), "=")
+	if encoded == "" {
+		return nil, newOIDCError("invalid_request", "request does not contain an assertion")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, newOIDCError("invalid_grant", "assertion is not base64url encoded")
+	}
+	assertion, sp, err := i.validateBearerAssertion(string(data))
+	if err != nil {
+		return nil, err
+	}
+	scope, err := tokenScope(r.PostForm.Get("scope"), sp.TokenScopes)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("saml2-bearer:%s", assertion.ID)
+	added, err := i.ExchangeCache.Add(key, []byte{1})
+	if err != nil {
+		return nil, err
+	}
+	if !added {
+		return nil, newOIDCError("invalid_grant", "assertion %s has already been exchanged", assertion.ID)
+	}
+	var atts []*model.Attribute
+	if assertion.AttributeStatement != nil {
+		for _, att := range assertion.AttributeStatement.Attribute {
+			values := make([]string, len(att.AttributeValue))
+			for j, value := range att.AttributeValue {
+				values[j] = value.Value
+			}
+			atts = append(atts, &model.Attribute{Name: att.Name, Value: values})
+		}
+	}
+	mappings := sp.TokenClaims
+	if len(mappings) == 0 {
+		mappings = i.oidcClaims
+	}
+	audience := sp.TokenAudiences
+	if len(audience) == 0 {
+		audience = []string{sp.EntityID}
+	}
+	signer, err := i.tokenSigner()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	lifetime := viper.GetDuration("oidc-token-lifetime")
+	// Attributes can't replace the registered claims
+	claims := releaseClaims(atts, mappings, scope)
+	claims["iss"] = i.oidcIssuer
+	claims["sub"] = assertion.Subject.NameID.Value
+	claims["aud"] = jwt.Audience(audience)
+	claims["exp"] = now.Add(lifetime).Unix()
+	claims["iat"] = now.Unix()
+	claims["jti"] = uuid.New().String()
+	claims["client_id"] = sp.EntityID
+	if scope != "" {
+		claims["scope"] = scope
+	}
+	accessToken, err := signer.Sign(accessTokenType, claims)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("exchanged assertion %s from %s for an access token", assertion.ID, sp.EntityID)
+	return &tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(lifetime / time.Second),
+		Scope:       scope,
+	}, nil
+}
+
+// validateBearerAssertion makes sure the assertion was signed by the IdP for a registered service provider that may
+// exchange it and that it's still valid. Only the signed assertion is returned to avoid signature wrapping attacks.
+func (i *IDP) validateBearerAssertion(data string) (*saml.Assertion, *ServiceProvider, error) {
+	ref, err := i.validator.ValidateWithKeys(data, i.publicKeys()...)
+	if err != nil {
+		return nil, nil, newOIDCError("invalid_grant", "assertion signature is not valid: %s", err)
+	}
+	if ref.Name != assertionName || ref.ID == "" {
+		return nil, nil, newOIDCError("invalid_grant", "signature does not cover the assertion")
+	}
+	assertion := &saml.Assertion{}
+	if err = xml.Unmarshal([]byte(ref.XML), assertion); err != nil {
+		return nil, nil, newOIDCError("invalid_grant", "malformed assertion: %s", err)
+	}
+	if assertion.Issuer == nil || assertion.Issuer.Value != i.entityID {
+		return nil, nil, newOIDCError("invalid_grant", "assertion was not issued by %s", i.entityID)
+	}
+	// The service provider the assertion was issued to must be allowed to exchange it
+	audience := assertionAudience(assertion)
+	sp, ok := i.getServiceProvider(audience)
+	if !ok || len(sp.TokenScopes) == 0 {
+		return nil, nil, newOIDCError("invalid_grant", "assertions issued to %s can't be exchanged", audience)
+	}
+	subject := assertion.Subject
+	if subject == nil || subject.NameID == nil || subject.NameID.Value == "" {
+		return nil, nil, newOIDCError("invalid_grant", "assertion does not identify a subject")
+	}
+	confirmation := subject.SubjectConfirmation
+	if confirmation == nil || confirmation.Method != "urn:oasis:names:tc:SAML:2.0:cm:bearer" ||
+		confirmation.SubjectConfirmationData == nil {
+		return nil, nil, newOIDCError("invalid_grant", "assertion does not have a bearer subject confirmation")
+	}
+	recipient := confirmation.SubjectConfirmationData.Recipient
+	if recipient != i.oidcTokenLocation && !sp.hasAssertionConsumerService(recipient) {
+		return nil, nil, newOIDCError("invalid_grant", "assertion recipient %s is not registered for %s",
+			recipient, sp.EntityID)
+	}
+	skew := viper.GetDuration("clock-skew")
+	now := time.Now()
+	notOnOrAfter := confirmation.SubjectConfirmationData.NotOnOrAfter
+	if conditions := assertion.Conditions; conditions != nil {
+		if !conditions.NotBefore.IsZero() && now.Add(skew).Before(conditions.NotBefore) {
+			return nil, nil, newOIDCError("invalid_grant", "assertion is not valid until %s",
+				conditions.NotBefore.Format(time.RFC3339))
+		}
+		if !conditions.NotOnOrAfter.IsZero() && conditions.NotOnOrAfter.Before(notOnOrAfter) {
+			notOnOrAfter = conditions.NotOnOrAfter
+		}
+	}
+	if notOnOrAfter.IsZero() || !now.Add(-skew).Before(notOnOrAfter) {
+		return nil, nil, newOIDCError("invalid_grant", "assertion has expired")
+	}
+	// Exchanged assertions are only remembered for exchange-cache-duration, so longer lived ones could be replayed
+	if notOnOrAfter.Add(skew).After(now.Add(viper.GetDuration("exchange-cache-duration"))) {
+		return nil, nil, newOIDCError("invalid_grant", "assertion is valid for longer than exchange-cache-duration")
+	}
+	return assertion, sp, nil
+}
+
+// tokenScope checks the requested scope against the scopes allowed for the service provider. All of them are
+// granted when no scope is requested.
+func tokenScope(requested string, allowed []string) (string, error) {
+	if requested == "" {
+		return strings.Join(allowed, " "), nil
+	}
+	for _, scope := range strings.Fields(requested) {
+		if !hasScope(strings.Join(allowed, " "), scope) {
+			return "", newOIDCError("invalid_scope", "scope %s is not allowed", scope)
+		}
+	}
+	return requested, nil
+}
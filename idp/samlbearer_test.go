@@ -0,0 +1,141 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/jwt"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_exchangeAssertion(t *testing.T) {
+	registerECPServiceProvider(t)
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	sp := i.sps["https://sp.example.com/"]
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "memberOf", Value: []string{"a", "b"}},
+	}}
+	issue := func() string {
+		resp := i.makeAuthnResponse(&model.AuthnRequest{
+			ID:                          "_123",
+			Issuer:                      sp.EntityID,
+			AssertionConsumerServiceURL: "https://sp.example.com/acs",
+		}, user)
+		if err := i.signResponse(resp, sp); err != nil {
+			t.Fatal(err)
+		}
+		data, err := xml.Marshal(resp.Assertion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	exchange := func(assertion, scope string) (int, map[string]interface{}) {
+		params := url.Values{"grant_type": {samlBearerGrant}, "assertion": {assertion}}
+		if scope != "" {
+			params.Set("scope", scope)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(params.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		i.DefaultOIDCTokenHandler()(w, r)
+		response := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, response
+	}
+
+	// Service providers have to be allowed to exchange assertions
+	status, response := exchange(issue(), "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", response["error"])
+
+	sp.TokenScopes = []string{"read", "write"}
+	sp.TokenAudiences = []string{"https://api.example.com/"}
+	sp.TokenClaims = []ClaimMapping{
+		{Claim: "email", Attribute: "mail"},
+		{Claim: "groups", Attribute: "memberOf", Scope: "write"},
+	}
+	status, response = exchange(issue(), "admin")
+	assert.Equal(t, "invalid_scope", response["error"])
+
+	assertion := issue()
+	status, response = exchange(assertion, "read")
+	if !assert.Equal(t, http.StatusOK, status, response) {
+		t.FailNow()
+	}
+	assert.Equal(t, "read", response["scope"])
+	var claims struct {
+		jwt.Claims
+		ClientID string   `json:"client_id"`
+		Email    string   `json:"email"`
+		Groups   []string `json:"groups"`
+	}
+	header, err := jwt.Verify(response["access_token"].(string), &claims, i.publicKeys()...)
+	if assert.NoError(t, err) {
+		assert.Equal(t, accessTokenType, header.Type)
+		assert.NoError(t, claims.Validate(i.oidcIssuer, "https://api.example.com/", time.Now(), 0))
+		assert.Equal(t, "joe", claims.Subject)
+		assert.Equal(t, sp.EntityID, claims.ClientID)
+		assert.Equal(t, "joe@example.com", claims.Email)
+		assert.Empty(t, claims.Groups, "groups require the write scope")
+	}
+
+	// Assertions can only be exchanged once
+	status, response = exchange(assertion, "read")
+	assert.Equal(t, "invalid_grant", response["error"])
+
+	// Tampering with the assertion breaks the signature
+	data, _ := base64.RawURLEncoding.DecodeString(issue())
+	tampered := strings.Replace(string(data), ">joe<", ">admin<", 1)
+	status, response = exchange(base64.RawURLEncoding.EncodeToString([]byte(tampered)), "")
+	assert.Equal(t, "invalid_grant", response["error"])
+
+	// The recipient must be registered for the service provider
+	sp.AssertionConsumerServices[0].Location = "https://sp.example.com/other"
+	status, response = exchange(issue(), "")
+	assert.Equal(t, "invalid_grant", response["error"])
+	sp.AssertionConsumerServices[0].Location = "https://sp.example.com/acs"
+
+	// Assertions that outlive the record of their exchange are rejected
+	sp.AssertionLifetime = 2 * time.Hour
+	status, response = exchange(issue(), "")
+	assert.Equal(t, "invalid_grant", response["error"])
+
+	// Expired assertions are rejected
+	sp.AssertionLifetime = time.Second
+	viper.Set("clock-skew", "0s")
+	defer viper.Set("clock-skew", "3m")
+	assertion = issue()
+	time.Sleep(1100 * time.Millisecond)
+	status, response = exchange(assertion, "")
+	assert.Equal(t, "invalid_grant", response["error"])
+}
@@ -15,22 +15,91 @@
 package idp
 
 import (
+	"bytes"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"time"
 
+	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
+	"github.com/amdonov/xmlsig"
+	"github.com/spf13/viper"
+)
+
+// Values of the service provider's Sign setting
+const (
+	signingAssertion = "assertion"
+	signingResponse  = "response"
+	signingBoth      = "both"
 )
 
 //ServiceProvider stores the Service Provider metadata required by the IdP
 type ServiceProvider struct {
-	EntityID                  string
+	EntityID string
+	// Name shown to users on the consent page. Defaults to the entity ID.
+	DisplayName               string
 	AssertionConsumerServices []AssertionConsumerService
 	Certificate               string
-	// Could be an RSA or DSA public key
+	// Reject SHA-1 and DSA signatures from the service provider
+	RejectWeakAlgorithms bool
+	// Overrides the require-signed-requests setting for the service provider
+	RequireSignedRequests *bool
+	// Overrides the ecp-require-client-certificate setting for the service provider
+	RequireClientCertificate *bool
+	// Format of the name identifiers sent to the service provider. Either transient, persistent, or empty to
+	// identify users by name.
+	NameIDFormat string
+	// Names of the attributes released to the service provider. All attributes are released when empty, except to
+	// service providers from metadata aggregates.
+	ReleaseAttributes []string
+	// Overrides the require-consent setting for the service provider
+	RequireConsent *bool
+	// Users are only sent assertions for the service provider when they meet one of the rules. Everyone is allowed
+	// when empty.
+	AccessRules []AccessRule
+	// Overrides the access-denied-page setting for the service provider
+	AccessDeniedPage *bool
+	// Certificate used to encrypt name identifiers sent to the service provider. The signing certificate is used
+	// when empty.
+	EncryptionCertificate string
+	// Endpoints that receive responses to ManageNameIDRequests sent with the redirect binding
+	ManageNameIDServices []ManageNameIDService
+	// Entity IDs of the service providers the service provider may map name identifiers to
+	NameIDMappingTargets []string
+	// How long assertions issued to the service provider are valid. Defaults to the assertion-lifetime setting.
+	AssertionLifetime time.Duration
+	// How far NotBefore is set in the past for service providers with slow clocks. Defaults to the
+	// assertion-clock-skew setting.
+	ClockSkew time.Duration
+	// Audiences added to assertions besides the service provider
+	Audiences []string
+	// Adds a OneTimeUse condition to assertions
+	OneTimeUse bool
+	// Adds a ProxyRestriction condition to assertions
+	ProxyRestriction *ProxyRestriction
+	// What to sign in responses: assertion, response, or both. Defaults to assertion.
+	Sign string
+	// Override the signature-algorithm and digest-algorithm settings for the service provider
+	SignatureAlgorithm string
+	DigestAlgorithm    string
+	// Scopes of the access tokens the service provider can get for its assertions with the SAML 2.0 bearer grant.
+	// The service provider's assertions can't be exchanged when it's empty.
+	TokenScopes []string
+	// Audiences of the access tokens. Defaults to the service provider's entity ID.
+	TokenAudiences []string
+	// Claims added to the access tokens from the assertion's attributes. Defaults to the oidc-claims setting.
+	TokenClaims []ClaimMapping
+	// Could be an RSA, ECDSA, or DSA public key
 	publicKey interface{}
+	// Release nothing rather than everything when ReleaseAttributes is empty
+	releaseOnlyListed bool
 }
 
 func (sp *ServiceProvider) parseCertificate() error {
@@ -46,12 +115,179 @@ func (sp *ServiceProvider) parseCertificate() error {
 	return nil
 }
 
+// encryptionCertificate returns the certificate used to encrypt data for the service provider
+func (sp *ServiceProvider) encryptionCertificate() (*x509.Certificate, error) {
+	encoded := sp.EncryptionCertificate
+	if encoded == "" {
+		encoded = sp.Certificate
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// redirectManageNameIDService returns the location that receives ManageNameIDResponses sent with the redirect binding
+func (sp *ServiceProvider) redirectManageNameIDService() string {
+	for _, service := range sp.ManageNameIDServices {
+		if service.Binding != "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" {
+			continue
+		}
+		if service.ResponseLocation != "" {
+			return service.ResponseLocation
+		}
+		return service.Location
+	}
+	return ""
+}
+
+// mayMapTo reports whether the service provider is allowed to map name identifiers to another service provider
+func (sp *ServiceProvider) mayMapTo(entityID string) bool {
+	for _, target := range sp.NameIDMappingTargets {
+		if target == entityID {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAssertionConsumerService reports whether the location is one of the service provider's assertion consumer
+// services
+func (sp *ServiceProvider) hasAssertionConsumerService(location string) bool {
+	for _, acs := range sp.AssertionConsumerServices {
+		if acs.Location == location {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyRestriction limits the use of assertions to obtain assertions for other service providers
+type ProxyRestriction struct {
+	// Maximum number of indirections. Proxying is unlimited when it's nil.
+	Count *int
+	// Service providers that may receive assertions based on the assertion
+	Audiences []string
+}
+
+// assertionLifetime returns how long assertions issued to the service provider are valid
+func (sp *ServiceProvider) assertionLifetime() time.Duration {
+	if sp != nil && sp.AssertionLifetime > 0 {
+		return sp.AssertionLifetime
+	}
+	return viper.GetDuration("assertion-lifetime")
+}
+
+// clockSkew returns how far assertions issued to the service provider are back-dated
+func (sp *ServiceProvider) clockSkew() time.Duration {
+	if sp != nil && sp.ClockSkew > 0 {
+		return sp.ClockSkew
+	}
+	return viper.GetDuration("assertion-clock-skew")
+}
+
+// signAssertions reports whether assertions sent to the service provider are signed
+func (sp *ServiceProvider) signAssertions() bool {
+	return sp == nil || sp.Sign == "" || sp.Sign == signingAssertion || sp.Sign == signingBoth
+}
+
+// signResponses reports whether responses sent to the service provider are signed
+func (sp *ServiceProvider) signResponses() bool {
+	return sp != nil && (sp.Sign == signingResponse || sp.Sign == signingBoth)
+}
+
+// requireSignedRequests reports whether unsigned authentication requests from the service provider are rejected
+func (sp *ServiceProvider) requireSignedRequests() bool {
+	if sp.RequireSignedRequests != nil {
+		return *sp.RequireSignedRequests
+	}
+	return viper.GetBool("require-signed-requests")
+}
+
+// requireClientCertificate reports whether ECP users logging in to the service provider must present a client
+// certificate rather than a password
+func (sp *ServiceProvider) requireClientCertificate() bool {
+	if sp.RequireClientCertificate != nil {
+		return *sp.RequireClientCertificate
+	}
+	return viper.GetBool("ecp-require-client-certificate")
+}
+
+// requireConsent reports whether users must agree to the attributes released to the service provider
+func (sp *ServiceProvider) requireConsent() bool {
+	if sp.RequireConsent != nil {
+		return *sp.RequireConsent
+	}
+	return viper.GetBool("require-consent")
+}
+
+// displayName returns the name users know the service provider by
+func (sp *ServiceProvider) displayName() string {
+	if sp.DisplayName != "" {
+		return sp.DisplayName
+	}
+	return sp.EntityID
+}
+
+// releasedAttributes returns the attributes the service provider is allowed to receive
+func (sp *ServiceProvider) releasedAttributes(atts []*model.Attribute) []*model.Attribute {
+	if sp == nil || (len(sp.ReleaseAttributes) == 0 && !sp.releaseOnlyListed) {
+		return atts
+	}
+	var released []*model.Attribute
+	for _, att := range atts {
+		for _, name := range sp.ReleaseAttributes {
+			if att.Name == name {
+				released = append(released, att)
+				break
+			}
+		}
+	}
+	return released
+}
+
+// checkSignatureAlgorithms rejects XML signatures made with SHA-1 or DSA or over SHA-1 digests when the service
+// provider's policy requires it
+func (sp *ServiceProvider) checkSignatureAlgorithms(ref *sign.Reference) error {
+	if !sp.RejectWeakAlgorithms {
+		return nil
+	}
+	if sign.IsWeakAlgorithm(ref.Algorithm) {
+		return fmt.Errorf("signature algorithm %s is not allowed for %s", ref.Algorithm, sp.EntityID)
+	}
+	if sign.IsWeakDigestAlgorithm(ref.DigestAlgorithm) {
+		return fmt.Errorf("digest algorithm %s is not allowed for %s", ref.DigestAlgorithm, sp.EntityID)
+	}
+	return nil
+}
+
+// presentedCertificate reports whether the request was sent over a TLS connection authenticated with the service
+// provider's registered certificate
+func (sp *ServiceProvider) presentedCertificate(r *http.Request) bool {
+	cert, err := getCertFromRequest(r)
+	if err != nil {
+		return false
+	}
+	registered, err := base64.StdEncoding.DecodeString(sp.Certificate)
+	return err == nil && bytes.Equal(cert.Raw, registered)
+}
+
 // AssertionConsumerService is a SAML assertion consumer service
 type AssertionConsumerService struct {
 	Index     uint32
 	IsDefault bool
 	Binding   string
 	Location  string
+	// Binding used to send responses to a holder-of-key service
+	ProtocolBinding string
+}
+
+// ManageNameIDService is a SAML name identifier management service
+type ManageNameIDService struct {
+	Binding          string
+	Location         string
+	ResponseLocation string
 }
 
 // ReadSPMetadata reads XML metadata from a reader
@@ -68,22 +304,132 @@ func convertMetadata(spMeta *saml.SPEntityDescriptor) (*ServiceProvider, error)
 	if spMeta == nil {
 		return nil, errors.New("service provider entity descriptor not found")
 	}
-	x509Data := spMeta.SPSSODescriptor.KeyDescriptor.KeyInfo.X509Data
+	var x509Data, encryptionData *xmlsig.X509Data
+	for _, kd := range spMeta.SPSSODescriptor.KeyDescriptor {
+		// Keys without a use are valid for both signing and encryption
+		if x509Data == nil && (kd.Use == "" || kd.Use == "signing") {
+			x509Data = kd.KeyInfo.X509Data
+		}
+		if encryptionData == nil && kd.Use == "encryption" {
+			encryptionData = kd.KeyInfo.X509Data
+		}
+	}
 	if x509Data == nil {
 		return nil, errors.New("service provider's SSO descriptor does not contain required X509Data element")
 	}
 	sp := &ServiceProvider{
-		Certificate: x509Data.X509Certificate,
+		// Aggregated metadata frequently wraps certificates across lines
+		Certificate: strings.Join(strings.Fields(x509Data.X509Certificate), ""),
 		EntityID:    spMeta.EntityDescriptor.EntityID,
 	}
+	// Display names are usually in the SSO descriptor's extensions but are sometimes on the entity
+	for _, ext := range []*saml.Extensions{spMeta.SPSSODescriptor.Extensions, spMeta.EntityDescriptor.Extensions} {
+		if sp.DisplayName == "" && ext != nil && ext.UIInfo != nil {
+			sp.DisplayName = localizedName(ext.UIInfo.DisplayName)
+		}
+	}
+	if encryptionData != nil {
+		sp.EncryptionCertificate = strings.Join(strings.Fields(encryptionData.X509Certificate), "")
+	}
+	// Metadata can't relax the signing requirement because the attribute defaults to false
+	if spMeta.SPSSODescriptor.AuthnRequestsSigned {
+		required := true
+		sp.RequireSignedRequests = &required
+	}
 	sp.AssertionConsumerServices = make([]AssertionConsumerService, len(spMeta.SPSSODescriptor.AssertionConsumerService))
 	for i, val := range spMeta.SPSSODescriptor.AssertionConsumerService {
 		sp.AssertionConsumerServices[i] = AssertionConsumerService{
-			Index:     val.Index,
-			IsDefault: val.IsDefault,
-			Binding:   val.Binding,
-			Location:  val.Location,
+			Index:           val.Index,
+			IsDefault:       val.IsDefault,
+			Binding:         val.Binding,
+			Location:        val.Location,
+			ProtocolBinding: val.ProtocolBinding,
 		}
 	}
+	for _, val := range spMeta.SPSSODescriptor.ManageNameIDService {
+		sp.ManageNameIDServices = append(sp.ManageNameIDServices, ManageNameIDService{
+			Binding:          val.Binding,
+			Location:         val.Location,
+			ResponseLocation: val.ResponseLocation,
+		})
+	}
 	return sp, nil
 }
+
+// localizedName picks the name in the metadata-lang language or the first name when there isn't one
+func localizedName(names []saml.LocalizedName) string {
+	lang := viper.GetString("metadata-lang")
+	for _, name := range names {
+		if name.Lang == lang {
+			return strings.TrimSpace(name.Value)
+		}
+	}
+	if len(names) > 0 {
+		return strings.TrimSpace(names[0].Value)
+	}
+	return ""
+}
+
+// entityDescriptor converts the service provider back into SAML metadata
+func (sp *ServiceProvider) entityDescriptor() *saml.SPEntityDescriptor {
+	ed := &saml.SPEntityDescriptor{
+		EntityDescriptor: saml.EntityDescriptor{
+			ID:       saml.NewID(),
+			EntityID: sp.EntityID,
+		},
+		SPSSODescriptor: saml.SPSSODescriptor{
+			AuthnRequestsSigned:        sp.requireSignedRequests(),
+			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+			KeyDescriptor: []saml.KeyDescriptor{
+				{
+					Use: "signing",
+					KeyInfo: xmlsig.KeyInfo{
+						X509Data: &xmlsig.X509Data{
+							X509Certificate: sp.Certificate,
+						},
+					},
+				},
+			},
+		},
+	}
+	if sp.DisplayName != "" {
+		ed.SPSSODescriptor.Extensions = &saml.Extensions{
+			UIInfo: &saml.UIInfo{
+				DisplayName: []saml.LocalizedName{{Lang: viper.GetString("metadata-lang"), Value: sp.DisplayName}},
+			},
+		}
+	}
+	for _, acs := range sp.AssertionConsumerServices {
+		ed.SPSSODescriptor.AssertionConsumerService = append(ed.SPSSODescriptor.AssertionConsumerService,
+			saml.AssertionConsumerService{
+				Service: saml.Service{
+					Binding:  acs.Binding,
+					Location: acs.Location,
+				},
+				IsDefault:       acs.IsDefault,
+				Index:           acs.Index,
+				ProtocolBinding: acs.ProtocolBinding,
+			})
+	}
+	if sp.EncryptionCertificate != "" {
+		ed.SPSSODescriptor.KeyDescriptor = append(ed.SPSSODescriptor.KeyDescriptor, saml.KeyDescriptor{
+			Use: "encryption",
+			KeyInfo: xmlsig.KeyInfo{
+				X509Data: &xmlsig.X509Data{
+					X509Certificate: sp.EncryptionCertificate,
+				},
+			},
+		})
+	}
+	for _, mni := range sp.ManageNameIDServices {
+		ed.SPSSODescriptor.ManageNameIDService = append(ed.SPSSODescriptor.ManageNameIDService,
+			saml.ManageNameIDService{
+				Service: saml.Service{
+					Binding:  mni.Binding,
+					Location: mni.Location,
+				},
+				ResponseLocation: mni.ResponseLocation,
+			})
+	}
+	return ed
+}
@@ -15,10 +15,15 @@
 package idp
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/amdonov/lite-idp/internal/testcert"
+	"github.com/amdonov/lite-idp/sign"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,6 +38,34 @@ func TestReadSPMetadata(t *testing.T) {
 		t.Fatal(err)
 	}
 	assert.Equal(t, "dex", sp.EntityID, "entity id is wrong")
+	assert.True(t, sp.requireSignedRequests(), "metadata requires signed requests")
+}
+
+func TestReadSPMetadataDisplayName(t *testing.T) {
+	sp := &ServiceProvider{
+		EntityID:    "https://sp.example.com/",
+		DisplayName: "Example Portal",
+		Certificate: base64.StdEncoding.EncodeToString(testcert.Throwaway(t)),
+	}
+	data, err := xml.Marshal(sp.entityDescriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSPMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Example Portal", read.displayName())
+
+	// Service providers without a display name are shown by entity ID
+	sp.DisplayName = ""
+	if data, err = xml.Marshal(sp.entityDescriptor()); err != nil {
+		t.Fatal(err)
+	}
+	if read, err = ReadSPMetadata(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sp.EntityID, read.displayName())
 }
 
 func TestReadInvalidSPMetadata(t *testing.T) {
@@ -46,3 +79,18 @@ func TestReadInvalidSPMetadata(t *testing.T) {
 		t.Fatal("expected failure")
 	}
 }
+
+func TestServiceProvider_checkSignatureAlgorithms(t *testing.T) {
+	sp := &ServiceProvider{EntityID: "https://sp.example.com/"}
+	strong := &sign.Reference{Algorithm: sign.RSASHA256, DigestAlgorithm: sign.DigestSHA256}
+	sha1Digest := &sign.Reference{Algorithm: sign.RSASHA256, DigestAlgorithm: sign.DigestSHA1}
+	sha1Signature := &sign.Reference{Algorithm: sign.RSASHA1, DigestAlgorithm: sign.DigestSHA256}
+	assert.NoError(t, sp.checkSignatureAlgorithms(sha1Digest))
+	assert.NoError(t, sp.checkSignatureAlgorithms(sha1Signature))
+
+	sp.RejectWeakAlgorithms = true
+	assert.NoError(t, sp.checkSignatureAlgorithms(strong))
+	assert.EqualError(t, sp.checkSignatureAlgorithms(sha1Digest),
+		"digest algorithm http://www.w3.org/2000/09/xmldsig#sha1 is not allowed for https://sp.example.com/")
+	assert.Error(t, sp.checkSignatureAlgorithms(sha1Signature))
+}
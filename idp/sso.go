@@ -15,40 +15,102 @@
 package idp
 
 import (
-	"bytes"
-	"compress/flate"
-	"crypto"
-	"crypto/dsa"
-	"crypto/rsa"
-	"crypto/sha1"
-	"crypto/sha256"
-	"encoding/asn1"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"math/big"
 	"net/http"
 	"net/url"
 	"strings"
 
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
 	"github.com/golang/protobuf/proto"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 func (i *IDP) validateRequest(request *saml.AuthnRequest, r *http.Request) error {
+	sp, err := i.requestingServiceProvider(request)
+	if err != nil {
+		return err
+	}
+	if err = resolveConsumerService(request, sp); err != nil {
+		return err
+	}
+	// At this point, we're OK with the request
+	// Need to validate the signature
+	signed := r.Form.Get("Signature") != ""
+	if signed {
+		// Have to use the raw query as pointed out in the spec.
+		// https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf
+		// Line 621
+		if err := verifySignature(r.URL.RawQuery, r.Form.Get("SigAlg"), r.Form.Get("Signature"), sp); err != nil {
+			return err
+		}
+	} else if sp.requireSignedRequests() {
+		return fmt.Errorf("requests from %s must be signed", sp.EntityID)
+	}
+	// Signed requests must include the destination
+	return i.checkAuthnRequest(request, i.singleSignOnServiceLocation, signed)
+}
+
+// validatePostedRequest verifies the signature of a request sent with the POST binding, replacing the request with
+// what was signed, and then makes the same checks as the redirect binding
+func (i *IDP) validatePostedRequest(message string, request *saml.AuthnRequest) error {
+	sp, err := i.requestingServiceProvider(request)
+	if err != nil {
+		return err
+	}
+	signed := request.Signature != nil
+	if signed {
+		ref, err := i.validator.ValidateWithKeys(message, sp.publicKey)
+		if err != nil {
+			return err
+		}
+		// Make sure the signature covers the request rather than some other element
+		if ref.Name != authnRequestName || ref.ID == "" || ref.ID != request.ID {
+			return errors.New("signature does not cover the authentication request")
+		}
+		if err = sp.checkSignatureAlgorithms(ref); err != nil {
+			return err
+		}
+		// Only use what was signed to avoid signature wrapping attacks
+		*request = saml.AuthnRequest{}
+		if err = xml.Unmarshal([]byte(ref.XML), request); err != nil {
+			return err
+		}
+		if request.Issuer != sp.EntityID {
+			return errors.New("signed request was issued by another service provider")
+		}
+	} else if sp.requireSignedRequests() {
+		return fmt.Errorf("requests from %s must be signed", sp.EntityID)
+	}
+	if err = resolveConsumerService(request, sp); err != nil {
+		return err
+	}
+	// Signed requests must include the destination
+	return i.checkAuthnRequest(request, i.postSingleSignOnServiceLocation, signed)
+}
+
+// requestingServiceProvider returns the registered service provider that issued the request
+func (i *IDP) requestingServiceProvider(request *saml.AuthnRequest) (*ServiceProvider, error) {
 	// Only accept requests from registered service providers
 	if request.Issuer == "" {
-		return errors.New("request does not contain an issuer")
+		return nil, errors.New("request does not contain an issuer")
 	}
 	log.Infof("received authentication request from %s", request.Issuer)
-	sp, ok := i.sps[request.Issuer]
+	sp, ok := i.getServiceProvider(request.Issuer)
 	if !ok {
-		return errors.New("request from an unregistered issuer")
+		return nil, errors.New("request from an unregistered issuer")
 	}
+	return sp, nil
+}
+
+// resolveConsumerService sets the request's assertion consumer service from the service provider's metadata
+func resolveConsumerService(request *saml.AuthnRequest, sp *ServiceProvider) error {
 	// Determine the right assertion consumer service
 	var acs *AssertionConsumerService
 	for i, a := range sp.AssertionConsumerServices {
@@ -74,81 +136,66 @@ func (i *IDP) validateRequest(request *saml.AuthnRequest, r *http.Request) error
 	} else if request.AssertionConsumerServiceURL != acs.Location {
 		return errors.New("assertion consumer location in request does not match metadata")
 	}
-	// At this point, we're OK with the request
-	// Need to validate the signature
-	// Have to use the raw query as pointed out in the spec.
-	// https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf
-	// Line 621
-	return verifySignature(r.URL.RawQuery, r.Form.Get("SigAlg"), r.Form.Get("Signature"), sp)
+	// Service providers can ask for holder-of-key assertions in the request or by registering a holder-of-key service
+	if request.ProtocolBinding == saml.HoKSSOBrowser || acs.Binding == saml.HoKSSOBrowser {
+		request.ProtocolBinding = saml.HoKSSOBrowser
+		if request.HoKProtocolBinding == "" {
+			request.HoKProtocolBinding = acs.ProtocolBinding
+		}
+		if request.HoKProtocolBinding == "" {
+			return errors.New("holder-of-key request does not specify a response binding")
+		}
+	}
+	return nil
 }
 
+// signedParameters are the redirect binding parameters covered by the signature in the order they're signed
+var signedParameters = []string{"SAMLRequest", "RelayState", "SigAlg"}
+
 func verifySignature(rawQuery, alg, expectedSig string, sp *ServiceProvider) error {
-	// Split up the parts
-	params := strings.Split(rawQuery, "&")
-	pMap := make(map[string]string, len(params))
-	for i := range params {
-		parts := strings.Split(params[i], "=")
-		if len(parts) != 2 {
-			return errors.New("trouble validating signature on request")
+	// The signature covers the parameters exactly as they were encoded by the sender
+	params := make(map[string]string, len(signedParameters))
+	for _, param := range strings.Split(rawQuery, "&") {
+		// Values may contain = so only split on the first one
+		parts := strings.SplitN(param, "=", 2)
+		name, err := url.QueryUnescape(parts[0])
+		if err != nil {
+			return err
+		}
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		for _, signed := range signedParameters {
+			if name != signed {
+				continue
+			}
+			if _, ok := params[name]; ok {
+				return fmt.Errorf("request contains more than one %s parameter", name)
+			}
+			params[name] = value
 		}
-		pMap[parts[0]] = parts[1]
+	}
+	if params["SAMLRequest"] == "" || params["SigAlg"] == "" {
+		return errors.New("signed request must contain SAMLRequest and SigAlg parameters")
 	}
 	// Order them
-	sigparts := []string{fmt.Sprintf("SAMLRequest=%s", pMap["SAMLRequest"])}
-	if state, ok := pMap["RelayState"]; ok {
-		sigparts = append(sigparts, fmt.Sprintf("RelayState=%s", state))
+	sigparts := make([]string, 0, len(signedParameters))
+	for _, name := range signedParameters {
+		if value, ok := params[name]; ok {
+			sigparts = append(sigparts, fmt.Sprintf("%s=%s", name, value))
+		}
 	}
-	sigparts = append(sigparts, fmt.Sprintf("SigAlg=%s", pMap["SigAlg"]))
 	sig := []byte(strings.Join(sigparts, "&"))
 	// Validate the signature
 	signature, err := base64.StdEncoding.DecodeString(expectedSig)
 	if err != nil {
 		return err
 	}
-	switch alg {
-	case "http://www.w3.org/2009/xmldsig11#dsa-sha256":
-		sum := sha256Sum(sig)
-		return verifyDSA(sp, signature, sum)
-	case "http://www.w3.org/2000/09/xmldsig#dsa-sha1":
-		sum := sha1Sum(sig)
-		return verifyDSA(sp, signature, sum)
-	case "http://www.w3.org/2000/09/xmldsig#rsa-sha1":
-		sum := sha1Sum(sig)
-		return rsa.VerifyPKCS1v15(sp.publicKey.(*rsa.PublicKey), crypto.SHA1, sum, signature)
-	case "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":
-		sum := sha256Sum(sig)
-		return rsa.VerifyPKCS1v15(sp.publicKey.(*rsa.PublicKey), crypto.SHA256, sum, signature)
-	default:
-		return fmt.Errorf("unsupported signature algorithm, %s", alg)
+	if sp.RejectWeakAlgorithms && sign.IsWeakAlgorithm(alg) {
+		return fmt.Errorf("signature algorithm %s is not allowed for %s", alg, sp.EntityID)
 	}
-}
-
-func verifyDSA(sp *ServiceProvider, signature, sum []byte) error {
-	dsaSig := new(dsaSignature)
-	if rest, err := asn1.Unmarshal(signature, dsaSig); err != nil {
-		return err
-	} else if len(rest) != 0 {
-		return errors.New("trailing data after DSA signature")
-	}
-	if dsaSig.R.Sign() <= 0 || dsaSig.S.Sign() <= 0 {
-		return errors.New("DSA signature contained zero or negative values")
-	}
-	if !dsa.Verify(sp.publicKey.(*dsa.PublicKey), sum, dsaSig.R, dsaSig.S) {
-		return errors.New("DSA verification failure")
-	}
-	return nil
-}
-
-func sha1Sum(sig []byte) []byte {
-	h := sha1.New()
-	h.Write(sig)
-	return h.Sum(nil)
-}
-
-func sha256Sum(sig []byte) []byte {
-	h := sha256.New()
-	h.Write(sig)
-	return h.Sum(nil)
+	return sign.Verify(alg, sp.publicKey, sig, signature)
 }
 
 // DefaultRedirectSSOHandler is the default implementation for the redirect login handler. It can be used as is, wrapped in other handlers, or replaced completely.
@@ -163,58 +210,41 @@ func (i *IDP) DefaultRedirectSSOHandler() http.HandlerFunc {
 			if len(relayState) > 80 {
 				return errors.New("RelayState cannot be longer than 80 characters")
 			}
-
-			samlReq := r.Form.Get("SAMLRequest")
-			// URL decoding is already performed
-			// remove base64 encoding
-			reqBytes, err := base64.StdEncoding.DecodeString(samlReq)
-			if err != nil {
-				return err
-			}
-			// Remove deflate
-			req := flate.NewReader(bytes.NewReader(reqBytes))
-			// Read the XML
-			decoder := xml.NewDecoder(req)
 			loginReq := &saml.AuthnRequest{}
-			if err = decoder.Decode(loginReq); err != nil {
-				return err
-			}
-
-			if err = i.validateRequest(loginReq, r); err != nil {
+			if err = decodeRedirectMessage(r.Form.Get("SAMLRequest"), loginReq); err != nil {
 				return err
 			}
+			return i.handleAuthnRequest(loginReq, relayState, i.validateRequest(loginReq, r), w, r)
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
 
-			// create saveable request
-			saveableRequest, err := model.NewAuthnRequest(loginReq, relayState)
+// DefaultPostSSOHandler is the default implementation for the POST binding login handler. It can be used as is,
+// wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultPostSSOHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			err := r.ParseForm()
 			if err != nil {
 				return err
 			}
-
-			// check for existing session
-			if user := i.getUserFromSession(r); user != nil {
-				return i.respond(saveableRequest, user, w, r)
-			}
-
-			// check to see if they presented a client cert
-			if user, err := i.loginWithCert(r, saveableRequest); user != nil {
-				return i.respond(saveableRequest, user, w, r)
-			} else if err != nil {
-				return err
+			relayState := r.PostForm.Get("RelayState")
+			if len(relayState) > 80 {
+				return errors.New("RelayState cannot be longer than 80 characters")
 			}
-
-			// need to display the login form
-			data, err := proto.Marshal(saveableRequest)
+			message, err := base64.StdEncoding.DecodeString(r.PostForm.Get("SAMLRequest"))
 			if err != nil {
 				return err
 			}
-			id := uuid.New().String()
-			err = i.TempCache.Set(id, data)
-			if err != nil {
+			loginReq := &saml.AuthnRequest{}
+			if err = xml.Unmarshal(message, loginReq); err != nil {
 				return err
 			}
-			http.Redirect(w, r, fmt.Sprintf("/ui/login.html?requestId=%s",
-				url.QueryEscape(id)), http.StatusTemporaryRedirect)
-			return nil
+			return i.handleAuthnRequest(loginReq, relayState, i.validatePostedRequest(string(message), loginReq), w, r)
 		}()
 		if err != nil {
 			log.Error(err)
@@ -223,6 +253,83 @@ func (i *IDP) DefaultRedirectSSOHandler() http.HandlerFunc {
 	}
 }
 
+// handleAuthnRequest answers a request that was validated with the error given. Requests that were denied with a
+// requestError receive an error response.
+func (i *IDP) handleAuthnRequest(loginReq *saml.AuthnRequest, relayState string, err error,
+	w http.ResponseWriter, r *http.Request) error {
+	rerr, denied := err.(*requestError)
+	if err != nil && !denied {
+		return err
+	}
+
+	// create saveable request
+	saveableRequest, err := model.NewAuthnRequest(loginReq, relayState)
+	if err != nil {
+		return err
+	}
+
+	if denied {
+		log.Infof("denied request from %s: %s", loginReq.Issuer, rerr)
+		return i.sendErrorResponse(saveableRequest, rerr, w, r)
+	}
+
+	// check for existing session. Holder-of-key assertions need a user who logged in with a certificate.
+	if user := i.getUserFromSession(r); user != nil &&
+		(!saveableRequest.HolderOfKey || len(user.X509Certificate) > 0) {
+		return i.respond(saveableRequest, user, w, r)
+	}
+
+	// check to see if they presented a client cert
+	if user, err := i.loginWithCert(r, saveableRequest); user != nil {
+		return i.respond(saveableRequest, user, w, r)
+	} else if err != nil {
+		return err
+	}
+
+	// need to display the login form
+	return i.showLoginForm(saveableRequest, w, r)
+}
+
+// showLoginForm saves the request and sends the user to the login form, which answers it once the user logs in.
+// Browsers are first sent to be asked for a Kerberos service ticket when Kerberos is configured. The challenge isn't
+// sent here, because browsers answer it by sending the protocol request again, which would then be a replay.
+func (i *IDP) showLoginForm(authnReq *model.AuthnRequest, w http.ResponseWriter, r *http.Request) error {
+	if i.Kerberos != nil {
+		if user, err := i.loginWithKerberos(w, r, authnReq); user != nil {
+			return i.respond(authnReq, user, w, r)
+		} else if err != nil {
+			return err
+		}
+	}
+	data, err := proto.Marshal(authnReq)
+	if err != nil {
+		return err
+	}
+	id := uuid.New().String()
+	err = i.TempCache.Set(id, data)
+	if err != nil {
+		return err
+	}
+	// Browsers that already sent a ticket that wasn't accepted aren't asked again
+	if _, sent := negotiateToken(r); i.Kerberos != nil && !sent {
+		http.Redirect(w, r, fmt.Sprintf("%s?requestId=%s", viper.GetString("negotiate-path"), url.QueryEscape(id)),
+			http.StatusFound)
+		return nil
+	}
+	http.Redirect(w, r, i.loginURL(id), http.StatusTemporaryRedirect)
+	return nil
+}
+
+// loginURL returns where users log in to answer the saved request
+func (i *IDP) loginURL(requestID string) string {
+	// Users choose where to log in when there are other authentication sources
+	loginPage := "/ui/login.html"
+	if len(i.AuthenticationSources) > 0 {
+		loginPage = viper.GetString("discovery-path")
+	}
+	return fmt.Sprintf("%s?requestId=%s", loginPage, url.QueryEscape(requestID))
+}
+
 func (i *IDP) loginWithCert(r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
 	// check to see if they presented a client cert
 	if clientCert, err := getCertFromRequest(r); err == nil {
@@ -246,10 +353,17 @@ func (i *IDP) loginWithCert(r *http.Request, authnReq *model.AuthnRequest) (*mod
 
 func (i *IDP) loginWithPasswordForm(r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
 	userName := r.Form.Get("username")
-	if err := i.PasswordValidator.Validate(userName, r.Form.Get("password")); err != nil {
+	if err := i.validatePassword(userName, r.Form.Get("password")); err != nil {
 		return nil, err
 	}
 	// They have provided the right password
+	return i.loginWithValidatedPassword(r, authnReq, userName)
+}
+
+// loginWithValidatedPassword creates and audits the session of a user whose password was accepted by the
+// PasswordValidator
+func (i *IDP) loginWithValidatedPassword(r *http.Request, authnReq *model.AuthnRequest,
+	userName string) (*model.User, error) {
 	user := &model.User{
 		Name:    userName,
 		Format:  "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
@@ -280,6 +394,18 @@ func (i *IDP) getUserFromSession(r *http.Request) *model.User {
 	return nil
 }
 
-type dsaSignature struct {
-	R, S *big.Int
+// endSession deletes the user's session and expires the session cookie
+func (i *IDP) endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(i.cookieName); err == nil {
+		if err = i.UserCache.Delete(cookie.Value); err != nil {
+			log.Errorf("failed to delete session: %s", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     i.cookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
 }
@@ -15,15 +15,25 @@
 package idp
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/amdonov/lite-idp/internal/testcert"
 	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
 	"github.com/golang/protobuf/proto"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -47,12 +57,32 @@ func TestIDP_DefaultRedirectSSOHandler(t *testing.T) {
 	i := &IDP{}
 	ts := getTestIDP(t, i)
 	defer ts.Close()
-	resp, err := ts.Client().Get(ts.URL + viper.GetString("sso-service-path") + "?SAMLRequest=fJFRi%2BIwEMe%2FSsh7mrS2Xhys0jsfTvBA1LvXI43pGrZN3cxU%2BvGX1RVcFnxMmN8w%2F99%2Fvhy7ll1cRN%2BHkqeJ4svFHE3XnqEa6BR27m1wSGy9Kvl%2FnU8b3UwykRa1FnlTWzGbZLWodZPnTWYLZTVn%2F%2B7bskRxtkYc3DogmUAlz1SqhZqJdHpQBagcilSoHJTibBt76m3f%2FvTh6MNLyYcYoDfoEYLpHAJZ2Fd%2FNpAlCurbEMLvw2Erqki%2BMZY4qxBdJN%2BHX33AoXNx7%2BLFW%2Fd3tyn5iegMUqbZj0QlKkmhKIqpPLpRWtO2tbGvnK0ckg%2BGrgG%2BAVppJc1AJxmdaTuUnUFyUZ4%2Fb5cf5jgbuzYgXC0%2Bj3HnHpHnhLkH5Lea4Oo3Lo5unMvHj9vra4uLdwAAAP%2F%2F&RelayState=ymktrbuodubogbc5gix6pyax5&SigAlg=http%3A%2F%2Fwww.w3.org%2F2000%2F09%2Fxmldsig%23rsa-sha1&Signature=FiWbe%2Fgui2UDb1FowmAudpNvX7ysQavigZ2j1C17E6TLYk9IsfV0nKY0shdKJZvBsceh5oGJAQDO5vUdLE29AUMdFvCYn1K90YI7Iu71ZBJdhh6veg6T5EW9cpQ%2FAalL66PU9J1IaF7vROElF0wJQNCMuMfwz1alug0d%2Fw49OtsSflZIIIQLYg9jRqIyoR4Qv4MdKLsYVJc5x3iyLNyu5tY01M5i5f%2FudgMxzGHg7hyM7AXbhJhBNMwuKxdC5A%2FIw72eFh0QIq%2Fb%2B%2BSgoMNpxCLtxnskk%2F5xoj3euNZntyKiL35VB6ZpXWku0uMd97ImRSrPgeRnXBltVcpiWLR1vg%3D%3D")
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	// The signed request was issued in 2018 for another IdP so it's denied
+	resp, err := client.Get(ts.URL + viper.GetString("sso-service-path") + "?SAMLRequest=fJFRi%2BIwEMe%2FSsh7mrS2Xhys0jsfTvBA1LvXI43pGrZN3cxU%2BvGX1RVcFnxMmN8w%2F99%2Fvhy7ll1cRN%2BHkqeJ4svFHE3XnqEa6BR27m1wSGy9Kvl%2FnU8b3UwykRa1FnlTWzGbZLWodZPnTWYLZTVn%2F%2B7bskRxtkYc3DogmUAlz1SqhZqJdHpQBagcilSoHJTibBt76m3f%2FvTh6MNLyYcYoDfoEYLpHAJZ2Fd%2FNpAlCurbEMLvw2Erqki%2BMZY4qxBdJN%2BHX33AoXNx7%2BLFW%2Fd3tyn5iegMUqbZj0QlKkmhKIqpPLpRWtO2tbGvnK0ckg%2BGrgG%2BAVppJc1AJxmdaTuUnUFyUZ4%2Fb5cf5jgbuzYgXC0%2Bj3HnHpHnhLkH5Lea4Oo3Lo5unMvHj9vra4uLdwAAAP%2F%2F&RelayState=ymktrbuodubogbc5gix6pyax5&SigAlg=http%3A%2F%2Fwww.w3.org%2F2000%2F09%2Fxmldsig%23rsa-sha1&Signature=FiWbe%2Fgui2UDb1FowmAudpNvX7ysQavigZ2j1C17E6TLYk9IsfV0nKY0shdKJZvBsceh5oGJAQDO5vUdLE29AUMdFvCYn1K90YI7Iu71ZBJdhh6veg6T5EW9cpQ%2FAalL66PU9J1IaF7vROElF0wJQNCMuMfwz1alug0d%2Fw49OtsSflZIIIQLYg9jRqIyoR4Qv4MdKLsYVJc5x3iyLNyu5tY01M5i5f%2FudgMxzGHg7hyM7AXbhJhBNMwuKxdC5A%2FIw72eFh0QIq%2Fb%2B%2BSgoMNpxCLtxnskk%2F5xoj3euNZntyKiL35VB6ZpXWku0uMd97ImRSrPgeRnXBltVcpiWLR1vg%3D%3D")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer resp.Body.Close()
-	assert.Equal(t, 200, resp.StatusCode, "expected login page from sso")
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "expected error response to the service provider")
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "127.0.0.1:5556", location.Host)
+	data, err := i.TempCache.Get(location.Query().Get("SAMLart"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifactResponse := &model.ArtifactResponse{}
+	if err = proto.Unmarshal(data, artifactResponse); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, statusRequestDenied, artifactResponse.StatusCode)
+	assert.Nil(t, artifactResponse.User)
 }
 
 const certPEM = `
@@ -147,3 +177,136 @@ func TestIDP_loginWithPasswordForm(t *testing.T) {
 	}
 	assert.Equal(t, "joe", user.Name, "user name doesn't match")
 }
+
+func Test_verifySignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := &ServiceProvider{EntityID: "https://sp.example.com/", Certificate: base64.StdEncoding.EncodeToString(der)}
+	if err = sp.parseCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := sign.NewSigner(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, sign.SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := "SAMLRequest=fZFRT4MwEMe%2FCum7FDaIriksuD1siZtko48vTAFJoVtV4&SigAlg=" + url.QueryEscape(signer.Algorithm())
+	signature, err := signer.Sign([]byte(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, verifySignature(query, signer.Algorithm(), signature, sp))
+
+	// an RSA algorithm with an EC key returns an error rather than panicking
+	rsaQuery := "SAMLRequest=fZFRT4MwEMe%2FCum7FDaIriksuD1siZtko48vTAFJoVtV4&SigAlg=" + url.QueryEscape(sign.RSASHA256)
+	assert.Error(t, verifySignature(rsaQuery, sign.RSASHA256, signature, sp))
+
+	// SHA-1 is rejected when the service provider's policy requires it
+	sp.RejectWeakAlgorithms = true
+	sha1Query := "SAMLRequest=fZFRT4MwEMe%2FCum7FDaIriksuD1siZtko48vTAFJoVtV4&SigAlg=" + url.QueryEscape(sign.ECDSASHA1)
+	assert.EqualError(t, verifySignature(sha1Query, sign.ECDSASHA1, signature, sp),
+		"signature algorithm http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha1 is not allowed for https://sp.example.com/")
+}
+
+func Test_verifySignatureRawQuery(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := &ServiceProvider{EntityID: "https://sp.example.com/", Certificate: base64.StdEncoding.EncodeToString(der)}
+	if err = sp.parseCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := sign.NewSigner(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, sign.SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Some senders don't escape = in values
+	signed := "SAMLRequest=fZFRT4MwEMe%2FCum7FDaIriksuD1siZtko48vTAFJoVtV4==&RelayState=a=b&SigAlg=" + url.QueryEscape(signer.Algorithm())
+	signature, err := signer.Sign([]byte(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The order of the parameters and unsigned parameters don't matter
+	query := "SigAlg=" + url.QueryEscape(signer.Algorithm()) + "&extra&RelayState=a=b&Signature=" + signature +
+		"&SAMLRequest=fZFRT4MwEMe%2FCum7FDaIriksuD1siZtko48vTAFJoVtV4=="
+	assert.NoError(t, verifySignature(query, signer.Algorithm(), signature, sp))
+
+	assert.EqualError(t, verifySignature(query+"&RelayState=c", signer.Algorithm(), signature, sp),
+		"request contains more than one RelayState parameter")
+	assert.Error(t, verifySignature(strings.Replace(query, "a=b", "a=c", 1), signer.Algorithm(), signature, sp))
+}
+
+func TestIDP_unsignedRedirectSSO(t *testing.T) {
+	required := false
+	viper.Set("sps", []ServiceProvider{
+		{
+			EntityID:    "https://sp.example.com/",
+			Certificate: base64.StdEncoding.EncodeToString(testcert.Throwaway(t)),
+			AssertionConsumerServices: []AssertionConsumerService{
+				{
+					IsDefault: true,
+					Binding:   "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+					Location:  "https://sp.example.com/acs",
+				},
+			},
+			RequireSignedRequests: &required,
+		},
+		{
+			EntityID:    "https://signed.example.com/",
+			Certificate: base64.StdEncoding.EncodeToString(testcert.Throwaway(t)),
+			AssertionConsumerServices: []AssertionConsumerService{
+				{
+					IsDefault: true,
+					Binding:   "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+					Location:  "https://signed.example.com/acs",
+				},
+			},
+		},
+	})
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	login := func(issuer string) int {
+		query := encodeRedirectRequest(t, &saml.AuthnRequest{
+			RequestAbstractType: saml.RequestAbstractType{
+				ID:           saml.NewID(),
+				Version:      "2.0",
+				IssueInstant: time.Now().UTC(),
+				Issuer:       issuer,
+			},
+			ProtocolBinding: "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+		})
+		resp, err := client.Get(ts.URL + viper.GetString("sso-service-path") + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusTemporaryRedirect, login("https://sp.example.com/"), "expected login page from sso")
+	assert.Equal(t, http.StatusBadRequest, login("https://signed.example.com/"), "expected unsigned request to be rejected")
+}
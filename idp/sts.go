@@ -0,0 +1,229 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/wsfed"
+	"github.com/amdonov/lite-idp/wstrust"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSTSHandler is the default implementation for the WS-Trust security token service handler. Clients authenticate with a client certificate or a UsernameToken. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultSTSHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		envelope, err := i.issueToken(r)
+		if fault, ok := err.(*soapFault); ok {
+			log.Infof("denied security token request: %s", fault)
+			sendSOAPFault(w, fault.code, fault.message)
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			sendSOAPFault(w, wstrust.FaultRequestFailed, "the token could not be issued")
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		if _, err = w.Write([]byte(xml.Header)); err != nil {
+			log.Error(err)
+			return
+		}
+		encoder := xml.NewEncoder(w)
+		if err = encoder.Encode(envelope); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// issueToken answers a WS-Trust issue request with a signed assertion for the service it applies to. Requests that
+// can't be answered result in a soapFault.
+func (i *IDP) issueToken(r *http.Request) (*wstrust.RequestSecurityTokenResponseEnvelope, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	envelope := &wstrust.RequestSecurityTokenEnvelope{}
+	if err = readSOAPEnvelope(data, envelope); err != nil {
+		return nil, err
+	}
+	header := envelope.Header
+	if header == nil {
+		header = &wstrust.RequestHeader{}
+	}
+	for _, block := range header.Other {
+		// WS-Addressing headers are understood even though only MessageID is used
+		if mustUnderstand(block.MustUnderstand) && block.XMLName.Space != wstrust.Addressing {
+			return nil, newSOAPFault(faultMustUnderstand, "header block %s %s is not understood",
+				block.XMLName.Space, block.XMLName.Local)
+		}
+	}
+	rst := envelope.Body.RequestSecurityToken
+	if rst.RequestType != wstrust.RequestTypeIssue {
+		return nil, newSOAPFault(wstrust.FaultInvalidRequest, "request type %s is not supported", rst.RequestType)
+	}
+	switch rst.TokenType {
+	case "", wstrust.TokenTypeSAML20, wsfed.TokenTypeSAML20:
+	default:
+		return nil, newSOAPFault(wstrust.FaultInvalidRequest, "token type %s is not supported", rst.TokenType)
+	}
+	holderOfKey := false
+	switch rst.KeyType {
+	case "", wstrust.KeyTypeBearer:
+	case wstrust.KeyTypePublicKey:
+		holderOfKey = true
+	default:
+		return nil, newSOAPFault(wstrust.FaultInvalidRequest, "key type %s is not supported", rst.KeyType)
+	}
+	if rst.AppliesTo == nil || rst.AppliesTo.EndpointReference.Address == "" {
+		return nil, newSOAPFault(wstrust.FaultInvalidRequest, "request does not say which service the token applies to")
+	}
+	address := rst.AppliesTo.EndpointReference.Address
+	sp, ok := i.getServiceProvider(address)
+	if !ok {
+		return nil, newSOAPFault(wstrust.FaultInvalidRequest, "token requested for unregistered service %s", address)
+	}
+	timestamp, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	request := &model.AuthnRequest{
+		ID:                          uuid.New().String(),
+		IssueInstant:                timestamp,
+		Issuer:                      sp.EntityID,
+		AssertionConsumerServiceURL: address,
+		HolderOfKey:                 holderOfKey,
+	}
+	user, err := i.authenticateSTSClient(r, header.Security, request)
+	if err != nil {
+		return nil, err
+	}
+	if holderOfKey {
+		if len(user.X509Certificate) == 0 {
+			return nil, newSOAPFault(wstrust.FaultInvalidRequest,
+				"holder-of-key tokens require client certificate authentication")
+		}
+		// The token can only be confirmed with the certificate the client proved it has
+		if rst.UseKey != nil {
+			if rst.UseKey.KeyInfo == nil {
+				return nil, newSOAPFault(wstrust.FaultInvalidRequest, "UseKey does not contain a certificate")
+			}
+			cert, err := getCertFromXML(rst.UseKey.KeyInfo.X509Data)
+			if err != nil || !bytes.Equal(cert.Raw, user.X509Certificate) {
+				return nil, newSOAPFault(wstrust.FaultInvalidRequest, "UseKey is not the client certificate")
+			}
+		}
+	}
+	err = sp.CheckAccess(user, getIP(r), time.Now())
+	if denied, ok := err.(*AccessDeniedError); ok {
+		i.auditDenied(user, request, denied.Reason)
+		return nil, newSOAPFault(wstrust.FaultRequestFailed, "%s is not allowed to access %s", user.Name, sp.EntityID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	nameID, err := i.makeNameID(user, sp.EntityID, sp)
+	if err != nil {
+		return nil, err
+	}
+	response := i.makeSubjectResponse("", sp.EntityID, sp, nameID, sp.releasedAttributes(user.Attributes))
+	assertion := response.Assertion
+	i.addAuthnStatement(assertion, request, user)
+	// The request ID is only meaningful to lite-idp, and tokens weren't asked for with a SAML request
+	assertion.Subject.SubjectConfirmation.SubjectConfirmationData.InResponseTo = ""
+	signer, err := i.signerFor(sp)
+	if err != nil {
+		return nil, err
+	}
+	if assertion.Signature, err = signer.CreateSignature(assertion); err != nil {
+		return nil, err
+	}
+	if err = i.rememberAssertion(assertion); err != nil {
+		return nil, err
+	}
+	token, err := xml.Marshal(assertion)
+	if err != nil {
+		return nil, err
+	}
+	keyType := wstrust.KeyTypeBearer
+	if holderOfKey {
+		keyType = wstrust.KeyTypePublicKey
+	}
+	log.Infof("issued security token for %s to %s", user.Name, sp.EntityID)
+	result := &wstrust.RequestSecurityTokenResponseEnvelope{
+		Body: wstrust.ResponseBody{
+			RequestSecurityTokenResponseCollection: wstrust.RequestSecurityTokenResponseCollection{
+				RequestSecurityTokenResponse: []wstrust.RequestSecurityTokenResponse{{
+					Context:                      rst.Context,
+					TokenType:                    wstrust.TokenTypeSAML20,
+					RequestedSecurityToken:       wstrust.RequestedSecurityToken{Token: string(token)},
+					AppliesTo:                    wsfed.NewAppliesTo(address),
+					RequestedAttachedReference:   wstrust.NewSAMLReference(assertion.ID),
+					RequestedUnattachedReference: wstrust.NewSAMLReference(assertion.ID),
+					Lifetime: &wstrust.Lifetime{
+						Created: assertion.IssueInstant,
+						Expires: assertion.Conditions.NotOnOrAfter,
+					},
+					KeyType: keyType,
+				}},
+			},
+		},
+	}
+	if header.MessageID != "" {
+		result.Header = &wstrust.ResponseHeader{
+			Action:    wstrust.ActionIssueFinal,
+			RelatesTo: header.MessageID,
+		}
+	}
+	return result, nil
+}
+
+// authenticateSTSClient logs in the client with its UsernameToken or, when it doesn't send one, its client
+// certificate
+func (i *IDP) authenticateSTSClient(r *http.Request, security *wstrust.Security,
+	request *model.AuthnRequest) (*model.User, error) {
+	if security != nil && security.UsernameToken != nil {
+		token := security.UsernameToken
+		if token.Password == nil || (token.Password.Type != "" && token.Password.Type != wstrust.PasswordText) {
+			return nil, newSOAPFault(wstrust.FaultFailedAuthentication, "UsernameToken must contain a text password")
+		}
+		if err := i.validatePassword(token.Username, token.Password.Value); err != nil {
+			if err == ErrInvalidPassword {
+				return nil, newSOAPFault(wstrust.FaultFailedAuthentication, "invalid password for %s", token.Username)
+			}
+			if err == errPasswordLoginDisabled {
+				return nil, newSOAPFault(wstrust.FaultFailedAuthentication, "%s", err)
+			}
+			return nil, err
+		}
+		return i.loginWithValidatedPassword(r, request, token.Username)
+	}
+	user, err := i.loginWithCert(r, request)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, newSOAPFault(wstrust.FaultFailedAuthentication,
+			"request does not contain a UsernameToken or a client certificate")
+	}
+	return user, nil
+}
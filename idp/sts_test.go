@@ -0,0 +1,163 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/wstrust"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// rstEnvelope returns a WS-Trust issue request for the service with the header blocks
+func rstEnvelope(header, appliesTo, keyType string) string {
+	return `<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/"><S:Header>` + header +
+		`<wsa:MessageID xmlns:wsa="http://www.w3.org/2005/08/addressing">urn:uuid:1234</wsa:MessageID>` +
+		`<wsa:Action xmlns:wsa="http://www.w3.org/2005/08/addressing" S:mustUnderstand="1">` +
+		`http://docs.oasis-open.org/ws-sx/ws-trust/200512/RST/Issue</wsa:Action></S:Header><S:Body>` +
+		`<wst:RequestSecurityToken xmlns:wst="http://docs.oasis-open.org/ws-sx/ws-trust/200512" Context="ctx-1">` +
+		`<wst:RequestType>http://docs.oasis-open.org/ws-sx/ws-trust/200512/Issue</wst:RequestType>` +
+		`<wst:TokenType>http://docs.oasis-open.org/wss/oasis-wss-saml-token-profile-1.1#SAMLV2.0</wst:TokenType>` +
+		`<wsp:AppliesTo xmlns:wsp="http://schemas.xmlsoap.org/ws/2004/09/policy">` +
+		`<wsa:EndpointReference xmlns:wsa="http://www.w3.org/2005/08/addressing"><wsa:Address>` + appliesTo +
+		`</wsa:Address></wsa:EndpointReference></wsp:AppliesTo>` +
+		`<wst:KeyType>` + keyType + `</wst:KeyType></wst:RequestSecurityToken></S:Body></S:Envelope>`
+}
+
+func usernameToken(user, password string) string {
+	return `<wsse:Security xmlns:wsse="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd" ` +
+		`S:mustUnderstand="1"><wsse:UsernameToken><wsse:Username>` + user + `</wsse:Username>` +
+		`<wsse:Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordText">` +
+		password + `</wsse:Password></wsse:UsernameToken></wsse:Security>`
+}
+
+func TestIDP_DefaultSTSHandler(t *testing.T) {
+	i := &IDP{PasswordValidator: &simpleValidator{
+		map[string][]byte{"joe": []byte("$2a$10$FNvHN.0e5LcLUonmGX0CIOAAEKYYSrlZkyibHgq3sLo0SizPtRhEG")},
+	}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	service := "https://service.example.com/ws"
+	i.sps[service] = &ServiceProvider{EntityID: service}
+	userCert, err := x509.ParseCertificate(i.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(body string, cert bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/SOAP/STS", strings.NewReader(body))
+		if cert {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{userCert}}
+		}
+		w := httptest.NewRecorder()
+		i.DefaultSTSHandler()(w, req)
+		return w
+	}
+	fault := func(w *httptest.ResponseRecorder) string {
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		var envelope struct {
+			Fault struct {
+				Code string `xml:"faultcode"`
+			} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body>Fault"`
+		}
+		if err := xml.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(envelope.Fault.Code, "wst:") {
+			// The prefix of the code must be declared
+			assert.Contains(t, w.Body.String(), `xmlns:wst="http://docs.oasis-open.org/ws-sx/ws-trust/200512"`)
+		}
+		return envelope.Fault.Code
+	}
+	issued := func(w *httptest.ResponseRecorder) (*wstrust.RequestSecurityTokenResponseEnvelope, *saml.Assertion) {
+		if !assert.Equal(t, http.StatusOK, w.Code, w.Body.String()) {
+			t.FailNow()
+		}
+		envelope := &wstrust.RequestSecurityTokenResponseEnvelope{}
+		if err := xml.Unmarshal(w.Body.Bytes(), envelope); err != nil {
+			t.Fatal(err)
+		}
+		rstr := envelope.Body.RequestSecurityTokenResponseCollection.RequestSecurityTokenResponse[0]
+		ref, err := i.validator.ValidateWithKeys(rstr.RequestedSecurityToken.Token, i.publicKeys()...)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assertion := &saml.Assertion{}
+		if err := xml.Unmarshal([]byte(ref.XML), assertion); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, ref.ID, rstr.RequestedAttachedReference.SecurityTokenReference.KeyIdentifier.Value)
+		return envelope, assertion
+	}
+
+	// Bearer token for a UsernameToken
+	envelope, assertion := issued(post(rstEnvelope(usernameToken("joe", "password"), service, wstrust.KeyTypeBearer), false))
+	if assert.NotNil(t, envelope.Header) {
+		assert.Equal(t, "urn:uuid:1234", envelope.Header.RelatesTo)
+	}
+	rstr := envelope.Body.RequestSecurityTokenResponseCollection.RequestSecurityTokenResponse[0]
+	assert.Equal(t, "ctx-1", rstr.Context)
+	assert.Equal(t, wstrust.KeyTypeBearer, rstr.KeyType)
+	assert.Equal(t, service, rstr.AppliesTo.EndpointReference.Address)
+	assert.Equal(t, "joe", assertion.Subject.NameID.Value)
+	assert.Equal(t, []string{service}, assertion.Conditions.AudienceRestriction.Audience)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:cm:bearer", assertion.Subject.SubjectConfirmation.Method)
+	assert.Empty(t, assertion.Subject.SubjectConfirmation.SubjectConfirmationData.InResponseTo)
+
+	// Holder-of-key token for a client certificate
+	_, assertion = issued(post(rstEnvelope("", service, wstrust.KeyTypePublicKey), true))
+	confirmation := assertion.Subject.SubjectConfirmation
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key", confirmation.Method)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(userCert.Raw),
+		confirmation.SubjectConfirmationData.KeyInfo.X509Data.X509Certificate)
+
+	// Holder-of-key tokens need a certificate
+	w := post(rstEnvelope(usernameToken("joe", "password"), service, wstrust.KeyTypePublicKey), true)
+	assert.Equal(t, wstrust.FaultInvalidRequest, fault(w))
+
+	assert.Equal(t, wstrust.FaultFailedAuthentication,
+		fault(post(rstEnvelope(usernameToken("joe", "wrong"), service, wstrust.KeyTypeBearer), false)))
+	assert.Equal(t, wstrust.FaultFailedAuthentication,
+		fault(post(rstEnvelope("", service, wstrust.KeyTypeBearer), false)))
+	assert.Equal(t, wstrust.FaultInvalidRequest,
+		fault(post(rstEnvelope("", "https://unknown.example.com/", wstrust.KeyTypeBearer), true)))
+	assert.Equal(t, wstrust.FaultInvalidRequest,
+		fault(post(rstEnvelope("", service, wstrust.KeyTypeSymmetricKey), true)))
+	// Passwords are refused when the discovery page doesn't offer them
+	i.AuthenticationSources = []AuthenticationSource{fakeSource{}}
+	viper.Set("discovery-local-login", false)
+	assert.Equal(t, wstrust.FaultFailedAuthentication,
+		fault(post(rstEnvelope(usernameToken("joe", "password"), service, wstrust.KeyTypeBearer), false)))
+	viper.Set("discovery-local-login", true)
+	i.AuthenticationSources = nil
+	unknown := `<x:Unknown xmlns:x="urn:example" S:mustUnderstand="1"/>`
+	assert.Equal(t, "SOAP-ENV:MustUnderstand", fault(post(rstEnvelope(unknown, service, wstrust.KeyTypeBearer), true)))
+
+	// Access rules apply to tokens too
+	i.sps[service].AccessRules = []AccessRule{{Attributes: []AttributeRequirement{{Name: "groups", Values: []string{"admins"}}}}}
+	if err := i.sps[service].validateAccessRules(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, wstrust.FaultRequestFailed,
+		fault(post(rstEnvelope(usernameToken("joe", "password"), service, wstrust.KeyTypeBearer), false)))
+}
@@ -0,0 +1,451 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sp"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// localSource is the discovery page choice for logging in with lite-idp's own login form
+const localSource = "local"
+
+// AuthenticationSource authenticates users somewhere other than lite-idp's login form such as an upstream identity
+// provider. Users choose a source on the discovery page.
+type AuthenticationSource interface {
+	// Name identifies the source in URLs
+	Name() string
+	// DisplayName is shown to users on the discovery page
+	DisplayName() string
+	// Login sends the user to the source. The state must be passed to the callback once they're authenticated.
+	Login(w http.ResponseWriter, r *http.Request, state []byte) error
+	// Handler returns the handler for requests under the source's path such as users returning from the source
+	Handler(done AuthenticationCallback) (http.Handler, error)
+}
+
+// AuthenticationCallback finishes logging in a user authenticated by an AuthenticationSource
+type AuthenticationCallback func(w http.ResponseWriter, r *http.Request, state []byte, user *model.User)
+
+// UpstreamIdP is a SAML identity provider users can log in with. lite-idp is a service provider to it.
+type UpstreamIdP struct {
+	// Name of the identity provider used in URLs
+	Name string
+	// Name shown to users on the discovery page
+	DisplayName string
+	EntityID    string
+	// Locations of the identity provider's redirect SingleSignOnService and ArtifactResolutionService
+	RedirectEndpoint string
+	ArtifactEndpoint string
+	// Upstream attribute holding the user's name. Users are named by their NameID qualified with the identity
+	// provider's entity ID when empty, so they can't be confused with local users or those of other identity
+	// providers.
+	NameAttribute string
+	// Scopes the identity provider may name users in, such as partner.edu. Names from the NameAttribute in a listed
+	// scope, such as jdoe@partner.edu, are used as they are. Other names are qualified with the entity ID.
+	NameScopes []string
+	// Attributes to keep from the identity provider's assertions. No attributes are kept when empty.
+	Attributes []AttributeMapping
+	// Local authentication context classes of the identity provider's AuthnContextClassRefs. Users have no
+	// authentication context when theirs isn't listed.
+	AuthnContexts []ContextMapping
+}
+
+// AttributeMapping renames an attribute received from an upstream identity provider
+type AttributeMapping struct {
+	// Name of the attribute at the identity provider
+	Upstream string
+	// Local name of the attribute. Defaults to the upstream name.
+	Attribute string
+}
+
+// ContextMapping translates an authentication context reference received from an upstream provider
+type ContextMapping struct {
+	// Reference used by the provider
+	Upstream string
+	// Local authentication context class
+	Context string
+}
+
+type samlSource struct {
+	upstream UpstreamIdP
+	entityID string
+	sp       sp.ServiceProvider
+}
+
+// NewSAMLAuthenticationSource returns a source logging users in with the upstream identity provider. The base URL is
+// where the source's handler is served. lite-idp's entity ID and TLS configuration are used toward the identity
+// provider, and the cache keeps track of users while they're away.
+func NewSAMLAuthenticationSource(upstream UpstreamIdP, baseURL, entityID string, tlsConfig *tls.Config,
+	cache store.Cache) (AuthenticationSource, error) {
+	if upstream.Name == "" {
+		return nil, errors.New("upstream identity provider does not specify a name")
+	}
+	if upstream.EntityID == "" || upstream.RedirectEndpoint == "" || upstream.ArtifactEndpoint == "" {
+		return nil, fmt.Errorf("upstream identity provider %s requires an entity ID, redirect endpoint, and artifact endpoint",
+			upstream.Name)
+	}
+	if upstream.DisplayName == "" {
+		upstream.DisplayName = upstream.Name
+	}
+	serviceProvider, err := sp.New(sp.Configuration{
+		EntityID:                    entityID,
+		AssertionConsumerServiceURL: strings.TrimSuffix(baseURL, "/") + "/acs",
+		IDPRedirectEndpoint:         upstream.RedirectEndpoint,
+		IDPArtifactEndpoint:         upstream.ArtifactEndpoint,
+		Timeout:                     viper.GetDuration("upstream-timeout"),
+		TLSConfig:                   tlsConfig,
+		Cache:                       cache,
+		TimestampMargin:             viper.GetDuration("clock-skew"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &samlSource{upstream: upstream, entityID: entityID, sp: serviceProvider}, nil
+}
+
+func (s *samlSource) Name() string {
+	return s.upstream.Name
+}
+
+func (s *samlSource) DisplayName() string {
+	return s.upstream.DisplayName
+}
+
+func (s *samlSource) Login(w http.ResponseWriter, r *http.Request, state []byte) error {
+	redirect, err := s.sp.GetRedirect(state)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+	return nil
+}
+
+// Handler serves the assertion consumer service at /acs and lite-idp's service provider metadata at /metadata
+func (s *samlSource) Handler(done AuthenticationCallback) (http.Handler, error) {
+	metadata, err := s.sp.MetadataFunc()
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/acs", s.sp.ArtifactFunc(func(w http.ResponseWriter, r *http.Request, state []byte,
+		assertion *saml.Assertion) {
+		user, err := s.user(assertion)
+		if err != nil {
+			log.Infof("rejected assertion from %s: %s", s.upstream.EntityID, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		done(w, r, state, user)
+	}))
+	mux.Handle("/metadata", metadata)
+	return mux, nil
+}
+
+// user translates an assertion from the identity provider into a local user
+func (s *samlSource) user(assertion *saml.Assertion) (*model.User, error) {
+	if assertion.Issuer == nil || assertion.Issuer.Value != s.upstream.EntityID {
+		return nil, errors.New("assertion was not issued by the upstream identity provider")
+	}
+	if assertion.Conditions == nil || assertion.Conditions.AudienceRestriction == nil ||
+		!contains(assertion.Conditions.AudienceRestriction.Audience, s.entityID) {
+		return nil, errors.New("assertion is not intended for lite-idp")
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, errors.New("assertion does not identify the user")
+	}
+	user := &model.User{
+		Name:   fmt.Sprintf("%s@%s", assertion.Subject.NameID.Value, s.upstream.EntityID),
+		Format: nameIDUnspecified,
+	}
+	if statement := assertion.AuthnStatement; statement != nil && statement.AuthnContext != nil {
+		user.Context = upstreamContext(s.upstream.AuthnContexts, statement.AuthnContext.AuthnContextClassRef)
+	}
+	var atts []saml.Attribute
+	if assertion.AttributeStatement != nil {
+		atts = assertion.AttributeStatement.Attribute
+	}
+	if s.upstream.NameAttribute != "" {
+		user.Name = ""
+		for _, att := range atts {
+			if att.Name == s.upstream.NameAttribute && len(att.AttributeValue) > 0 {
+				user.Name = att.AttributeValue[0].Value
+				break
+			}
+		}
+		if user.Name == "" {
+			return nil, fmt.Errorf("assertion does not contain the %s attribute", s.upstream.NameAttribute)
+		}
+		user.Name = scopedName(user.Name, s.upstream.EntityID, s.upstream.NameScopes)
+	}
+	for _, att := range atts {
+		name, ok := s.attributeName(att.Name)
+		if !ok {
+			continue
+		}
+		values := make([]string, len(att.AttributeValue))
+		for j, value := range att.AttributeValue {
+			values[j] = value.Value
+		}
+		user.AppendAttributes([]*model.Attribute{{Name: name, Value: values}})
+	}
+	return user, nil
+}
+
+// scopedName returns a name asserted by an upstream provider as it is when it's in one of the provider's scopes.
+// Other names are qualified with the provider's identifier, so a provider can't claim to be a local user or a user of
+// another provider.
+func scopedName(name, qualifier string, scopes []string) string {
+	if at := strings.LastIndex(name, "@"); at > 0 {
+		for _, scope := range scopes {
+			if strings.EqualFold(name[at+1:], scope) {
+				return name
+			}
+		}
+	}
+	return fmt.Sprintf("%s@%s", name, qualifier)
+}
+
+// upstreamContext returns the local authentication context class of a reference received from an upstream provider.
+// References that aren't mapped aren't trusted.
+func upstreamContext(mappings []ContextMapping, reference string) string {
+	for _, mapping := range mappings {
+		if mapping.Upstream == reference {
+			return mapping.Context
+		}
+	}
+	return ""
+}
+
+// attributeName returns the local name of an upstream attribute and whether it's kept
+func (s *samlSource) attributeName(upstream string) (string, bool) {
+	for _, mapping := range s.upstream.Attributes {
+		if mapping.Upstream == upstream {
+			if mapping.Attribute == "" {
+				return upstream, true
+			}
+			return mapping.Attribute, true
+		}
+	}
+	return "", false
+}
+
+func (i *IDP) configureAuthenticationSources() error {
+	if i.AuthenticationSources != nil {
+		return nil
+	}
+	baseURL := func(name string) string {
+		return fmt.Sprintf("https://%s%s/%s", i.serverName, strings.TrimSuffix(viper.GetString("upstream-path"), "/"),
+			name)
+	}
+	var sources []AuthenticationSource
+	upstreams := []UpstreamIdP{}
+	if err := viper.UnmarshalKey("upstream-idps", &upstreams); err != nil {
+		return err
+	}
+	for _, upstream := range upstreams {
+		source, err := NewSAMLAuthenticationSource(upstream, baseURL(upstream.Name), i.entityID, i.TLSConfig,
+			i.TempCache)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source)
+	}
+	providers := []UpstreamOIDCProvider{}
+	if err := viper.UnmarshalKey("upstream-oidc-providers", &providers); err != nil {
+		return err
+	}
+	// Providers are usually on the internet, so their certificates are checked with the system's trusted CAs
+	client := &http.Client{Timeout: viper.GetDuration("upstream-timeout")}
+	for _, provider := range providers {
+		source, err := NewOIDCAuthenticationSource(provider, baseURL(provider.Name), client, i.TempCache)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source)
+	}
+	// Names are used in URLs
+	names := map[string]bool{}
+	for _, source := range sources {
+		if names[source.Name()] || source.Name() == localSource {
+			return fmt.Errorf("authentication source name %s is already in use", source.Name())
+		}
+		names[source.Name()] = true
+	}
+	i.AuthenticationSources = sources
+	return nil
+}
+
+// authenticationSource returns the source with the name
+func (i *IDP) authenticationSource(name string) (AuthenticationSource, bool) {
+	for _, source := range i.AuthenticationSources {
+		if source.Name() == name {
+			return source, true
+		}
+	}
+	return nil, false
+}
+
+// upstreamCookie ties logins with authentication sources to the browser that started them
+const upstreamCookie = "lite-idp-upstream"
+
+func upstreamBrowserKey(requestID string) string {
+	return "upstream-browser:" + requestID
+}
+
+// finishUpstreamLogin answers the saved request once the user is authenticated by a source. The state is the ID of
+// the saved request.
+func (i *IDP) finishUpstreamLogin(source AuthenticationSource) AuthenticationCallback {
+	return func(w http.ResponseWriter, r *http.Request, state []byte, user *model.User) {
+		err := func() error {
+			// Otherwise anyone could send a user the response to their own login and log them in as someone else
+			browser, err := i.TempCache.Take(upstreamBrowserKey(string(state)))
+			if err != nil {
+				return errors.New("login request has expired")
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     upstreamCookie,
+				Path:     "/",
+				MaxAge:   -1,
+				Secure:   true,
+				HttpOnly: true,
+			})
+			cookie, err := r.Cookie(upstreamCookie)
+			if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), browser) != 1 {
+				return errors.New("login was started by another browser")
+			}
+			// The request can only be answered once
+			data, err := i.TempCache.Take(string(state))
+			if err != nil {
+				return errors.New("login request has expired")
+			}
+			req := &model.AuthnRequest{}
+			if err = proto.Unmarshal(data, req); err != nil {
+				return err
+			}
+			user.IP = getIP(r).String()
+			// Local attribute sources add to what the source knows about the user
+			if err = i.setUserAttributes(user, req); err != nil {
+				return err
+			}
+			i.Auditor.LogSuccess(user, req, UpstreamLogin)
+			log.Infof("successful login for %s with %s", user.Name, source.Name())
+			return i.respond(req, user, w, r)
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// DefaultDiscoveryHandler is the default implementation for the discovery handler, which lets users choose where to log in when there are authentication sources. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultDiscoveryHandler() (http.HandlerFunc, error) {
+	templ, err := template.New("discovery").Parse(discoveryTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			requestID := r.Form.Get("requestId")
+			if _, err := i.TempCache.Get(requestID); err != nil {
+				return errors.New("login request has expired")
+			}
+			local := viper.GetBool("discovery-local-login")
+			switch choice := r.Form.Get("source"); choice {
+			case "":
+				type choice struct {
+					Name        string
+					DisplayName string
+				}
+				data := struct {
+					RequestID string
+					Local     bool
+					Sources   []choice
+				}{RequestID: requestID, Local: local}
+				for _, source := range i.AuthenticationSources {
+					data.Sources = append(data.Sources, choice{source.Name(), source.DisplayName()})
+				}
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				return templ.Execute(w, data)
+			case localSource:
+				if !local {
+					return errPasswordLoginDisabled
+				}
+				http.Redirect(w, r, fmt.Sprintf("/ui/login.html?requestId=%s", url.QueryEscape(requestID)),
+					http.StatusFound)
+				return nil
+			default:
+				source, ok := i.authenticationSource(choice)
+				if !ok {
+					return fmt.Errorf("unknown authentication source %s", choice)
+				}
+				browser, err := randomToken()
+				if err != nil {
+					return err
+				}
+				if err = i.TempCache.Set(upstreamBrowserKey(requestID), []byte(browser)); err != nil {
+					return err
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     upstreamCookie,
+					Path:     "/",
+					Value:    browser,
+					MaxAge:   int(viper.GetDuration("temp-cache-duration").Seconds()),
+					Secure:   true,
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+				log.Infof("sending user to %s", source.Name())
+				return source.Login(w, r, []byte(requestID))
+			}
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}, nil
+}
+
+const discoveryTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Choose your organization</title>
+</head>
+<body>
+<h1>Choose your organization</h1>
+<ul>
+{{ range .Sources }}<li><a href="?requestId={{ $.RequestID }}&amp;source={{ .Name }}">{{ .DisplayName }}</a></li>
+{{ end }}{{ if .Local }}<li><a href="?requestId={{ .RequestID }}&amp;source=local">Log in with a password</a></li>
+{{ end }}</ul>
+</body>
+</html>`
@@ -0,0 +1,236 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSource logs in everyone as joe
+type fakeSource struct{}
+
+func (fakeSource) Name() string {
+	return "partner"
+}
+
+func (fakeSource) DisplayName() string {
+	return "Partner University"
+}
+
+func (fakeSource) Login(w http.ResponseWriter, r *http.Request, state []byte) error {
+	http.Redirect(w, r, "/upstream/partner/done?state="+url.QueryEscape(string(state)), http.StatusFound)
+	return nil
+}
+
+func (fakeSource) Handler(done AuthenticationCallback) (http.Handler, error) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/done" {
+			http.NotFound(w, r)
+			return
+		}
+		done(w, r, []byte(r.URL.Query().Get("state")), &model.User{Name: "joe",
+			Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"})
+	}), nil
+}
+
+func TestIDP_upstreamLogin(t *testing.T) {
+	i := &IDP{AuthenticationSources: []AuthenticationSource{fakeSource{}}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	service := &CASService{ServicePattern: `https://portal\.example\.com/.*`}
+	if err := service.compilePattern(); err != nil {
+		t.Fatal(err)
+	}
+	i.casServices = []*CASService{service}
+	// The browser keeps the cookie tying it to its login
+	var browser *http.Cookie
+	get := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if browser != nil {
+			r.AddCookie(browser)
+		}
+		w := httptest.NewRecorder()
+		ts.Config.Handler.ServeHTTP(w, r)
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == upstreamCookie {
+				browser = cookie
+			}
+		}
+		return w
+	}
+
+	// Users without a session choose where to log in
+	serviceURL := "https://portal.example.com/app"
+	start := func() *url.URL {
+		w := get("/cas/login?" + url.Values{"service": {serviceURL}}.Encode())
+		if !assert.Equal(t, http.StatusTemporaryRedirect, w.Code) {
+			t.FailNow()
+		}
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return location
+	}
+	location := start()
+	assert.Equal(t, "/discovery", location.Path)
+	requestID := location.Query().Get("requestId")
+
+	w := get(location.String())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Partner University")
+	assert.Contains(t, w.Body.String(), "source=local")
+
+	w = get("/discovery?" + url.Values{"requestId": {requestID}, "source": {"local"}}.Encode())
+	assert.Equal(t, "/ui/login.html?requestId="+url.QueryEscape(requestID), w.Header().Get("Location"))
+	w = get("/discovery?" + url.Values{"requestId": {requestID}, "source": {"other"}}.Encode())
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = get("/discovery?" + url.Values{"requestId": {"expired"}, "source": {"partner"}}.Encode())
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The source sends the user back and the original request is answered
+	w = get("/discovery?" + url.Values{"requestId": {requestID}, "source": {"partner"}}.Encode())
+	if !assert.Equal(t, http.StatusFound, w.Code) {
+		t.FailNow()
+	}
+	callback := w.Header().Get("Location")
+	w = get(callback)
+	if !assert.Equal(t, http.StatusFound, w.Code, w.Body.String()) {
+		t.FailNow()
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "portal.example.com", location.Host)
+	w = get("/cas/serviceValidate?" + url.Values{"service": {serviceURL}, "ticket": {location.Query().Get("ticket")}}.Encode())
+	assert.Contains(t, w.Body.String(), "<cas:user>joe</cas:user>")
+
+	// Logins can't be finished twice
+	assert.Equal(t, http.StatusBadRequest, get(callback).Code)
+
+	// Logins can't be finished by another browser, such as a victim sent the response to an attacker's login
+	requestID = start().Query().Get("requestId")
+	w = get("/discovery?" + url.Values{"requestId": {requestID}, "source": {"partner"}}.Encode())
+	browser = nil
+	w = get(w.Header().Get("Location"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "another browser")
+	requestID = start().Query().Get("requestId")
+
+	// Passwords are refused when the discovery page doesn't offer them
+	viper.Set("discovery-local-login", false)
+	defer viper.Set("discovery-local-login", true)
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/ui/login.html", strings.NewReader(url.Values{
+		"requestId": {requestID}, "username": {"joe"}, "password": {"password"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	i.DefaultPasswordLoginHandler()(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func Test_samlSource_user(t *testing.T) {
+	source := &samlSource{entityID: "https://idp.example.com/", upstream: UpstreamIdP{
+		EntityID:   "https://partner.example.com/",
+		Attributes: []AttributeMapping{{Upstream: "urn:oid:0.9.2342.19200300.100.1.3", Attribute: "mail"}, {Upstream: "memberOf"}},
+		AuthnContexts: []ContextMapping{{Upstream: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+			Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"}},
+	}}
+	assertion := func() *saml.Assertion {
+		return &saml.Assertion{
+			Issuer: &saml.Issuer{Value: "https://partner.example.com/"},
+			Subject: &saml.Subject{NameID: &saml.NameID{Value: "joe",
+				Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"}},
+			Conditions: &saml.Conditions{AudienceRestriction: &saml.AudienceRestriction{
+				Audience: []string{"https://idp.example.com/"}}},
+			AuthnStatement: &saml.AuthnStatement{AuthnContext: &saml.AuthnContext{
+				AuthnContextClassRef: "urn:oasis:names:tc:SAML:2.0:ac:classes:X509"}},
+			AttributeStatement: &saml.AttributeStatement{Attribute: []saml.Attribute{
+				{Name: "urn:oid:0.9.2342.19200300.100.1.3", AttributeValue: []saml.AttributeValue{{Value: "joe@partner.example.com"}}},
+				{Name: "memberOf", AttributeValue: []saml.AttributeValue{{Value: "a"}, {Value: "b"}}},
+				{Name: "secret", AttributeValue: []saml.AttributeValue{{Value: "hidden"}}},
+			}},
+		}
+	}
+	user, err := source.user(assertion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "joe@https://partner.example.com/", user.Name)
+	assert.Equal(t, nameIDUnspecified, user.Format)
+	assert.Empty(t, user.Context, "unmapped context classes were trusted")
+	assert.Equal(t, []*model.Attribute{
+		{Name: "mail", Value: []string{"joe@partner.example.com"}},
+		{Name: "memberOf", Value: []string{"a", "b"}},
+	}, user.Attributes)
+
+	mapped := assertion()
+	mapped.AuthnStatement.AuthnContext.AuthnContextClassRef = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	user, err = source.user(mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport", user.Context)
+
+	// Without mappings no attributes are kept
+	source.upstream.Attributes = nil
+	user, err = source.user(assertion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, user.Attributes)
+
+	// Users can be named by an attribute instead
+	source.upstream.NameAttribute = "urn:oid:0.9.2342.19200300.100.1.3"
+	user, err = source.user(assertion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "joe@partner.example.com@https://partner.example.com/", user.Name,
+		"names outside the identity provider's scopes weren't qualified")
+	source.upstream.NameScopes = []string{"partner.example.com"}
+	user, err = source.user(assertion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "joe@partner.example.com", user.Name)
+	source.upstream.NameScopes = nil
+	source.upstream.NameAttribute = "eppn"
+	_, err = source.user(assertion())
+	assert.Error(t, err)
+	source.upstream.NameAttribute = ""
+
+	other := assertion()
+	other.Issuer.Value = "https://other.example.com/"
+	_, err = source.user(other)
+	assert.Error(t, err)
+	other = assertion()
+	other.Conditions.AudienceRestriction.Audience = []string{"https://sp.example.com/"}
+	_, err = source.user(other)
+	assert.Error(t, err)
+	other = assertion()
+	other.Subject.NameID = nil
+	_, err = source.user(other)
+	assert.Error(t, err)
+}
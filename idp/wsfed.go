@@ -0,0 +1,426 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/saml11"
+	"github.com/amdonov/lite-idp/wsfed"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// wsfedBinding marks saved authentication requests that are answered with a WS-Federation sign in response
+const wsfedBinding = "urn:lite-idp:wsfed:signin"
+
+// Token types of relying parties
+const (
+	tokenSAML11 = "saml11"
+	tokenSAML20 = "saml2"
+)
+
+// RelyingParty is a WS-Federation relying party
+type RelyingParty struct {
+	// Realm (wtrealm) of the relying party. It's the audience of the relying party's tokens.
+	Realm string
+	// URLs the relying party's tokens may be posted to. The first one is used when a request doesn't include wreply.
+	ReplyURLs []string
+	// Type of token issued to the relying party. Either saml11 (the default) or saml2.
+	TokenType string
+	// Names of the attributes released to the relying party. All attributes are released when empty.
+	ReleaseAttributes []string
+	// Rules limiting who can use the relying party. Every user can when empty.
+	AccessRules []AccessRule
+}
+
+// accessControl returns a service provider with the relying party's access rules. WS-Federation doesn't have a way
+// to report denials to the relying party, so users are shown the access denied page.
+func (rp *RelyingParty) accessControl() *ServiceProvider {
+	page := true
+	return &ServiceProvider{EntityID: rp.Realm, AccessRules: rp.AccessRules, AccessDeniedPage: &page}
+}
+
+// releasedAttributes returns the attributes the relying party is allowed to receive
+func (rp *RelyingParty) releasedAttributes(atts []*model.Attribute) []*model.Attribute {
+	return (&ServiceProvider{ReleaseAttributes: rp.ReleaseAttributes}).releasedAttributes(atts)
+}
+
+// replyURL returns the URL the relying party's token is posted to. The requested URL must be registered.
+func (rp *RelyingParty) replyURL(requested string) (string, error) {
+	if requested == "" {
+		return rp.ReplyURLs[0], nil
+	}
+	for _, url := range rp.ReplyURLs {
+		if url == requested {
+			return url, nil
+		}
+	}
+	return "", fmt.Errorf("wreply %s is not registered for %s", requested, rp.Realm)
+}
+
+// tokenType returns the type of token issued to the relying party
+func (rp *RelyingParty) tokenType() string {
+	if rp.TokenType == "" {
+		return tokenSAML11
+	}
+	return rp.TokenType
+}
+
+func (i *IDP) configureWSFed() error {
+	i.wsfedLocation = fmt.Sprintf("https://%s%s", i.serverName, viper.GetString("wsfed-path"))
+	templ, err := template.New("wsfed").Parse(wsfedTemplate)
+	if err != nil {
+		return err
+	}
+	i.wsfedTemplate = templ
+	rps := []*RelyingParty{}
+	if err := viper.UnmarshalKey("wsfed-relying-parties", &rps); err != nil {
+		return err
+	}
+	i.relyingParties = make(map[string]*RelyingParty, len(rps))
+	for _, rp := range rps {
+		if rp.Realm == "" {
+			return errors.New("WS-Federation relying party does not specify a realm")
+		}
+		if len(rp.ReplyURLs) == 0 {
+			return fmt.Errorf("WS-Federation relying party %s does not have a reply URL", rp.Realm)
+		}
+		switch rp.TokenType {
+		case "", tokenSAML11, tokenSAML20:
+		default:
+			return fmt.Errorf("unsupported token type %s for %s", rp.TokenType, rp.Realm)
+		}
+		if err := rp.accessControl().validateAccessRules(); err != nil {
+			return fmt.Errorf("invalid access rule for %s: %s", rp.Realm, err)
+		}
+		i.relyingParties[rp.Realm] = rp
+	}
+	return nil
+}
+
+// DefaultWSFedHandler is the default implementation for the WS-Federation passive requestor handler. Users share their session with SAML service providers. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultWSFedHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			switch action := r.Form.Get("wa"); action {
+			case wsfed.SignIn:
+				return i.wsfedSignIn(w, r)
+			case wsfed.SignOut, wsfed.SignOutCleanup:
+				return i.wsfedSignOut(w, r)
+			default:
+				return fmt.Errorf("unsupported WS-Federation action %s", action)
+			}
+		}()
+		if err != nil {
+			log.Error(err)
+			i.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+func (i *IDP) wsfedSignIn(w http.ResponseWriter, r *http.Request) error {
+	realm := r.Form.Get("wtrealm")
+	rp, ok := i.relyingParties[realm]
+	if !ok {
+		return fmt.Errorf("sign in request from unregistered realm %s", realm)
+	}
+	reply, err := rp.replyURL(r.Form.Get("wreply"))
+	if err != nil {
+		return err
+	}
+	log.Infof("received sign in request from %s", realm)
+	timestamp, err := ptypes.TimestampProto(time.Now())
+	if err != nil {
+		return err
+	}
+	req := &model.AuthnRequest{
+		ID:                          uuid.New().String(),
+		IssueInstant:                timestamp,
+		Issuer:                      realm,
+		AssertionConsumerServiceURL: reply,
+		ProtocolBinding:             wsfedBinding,
+		RelayState:                  r.Form.Get("wctx"),
+	}
+	// wfresh=0 asks for the user to log in again
+	if r.Form.Get("wfresh") != "0" {
+		if user := i.getUserFromSession(r); user != nil {
+			return i.respond(req, user, w, r)
+		}
+	}
+	if user, err := i.loginWithCert(r, req); user != nil {
+		return i.respond(req, user, w, r)
+	} else if err != nil {
+		return err
+	}
+	return i.showLoginForm(req, w, r)
+}
+
+// wsfedSignOut ends the user's session and returns them to the relying party
+func (i *IDP) wsfedSignOut(w http.ResponseWriter, r *http.Request) error {
+	reply := r.Form.Get("wreply")
+	if reply != "" && !i.isReplyURL(reply) {
+		return fmt.Errorf("wreply %s is not registered", reply)
+	}
+	i.endSession(w, r)
+	if reply != "" {
+		http.Redirect(w, r, reply, http.StatusFound)
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := w.Write([]byte("You have been signed out."))
+	return err
+}
+
+// isReplyURL reports whether the URL is registered for a relying party
+func (i *IDP) isReplyURL(url string) bool {
+	for _, rp := range i.relyingParties {
+		if _, err := rp.replyURL(url); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sendWSFedResponse posts a signed token for the user to the relying party
+func (i *IDP) sendWSFedResponse(authRequest *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) error {
+	rp, ok := i.relyingParties[authRequest.Issuer]
+	if !ok {
+		return fmt.Errorf("%s is no longer a registered relying party", authRequest.Issuer)
+	}
+	now := time.Now().UTC()
+	conditions := makeConditions(now, rp.Realm, nil)
+	expires := conditions.NotOnOrAfter
+	var (
+		token     interface{}
+		tokenType string
+		err       error
+	)
+	released := &model.User{
+		Name:            user.Name,
+		Format:          user.Format,
+		Context:         user.Context,
+		IP:              user.IP,
+		Attributes:      rp.releasedAttributes(user.Attributes),
+		X509Certificate: user.X509Certificate,
+	}
+	if rp.tokenType() == tokenSAML20 {
+		tokenType = wsfed.TokenTypeSAML20
+		nameID, err := i.makeNameID(user, rp.Realm, nil)
+		if err != nil {
+			return err
+		}
+		assertion := i.makeSubjectResponse("", rp.Realm, nil, nameID, released.Attributes).Assertion
+		i.addAuthnStatement(assertion, authRequest, released)
+		// The request ID is only meaningful to lite-idp
+		assertion.Subject.SubjectConfirmation.SubjectConfirmationData.InResponseTo = ""
+		expires = assertion.Conditions.NotOnOrAfter
+		if assertion.Signature, err = i.signer.CreateSignature(assertion); err != nil {
+			return err
+		}
+		token = assertion
+	} else {
+		tokenType = wsfed.TokenTypeSAML11
+		assertion := i.makeSAML11Assertion(rp, released, now, conditions)
+		if assertion.Signature, err = i.signer.CreateSignature(assertion); err != nil {
+			return err
+		}
+		token = assertion
+	}
+	signed, err := xml.Marshal(token)
+	if err != nil {
+		return err
+	}
+	rstr := &wsfed.RequestSecurityTokenResponse{
+		Lifetime:               &wsfed.Lifetime{Created: now, Expires: expires},
+		AppliesTo:              wsfed.NewAppliesTo(rp.Realm),
+		RequestedSecurityToken: wsfed.RequestedSecurityToken{Token: string(signed)},
+		TokenType:              tokenType,
+		RequestType:            wsfed.RequestTypeIssue,
+		KeyType:                wsfed.KeyTypeBearer,
+	}
+	result, err := xml.Marshal(rstr)
+	if err != nil {
+		return err
+	}
+	log.Infof("sending %s token for %s to %s", rp.tokenType(), user.Name, rp.Realm)
+	data := struct {
+		Action  string
+		Reply   string
+		Result  string
+		Context string
+	}{
+		wsfed.SignIn,
+		authRequest.AssertionConsumerServiceURL,
+		string(result),
+		authRequest.RelayState,
+	}
+	return i.wsfedTemplate.Execute(w, data)
+}
+
+// makeSAML11Assertion creates a SAML 1.1 assertion about the user for the relying party
+func (i *IDP) makeSAML11Assertion(rp *RelyingParty, user *model.User, now time.Time,
+	conditions *saml.Conditions) *saml11.Assertion {
+	subject := saml11.Subject{
+		NameIdentifier: &saml11.NameIdentifier{
+			Format: user.Format,
+			Value:  user.Name,
+		},
+		SubjectConfirmation: &saml11.SubjectConfirmation{
+			ConfirmationMethod: []string{saml11.ConfirmationBearer},
+		},
+	}
+	assertion := &saml11.Assertion{
+		MajorVersion: 1,
+		MinorVersion: 1,
+		AssertionID:  saml.NewID(),
+		Issuer:       i.entityID,
+		IssueInstant: now,
+		Conditions: &saml11.Conditions{
+			NotBefore:    conditions.NotBefore,
+			NotOnOrAfter: conditions.NotOnOrAfter,
+			AudienceRestrictionCondition: &saml11.AudienceRestrictionCondition{
+				Audience: []string{rp.Realm},
+			},
+		},
+		AuthenticationStatement: &saml11.AuthenticationStatement{
+			AuthenticationMethod:  authenticationMethod(user.Context),
+			AuthenticationInstant: now,
+			Subject:               subject,
+		},
+	}
+	namespace := viper.GetString("wsfed-attribute-namespace")
+	var atts []saml11.Attribute
+	for _, att := range user.Attributes {
+		// SAML 1.1 requires a value
+		if len(att.Value) == 0 {
+			continue
+		}
+		// Relying parties join the namespace and name to get the claim type
+		attribute := saml11.Attribute{
+			AttributeName:      att.Name,
+			AttributeNamespace: namespace,
+			AttributeValue:     att.Value,
+		}
+		if j := strings.LastIndex(att.Name, "/"); strings.Contains(att.Name, "://") && j < len(att.Name)-1 {
+			attribute.AttributeNamespace, attribute.AttributeName = att.Name[:j], att.Name[j+1:]
+		}
+		atts = append(atts, attribute)
+	}
+	if len(atts) > 0 {
+		assertion.AttributeStatement = &saml11.AttributeStatement{
+			Subject:   subject,
+			Attribute: atts,
+		}
+	}
+	return assertion
+}
+
+// authenticationMethod returns the SAML 1.1 authentication method for a SAML 2.0 authentication context
+func authenticationMethod(context string) string {
+	switch context {
+	case "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+		"urn:oasis:names:tc:SAML:2.0:ac:classes:Password":
+		return saml11.MethodPassword
+	case "urn:oasis:names:tc:SAML:2.0:ac:classes:X509", "urn:oasis:names:tc:SAML:2.0:ac:classes:TLSClient":
+		return saml11.MethodTLSClient
+	default:
+		return saml11.MethodUnspecified
+	}
+}
+
+// DefaultWSFedMetadataHandler is the default implementation for the WS-Federation metadata handler. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultWSFedMetadataHandler() (http.HandlerFunc, error) {
+	docs, err := i.newMetadataDocuments(func(now time.Time) (map[string][]byte, error) {
+		ed := i.wsfedEntityDescriptor(now)
+		ed.ValidUntil, ed.CacheDuration = i.metadataValidity(now)
+		metadata, err := i.signMetadata(ed, &ed.Signature)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{"": metadata}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		metadata, modified, _, err := docs.get("")
+		if err != nil {
+			log.Error(err)
+			i.Error(w, "failed to generate metadata", http.StatusInternalServerError)
+			return
+		}
+		i.serveMetadata(w, r, metadata, modified)
+	}, nil
+}
+
+func (i *IDP) wsfedEntityDescriptor(now time.Time) *wsfed.EntityDescriptor {
+	role := wsfed.NewSecurityTokenServiceDescriptor()
+	for _, key := range i.keystore.published(now) {
+		role.KeyDescriptor = append(role.KeyDescriptor, keyDescriptor("signing", key.certificate.Certificate[0]))
+	}
+	role.TokenTypesOffered.TokenType = []wsfed.TokenType{
+		{URI: wsfed.TokenTypeSAML11},
+		{URI: wsfed.TokenTypeSAML20},
+	}
+	role.SecurityTokenServiceEndpoint.EndpointReference.Address = i.stsLocation
+	role.PassiveRequestorEndpoint.EndpointReference.Address = i.wsfedLocation
+	return &wsfed.EntityDescriptor{
+		EntityDescriptor: saml.EntityDescriptor{
+			ID:       saml.NewID(),
+			EntityID: i.entityID,
+		},
+		RoleDescriptor: role,
+	}
+}
+
+// The token is HTML escaped because it's XML
+const wsfedTemplate = `<!DOCTYPE html>
+<html lang="en">
+<body onload="document.getElementById('wsfedpost').submit()">
+<noscript>
+<p>
+<strong>Note:</strong> Since your browser does not support JavaScript,
+you must press the Continue button once to proceed.
+</p>
+</noscript>
+<form action="{{ html .Reply }}" method="post" id="wsfedpost">
+<div>
+<input type="hidden" name="wa" value="{{ .Action }}"/>
+<input type="hidden" name="wresult" value="{{ html .Result }}"/>
+{{ if .Context }}<input type="hidden" name="wctx" value="{{ html .Context }}"/>{{ end }}
+</div>
+<noscript>
+<div>
+<input type="submit" value="Continue"/>
+</div>
+</noscript>
+</form>
+</body>
+</html>`
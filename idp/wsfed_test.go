@@ -0,0 +1,191 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml11"
+	"github.com/amdonov/lite-idp/wsfed"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_wsfedSignIn(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	i.relyingParties["urn:sharepoint:portal"] = &RelyingParty{
+		Realm:             "urn:sharepoint:portal",
+		ReplyURLs:         []string{"https://portal.example.com/_trust/", "https://portal.example.com/other/"},
+		ReleaseAttributes: []string{"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress", "memberOf"},
+	}
+
+	user := &model.User{Name: "joe", Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+		Attributes: []*model.Attribute{
+			{Name: "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress", Value: []string{"joe@example.com"}},
+			{Name: "memberOf", Value: []string{"a", "b"}},
+			{Name: "secret", Value: []string{"hidden"}},
+		}}
+	data, err := proto.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.UserCache.Set("session", data)
+
+	signIn := func(params url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/wsfed?"+params.Encode(), nil)
+		r.AddCookie(&http.Cookie{Name: i.cookieName, Value: "session"})
+		w := httptest.NewRecorder()
+		i.DefaultWSFedHandler()(w, r)
+		return w
+	}
+	formValue := func(body, name string) string {
+		marker := `name="` + name + `" value="`
+		start := strings.Index(body, marker)
+		if start < 0 {
+			return ""
+		}
+		body = body[start+len(marker):]
+		return html.UnescapeString(body[:strings.Index(body, `"`)])
+	}
+
+	// Unregistered realms and reply URLs are rejected
+	params := url.Values{"wa": {wsfed.SignIn}, "wtrealm": {"urn:unknown"}}
+	assert.Equal(t, http.StatusBadRequest, signIn(params).Code)
+	params.Set("wtrealm", "urn:sharepoint:portal")
+	params.Set("wreply", "https://evil.example.com/")
+	assert.Equal(t, http.StatusBadRequest, signIn(params).Code)
+
+	params.Set("wreply", "https://portal.example.com/other/")
+	params.Set("wctx", "rm=0&id=passive")
+	w := signIn(params)
+	if !assert.Equal(t, http.StatusOK, w.Code) {
+		t.FailNow()
+	}
+	body := w.Body.String()
+	assert.Contains(t, body, `action="https://portal.example.com/other/"`)
+	assert.Equal(t, wsfed.SignIn, formValue(body, "wa"))
+	assert.Equal(t, "rm=0&id=passive", formValue(body, "wctx"))
+
+	rstr := &wsfed.RequestSecurityTokenResponse{}
+	if err := xml.Unmarshal([]byte(formValue(body, "wresult")), rstr); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, wsfed.TokenTypeSAML11, rstr.TokenType)
+	assert.Equal(t, "urn:sharepoint:portal", rstr.AppliesTo.EndpointReference.Address)
+	ref, err := i.validator.ValidateWithKeys(rstr.RequestedSecurityToken.Token, i.publicKeys()...)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assertion := &saml11.Assertion{}
+	if err := xml.Unmarshal([]byte(ref.XML), assertion); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, assertion.AssertionID, ref.ID)
+	assert.Equal(t, i.entityID, assertion.Issuer)
+	assert.Equal(t, []string{"urn:sharepoint:portal"}, assertion.Conditions.AudienceRestrictionCondition.Audience)
+	assert.Equal(t, saml11.MethodPassword, assertion.AuthenticationStatement.AuthenticationMethod)
+	assert.Equal(t, "joe", assertion.AuthenticationStatement.Subject.NameIdentifier.Value)
+	if assert.NotNil(t, assertion.AttributeStatement) && assert.Len(t, assertion.AttributeStatement.Attribute, 2) {
+		email := assertion.AttributeStatement.Attribute[0]
+		assert.Equal(t, "http://schemas.xmlsoap.org/ws/2005/05/identity/claims", email.AttributeNamespace)
+		assert.Equal(t, "emailaddress", email.AttributeName)
+		groups := assertion.AttributeStatement.Attribute[1]
+		assert.Equal(t, "http://schemas.xmlsoap.org/claims", groups.AttributeNamespace)
+		assert.Equal(t, "memberOf", groups.AttributeName)
+		assert.Equal(t, []string{"a", "b"}, groups.AttributeValue)
+	}
+
+	// SAML 2.0 tokens are confirmed for the reply URL
+	i.relyingParties["urn:sharepoint:portal"].TokenType = tokenSAML20
+	params.Del("wreply")
+	body = signIn(params).Body.String()
+	assert.Contains(t, body, `action="https://portal.example.com/_trust/"`)
+	rstr = &wsfed.RequestSecurityTokenResponse{}
+	if err := xml.Unmarshal([]byte(formValue(body, "wresult")), rstr); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, wsfed.TokenTypeSAML20, rstr.TokenType)
+	ref, err = i.validator.ValidateWithKeys(rstr.RequestedSecurityToken.Token, i.publicKeys()...)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Assertion", ref.Name.Local)
+		assert.Contains(t, ref.XML, `Recipient="https://portal.example.com/_trust/"`)
+		assert.NotContains(t, ref.XML, "InResponseTo")
+	}
+}
+
+func TestIDP_wsfedSignOut(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	i.relyingParties["urn:app"] = &RelyingParty{
+		Realm:     "urn:app",
+		ReplyURLs: []string{"https://app.example.com/"},
+	}
+	i.UserCache.Set("session", []byte{})
+
+	signOut := func(params url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/wsfed?"+params.Encode(), nil)
+		r.AddCookie(&http.Cookie{Name: i.cookieName, Value: "session"})
+		w := httptest.NewRecorder()
+		i.DefaultWSFedHandler()(w, r)
+		return w
+	}
+
+	// Users are only sent to registered reply URLs
+	w := signOut(url.Values{"wa": {wsfed.SignOut}, "wreply": {"https://evil.example.com/"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	_, err := i.UserCache.Get("session")
+	assert.NoError(t, err)
+
+	w = signOut(url.Values{"wa": {wsfed.SignOut}, "wreply": {"https://app.example.com/"}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://app.example.com/", w.Header().Get("Location"))
+	assert.Contains(t, w.Header().Get("Set-Cookie"), "Max-Age=0")
+	_, err = i.UserCache.Get("session")
+	assert.Error(t, err)
+
+	w = signOut(url.Values{"wa": {wsfed.SignOutCleanup}})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestIDP_wsfedMetadata(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	w := httptest.NewRecorder()
+	i.WSFedMetadataHandler(w, httptest.NewRequest(http.MethodGet, "/FederationMetadata/2007-06/FederationMetadata.xml", nil))
+	if !assert.Equal(t, http.StatusOK, w.Code) {
+		t.FailNow()
+	}
+	ref, err := i.validator.ValidateWithKeys(w.Body.String(), i.publicKeys()...)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "EntityDescriptor", ref.Name.Local)
+	assert.Contains(t, w.Body.String(), `xmlns:fed="http://docs.oasis-open.org/wsfed/federation/200706"`)
+	assert.Contains(t, ref.XML, `xsi:type="fed:SecurityTokenServiceType"`)
+	assert.Contains(t, ref.XML, i.wsfedLocation)
+	assert.Contains(t, ref.XML, i.stsLocation)
+	assert.Contains(t, ref.XML, wsfed.TokenTypeSAML11)
+}
@@ -0,0 +1,381 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jwt implements the subset of JSON Web Signature and JSON Web Key needed to issue and verify signed JSON
+// Web Tokens. Tokens are signed with RS256 for RSA keys and ES256, ES384, or ES512 for ECDSA keys.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSignature is returned when a token isn't signed by any of the keys it's verified with
+var ErrInvalidSignature = errors.New("token signature is not valid")
+
+// Header is the JOSE header of a signed token
+type Header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Audience is one or more recipients of a token. A single audience is encoded as a string.
+type Audience []string
+
+// MarshalJSON encodes a single audience as a string
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// UnmarshalJSON accepts an audience encoded as either a string or an array
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// Contains reports whether the recipient is in the audience
+func (a Audience) Contains(recipient string) bool {
+	for _, value := range a {
+		if value == recipient {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims are the registered claims of a token. Embed them in a struct to add other claims.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	Expires   int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Validate checks the issuer, audience, and validity period of the claims. The skew allows for clocks that
+// aren't quite in sync.
+func (c *Claims) Validate(issuer, audience string, now time.Time, skew time.Duration) error {
+	if c.Issuer != issuer {
+		return fmt.Errorf("token was issued by %s", c.Issuer)
+	}
+	if !c.Audience.Contains(audience) {
+		return fmt.Errorf("token is not intended for %s", audience)
+	}
+	if c.Expires == 0 || !now.Add(-skew).Before(time.Unix(c.Expires, 0)) {
+		return errors.New("token has expired")
+	}
+	if c.NotBefore != 0 && now.Add(skew).Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// Signer signs tokens with a private key
+type Signer struct {
+	key       crypto.Signer
+	algorithm string
+	keyID     string
+}
+
+// NewSigner returns a signer for the certificate's private key. The key ID is the certificate's thumbprint.
+func NewSigner(cert tls.Certificate) (*Signer, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("certificate is empty")
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot be used for signing")
+	}
+	algorithm, err := Algorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{
+		key:       key,
+		algorithm: algorithm,
+		keyID:     KeyID(cert.Certificate[0]),
+	}, nil
+}
+
+// Algorithm returns the signature algorithm used with the public key
+func Algorithm(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		case elliptic.P521():
+			return "ES512", nil
+		}
+		return "", fmt.Errorf("unsupported elliptic curve %s", k.Curve.Params().Name)
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// KeyID returns the base64url encoded SHA-256 thumbprint of a DER encoded certificate
+func KeyID(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Algorithm returns the signer's signature algorithm
+func (s *Signer) Algorithm() string {
+	return s.algorithm
+}
+
+// Sign returns the compact serialization of the claims signed with the signer's key. The type is added to the
+// header when it isn't empty.
+func (s *Signer) Sign(typ string, claims interface{}) (string, error) {
+	header, err := json.Marshal(Header{Algorithm: s.algorithm, Type: typ, KeyID: s.keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := hashFor(s.algorithm)
+	h := hash.New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+	var signature []byte
+	switch key := s.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		// JWS uses the fixed length concatenation of R and S rather than ASN.1
+		priv, ok := s.key.(*ecdsa.PrivateKey)
+		if !ok {
+			return "", errors.New("ECDSA signing requires an ecdsa.PrivateKey")
+		}
+		r, ss, err := ecdsa.Sign(rand.Reader, priv, digest)
+		if err != nil {
+			return "", err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(pad(r.Bytes(), size), pad(ss.Bytes(), size)...)
+	default:
+		if signature, err = s.key.Sign(rand.Reader, digest, hash); err != nil {
+			return "", err
+		}
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func hashFor(algorithm string) crypto.Hash {
+	switch algorithm {
+	case "ES384":
+		return crypto.SHA384
+	case "ES512":
+		return crypto.SHA512
+	default:
+		return crypto.SHA256
+	}
+}
+
+// Verify checks that the token was signed by one of the keys and unmarshals its payload into claims. The header is
+// returned so callers can check the token type.
+func Verify(token string, claims interface{}, keys ...crypto.PublicKey) (*Header, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a signed JWT")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %s", err)
+	}
+	header := &Header{}
+	if err = json.Unmarshal(data, header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %s", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %s", err)
+	}
+	hash := hashFor(header.Algorithm)
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	verified := false
+	for _, key := range keys {
+		// The algorithm must match the key so a token can't pick a weaker or different one
+		if algorithm, err := Algorithm(key); err != nil || algorithm != header.Algorithm {
+			continue
+		}
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			verified = rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(signature) == 2*size {
+				r := new(big.Int).SetBytes(signature[:size])
+				s := new(big.Int).SetBytes(signature[size:])
+				verified = ecdsa.Verify(k, digest, r, s)
+			}
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidSignature
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %s", err)
+	}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %s", err)
+	}
+	return header, nil
+}
+
+// JWK is a public JSON Web Key
+type JWK struct {
+	KeyType   string   `json:"kty"`
+	Use       string   `json:"use,omitempty"`
+	KeyID     string   `json:"kid,omitempty"`
+	Algorithm string   `json:"alg,omitempty"`
+	N         string   `json:"n,omitempty"`
+	E         string   `json:"e,omitempty"`
+	Curve     string   `json:"crv,omitempty"`
+	X         string   `json:"x,omitempty"`
+	Y         string   `json:"y,omitempty"`
+	X5C       []string `json:"x5c,omitempty"`
+}
+
+// JWKSet is a set of JSON Web Keys
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK describes the certificate's public key as a signing key
+func NewJWK(cert *x509.Certificate) (JWK, error) {
+	algorithm, err := Algorithm(cert.PublicKey)
+	if err != nil {
+		return JWK{}, err
+	}
+	jwk := JWK{
+		Use:       "sig",
+		KeyID:     KeyID(cert.Raw),
+		Algorithm: algorithm,
+		X5C:       []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = key.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(pad(key.X.Bytes(), size))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pad(key.Y.Bytes(), size))
+	}
+	return jwk, nil
+}
+
+// PublicKey returns the RSA or elliptic curve key described by the JWK
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed key %s: %s", k.KeyID, err)
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %s has an unsupported exponent", k.KeyID)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key %s uses unsupported curve %s", k.KeyID, k.Curve)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("key %s is not on curve %s", k.KeyID, k.Curve)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("key %s has unsupported type %s", k.KeyID, k.KeyType)
+}
+
+// pad left pads a big-endian integer to the size of the curve's coordinates
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
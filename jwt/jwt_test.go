@@ -0,0 +1,158 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+type testClaims struct {
+	Claims
+	Nonce string `json:"nonce"`
+}
+
+func TestSignAndVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		key       crypto.Signer
+		algorithm string
+	}{
+		{rsaKey, "RS256"},
+		{ecKey, "ES384"},
+	} {
+		cert := testcert.New(t, test.key)
+		signer, err := NewSigner(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.algorithm, signer.Algorithm())
+		now := time.Now()
+		token, err := signer.Sign("JWT", testClaims{
+			Claims: Claims{
+				Issuer:   "https://idp.example.com",
+				Subject:  "joe",
+				Audience: Audience{"client"},
+				Expires:  now.Add(time.Minute).Unix(),
+			},
+			Nonce: "n-0S6_WzA2Mj",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := testClaims{}
+		header, err := Verify(token, &claims, other.Public(), test.key.Public())
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.algorithm, header.Algorithm)
+			assert.Equal(t, "JWT", header.Type)
+			assert.Equal(t, KeyID(cert.Certificate[0]), header.KeyID)
+			assert.Equal(t, "n-0S6_WzA2Mj", claims.Nonce)
+			assert.NoError(t, claims.Validate("https://idp.example.com", "client", now, 0))
+			assert.Error(t, claims.Validate("https://idp.example.com", "other", now, 0))
+			assert.Error(t, claims.Validate("https://idp.example.com", "client", now.Add(time.Hour), 0))
+		}
+
+		// Tampering with the payload invalidates the signature
+		parts := strings.Split(token, ".")
+		parts[1] = parts[1][:len(parts[1])-2] + "AA"
+		_, err = Verify(strings.Join(parts, "."), &claims, test.key.Public())
+		assert.Equal(t, ErrInvalidSignature, err)
+		_, err = Verify(token, &claims, other.Public())
+		assert.Equal(t, ErrInvalidSignature, err)
+	}
+}
+
+func TestNewJWK(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testcert.New(t, key)
+	jwk, err := NewJWK(cert.Leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "EC", jwk.KeyType)
+	assert.Equal(t, "P-256", jwk.Curve)
+	assert.Equal(t, "ES256", jwk.Algorithm)
+	assert.Len(t, jwk.X, 43)
+	assert.Len(t, jwk.Y, 43)
+	data, err := json.Marshal(JWKSet{Keys: []JWK{jwk}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), `"n"`)
+}
+
+func TestJWK_PublicKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []crypto.Signer{ecKey, rsaKey} {
+		jwk, err := NewJWK(testcert.New(t, key).Leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public, err := jwk.PublicKey()
+		if assert.NoError(t, err) {
+			assert.Equal(t, key.Public(), public)
+		}
+	}
+	_, err = JWK{KeyType: "EC", Curve: "P-256", X: "AA", Y: "AA"}.PublicKey()
+	assert.Error(t, err)
+	_, err = JWK{KeyType: "oct"}.PublicKey()
+	assert.Error(t, err)
+}
+
+func TestAudience(t *testing.T) {
+	data, err := json.Marshal(Audience{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"a"`, string(data))
+	var audience Audience
+	if assert.NoError(t, json.Unmarshal([]byte(`["a","b"]`), &audience)) {
+		assert.True(t, audience.Contains("b"))
+	}
+	if assert.NoError(t, json.Unmarshal([]byte(`"c"`), &audience)) {
+		assert.Equal(t, Audience{"c"}, audience)
+	}
+}
@@ -75,6 +75,7 @@ func main() {
 	rootCmd.AddCommand(cmd.ServeCmd(&idp.IDP{}))
 	rootCmd.AddCommand(cmd.AddCmd)
 	rootCmd.AddCommand(cmd.HashCmd)
+	rootCmd.AddCommand(cmd.CheckAccessCmd(&idp.IDP{}))
 	rootCmd.AddCommand(cmd.ClusterCmd())
 	Execute()
 }
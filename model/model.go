@@ -62,14 +62,20 @@ func NewAuthnRequest(src *saml.AuthnRequest, relayState string) (*AuthnRequest,
 	if err != nil {
 		return nil, err
 	}
+	// Holder-of-key responses are sent with the binding named by the profile's ProtocolBinding attribute
+	binding, holderOfKey := src.ProtocolBinding, src.ProtocolBinding == saml.HoKSSOBrowser
+	if holderOfKey {
+		binding = src.HoKProtocolBinding
+	}
 	return &AuthnRequest{
 		AssertionConsumerServiceURL:   src.AssertionConsumerServiceURL,
 		AssertionConsumerServiceIndex: src.AssertionConsumerServiceIndex,
 		Destination:                   src.Destination,
 		ID:                            src.ID,
-		ProtocolBinding:               src.ProtocolBinding,
+		ProtocolBinding:               binding,
 		RelayState:                    relayState,
 		IssueInstant:                  t,
 		Issuer:                        src.Issuer,
+		HolderOfKey:                   holderOfKey,
 	}, nil
 }
@@ -33,9 +33,11 @@ type AuthnRequest struct {
 	ProtocolBinding               string               `protobuf:"bytes,7,opt,name=ProtocolBinding,proto3" json:"ProtocolBinding,omitempty"`
 	AssertionConsumerServiceIndex uint32               `protobuf:"varint,8,opt,name=AssertionConsumerServiceIndex,proto3" json:"AssertionConsumerServiceIndex,omitempty"`
 	RelayState                    string               `protobuf:"bytes,9,opt,name=RelayState,proto3" json:"RelayState,omitempty"`
-	XXX_NoUnkeyedLiteral          struct{}             `json:"-"`
-	XXX_unrecognized              []byte               `json:"-"`
-	XXX_sizecache                 int32                `json:"-"`
+	// The service provider asked for a holder-of-key assertion
+	HolderOfKey          bool     `protobuf:"varint,10,opt,name=HolderOfKey,proto3" json:"HolderOfKey,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *AuthnRequest) Reset()         { *m = AuthnRequest{} }
@@ -126,6 +128,13 @@ func (m *AuthnRequest) GetRelayState() string {
 	return ""
 }
 
+func (m *AuthnRequest) GetHolderOfKey() bool {
+	if m != nil {
+		return m.HolderOfKey
+	}
+	return false
+}
+
 // Allows storage of user information to avoid
 // repeated logins, basis of SSO
 type User struct {
@@ -258,11 +267,14 @@ func (m *Attribute) GetValue() []string {
 // Allows storage of data required for artifact
 // response until service provider retrieves it
 type ArtifactResponse struct {
-	User                 *User         `protobuf:"bytes,1,opt,name=User,proto3" json:"User,omitempty"`
-	Request              *AuthnRequest `protobuf:"bytes,2,opt,name=Request,proto3" json:"Request,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
-	XXX_unrecognized     []byte        `json:"-"`
-	XXX_sizecache        int32         `json:"-"`
+	User    *User         `protobuf:"bytes,1,opt,name=User,proto3" json:"User,omitempty"`
+	Request *AuthnRequest `protobuf:"bytes,2,opt,name=Request,proto3" json:"Request,omitempty"`
+	// Second-level status code and message of a rejected request
+	StatusCode           string   `protobuf:"bytes,3,opt,name=StatusCode,proto3" json:"StatusCode,omitempty"`
+	StatusMessage        string   `protobuf:"bytes,4,opt,name=StatusMessage,proto3" json:"StatusMessage,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *ArtifactResponse) Reset()         { *m = ArtifactResponse{} }
@@ -304,6 +316,20 @@ func (m *ArtifactResponse) GetRequest() *AuthnRequest {
 	return nil
 }
 
+func (m *ArtifactResponse) GetStatusCode() string {
+	if m != nil {
+		return m.StatusCode
+	}
+	return ""
+}
+
+func (m *ArtifactResponse) GetStatusMessage() string {
+	if m != nil {
+		return m.StatusMessage
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*AuthnRequest)(nil), "model.AuthnRequest")
 	proto.RegisterType((*User)(nil), "model.User")
@@ -314,33 +340,36 @@ func init() {
 func init() { proto.RegisterFile("model.proto", fileDescriptor_4c16552f9fdb66d8) }
 
 var fileDescriptor_4c16552f9fdb66d8 = []byte{
-	// 438 bytes of a gzipped FileDescriptorProto
+	// 481 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x52, 0x4d, 0x6f, 0xd3, 0x40,
-	0x10, 0x95, 0x9d, 0x2f, 0x3c, 0x0e, 0x50, 0x2d, 0x08, 0xad, 0x8a, 0xa0, 0x56, 0x4e, 0xbe, 0xe0,
-	0x56, 0x41, 0x3d, 0x70, 0x41, 0x84, 0x44, 0x48, 0x96, 0x10, 0x8a, 0xb6, 0xb4, 0xe2, 0xba, 0x49,
-	0xa6, 0xc1, 0x92, 0xbd, 0x1b, 0x76, 0xc7, 0xa8, 0xdc, 0xf9, 0x51, 0xfc, 0x3c, 0xb4, 0x6b, 0xbb,
-	0x32, 0x15, 0xed, 0xcd, 0xef, 0xf9, 0xcd, 0xbc, 0xd9, 0x37, 0x03, 0x71, 0xa5, 0x77, 0x58, 0x66,
-	0x07, 0xa3, 0x49, 0xb3, 0x91, 0x07, 0xc7, 0x27, 0x7b, 0xad, 0xf7, 0x25, 0x9e, 0x7a, 0x72, 0x53,
-	0x5f, 0x9f, 0x52, 0x51, 0xa1, 0x25, 0x59, 0x1d, 0x1a, 0xdd, 0xec, 0xf7, 0x00, 0xa6, 0x8b, 0x9a,
-	0xbe, 0x2b, 0x81, 0x3f, 0x6a, 0xb4, 0xc4, 0x9e, 0x40, 0x98, 0xaf, 0x78, 0x90, 0x04, 0x69, 0x24,
-	0xc2, 0x7c, 0xc5, 0x38, 0x4c, 0xae, 0xd0, 0xd8, 0x42, 0x2b, 0x1e, 0x7a, 0xb2, 0x83, 0xec, 0x3d,
-	0x4c, 0x73, 0x6b, 0x6b, 0xcc, 0x95, 0x25, 0xa9, 0x88, 0x0f, 0x92, 0x20, 0x8d, 0xe7, 0xc7, 0x59,
-	0x63, 0x99, 0x75, 0x96, 0xd9, 0xd7, 0xce, 0x52, 0xfc, 0xa3, 0x67, 0x2f, 0x60, 0xec, 0xb1, 0xe1,
-	0x43, 0xdf, 0xb8, 0x45, 0x2c, 0x81, 0x78, 0x85, 0x96, 0x0a, 0x25, 0xc9, 0xb9, 0x8e, 0xfc, 0xcf,
-	0x3e, 0xc5, 0x3e, 0xc0, 0xcb, 0x85, 0xb5, 0x68, 0x1c, 0x58, 0x6a, 0x65, 0xeb, 0x0a, 0xcd, 0x05,
-	0x9a, 0x9f, 0xc5, 0x16, 0x2f, 0xc5, 0x67, 0x3e, 0xf6, 0x15, 0x0f, 0x49, 0x58, 0x0a, 0x4f, 0xd7,
-	0x6e, 0xbe, 0xad, 0x2e, 0x3f, 0x16, 0x6a, 0x57, 0xa8, 0x3d, 0x9f, 0xf8, 0xaa, 0xbb, 0x34, 0x5b,
-	0xc1, 0xab, 0xfb, 0x1a, 0xe5, 0x6a, 0x87, 0x37, 0xfc, 0x51, 0x12, 0xa4, 0x8f, 0xc5, 0xc3, 0x22,
-	0xf6, 0x1a, 0x40, 0x60, 0x29, 0x7f, 0x5d, 0x90, 0x24, 0xe4, 0x91, 0xb7, 0xea, 0x31, 0xb3, 0x3f,
-	0x01, 0x0c, 0x2f, 0x2d, 0x1a, 0xc6, 0x60, 0xf8, 0x45, 0x56, 0xd8, 0x2e, 0xc0, 0x7f, 0xbb, 0xa0,
-	0x3e, 0x69, 0x53, 0x49, 0x6a, 0x37, 0xd0, 0x22, 0xb7, 0x9a, 0xa5, 0x56, 0x84, 0x37, 0x4d, 0xf6,
-	0x91, 0xe8, 0xa0, 0x5f, 0xe2, 0xba, 0x8d, 0x35, 0xcc, 0xd7, 0xec, 0x0c, 0x60, 0x41, 0x64, 0x8a,
-	0x4d, 0x4d, 0x68, 0xf9, 0x28, 0x19, 0xa4, 0xf1, 0xfc, 0x28, 0x6b, 0xee, 0xe5, 0xf6, 0x87, 0xe8,
-	0x69, 0x5c, 0x40, 0xdf, 0xce, 0xcf, 0xde, 0x2d, 0xdd, 0x9b, 0xae, 0x8b, 0xad, 0x9b, 0xda, 0xc5,
-	0x3a, 0x15, 0x77, 0xe9, 0xd9, 0x39, 0x44, 0xb7, 0x75, 0xff, 0x1d, 0xff, 0x39, 0x8c, 0xae, 0x64,
-	0x59, 0x23, 0x0f, 0x93, 0x41, 0x1a, 0x89, 0x06, 0xcc, 0x36, 0x70, 0xb4, 0x70, 0x4d, 0xe4, 0x96,
-	0x04, 0xda, 0x83, 0x56, 0x16, 0xd9, 0x49, 0x13, 0x82, 0xaf, 0x8e, 0xe7, 0x71, 0x3b, 0xa0, 0xa3,
-	0x44, 0x93, 0xce, 0x1b, 0x98, 0xb4, 0x77, 0xea, 0xa3, 0x88, 0xe7, 0xcf, 0xba, 0x47, 0xf4, 0x4e,
-	0x58, 0x74, 0x9a, 0xcd, 0xd8, 0xdf, 0xe0, 0xdb, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff, 0x6d, 0x90,
-	0x64, 0xb4, 0x1a, 0x03, 0x00, 0x00,
+	0x10, 0x95, 0x9d, 0xaf, 0x7a, 0x9c, 0x42, 0xb5, 0x20, 0xb4, 0x2a, 0x82, 0x5a, 0x11, 0x07, 0x5f,
+	0x70, 0xab, 0xa0, 0x1e, 0xb8, 0x20, 0x42, 0x22, 0x84, 0xc5, 0x57, 0xb4, 0xa5, 0x15, 0xd7, 0x4d,
+	0x3c, 0x09, 0x96, 0xec, 0xdd, 0xb0, 0xbb, 0x46, 0xed, 0x1f, 0x42, 0xfc, 0x04, 0x7e, 0x1e, 0xda,
+	0xb5, 0x5d, 0xb9, 0x15, 0xed, 0xcd, 0xef, 0xf9, 0xcd, 0xce, 0xcc, 0x7b, 0x03, 0x61, 0x29, 0x33,
+	0x2c, 0x92, 0x9d, 0x92, 0x46, 0x92, 0x81, 0x03, 0x87, 0x47, 0x5b, 0x29, 0xb7, 0x05, 0x1e, 0x3b,
+	0x72, 0x55, 0x6d, 0x8e, 0x4d, 0x5e, 0xa2, 0x36, 0xbc, 0xdc, 0xd5, 0xba, 0xc9, 0xef, 0x1e, 0x8c,
+	0x67, 0x95, 0xf9, 0x21, 0x18, 0xfe, 0xac, 0x50, 0x1b, 0xf2, 0x00, 0xfc, 0x74, 0x41, 0xbd, 0xc8,
+	0x8b, 0x03, 0xe6, 0xa7, 0x0b, 0x42, 0x61, 0x74, 0x81, 0x4a, 0xe7, 0x52, 0x50, 0xdf, 0x91, 0x2d,
+	0x24, 0x6f, 0x60, 0x9c, 0x6a, 0x5d, 0x61, 0x2a, 0xb4, 0xe1, 0xc2, 0xd0, 0x5e, 0xe4, 0xc5, 0xe1,
+	0xf4, 0x30, 0xa9, 0x5b, 0x26, 0x6d, 0xcb, 0xe4, 0x5b, 0xdb, 0x92, 0xdd, 0xd0, 0x93, 0x27, 0x30,
+	0x74, 0x58, 0xd1, 0xbe, 0x7b, 0xb8, 0x41, 0x24, 0x82, 0x70, 0x81, 0xda, 0xe4, 0x82, 0x1b, 0xdb,
+	0x75, 0xe0, 0x7e, 0x76, 0x29, 0xf2, 0x16, 0x9e, 0xce, 0xb4, 0x46, 0x65, 0xc1, 0x5c, 0x0a, 0x5d,
+	0x95, 0xa8, 0xce, 0x50, 0xfd, 0xca, 0xd7, 0x78, 0xce, 0x3e, 0xd1, 0xa1, 0xab, 0xb8, 0x4f, 0x42,
+	0x62, 0x78, 0xb8, 0xb4, 0xf3, 0xad, 0x65, 0xf1, 0x2e, 0x17, 0x59, 0x2e, 0xb6, 0x74, 0xe4, 0xaa,
+	0x6e, 0xd3, 0x64, 0x01, 0xcf, 0xee, 0x7a, 0x28, 0x15, 0x19, 0x5e, 0xd2, 0xbd, 0xc8, 0x8b, 0xf7,
+	0xd9, 0xfd, 0x22, 0xf2, 0x1c, 0x80, 0x61, 0xc1, 0xaf, 0xce, 0x0c, 0x37, 0x48, 0x03, 0xd7, 0xaa,
+	0xc3, 0xd8, 0x9d, 0x3f, 0xc8, 0x22, 0x43, 0xf5, 0x75, 0xf3, 0x11, 0xaf, 0x28, 0x44, 0x5e, 0xbc,
+	0xc7, 0xba, 0xd4, 0xe4, 0xaf, 0x07, 0xfd, 0x73, 0x8d, 0x8a, 0x10, 0xe8, 0x7f, 0xe1, 0x25, 0x36,
+	0x11, 0xb9, 0x6f, 0x6b, 0xe5, 0x7b, 0xa9, 0x4a, 0x6e, 0x9a, 0x8c, 0x1a, 0x64, 0xc3, 0x9b, 0x4b,
+	0x61, 0xf0, 0xb2, 0x4e, 0x27, 0x60, 0x2d, 0x74, 0x31, 0x2f, 0x1b, 0xe3, 0xfd, 0x74, 0x49, 0x4e,
+	0x00, 0x66, 0xc6, 0xa8, 0x7c, 0x55, 0x19, 0xd4, 0x74, 0x10, 0xf5, 0xe2, 0x70, 0x7a, 0x90, 0xd4,
+	0x17, 0x75, 0xfd, 0x83, 0x75, 0x34, 0xd6, 0xc2, 0xef, 0xa7, 0x27, 0xaf, 0xe7, 0x76, 0xeb, 0x4d,
+	0xbe, 0xb6, 0x7b, 0x59, 0xe3, 0xc7, 0xec, 0x36, 0x3d, 0x39, 0x85, 0xe0, 0xba, 0xee, 0xbf, 0xe3,
+	0x3f, 0x86, 0xc1, 0x05, 0x2f, 0x2a, 0xa4, 0x7e, 0xd4, 0x8b, 0x03, 0x56, 0x83, 0xc9, 0x1f, 0x0f,
+	0x0e, 0x66, 0xf6, 0x15, 0xbe, 0x36, 0x0c, 0xf5, 0x4e, 0x0a, 0x8d, 0xe4, 0xa8, 0x76, 0xc1, 0x95,
+	0x87, 0xd3, 0xb0, 0x99, 0xd0, 0x52, 0xac, 0xb6, 0xe7, 0x25, 0x8c, 0x9a, 0x53, 0x76, 0x5e, 0x84,
+	0xd3, 0x47, 0xed, 0x16, 0x9d, 0x2b, 0x67, 0xad, 0xc6, 0x06, 0x63, 0x13, 0xa8, 0xf4, 0x5c, 0x66,
+	0xd8, 0x98, 0xd4, 0x61, 0xc8, 0x0b, 0xd8, 0xaf, 0xd1, 0x67, 0xd4, 0x9a, 0x6f, 0xb1, 0xb1, 0xec,
+	0x26, 0xb9, 0x1a, 0xba, 0x63, 0x7f, 0xf5, 0x6f, 0x00, 0x7e, 0x53, 0x49, 0x38, 0x83, 0x03, 0x00,
+	0x00,
 }
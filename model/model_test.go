@@ -40,6 +40,23 @@ func TestNewAuthnRequest(t *testing.T) {
 	assert.Equal(t, "http://sp.example.com/demo1/metadata.php", modelReq.GetIssuer(), "issuer doesn't match")
 }
 
+func TestNewAuthnRequestHolderOfKey(t *testing.T) {
+	data := `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ` +
+		`xmlns:hoksso="urn:oasis:names:tc:SAML:2.0:profiles:holder-of-key:SSO:browser" ID="_1" Version="2.0" ` +
+		`hoksso:ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" ` +
+		`ProtocolBinding="urn:oasis:names:tc:SAML:2.0:profiles:holder-of-key:SSO:browser"/>`
+	req := &saml.AuthnRequest{}
+	if err := xml.Unmarshal([]byte(data), req); err != nil {
+		t.Fatal(err)
+	}
+	modelReq, err := NewAuthnRequest(req, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, modelReq.GetHolderOfKey(), "expected holder-of-key request")
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST", modelReq.GetProtocolBinding())
+}
+
 func TestUser_AttributeStatement(t *testing.T) {
 	user := &User{Name: "joe"}
 	user.AppendAttributes([]*Attribute{
@@ -39,6 +39,8 @@ type Conditions struct {
 	NotBefore           time.Time `xml:",attr"`
 	NotOnOrAfter        time.Time `xml:",attr"`
 	AudienceRestriction *AudienceRestriction
+	OneTimeUse          *OneTimeUse
+	ProxyRestriction    *ProxyRestriction
 }
 
 type SubjectLocality struct {
@@ -67,7 +69,7 @@ type AttributeValue struct {
 
 type Attribute struct {
 	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
-	FriendlyName   string   `xml:",attr"`
+	FriendlyName   string   `xml:",attr,omitempty"`
 	Name           string   `xml:",attr"`
 	NameFormat     string   `xml:",attr"`
 	AttributeValue []AttributeValue
@@ -83,7 +85,9 @@ type NameID struct {
 	Format          string   `xml:",attr"`
 	NameQualifier   string   `xml:",attr"`
 	SPNameQualifier string   `xml:",attr"`
-	Value           string   `xml:",chardata"`
+	// Identifier the service provider set with a ManageNameIDRequest
+	SPProvidedID string `xml:",attr,omitempty"`
+	Value        string `xml:",chardata"`
 }
 
 type SubjectConfirmation struct {
@@ -95,14 +99,28 @@ type SubjectConfirmation struct {
 type SubjectConfirmationData struct {
 	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
 	Address      net.IP    `xml:",attr"`
-	InResponseTo string    `xml:",attr"`
+	InResponseTo string    `xml:",attr,omitempty"`
 	NotOnOrAfter time.Time `xml:",attr"`
 	Recipient    string    `xml:",attr"`
+	// KeyInfoConfirmationDataType for holder-of-key confirmation
+	Type    string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr,omitempty"`
+	KeyInfo *xmlsig.KeyInfo
 }
 
 type AudienceRestriction struct {
 	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction"`
-	Audience string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
+	Audience []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
+}
+
+type OneTimeUse struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion OneTimeUse"`
+}
+
+type ProxyRestriction struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion ProxyRestriction"`
+	// Maximum number of indirections. Proxying is unlimited when it's nil.
+	Count    *int     `xml:",attr,omitempty"`
+	Audience []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
 }
 
 type Assertion struct {
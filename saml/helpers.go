@@ -16,6 +16,10 @@ package saml
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -27,3 +31,61 @@ func NewID() string {
 func NewIssuer(issuer string) *Issuer {
 	return &Issuer{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity", Value: issuer}
 }
+
+var durationPattern = regexp.MustCompile(`^(-)?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// ParseDuration converts an xs:duration such as PT6H, used by metadata cacheDuration attributes, to a time.Duration.
+// Years and months are approximated as 365 and 30 days.
+func ParseDuration(duration string) (time.Duration, error) {
+	parts := durationPattern.FindStringSubmatch(duration)
+	if parts == nil || duration == "P" || duration[len(duration)-1] == 'T' {
+		return 0, fmt.Errorf("invalid duration, %s", duration)
+	}
+	units := []time.Duration{0, 0, 365 * 24 * time.Hour, 30 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute}
+	var d time.Duration
+	for i := 2; i < 7; i++ {
+		if parts[i] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n) * units[i]
+	}
+	if parts[7] != "" {
+		seconds, err := strconv.ParseFloat(parts[7], 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(seconds * float64(time.Second))
+	}
+	if parts[1] != "" {
+		d = -d
+	}
+	return d, nil
+}
+
+// FormatDuration converts a time.Duration to an xs:duration such as PT6H for use in metadata cacheDuration attributes.
+func FormatDuration(d time.Duration) string {
+	var b strings.Builder
+	if d < 0 {
+		b.WriteString("-")
+		d = -d
+	}
+	b.WriteString("PT")
+	empty := d == 0
+	if hours := d / time.Hour; hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+		d -= hours * time.Hour
+	}
+	if minutes := d / time.Minute; minutes > 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+		d -= minutes * time.Minute
+	}
+	if d > 0 || empty {
+		b.WriteString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+		b.WriteString("S")
+	}
+	return b.String()
+}
@@ -18,6 +18,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -45,3 +46,50 @@ func TestNewIssuer(t *testing.T) {
 func TestNewID(t *testing.T) {
 	assert.True(t, strings.HasPrefix(NewID(), "_"), "id doesn't start with _")
 }
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		duration string
+		want     time.Duration
+		wantErr  bool
+	}{
+		{"PT6H", 6 * time.Hour, false},
+		{"P1DT30M", 24*time.Hour + 30*time.Minute, false},
+		{"PT1.5S", 1500 * time.Millisecond, false},
+		{"-PT10M", -10 * time.Minute, false},
+		{"P", 0, true},
+		{"PT", 0, true},
+		{"6h", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.duration, func(t *testing.T) {
+			got, err := ParseDuration(tt.duration)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDuration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		want     string
+	}{
+		{6 * time.Hour, "PT6H"},
+		{24*time.Hour + 30*time.Minute, "PT24H30M"},
+		{1500 * time.Millisecond, "PT1.5S"},
+		{-10 * time.Minute, "-PT10M"},
+		{0, "PT0S"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got := FormatDuration(tt.duration)
+			assert.Equal(t, tt.want, got)
+			parsed, err := ParseDuration(got)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.duration, parsed)
+		})
+	}
+}
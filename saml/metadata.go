@@ -16,15 +16,94 @@ package saml
 
 import (
 	"encoding/xml"
+	"time"
 
 	"github.com/amdonov/xmlsig"
 )
 
+type EntitiesDescriptor struct {
+	XMLName             xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+	ID                  string     `xml:",attr,omitempty"`
+	Name                string     `xml:",attr,omitempty"`
+	ValidUntil          *time.Time `xml:"validUntil,attr,omitempty"`
+	CacheDuration       string     `xml:"cacheDuration,attr,omitempty"`
+	Signature           *xmlsig.Signature
+	Extensions          *Extensions
+	EntityDescriptors   []SPEntityDescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntitiesDescriptors []EntitiesDescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+}
+
 type EntityDescriptor struct {
-	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
-	ID        string   `xml:",attr"`
-	EntityID  string   `xml:"entityID,attr"`
-	Signature *xmlsig.Signature
+	XMLName       xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	ID            string     `xml:",attr"`
+	EntityID      string     `xml:"entityID,attr"`
+	ValidUntil    *time.Time `xml:"validUntil,attr,omitempty"`
+	CacheDuration string     `xml:"cacheDuration,attr,omitempty"`
+	Signature     *xmlsig.Signature
+	Extensions    *Extensions
+}
+
+type Extensions struct {
+	XMLName          xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
+	RegistrationInfo *RegistrationInfo
+	EntityAttributes *EntityAttributes
+	Scope            []Scope
+	UIInfo           *UIInfo
+}
+
+type RegistrationInfo struct {
+	XMLName               xml.Name `xml:"urn:oasis:names:tc:SAML:metadata:rpi RegistrationInfo"`
+	RegistrationAuthority string   `xml:"registrationAuthority,attr"`
+}
+
+type EntityAttributes struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:metadata:attribute EntityAttributes"`
+	Attribute []Attribute
+}
+
+type Scope struct {
+	XMLName xml.Name `xml:"urn:mace:shibboleth:metadata:1.0 Scope"`
+	Regexp  bool     `xml:"regexp,attr"`
+	Value   string   `xml:",chardata"`
+}
+
+type UIInfo struct {
+	XMLName             xml.Name        `xml:"urn:oasis:names:tc:SAML:metadata:ui UIInfo"`
+	DisplayName         []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui DisplayName"`
+	Description         []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui Description"`
+	InformationURL      []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui InformationURL"`
+	PrivacyStatementURL []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui PrivacyStatementURL"`
+	Logo                []Logo          `xml:"urn:oasis:names:tc:SAML:metadata:ui Logo"`
+}
+
+type Logo struct {
+	Lang   string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Height uint   `xml:"height,attr"`
+	Width  uint   `xml:"width,attr"`
+	Value  string `xml:",chardata"`
+}
+
+// LocalizedName is used for the various metadata elements with an xml:lang attribute
+type LocalizedName struct {
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Value string `xml:",chardata"`
+}
+
+type Organization struct {
+	XMLName                 xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata Organization"`
+	OrganizationName        []LocalizedName `xml:"urn:oasis:names:tc:SAML:2.0:metadata OrganizationName"`
+	OrganizationDisplayName []LocalizedName `xml:"urn:oasis:names:tc:SAML:2.0:metadata OrganizationDisplayName"`
+	OrganizationURL         []LocalizedName `xml:"urn:oasis:names:tc:SAML:2.0:metadata OrganizationURL"`
+}
+
+type ContactPerson struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata ContactPerson"`
+	ContactType     string   `xml:"contactType,attr"`
+	Company         string   `xml:"urn:oasis:names:tc:SAML:2.0:metadata Company,omitempty"`
+	GivenName       string   `xml:"urn:oasis:names:tc:SAML:2.0:metadata GivenName,omitempty"`
+	SurName         string   `xml:"urn:oasis:names:tc:SAML:2.0:metadata SurName,omitempty"`
+	EmailAddress    []string `xml:"urn:oasis:names:tc:SAML:2.0:metadata EmailAddress"`
+	TelephoneNumber []string `xml:"urn:oasis:names:tc:SAML:2.0:metadata TelephoneNumber"`
 }
 
 type SPEntityDescriptor struct {
@@ -36,16 +115,24 @@ type IDPEntityDescriptor struct {
 	EntityDescriptor
 	IDPSSODescriptor             IDPSSODescriptor
 	AttributeAuthorityDescriptor AttributeAuthorityDescriptor
+	AuthnAuthorityDescriptor     *AuthnAuthorityDescriptor
+	Organization                 *Organization
+	ContactPerson                []ContactPerson
 }
 
 type IDPSSODescriptor struct {
 	XMLName                    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
 	ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
 	WantAuthnRequestsSigned    bool     `xml:",attr"`
-	KeyDescriptor              KeyDescriptor
+	Extensions                 *Extensions
+	KeyDescriptor              []KeyDescriptor
 	ArtifactResolutionService  ArtifactResolutionService
-	NameIDFormat               string `xml:"NameIDFormat"`
+	SingleLogoutService        []SingleLogoutService
+	ManageNameIDService        []ManageNameIDService
+	NameIDFormat               []string `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
 	SingleSignOnService        []SingleSignOnService
+	NameIDMappingService       []NameIDMappingService
+	AssertionIDRequestService  []AssertionIDRequestService
 }
 
 type Service struct {
@@ -61,14 +148,54 @@ type AttributeService struct {
 type AttributeAuthorityDescriptor struct {
 	XMLName                    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata AttributeAuthorityDescriptor"`
 	ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
-	KeyDescriptor              KeyDescriptor
+	Extensions                 *Extensions
+	KeyDescriptor              []KeyDescriptor
 	AttributeService           AttributeService
-	NameIDFormat               string `xml:"NameIDFormat"`
+	AssertionIDRequestService  []AssertionIDRequestService
+	NameIDFormat               []string `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+}
+
+type AuthnAuthorityDescriptor struct {
+	XMLName                    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata AuthnAuthorityDescriptor"`
+	ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
+	Extensions                 *Extensions
+	KeyDescriptor              []KeyDescriptor
+	AuthnQueryService          []AuthnQueryService
+	AssertionIDRequestService  []AssertionIDRequestService
+	NameIDFormat               []string `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+}
+
+type AuthnQueryService struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata AuthnQueryService"`
+	Service
+}
+
+type AssertionIDRequestService struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionIDRequestService"`
+	Service
 }
 
 type SingleSignOnService struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
 	Service
+	// Binding used for requests to a holder-of-key service
+	ProtocolBinding string `xml:"urn:oasis:names:tc:SAML:2.0:profiles:holder-of-key:SSO:browser ProtocolBinding,attr,omitempty"`
+}
+
+type ManageNameIDService struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata ManageNameIDService"`
+	Service
+	ResponseLocation string `xml:",attr,omitempty"`
+}
+
+type NameIDMappingService struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDMappingService"`
+	Service
+}
+
+type SingleLogoutService struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleLogoutService"`
+	Service
 }
 
 type ArtifactResolutionService struct {
@@ -82,8 +209,10 @@ type SPSSODescriptor struct {
 	AuthnRequestsSigned        bool     `xml:",attr"`
 	WantAssertionsSigned       bool     `xml:",attr"`
 	ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
+	Extensions                 *Extensions
+	ManageNameIDService        []ManageNameIDService
 	AssertionConsumerService   []AssertionConsumerService
-	KeyDescriptor              KeyDescriptor
+	KeyDescriptor              []KeyDescriptor
 }
 
 type AssertionConsumerService struct {
@@ -91,6 +220,8 @@ type AssertionConsumerService struct {
 	Service
 	IsDefault bool   `xml:"isDefault,attr"`
 	Index     uint32 `xml:"index,attr"`
+	// Binding used for responses sent to a holder-of-key service
+	ProtocolBinding string `xml:"urn:oasis:names:tc:SAML:2.0:profiles:holder-of-key:SSO:browser ProtocolBinding,attr,omitempty"`
 }
 
 type KeyDescriptor struct {
@@ -0,0 +1,118 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saml
+
+import (
+	"encoding/xml"
+
+	"github.com/amdonov/lite-idp/encrypt"
+	"github.com/amdonov/xmlsig"
+)
+
+type EncryptedID struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedID"`
+	EncryptedData encrypt.EncryptedData
+	EncryptedKey  []encrypt.EncryptedKey
+}
+
+type NewEncryptedID struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NewEncryptedID"`
+	EncryptedData encrypt.EncryptedData
+	EncryptedKey  []encrypt.EncryptedKey
+}
+
+type Terminate struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Terminate"`
+}
+
+type ManageNameIDRequest struct {
+	RequestAbstractType
+	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol ManageNameIDRequest"`
+	Signature   *xmlsig.Signature
+	NameID      *NameID
+	EncryptedID *EncryptedID
+	// Identifier the service provider will use for the subject from now on
+	NewID          string `xml:"urn:oasis:names:tc:SAML:2.0:protocol NewID,omitempty"`
+	NewEncryptedID *NewEncryptedID
+	Terminate      *Terminate
+}
+
+type ManageNameIDRequestEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    ManageNameIDRequestBody
+}
+
+type ManageNameIDRequestBody struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	Request ManageNameIDRequest
+}
+
+type ManageNameIDResponse struct {
+	StatusResponseType
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol ManageNameIDResponse"`
+}
+
+type ManageNameIDResponseEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    ManageNameIDResponseBody
+}
+
+type ManageNameIDResponseBody struct {
+	XMLName  xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	Response ManageNameIDResponse
+}
+
+type NameIDPolicy struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	Format          string   `xml:",attr,omitempty"`
+	SPNameQualifier string   `xml:",attr,omitempty"`
+	AllowCreate     bool     `xml:",attr,omitempty"`
+}
+
+type NameIDMappingRequest struct {
+	RequestAbstractType
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDMappingRequest"`
+	Signature    *xmlsig.Signature
+	NameID       *NameID
+	EncryptedID  *EncryptedID
+	NameIDPolicy NameIDPolicy
+}
+
+type NameIDMappingRequestEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    NameIDMappingRequestBody
+}
+
+type NameIDMappingRequestBody struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	Request NameIDMappingRequest
+}
+
+type NameIDMappingResponse struct {
+	StatusResponseType
+	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDMappingResponse"`
+	NameID      *NameID
+	EncryptedID *EncryptedID
+}
+
+type NameIDMappingResponseEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    NameIDMappingResponseBody
+}
+
+type NameIDMappingResponseBody struct {
+	XMLName  xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	Response NameIDMappingResponse
+}
@@ -21,12 +21,102 @@ import (
 	"github.com/amdonov/xmlsig"
 )
 
+// HoKSSOBrowser identifies the Holder-of-Key Web Browser SSO profile. It's used as the binding of holder-of-key
+// endpoints and as the namespace of the attribute naming the binding actually used for the messages.
+const HoKSSOBrowser = "urn:oasis:names:tc:SAML:2.0:profiles:holder-of-key:SSO:browser"
+
 type AuthnRequest struct {
 	RequestAbstractType
 	XMLName                       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
 	AssertionConsumerServiceURL   string   `xml:",attr"`
 	ProtocolBinding               string   `xml:",attr"`
 	AssertionConsumerServiceIndex uint32   `xml:",attr"`
+	// Binding for the response to a holder-of-key request
+	HoKProtocolBinding string `xml:"urn:oasis:names:tc:SAML:2.0:profiles:holder-of-key:SSO:browser ProtocolBinding,attr,omitempty"`
+	Signature          *xmlsig.Signature
+}
+
+// UnmarshalXML keeps the holder-of-key ProtocolBinding attribute from being read as the request's ProtocolBinding.
+// Unqualified attribute fields match attributes with the same name in any namespace.
+func (r *AuthnRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type authnRequest AuthnRequest
+	if err := d.DecodeElement((*authnRequest)(r), &start); err != nil {
+		return err
+	}
+	r.ProtocolBinding, r.HoKProtocolBinding = "", ""
+	for _, attr := range start.Attr {
+		if attr.Name.Local != "ProtocolBinding" {
+			continue
+		}
+		switch attr.Name.Space {
+		case "":
+			r.ProtocolBinding = attr.Value
+		case HoKSSOBrowser:
+			r.HoKProtocolBinding = attr.Value
+		}
+	}
+	return nil
+}
+
+type AuthnRequestEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Header  *ECPRequestHeader
+	Body    AuthnRequestBody
+}
+
+// ECPRequestHeader contains the header blocks an ECP may send along with an authentication request
+type ECPRequestHeader struct {
+	XMLName         xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Header"`
+	PAOSRequest     *PAOSRequest
+	ECPRequest      *ECPRequest
+	RelayState      *ECPRelayState
+	ChannelBindings []ChannelBindings
+	// Header blocks that aren't part of the ECP profile
+	Other []SOAPHeaderBlock `xml:",any"`
+}
+
+type PAOSRequest struct {
+	XMLName             xml.Name `xml:"urn:liberty:paos:2003-08 Request"`
+	Actor               string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr"`
+	MustUnderstand      string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+	ResponseConsumerURL string   `xml:"responseConsumerURL,attr"`
+	Service             string   `xml:"service,attr"`
+	MessageID           string   `xml:"messageID,attr,omitempty"`
+}
+
+type ECPRequest struct {
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp Request"`
+	Actor          string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr"`
+	MustUnderstand string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+	ProviderName   string   `xml:",attr,omitempty"`
+	IsPassive      bool     `xml:",attr,omitempty"`
+	Issuer         string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+type ECPRelayState struct {
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp RelayState"`
+	Actor          string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr"`
+	MustUnderstand string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+	Value          string   `xml:",chardata"`
+}
+
+// ChannelBindings binds a message to the TLS channel it was sent over
+type ChannelBindings struct {
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:protocol:ext:channel-binding ChannelBindings"`
+	Actor          string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr,omitempty"`
+	MustUnderstand string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr,omitempty"`
+	Type           string   `xml:",attr"`
+	Value          string   `xml:",chardata"`
+}
+
+type SOAPHeaderBlock struct {
+	XMLName        xml.Name
+	MustUnderstand string `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+}
+
+type AuthnRequestBody struct {
+	XMLName      xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	AuthnRequest AuthnRequest
 }
 
 type ArtifactResolveEnvelope struct {
@@ -72,6 +162,7 @@ type ECPResponseHeader struct {
 	XMLName                 xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Header"`
 	ECPResponse             ECPResponse
 	ECPRequestAuthenticated ECPRequestAuthenticated
+	RelayState              *ECPRelayState
 }
 
 type ECPResponse struct {
@@ -99,13 +190,16 @@ type Response struct {
 }
 
 type Status struct {
-	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
-	StatusCode StatusCode
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	StatusCode    StatusCode
+	StatusMessage string `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage,omitempty"`
 }
 
 type StatusCode struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
 	Value   string   `xml:",attr"`
+	// Optional second-level status code
+	StatusCode *StatusCode
 }
 
 type RequestAbstractType struct {
@@ -121,23 +215,29 @@ type StatusResponseType struct {
 	Version      string    `xml:",attr"`
 	IssueInstant time.Time `xml:",attr"`
 	Issuer       *Issuer
+	Signature    *xmlsig.Signature
 	Destination  string `xml:",attr,omitempty"`
 	InResponseTo string `xml:",attr"`
 	Status       *Status
 }
 
+// SOAPFaultEnvelope is written with an explicit SOAP-ENV prefix because fault codes are qualified names using it
+// and the faultcode and faultstring elements must not be namespace qualified
 type SOAPFaultEnvelope struct {
-	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
-	Body    SOAPFaultBody
+	XMLName   xml.Name `xml:"SOAP-ENV:Envelope"`
+	Namespace string   `xml:"xmlns:SOAP-ENV,attr"`
+	// Declarations of other prefixes used by fault codes
+	Namespaces []xml.Attr `xml:",any,attr"`
+	Body       SOAPFaultBody
 }
 
 type SOAPFaultBody struct {
-	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	XMLName xml.Name `xml:"SOAP-ENV:Body"`
 	Fault   SOAPFault
 }
 
 type SOAPFault struct {
-	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Fault"`
-	Code    string   `xml:",faultcode"`
-	String  string   `xml:",faultstring"`
+	XMLName xml.Name `xml:"SOAP-ENV:Fault"`
+	Code    string   `xml:"faultcode"`
+	String  string   `xml:"faultstring"`
 }
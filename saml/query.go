@@ -18,8 +18,10 @@ type AttributeQueryBody struct {
 
 type AttributeQuery struct {
 	RequestAbstractType
-	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
-	Subject   Subject
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
+	Subject Subject
+	// Attributes being asked for. All attributes are requested when empty.
+	Attribute []Attribute
 	Signature *xmlsig.Signature
 }
 
@@ -32,3 +34,38 @@ type AttributeRespBody struct {
 	XMLName  xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
 	Response Response
 }
+
+type AssertionIDRequestEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    AssertionIDRequestBody
+}
+
+type AssertionIDRequestBody struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	Request AssertionIDRequest
+}
+
+type AssertionIDRequest struct {
+	RequestAbstractType
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AssertionIDRequest"`
+	AssertionIDRef []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AssertionIDRef"`
+	Signature      *xmlsig.Signature
+}
+
+type AuthnQueryEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    AuthnQueryBody
+}
+
+type AuthnQueryBody struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	Query   AuthnQuery
+}
+
+type AuthnQuery struct {
+	RequestAbstractType
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnQuery"`
+	SessionIndex string   `xml:",attr,omitempty"`
+	Subject      Subject
+	Signature    *xmlsig.Signature
+}
@@ -0,0 +1,96 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package saml11 contains the SAML 1.1 assertion types issued to WS-Federation relying parties
+package saml11
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/amdonov/xmlsig"
+)
+
+const (
+	// ConfirmationBearer is the bearer subject confirmation method
+	ConfirmationBearer = "urn:oasis:names:tc:SAML:1.0:cm:bearer"
+	// MethodPassword is the authentication method for password logins
+	MethodPassword = "urn:oasis:names:tc:SAML:1.0:am:password"
+	// MethodTLSClient is the authentication method for TLS client certificate logins
+	MethodTLSClient = "urn:ietf:rfc:2246"
+	// MethodUnspecified is used when the authentication method isn't known
+	MethodUnspecified = "urn:oasis:names:tc:SAML:1.0:am:unspecified"
+)
+
+type Assertion struct {
+	XMLName                 xml.Name  `xml:"urn:oasis:names:tc:SAML:1.0:assertion Assertion"`
+	MajorVersion            int       `xml:",attr"`
+	MinorVersion            int       `xml:",attr"`
+	AssertionID             string    `xml:",attr"`
+	Issuer                  string    `xml:",attr"`
+	IssueInstant            time.Time `xml:",attr"`
+	Conditions              *Conditions
+	AttributeStatement      *AttributeStatement
+	AuthenticationStatement *AuthenticationStatement
+	Signature               *xmlsig.Signature
+}
+
+type Conditions struct {
+	XMLName                      xml.Name  `xml:"urn:oasis:names:tc:SAML:1.0:assertion Conditions"`
+	NotBefore                    time.Time `xml:",attr"`
+	NotOnOrAfter                 time.Time `xml:",attr"`
+	AudienceRestrictionCondition *AudienceRestrictionCondition
+}
+
+type AudienceRestrictionCondition struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion AudienceRestrictionCondition"`
+	Audience []string `xml:"urn:oasis:names:tc:SAML:1.0:assertion Audience"`
+}
+
+type Subject struct {
+	XMLName             xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion Subject"`
+	NameIdentifier      *NameIdentifier
+	SubjectConfirmation *SubjectConfirmation
+}
+
+type NameIdentifier struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion NameIdentifier"`
+	Format  string   `xml:",attr,omitempty"`
+	Value   string   `xml:",chardata"`
+}
+
+type SubjectConfirmation struct {
+	XMLName            xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion SubjectConfirmation"`
+	ConfirmationMethod []string `xml:"urn:oasis:names:tc:SAML:1.0:assertion ConfirmationMethod"`
+}
+
+type AuthenticationStatement struct {
+	XMLName               xml.Name  `xml:"urn:oasis:names:tc:SAML:1.0:assertion AuthenticationStatement"`
+	AuthenticationMethod  string    `xml:",attr"`
+	AuthenticationInstant time.Time `xml:",attr"`
+	Subject               Subject
+}
+
+type AttributeStatement struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion AttributeStatement"`
+	Subject   Subject
+	Attribute []Attribute
+}
+
+type Attribute struct {
+	XMLName            xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion Attribute"`
+	AttributeName      string   `xml:",attr"`
+	AttributeNamespace string   `xml:",attr"`
+	AttributeValue     []string `xml:"urn:oasis:names:tc:SAML:1.0:assertion AttributeValue"`
+}
@@ -0,0 +1,184 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	// register the hashes used by the supported algorithms
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Signature algorithms from XML Signature and RFC 6931
+const (
+	RSASHA1      = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	RSASHA256    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	RSASHA384    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha384"
+	RSASHA512    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	RSAPSSSHA256 = "http://www.w3.org/2007/05/xmldsig-more#sha256-rsa-MGF1"
+	RSAPSSSHA384 = "http://www.w3.org/2007/05/xmldsig-more#sha384-rsa-MGF1"
+	RSAPSSSHA512 = "http://www.w3.org/2007/05/xmldsig-more#sha512-rsa-MGF1"
+	ECDSASHA1    = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha1"
+	ECDSASHA256  = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	ECDSASHA384  = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384"
+	ECDSASHA512  = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"
+	DSASHA1      = "http://www.w3.org/2000/09/xmldsig#dsa-sha1"
+	DSASHA256    = "http://www.w3.org/2009/xmldsig11#dsa-sha256"
+)
+
+// Digest algorithms from XML Signature and XML Encryption
+const (
+	DigestSHA1   = "http://www.w3.org/2000/09/xmldsig#sha1"
+	DigestSHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+	DigestSHA384 = "http://www.w3.org/2001/04/xmldsig-more#sha384"
+	DigestSHA512 = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+type algorithm struct {
+	keyType x509.PublicKeyAlgorithm
+	hash    crypto.Hash
+	pss     bool
+}
+
+var signatureAlgorithms = map[string]algorithm{
+	RSASHA1:      {x509.RSA, crypto.SHA1, false},
+	RSASHA256:    {x509.RSA, crypto.SHA256, false},
+	RSASHA384:    {x509.RSA, crypto.SHA384, false},
+	RSASHA512:    {x509.RSA, crypto.SHA512, false},
+	RSAPSSSHA256: {x509.RSA, crypto.SHA256, true},
+	RSAPSSSHA384: {x509.RSA, crypto.SHA384, true},
+	RSAPSSSHA512: {x509.RSA, crypto.SHA512, true},
+	ECDSASHA1:    {x509.ECDSA, crypto.SHA1, false},
+	ECDSASHA256:  {x509.ECDSA, crypto.SHA256, false},
+	ECDSASHA384:  {x509.ECDSA, crypto.SHA384, false},
+	ECDSASHA512:  {x509.ECDSA, crypto.SHA512, false},
+	DSASHA1:      {x509.DSA, crypto.SHA1, false},
+	DSASHA256:    {x509.DSA, crypto.SHA256, false},
+}
+
+var digestAlgorithms = map[string]crypto.Hash{
+	DigestSHA1:   crypto.SHA1,
+	DigestSHA256: crypto.SHA256,
+	DigestSHA384: crypto.SHA384,
+	DigestSHA512: crypto.SHA512,
+}
+
+// IsWeakAlgorithm reports whether a signature algorithm uses SHA-1 or DSA
+func IsWeakAlgorithm(alg string) bool {
+	a, ok := signatureAlgorithms[alg]
+	return ok && (a.hash == crypto.SHA1 || a.keyType == x509.DSA)
+}
+
+// IsWeakDigestAlgorithm reports whether a digest algorithm is SHA-1
+func IsWeakDigestAlgorithm(alg string) bool {
+	return digestAlgorithms[alg] == crypto.SHA1
+}
+
+// Verify checks a signature created with the algorithm over data, such as the signed portion of a redirect binding
+// query string. ECDSA signatures may be either the XML Signature concatenation of r and s or ASN.1 encoded.
+func Verify(alg string, key crypto.PublicKey, data, signature []byte) error {
+	a, ok := signatureAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm, %s", alg)
+	}
+	if err := checkKeyType(alg, a, key); err != nil {
+		return err
+	}
+	h := a.hash.New()
+	h.Write(data)
+	sum := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if a.pss {
+			return rsa.VerifyPSS(key, a.hash, sum, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		}
+		return rsa.VerifyPKCS1v15(key, a.hash, sum, signature)
+	case *ecdsa.PublicKey:
+		r, s, err := parseECDSASignature(key, signature)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.Verify(key, sum, r, s) {
+			return errors.New("ECDSA verification failure")
+		}
+		return nil
+	case *dsa.PublicKey:
+		sig := new(dsaSignature)
+		if rest, err := asn1.Unmarshal(signature, sig); err != nil {
+			return err
+		} else if len(rest) != 0 {
+			return errors.New("trailing data after DSA signature")
+		}
+		if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 {
+			return errors.New("DSA signature contained zero or negative values")
+		}
+		if !dsa.Verify(key, sum, sig.R, sig.S) {
+			return errors.New("DSA verification failure")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", key)
+}
+
+func checkKeyType(alg string, a algorithm, key crypto.PublicKey) error {
+	var keyType x509.PublicKeyAlgorithm
+	switch key.(type) {
+	case *rsa.PublicKey:
+		keyType = x509.RSA
+	case *ecdsa.PublicKey:
+		keyType = x509.ECDSA
+	case *dsa.PublicKey:
+		keyType = x509.DSA
+	case nil:
+		return errors.New("no public key is available to verify the signature")
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	if keyType != a.keyType {
+		return fmt.Errorf("signature algorithm %s cannot be used with %s keys", alg, keyType)
+	}
+	return nil
+}
+
+type dsaSignature struct {
+	R, S *big.Int
+}
+
+// ecdsaSignature is the ASN.1 encoding of an ECDSA signature
+type ecdsaSignature dsaSignature
+
+func parseECDSASignature(key *ecdsa.PublicKey, signature []byte) (*big.Int, *big.Int, error) {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(signature) == 2*size {
+		return new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:]), nil
+	}
+	sig := new(ecdsaSignature)
+	if rest, err := asn1.Unmarshal(signature, sig); err != nil {
+		return nil, nil, errors.New("malformed ECDSA signature")
+	} else if len(rest) != 0 {
+		return nil, nil, errors.New("trailing data after ECDSA signature")
+	}
+	return sig.R, sig.S, nil
+}
@@ -15,6 +15,8 @@
 package sign
 
 import (
+	"crypto"
+
 	"github.com/amdonov/xmlsig"
 )
 
@@ -23,5 +25,9 @@ type Signer interface {
 }
 
 type Validator interface {
+	// Validate verifies the document's signature and returns the signed XML
 	Validate(xml string) ([]string, error)
+	// ValidateWithKeys verifies the document's signature with one of the trusted keys, ignoring any keys embedded
+	// in the message, and returns the signed element
+	ValidateWithKeys(xml string, keys ...crypto.PublicKey) (*Reference, error)
 }
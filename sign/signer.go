@@ -0,0 +1,205 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/amdonov/xmlsig"
+	"github.com/ma314smith/signedxml"
+)
+
+const (
+	exclusiveC14N      = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSignature = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+// SignerOptions selects the signature and digest algorithms. By default, RSA keys use RSA-SHA256, ECDSA keys use the
+// hash matching their curve size, and digests use SHA-256.
+type SignerOptions struct {
+	SignatureAlgorithm string
+	DigestAlgorithm    string
+}
+
+type signer struct {
+	cert      string
+	algorithm string
+	sigAlg    algorithm
+	digestAlg string
+	digest    crypto.Hash
+	key       crypto.Signer
+}
+
+// NewSigner returns a Signer for the certificate's private key. In addition to the algorithms supported by xmlsig, it
+// supports RSA-SHA384/512, RSA-PSS, and ECDSA.
+func NewSigner(cert tls.Certificate, options SignerOptions) (Signer, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("certificate is required for signing")
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot be used for signing")
+	}
+	alg := options.SignatureAlgorithm
+	if alg == "" {
+		alg = defaultAlgorithm(parsed.PublicKey)
+	}
+	sigAlg, ok := signatureAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm, %s", alg)
+	}
+	if err = checkKeyType(alg, sigAlg, key.Public()); err != nil {
+		return nil, err
+	}
+	if sigAlg.keyType == x509.DSA {
+		return nil, errors.New("DSA keys cannot be used for signing")
+	}
+	digestAlg := options.DigestAlgorithm
+	if digestAlg == "" {
+		digestAlg = DigestSHA256
+	}
+	digest, ok := digestAlgorithms[digestAlg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm, %s", digestAlg)
+	}
+	return &signer{
+		cert:      base64.StdEncoding.EncodeToString(cert.Certificate[0]),
+		algorithm: alg,
+		sigAlg:    sigAlg,
+		digestAlg: digestAlg,
+		digest:    digest,
+		key:       key,
+	}, nil
+}
+
+func defaultAlgorithm(key crypto.PublicKey) string {
+	if key, ok := key.(*ecdsa.PublicKey); ok {
+		switch key.Curve {
+		case elliptic.P384():
+			return ECDSASHA384
+		case elliptic.P521():
+			return ECDSASHA512
+		}
+		return ECDSASHA256
+	}
+	return RSASHA256
+}
+
+func (s *signer) Algorithm() string {
+	return s.algorithm
+}
+
+// Sign signs data, such as the signed portion of a redirect binding query string, and returns the base64 encoded
+// signature. ECDSA signatures are the XML Signature concatenation of r and s.
+func (s *signer) Sign(data []byte) (string, error) {
+	h := s.sigAlg.hash.New()
+	h.Write(data)
+	sum := h.Sum(nil)
+	var opts crypto.SignerOpts = s.sigAlg.hash
+	if s.sigAlg.pss {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: s.sigAlg.hash}
+	}
+	sig, err := s.key.Sign(rand.Reader, sum, opts)
+	if err != nil {
+		return "", err
+	}
+	if key, ok := s.key.Public().(*ecdsa.PublicKey); ok {
+		parsed := new(ecdsaSignature)
+		if _, err = asn1.Unmarshal(sig, parsed); err != nil {
+			return "", err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		parsed.R.FillBytes(sig[:size])
+		parsed.S.FillBytes(sig[size:])
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// CreateSignature creates an enveloped signature for the data structure. The structure is serialized and then
+// canonicalized with exclusive canonicalization.
+func (s *signer) CreateSignature(data interface{}) (*xmlsig.Signature, error) {
+	canonical, id, err := canonicalize(data)
+	if err != nil {
+		return nil, err
+	}
+	signature := &xmlsig.Signature{}
+	signature.SignedInfo.CanonicalizationMethod.Algorithm = exclusiveC14N
+	signature.SignedInfo.SignatureMethod.Algorithm = s.algorithm
+	reference := &signature.SignedInfo.Reference
+	if id != "" {
+		reference.URI = "#" + id
+	}
+	reference.Transforms.Transform = []xmlsig.Algorithm{{Algorithm: envelopedSignature}, {Algorithm: exclusiveC14N}}
+	reference.DigestMethod.Algorithm = s.digestAlg
+	h := s.digest.New()
+	h.Write(canonical)
+	reference.DigestValue = base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	if canonical, _, err = canonicalize(signature.SignedInfo); err != nil {
+		return nil, err
+	}
+	if signature.SignatureValue, err = s.Sign(canonical); err != nil {
+		return nil, err
+	}
+	signature.KeyInfo.X509Data = &xmlsig.X509Data{X509Certificate: s.cert}
+	return signature, nil
+}
+
+// canonicalize returns the exclusive canonicalization of the serialized data and the ID of its root element
+func canonicalize(data interface{}) ([]byte, string, error) {
+	serialized, err := xml.Marshal(data)
+	if err != nil {
+		return nil, "", err
+	}
+	id := ""
+	decoder := xml.NewDecoder(bytes.NewReader(serialized))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			for _, attr := range start.Attr {
+				// SAML 1.1 assertions are identified by AssertionID
+				if attr.Name.Local == "ID" || attr.Name.Local == "AssertionID" {
+					id = attr.Value
+				}
+			}
+			break
+		}
+	}
+	canonical, err := signedxml.ExclusiveCanonicalization{}.Process(string(serialized), "")
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(canonical), id, nil
+}
@@ -0,0 +1,143 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/xml"
+	"testing"
+
+	"github.com/amdonov/lite-idp/internal/testcert"
+	"github.com/amdonov/xmlsig"
+	"github.com/stretchr/testify/assert"
+)
+
+type testDocument struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID        string   `xml:",attr"`
+	Signature *xmlsig.Signature
+	Lang      string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Value     string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+func TestSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		key     crypto.Signer
+		options SignerOptions
+		want    string
+		wantErr bool
+	}{
+		{"rsa default", rsaKey, SignerOptions{}, RSASHA256, false},
+		{"rsa-sha512", rsaKey, SignerOptions{SignatureAlgorithm: RSASHA512, DigestAlgorithm: DigestSHA512}, RSASHA512, false},
+		{"rsa-pss", rsaKey, SignerOptions{SignatureAlgorithm: RSAPSSSHA256}, RSAPSSSHA256, false},
+		{"p-256 default", p256, SignerOptions{}, ECDSASHA256, false},
+		{"p-384 default", p384, SignerOptions{}, ECDSASHA384, false},
+		{"key mismatch", p256, SignerOptions{SignatureAlgorithm: RSASHA256}, "", true},
+		{"unknown digest", rsaKey, SignerOptions{DigestAlgorithm: "md5"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewSigner(testcert.New(t, tt.key), tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSigner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tt.want, signer.Algorithm())
+
+			// redirect binding style signatures
+			data := []byte("SAMLRequest=request&RelayState=state&SigAlg=alg")
+			sig, err := signer.Sign(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, _ := base64.StdEncoding.DecodeString(sig)
+			assert.NoError(t, Verify(tt.want, tt.key.Public(), data, value))
+
+			// enveloped signatures
+			doc := &testDocument{ID: "_1", Lang: "en", Value: "a & b"}
+			signature, err := signer.CreateSignature(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "#_1", signature.SignedInfo.Reference.URI)
+			signedInfo, _, err := canonicalize(signature.SignedInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, _ = base64.StdEncoding.DecodeString(signature.SignatureValue)
+			assert.NoError(t, Verify(tt.want, tt.key.Public(), signedInfo, value))
+			doc.Signature = signature
+			serialized, err := xml.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = NewValidator().Validate(string(serialized))
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("data")
+	sum := sha256Sum(data)
+	// ASN.1 encoded ECDSA signatures are accepted as well
+	der, err := key.Sign(rand.Reader, sum, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, Verify(ECDSASHA256, key.Public(), data, der))
+	assert.Error(t, Verify(ECDSASHA256, key.Public(), []byte("other"), der))
+	assert.EqualError(t, Verify(RSASHA256, key.Public(), data, der),
+		"signature algorithm http://www.w3.org/2001/04/xmldsig-more#rsa-sha256 cannot be used with ECDSA keys")
+	assert.Error(t, Verify("http://www.w3.org/2001/04/xmldsig-more#rsa-md5", key.Public(), data, der))
+	assert.Error(t, Verify(ECDSASHA256, nil, data, der))
+
+	assert.True(t, IsWeakAlgorithm(RSASHA1))
+	assert.True(t, IsWeakAlgorithm(DSASHA256))
+	assert.False(t, IsWeakAlgorithm(ECDSASHA384))
+	assert.True(t, IsWeakDigestAlgorithm(DigestSHA1))
+	assert.False(t, IsWeakDigestAlgorithm(DigestSHA256))
+	assert.False(t, IsWeakDigestAlgorithm("http://www.w3.org/2001/04/xmldsig-more#md5"))
+}
+
+func sha256Sum(data []byte) []byte {
+	h := crypto.SHA256.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
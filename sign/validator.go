@@ -15,21 +15,317 @@
 package sign
 
 import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/beevik/etree"
 	"github.com/ma314smith/signedxml"
 )
 
-type signedxmlValidator struct {
+const dsigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+
+// Reference is an element protected by a verified signature
+type Reference struct {
+	// Name of the signed element
+	Name xml.Name
+	// ID attribute of the signed element. It's empty if the signature covers a document without one.
+	ID string
+	// The signed element exactly as it was digested. Use it rather than the original document to
+	// make sure only signed content is processed.
+	XML string
+	// Algorithm used to create the signature
+	Algorithm string
+	// Algorithm used to digest the signed element
+	DigestAlgorithm string
 }
 
+type validator struct {
+	keys []crypto.PublicKey
+}
+
+// NewValidator returns a Validator that trusts the certificates embedded in the message when keys aren't provided
 func NewValidator() Validator {
-	return &signedxmlValidator{}
+	return &validator{}
 }
 
-func (v *signedxmlValidator) Validate(xml string) ([]string, error) {
-	validator, err := signedxml.NewValidator(xml)
+// NewCertificateValidator returns a Validator that ignores any keys embedded in the
+// message and only accepts signatures made by one of the provided certificates.
+func NewCertificateValidator(certs ...*x509.Certificate) Validator {
+	v := &validator{}
+	for _, cert := range certs {
+		v.keys = append(v.keys, cert.PublicKey)
+	}
+	return v
+}
+
+func (v *validator) Validate(xml string) ([]string, error) {
+	ref, err := v.verify(xml, v.keys, len(v.keys) == 0)
 	if err != nil {
 		return nil, err
 	}
+	return []string{ref.XML}, nil
+}
+
+func (v *validator) ValidateWithKeys(xml string, keys ...crypto.PublicKey) (*Reference, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no trusted keys were provided to verify the signature")
+	}
+	return v.verify(xml, keys, false)
+}
+
+// verify checks the outermost enveloped signature in the document. The signature must reference the element that
+// contains it, and that element's ID must be unique, so the signed content can't be moved or duplicated.
+func (v *validator) verify(data string, keys []crypto.PublicKey, embedded bool) (*Reference, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(data); err != nil {
+		return nil, err
+	}
+	root := doc.Root()
+	if root == nil {
+		return nil, errors.New("document does not contain an element")
+	}
+	signature := findSignature(root)
+	if signature == nil {
+		return nil, errors.New("document is not signed")
+	}
+	signed := signature.Parent()
+	signedInfo := dsigChild(signature, "SignedInfo")
+	if signedInfo == nil {
+		return nil, errors.New("signature does not contain SignedInfo")
+	}
+	references := dsigChildren(signedInfo, "Reference")
+	if len(references) != 1 {
+		return nil, errors.New("signature must contain a single reference")
+	}
+	reference := references[0]
+	id := elementID(signed)
+	switch uri := reference.SelectAttrValue("URI", ""); {
+	case uri == "" && signed == root:
+		// the whole document is signed
+	case id != "" && uri == "#"+id:
+		if countIDs(root, id) != 1 {
+			return nil, fmt.Errorf("document contains more than one element with ID %s", id)
+		}
+	default:
+		return nil, errors.New("signature does not reference the element that contains it")
+	}
 
-	return validator.ValidateReferences()
+	// Apply the transforms to the signed element
+	content := withNamespaces(signed)
+	canonical, transformed := "", false
+	if transforms := dsigChild(reference, "Transforms"); transforms != nil {
+		for _, transform := range dsigChildren(transforms, "Transform") {
+			algorithm := transform.SelectAttrValue("Algorithm", "")
+			if algorithm == envelopedSignature {
+				if transformed {
+					return nil, errors.New("enveloped signature transform must be applied before canonicalization")
+				}
+				content.RemoveChildAt(signature.Index())
+				continue
+			}
+			if !strings.HasPrefix(algorithm, exclusiveC14N) {
+				return nil, fmt.Errorf("unsupported transform, %s", algorithm)
+			}
+			input := canonical
+			if !transformed {
+				var err error
+				if input, err = serialize(content); err != nil {
+					return nil, err
+				}
+			}
+			var err error
+			if canonical, err = canonicalizeElement(input, algorithm, transform); err != nil {
+				return nil, err
+			}
+			transformed = true
+		}
+	}
+	if !transformed {
+		return nil, errors.New("reference must use exclusive canonicalization")
+	}
+	digestMethod := dsigChild(reference, "DigestMethod")
+	digestValue := dsigChild(reference, "DigestValue")
+	if digestMethod == nil || digestValue == nil {
+		return nil, errors.New("reference does not contain a digest")
+	}
+	digestAlg := digestMethod.SelectAttrValue("Algorithm", "")
+	digest, ok := digestAlgorithms[digestAlg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm, %s", digestAlg)
+	}
+	h := digest.New()
+	h.Write([]byte(canonical))
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != strings.Join(strings.Fields(digestValue.Text()), "") {
+		return nil, errors.New("calculated digest does not match the signed digest")
+	}
+
+	// Check the signature over SignedInfo
+	method := dsigChild(signedInfo, "CanonicalizationMethod")
+	if method == nil {
+		return nil, errors.New("signature does not contain a canonicalization method")
+	}
+	serialized, err := serialize(withNamespaces(signedInfo))
+	if err != nil {
+		return nil, err
+	}
+	canonicalSignedInfo, err := canonicalizeElement(serialized, method.SelectAttrValue("Algorithm", ""), method)
+	if err != nil {
+		return nil, err
+	}
+	signatureMethod := dsigChild(signedInfo, "SignatureMethod")
+	signatureValue := dsigChild(signature, "SignatureValue")
+	if signatureMethod == nil || signatureValue == nil {
+		return nil, errors.New("signature does not contain a signature value")
+	}
+	value, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(signatureValue.Text()), ""))
+	if err != nil {
+		return nil, err
+	}
+	if embedded {
+		if keys, err = embeddedKeys(signature); err != nil {
+			return nil, err
+		}
+	}
+	algorithm := signatureMethod.SelectAttrValue("Algorithm", "")
+	for _, key := range keys {
+		if err = Verify(algorithm, key, []byte(canonicalSignedInfo), value); err == nil {
+			return &Reference{
+				Name:            xml.Name{Space: signed.NamespaceURI(), Local: signed.Tag},
+				ID:              id,
+				XML:             canonical,
+				Algorithm:       algorithm,
+				DigestAlgorithm: digestAlg,
+			}, nil
+		}
+	}
+	return nil, errors.New("signature was not made by a trusted key")
+}
+
+// findSignature returns the signature closest to the root
+func findSignature(root *etree.Element) *etree.Element {
+	level := []*etree.Element{root}
+	for len(level) > 0 {
+		var next []*etree.Element
+		for _, e := range level {
+			for _, child := range e.ChildElements() {
+				if child.Tag == "Signature" && child.NamespaceURI() == dsigNamespace {
+					return child
+				}
+				next = append(next, child)
+			}
+		}
+		level = next
+	}
+	return nil
+}
+
+func dsigChildren(e *etree.Element, tag string) []*etree.Element {
+	var children []*etree.Element
+	for _, child := range e.ChildElements() {
+		if child.Tag == tag && child.NamespaceURI() == dsigNamespace {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+func dsigChild(e *etree.Element, tag string) *etree.Element {
+	if children := dsigChildren(e, tag); len(children) > 0 {
+		return children[0]
+	}
+	return nil
+}
+
+func countIDs(e *etree.Element, id string) int {
+	count := 0
+	if elementID(e) == id {
+		count++
+	}
+	for _, child := range e.ChildElements() {
+		count += countIDs(child, id)
+	}
+	return count
+}
+
+// elementID returns the ID of the element. SAML 1.1 assertions are identified by AssertionID.
+func elementID(e *etree.Element) string {
+	if id := e.SelectAttrValue("ID", ""); id != "" {
+		return id
+	}
+	return e.SelectAttrValue("AssertionID", "")
+}
+
+// withNamespaces copies the element adding the namespace declarations it inherits from its ancestors
+func withNamespaces(e *etree.Element) *etree.Element {
+	c := e.Copy()
+	declared := make(map[string]bool)
+	for _, attr := range c.Attr {
+		if prefix, ok := namespacePrefix(attr); ok {
+			declared[prefix] = true
+		}
+	}
+	for parent := e.Parent(); parent != nil; parent = parent.Parent() {
+		for _, attr := range parent.Attr {
+			if prefix, ok := namespacePrefix(attr); ok && !declared[prefix] {
+				declared[prefix] = true
+				c.CreateAttr(attr.FullKey(), attr.Value)
+			}
+		}
+	}
+	return c
+}
+
+func namespacePrefix(attr etree.Attr) (string, bool) {
+	switch {
+	case attr.Space == "xmlns":
+		return attr.Key, true
+	case attr.Space == "" && attr.Key == "xmlns":
+		return "", true
+	}
+	return "", false
+}
+
+func serialize(e *etree.Element) (string, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(e)
+	return doc.WriteToString()
+}
+
+// canonicalizeElement applies exclusive canonicalization including any prefix list in the transform
+func canonicalizeElement(data, algorithm string, transform *etree.Element) (string, error) {
+	if algorithm != exclusiveC14N && algorithm != exclusiveC14N+"WithComments" {
+		return "", fmt.Errorf("unsupported canonicalization algorithm, %s", algorithm)
+	}
+	parameters := ""
+	if len(transform.ChildElements()) > 0 {
+		var err error
+		if parameters, err = serialize(transform.Copy()); err != nil {
+			return "", err
+		}
+	}
+	return signedxml.CanonicalizationAlgorithms[algorithm].Process(data, parameters)
+}
+
+func embeddedKeys(signature *etree.Element) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, e := range signature.FindElements(".//X509Certificate") {
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(e.Text()), ""))
+		if err != nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, cert.PublicKey)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("signature does not contain a certificate")
+	}
+	return keys, nil
 }
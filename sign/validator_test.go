@@ -0,0 +1,75 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateWithKeys(t *testing.T) {
+	trusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(testcert.New(t, trusted), SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := &testDocument{ID: "_123", Value: "issuer"}
+	if doc.Signature, err = signer.CreateSignature(doc); err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := string(data)
+
+	ref, err := NewValidator().ValidateWithKeys(signed, other.Public(), trusted.Public())
+	if assert.NoError(t, err) {
+		assert.Equal(t, xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:assertion", Local: "Assertion"}, ref.Name)
+		assert.Equal(t, "_123", ref.ID)
+		assert.Equal(t, ECDSASHA256, ref.Algorithm)
+		assert.Equal(t, DigestSHA256, ref.DigestAlgorithm)
+		assert.NotContains(t, ref.XML, "Signature")
+	}
+
+	// The certificate embedded in the message isn't trusted
+	_, err = NewValidator().ValidateWithKeys(signed, other.Public())
+	assert.Error(t, err)
+	_, err = NewValidator().ValidateWithKeys(signed)
+	assert.Error(t, err)
+
+	// Signed content can't be changed
+	_, err = NewValidator().ValidateWithKeys(strings.Replace(signed, "issuer", "attacker", 1), trusted.Public())
+	assert.Error(t, err)
+
+	// Another element with the same ID could be processed instead of the signed one
+	wrapped := `<Wrapper>` + signed + `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_123"/></Wrapper>`
+	_, err = NewValidator().ValidateWithKeys(wrapped, trusted.Public())
+	assert.EqualError(t, err, "document contains more than one element with ID _123")
+}
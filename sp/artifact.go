@@ -16,18 +16,22 @@ package sp
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/amdonov/lite-idp/saml"
 	log "github.com/sirupsen/logrus"
 )
 
+const holderOfKeyMethod = "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"
+
 // ArtifactCallback is called by the service provider following success retrieval of a SAML assertion
 type ArtifactCallback func(w http.ResponseWriter, r *http.Request, state []byte, assertion *saml.Assertion)
 
@@ -59,6 +63,14 @@ func (sp *serviceProvider) ArtifactFunc(callback ArtifactCallback) http.HandlerF
 			return
 		}
 
+		// make sure the user presented the certificate the assertion was issued to
+		if sp.configuration.HolderOfKey {
+			if err = validateHolderOfKey(assertion, r); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+
 		// allow the application to write the response
 		callback(w, r, state, assertion)
 	}
@@ -82,6 +94,34 @@ func (sp *serviceProvider) validateAssertion(assertion *saml.Assertion) error {
 	return nil
 }
 
+// validateHolderOfKey checks the assertion confirms the subject with the TLS client certificate presented with the request
+func validateHolderOfKey(assertion *saml.Assertion, r *http.Request) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return errors.New("holder-of-key assertions require a client certificate")
+	}
+	presented := r.TLS.PeerCertificates[0].Raw
+	if assertion.Subject == nil {
+		return errors.New("assertion does not have a subject")
+	}
+	confirmation := assertion.Subject.SubjectConfirmation
+	if confirmation == nil || confirmation.Method != holderOfKeyMethod {
+		return errors.New("assertion is not a holder-of-key assertion")
+	}
+	data := confirmation.SubjectConfirmationData
+	if data == nil || data.KeyInfo == nil || data.KeyInfo.X509Data == nil {
+		return errors.New("holder-of-key assertion does not contain a certificate")
+	}
+	// Certificates may be wrapped across lines
+	cert, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data.KeyInfo.X509Data.X509Certificate), ""))
+	if err != nil {
+		return errors.New("failed to decode holder-of-key certificate")
+	}
+	if !bytes.Equal(cert, presented) {
+		return errors.New("client certificate does not match the holder-of-key assertion")
+	}
+	return nil
+}
+
 func (sp *serviceProvider) retrieveState(r *http.Request) (state []byte, err error) {
 	// retrieve the relayState from our cache
 	stateID := r.Form.Get("RelayState")
@@ -15,6 +15,9 @@
 package sp
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -24,9 +27,9 @@ import (
 	"testing"
 	"time"
 
-	"github.com/amdonov/lite-idp/idp"
 	"github.com/amdonov/lite-idp/saml"
 	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/xmlsig"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -42,7 +45,7 @@ func Test_serviceProvider_resolveArtifact(t *testing.T) {
 		io.Copy(w, f)
 	}))
 
-	tlsConfigClient, err := idp.ConfigureTLS()
+	tlsConfigClient, err := testTLSConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,7 +66,7 @@ func Test_serviceProvider_resolveArtifact(t *testing.T) {
 func Test_serviceProvider_ArtifactFunc(t *testing.T) {
 	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
 	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
-	tlsConfigClient, err := idp.ConfigureTLS()
+	tlsConfigClient, err := testTLSConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -88,7 +91,7 @@ func Test_serviceProvider_ArtifactFunc(t *testing.T) {
 func Test_serviceProvider_retrieveState(t *testing.T) {
 	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
 	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
-	tlsConfigClient, err := idp.ConfigureTLS()
+	tlsConfigClient, err := testTLSConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -126,7 +129,7 @@ func Test_serviceProvider_retrieveState(t *testing.T) {
 func Test_serviceProvider_validateAssertion(t *testing.T) {
 	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
 	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
-	tlsConfigClient, err := idp.ConfigureTLS()
+	tlsConfigClient, err := testTLSConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -159,7 +162,7 @@ func Test_serviceProvider_validateAssertion(t *testing.T) {
 func Test_serviceProvider_validateAssertionWithThreshold(t *testing.T) {
 	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
 	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
-	tlsConfigClient, err := idp.ConfigureTLS()
+	tlsConfigClient, err := testTLSConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -199,3 +202,51 @@ func Test_serviceProvider_validateAssertionWithThreshold(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 	assert.Contains(t, err.Error(), "got response that cannot be processed because it expired at")
 }
+
+func Test_validateHolderOfKey(t *testing.T) {
+	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
+	tlsConfig, err := testTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := tlsConfig.Certificates[0].Certificate[0]
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion := &saml.Assertion{
+		Subject: &saml.Subject{
+			SubjectConfirmation: &saml.SubjectConfirmation{
+				Method: holderOfKeyMethod,
+				SubjectConfirmationData: &saml.SubjectConfirmationData{
+					KeyInfo: &xmlsig.KeyInfo{
+						X509Data: &xmlsig.X509Data{X509Certificate: base64.StdEncoding.EncodeToString(der)},
+					},
+				},
+			},
+		},
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	assert.NoError(t, validateHolderOfKey(assertion, req))
+
+	req.TLS = nil
+	assert.EqualError(t, validateHolderOfKey(assertion, req), "holder-of-key assertions require a client certificate")
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: []byte("other")}}}
+	assert.EqualError(t, validateHolderOfKey(assertion, req), "client certificate does not match the holder-of-key assertion")
+
+	assertion.Subject.SubjectConfirmation.Method = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	assert.EqualError(t, validateHolderOfKey(assertion, req), "assertion is not a holder-of-key assertion")
+}
+
+// testTLSConfig loads the certificate and key configured for the test. The idp package can't be used for this since
+// it imports sp.
+func testTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(viper.GetString("tls-certificate"), viper.GetString("tls-private-key"))
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
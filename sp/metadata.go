@@ -45,16 +45,23 @@ func (sp *serviceProvider) MetadataFunc() (http.HandlerFunc, error) {
 					},
 				},
 			},
-			KeyDescriptor: saml.KeyDescriptor{
-				Use: "signing",
-				KeyInfo: xmlsig.KeyInfo{
-					X509Data: &xmlsig.X509Data{
-						X509Certificate: base64.StdEncoding.EncodeToString(certData),
+			KeyDescriptor: []saml.KeyDescriptor{
+				{
+					Use: "signing",
+					KeyInfo: xmlsig.KeyInfo{
+						X509Data: &xmlsig.X509Data{
+							X509Certificate: base64.StdEncoding.EncodeToString(certData),
+						},
 					},
 				},
 			},
 		},
 	}
+	if sp.configuration.HolderOfKey {
+		acs := &ed.SPSSODescriptor.AssertionConsumerService[0]
+		acs.Binding = saml.HoKSSOBrowser
+		acs.ProtocolBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"
+	}
 	sig, err := sp.signer.CreateSignature(ed)
 	if err != nil {
 		return nil, err
@@ -19,7 +19,6 @@ import (
 	"path/filepath"
 	"testing"
 
-	"github.com/amdonov/lite-idp/idp"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -27,7 +26,7 @@ import (
 func Test_serviceProvider_MetadataFunc(t *testing.T) {
 	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
 	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
-	tlsConfigClient, err := idp.ConfigureTLS()
+	tlsConfigClient, err := testTLSConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -8,7 +8,6 @@ import (
 	"path/filepath"
 	"testing"
 
-	"github.com/amdonov/lite-idp/idp"
 	"github.com/spf13/viper"
 )
 
@@ -23,7 +22,7 @@ func TestQuery(t *testing.T) {
 		io.Copy(w, f)
 	}))
 
-	tlsConfigClient, err := idp.ConfigureTLS()
+	tlsConfigClient, err := testTLSConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
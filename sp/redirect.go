@@ -28,17 +28,19 @@ import (
 // GetRedirect stores the provided state and returns a URL suitable for redirecting the SAML IdP (redirect binding)
 func (sp *serviceProvider) GetRedirect(state []byte) (string, error) {
 	data := struct {
-		ID       string
-		Time     string
-		IDP      string
-		ACSURL   string
-		EntityID string
+		ID          string
+		Time        string
+		IDP         string
+		ACSURL      string
+		EntityID    string
+		HolderOfKey bool
 	}{
 		saml.NewID(),
 		time.Now().UTC().Format(time.RFC3339),
 		sp.configuration.IDPRedirectEndpoint,
 		sp.configuration.AssertionConsumerServiceURL,
 		sp.configuration.EntityID,
+		sp.configuration.HolderOfKey,
 	}
 	var b bytes.Buffer
 	writer, err := flate.NewWriter(&b, flate.DefaultCompression)
@@ -76,4 +78,4 @@ func (sp *serviceProvider) GetRedirect(state []byte) (string, error) {
 	return sp.configuration.IDPRedirectEndpoint + "?" + query, err
 }
 
-const requestTemplate = `<?xml version="1.0"?><samlp:AuthnRequest ID="{{ .ID }}" Version="2.0" IssueInstant="{{ .Time }}" ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact" AssertionConsumerServiceURL="{{ .ACSURL }}" Destination="{{ .IDP }}" xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"><saml:Issuer>{{ .EntityID }}</saml:Issuer></samlp:AuthnRequest>`
+const requestTemplate = `<?xml version="1.0"?><samlp:AuthnRequest ID="{{ .ID }}" Version="2.0" IssueInstant="{{ .Time }}" {{ if .HolderOfKey }}ProtocolBinding="urn:oasis:names:tc:SAML:2.0:profiles:holder-of-key:SSO:browser" xmlns:hoksso="urn:oasis:names:tc:SAML:2.0:profiles:holder-of-key:SSO:browser" hoksso:ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"{{ else }}ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"{{ end }} AssertionConsumerServiceURL="{{ .ACSURL }}" Destination="{{ .IDP }}" xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"><saml:Issuer>{{ .EntityID }}</saml:Issuer></samlp:AuthnRequest>`
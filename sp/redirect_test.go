@@ -18,14 +18,13 @@ import (
 	"path/filepath"
 	"testing"
 
-	"github.com/amdonov/lite-idp/idp"
 	"github.com/spf13/viper"
 )
 
 func Test_serviceProvider_GetRedirect(t *testing.T) {
 	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
 	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
-	tlsConfigClient, err := idp.ConfigureTLS()
+	tlsConfigClient, err := testTLSConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -21,8 +21,8 @@ import (
 	"time"
 
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sign"
 	"github.com/amdonov/lite-idp/store"
-	"github.com/amdonov/xmlsig"
 )
 
 // ServiceProvider acts as a SAML service provider
@@ -47,6 +47,12 @@ type Configuration struct {
 	TLSConfig       *tls.Config
 	Cache           store.Cache
 	TimestampMargin time.Duration
+	// Optional signature and digest algorithms for requests. Defaults to RSA-SHA256 or the ECDSA
+	// algorithm matching the key's curve with SHA-256 digests.
+	SignatureAlgorithm string
+	DigestAlgorithm    string
+	// Request holder-of-key assertions bound to the user's TLS client certificate
+	HolderOfKey bool
 }
 
 // New creates a service provider from the provided configuration
@@ -57,7 +63,10 @@ func New(conf Configuration) (ServiceProvider, error) {
 	}
 	cert := conf.TLSConfig.Certificates[0]
 
-	signer, err := xmlsig.NewSigner(cert)
+	signer, err := sign.NewSigner(cert, sign.SignerOptions{
+		SignatureAlgorithm: conf.SignatureAlgorithm,
+		DigestAlgorithm:    conf.DigestAlgorithm,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +93,7 @@ func New(conf Configuration) (ServiceProvider, error) {
 type serviceProvider struct {
 	configuration   Configuration
 	requestTemplate *template.Template
-	signer          xmlsig.Signer
+	signer          sign.Signer
 	client          *http.Client
 	stateCache      store.Cache
 	timestampMargin time.Duration
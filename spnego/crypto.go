@@ -0,0 +1,280 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spnego
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Encryption types of the keys that can be used. These are the simplified profile AES types of RFC 3962.
+const (
+	AES128CTSHMACSHA196 int32 = 17
+	AES256CTSHMACSHA196 int32 = 18
+)
+
+// Key usage numbers of RFC 4120
+const (
+	usageTicket        uint32 = 2
+	usageAuthenticator uint32 = 11
+)
+
+const (
+	// Size of the HMAC-SHA1-96 checksum appended to ciphertext
+	macSize = 12
+	// The confounder is one AES block
+	confounderSize = aes.BlockSize
+)
+
+// ErrIntegrity is returned when ciphertext wasn't encrypted with the key or has been modified
+var ErrIntegrity = errors.New("ciphertext integrity check failed")
+
+// EncryptionKey is a Kerberos key
+type EncryptionKey struct {
+	Type  int32  `asn1:"explicit,tag:0"`
+	Value []byte `asn1:"explicit,tag:1"`
+}
+
+// keySize returns the size of keys of the encryption type
+func keySize(etype int32) (int, error) {
+	switch etype {
+	case AES128CTSHMACSHA196:
+		return 16, nil
+	case AES256CTSHMACSHA196:
+		return 32, nil
+	}
+	return 0, fmt.Errorf("unsupported encryption type %d", etype)
+}
+
+// NewEncryptionKey returns a random key of the encryption type
+func NewEncryptionKey(etype int32) (EncryptionKey, error) {
+	size, err := keySize(etype)
+	if err != nil {
+		return EncryptionKey{}, err
+	}
+	key := EncryptionKey{Type: etype, Value: make([]byte, size)}
+	if _, err = rand.Read(key.Value); err != nil {
+		return EncryptionKey{}, err
+	}
+	return key, nil
+}
+
+// usageKeys returns the encryption and integrity keys derived for the usage
+func (k EncryptionKey) usageKeys(usage uint32) ([]byte, []byte, error) {
+	size, err := keySize(k.Type)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(k.Value) != size {
+		return nil, nil, fmt.Errorf("key is %d bytes instead of %d", len(k.Value), size)
+	}
+	constant := make([]byte, 5)
+	binary.BigEndian.PutUint32(constant, usage)
+	constant[4] = 0xAA
+	ke, err := deriveKey(k.Value, constant)
+	if err != nil {
+		return nil, nil, err
+	}
+	constant[4] = 0x55
+	ki, err := deriveKey(k.Value, constant)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ke, ki, nil
+}
+
+// encrypt returns the ciphertext of the plaintext for the key usage. A random confounder is prepended to the
+// plaintext and an HMAC of both is appended to the ciphertext.
+func (k EncryptionKey) encrypt(usage uint32, plaintext []byte) ([]byte, error) {
+	ke, ki, err := k.usageKeys(usage)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, confounderSize, confounderSize+len(plaintext))
+	if _, err = rand.Read(data); err != nil {
+		return nil, err
+	}
+	data = append(data, plaintext...)
+	ciphertext, err := encryptCTS(ke, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(ciphertext, mac(ki, data)...), nil
+}
+
+// decrypt checks the integrity of the ciphertext and returns its plaintext
+func (k EncryptionKey) decrypt(usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < confounderSize+macSize {
+		return nil, errors.New("ciphertext is too short")
+	}
+	ke, ki, err := k.usageKeys(usage)
+	if err != nil {
+		return nil, err
+	}
+	checksum := ciphertext[len(ciphertext)-macSize:]
+	data, err := decryptCTS(ke, ciphertext[:len(ciphertext)-macSize])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(checksum, mac(ki, data)) {
+		return nil, ErrIntegrity
+	}
+	return data[confounderSize:], nil
+}
+
+// mac is the truncated HMAC-SHA1 of the data
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha1.New, key)
+	h.Write(data)
+	return h.Sum(nil)[:macSize]
+}
+
+// deriveKey is the DK function of RFC 3961. Random-to-key is the identity function for AES.
+func deriveKey(key, constant []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	derived := make([]byte, 0, len(key)+aes.BlockSize)
+	input := nfold(constant, aes.BlockSize)
+	for len(derived) < len(key) {
+		output := make([]byte, aes.BlockSize)
+		block.Encrypt(output, input)
+		derived = append(derived, output...)
+		input = output
+	}
+	return derived[:len(key)], nil
+}
+
+// nfold stretches or folds the input to size bytes as described in RFC 3961
+func nfold(input []byte, size int) []byte {
+	inBits := len(input) * 8
+	outBits := size * 8
+	lcm := inBits * outBits / gcd(inBits, outBits)
+	// Concatenate copies of the input rotated right by 13 bits more each time, then add the size byte chunks of
+	// the result with ones' complement addition
+	buf := make([]byte, lcm/8)
+	for i := 0; i < lcm/inBits; i++ {
+		for bit := 0; bit < inBits; bit++ {
+			from := ((bit-13*i)%inBits + inBits) % inBits
+			if input[from/8]&(0x80>>uint(from%8)) != 0 {
+				to := i*inBits + bit
+				buf[to/8] |= 0x80 >> uint(to%8)
+			}
+		}
+	}
+	out := make([]byte, size)
+	for chunk := 0; chunk < len(buf); chunk += size {
+		carry := 0
+		for i := size - 1; i >= 0; i-- {
+			sum := int(out[i]) + int(buf[chunk+i]) + carry
+			out[i] = byte(sum)
+			carry = sum >> 8
+		}
+		for carry != 0 {
+			for i := size - 1; i >= 0 && carry != 0; i-- {
+				sum := int(out[i]) + carry
+				out[i] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// encryptCTS encrypts with AES in CBC mode with ciphertext stealing and a zero IV as described in RFC 3962
+func encryptCTS(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) < aes.BlockSize {
+		return nil, errors.New("plaintext is shorter than a block")
+	}
+	iv := make([]byte, aes.BlockSize)
+	if len(plaintext) == aes.BlockSize {
+		ciphertext := make([]byte, aes.BlockSize)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+		return ciphertext, nil
+	}
+	// Zero padding the last block and swapping the last two ciphertext blocks is equivalent to stealing
+	partial := len(plaintext) % aes.BlockSize
+	if partial == 0 {
+		partial = aes.BlockSize
+	}
+	padded := make([]byte, len(plaintext)+aes.BlockSize-partial)
+	copy(padded, plaintext)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	n := len(padded)
+	ciphertext := make([]byte, 0, len(plaintext))
+	ciphertext = append(ciphertext, padded[:n-2*aes.BlockSize]...)
+	ciphertext = append(ciphertext, padded[n-aes.BlockSize:]...)
+	return append(ciphertext, padded[n-2*aes.BlockSize:n-2*aes.BlockSize+partial]...), nil
+}
+
+// decryptCTS reverses encryptCTS
+func decryptCTS(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("ciphertext is shorter than a block")
+	}
+	iv := make([]byte, aes.BlockSize)
+	if len(ciphertext) == aes.BlockSize {
+		plaintext := make([]byte, aes.BlockSize)
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+		return plaintext, nil
+	}
+	partial := len(ciphertext) % aes.BlockSize
+	if partial == 0 {
+		partial = aes.BlockSize
+	}
+	// Blocks before the last two are plain CBC
+	head := len(ciphertext) - aes.BlockSize - partial
+	plaintext := make([]byte, len(ciphertext))
+	if head > 0 {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext[:head], ciphertext[:head])
+		iv = ciphertext[head-aes.BlockSize : head]
+	}
+	// The second to last block holds the last CBC block. Decrypting it reveals the stolen end of the block before.
+	last := make([]byte, aes.BlockSize)
+	block.Decrypt(last, ciphertext[head:head+aes.BlockSize])
+	stolen := make([]byte, aes.BlockSize)
+	copy(stolen, ciphertext[head+aes.BlockSize:])
+	copy(stolen[partial:], last[partial:])
+	for i := 0; i < partial; i++ {
+		plaintext[head+aes.BlockSize+i] = last[i] ^ stolen[i]
+	}
+	block.Decrypt(plaintext[head:head+aes.BlockSize], stolen)
+	for i := 0; i < aes.BlockSize; i++ {
+		plaintext[head+i] ^= iv[i]
+	}
+	return plaintext, nil
+}
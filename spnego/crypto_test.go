@@ -0,0 +1,111 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spnego
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_nfold(t *testing.T) {
+	// Test vectors from RFC 3961
+	tests := []struct {
+		input  string
+		size   int
+		output string
+	}{
+		{"012345", 8, "be072631276b1955"},
+		{"password", 7, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 8, "bb6ed30870b7f0e0"},
+		{"password", 21, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"kerberos", 16, "6b65726265726f737b9b5b2b93132b93"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.output, hex.EncodeToString(nfold([]byte(test.input), test.size)), test.input)
+	}
+}
+
+func Test_deriveKey(t *testing.T) {
+	// The string-to-key test vectors of RFC 3962 for the password "password", salt "ATHENA.MIT.EDUraeburn", and 1
+	// iteration. The input is the PBKDF2 output and the derived key is the resulting AES key.
+	tkey, _ := hex.DecodeString("cdedb5281bb2f801565a1122b25635150ad1f7a04bb9f3a333ecc0e2e1f70837")
+	key, err := deriveKey(tkey[:16], []byte("kerberos"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "42263c6e89f4fc28b8df68ee09799f15", hex.EncodeToString(key))
+	}
+	key, err = deriveKey(tkey, []byte("kerberos"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161", hex.EncodeToString(key))
+	}
+}
+
+func Test_encryptCTS(t *testing.T) {
+	// Test vectors from RFC 3962
+	key := []byte("chicken teriyaki")
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"4920776f756c64206c696b652074686520",
+			"c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320",
+			"fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c2047617527732043",
+			"39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c",
+			"97687268d6ecccc0c07b25e25ecfe584b3fffd940c16a18c1b5549d2f838029e39312523a78662d5be7fcbcc98ebf5"},
+	}
+	for _, test := range tests {
+		input, _ := hex.DecodeString(test.input)
+		ciphertext, err := encryptCTS(key, input)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.output, hex.EncodeToString(ciphertext))
+		}
+		plaintext, err := decryptCTS(key, ciphertext)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.input, hex.EncodeToString(plaintext))
+		}
+	}
+}
+
+func TestEncryptionKey_decrypt(t *testing.T) {
+	for _, etype := range []int32{AES128CTSHMACSHA196, AES256CTSHMACSHA196} {
+		key, err := NewEncryptionKey(etype)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []int{0, 1, 16, 33} {
+			plaintext := make([]byte, size)
+			ciphertext, err := key.encrypt(usageTicket, plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := key.decrypt(usageTicket, ciphertext)
+			if assert.NoError(t, err) {
+				assert.Equal(t, plaintext, decrypted)
+			}
+			// Keys are derived for each usage
+			_, err = key.decrypt(usageAuthenticator, ciphertext)
+			assert.Equal(t, ErrIntegrity, err)
+			ciphertext[0] ^= 1
+			_, err = key.decrypt(usageTicket, ciphertext)
+			assert.Equal(t, ErrIntegrity, err)
+		}
+	}
+	_, err := NewEncryptionKey(23)
+	assert.EqualError(t, err, "unsupported encryption type 23")
+}
@@ -0,0 +1,242 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spnego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Name types of RFC 4120
+const (
+	NameTypePrincipal   int32 = 1
+	NameTypeServiceHost int32 = 3
+)
+
+// keytabVersion is the MIT keytab format written by ktutil and ktpass
+const keytabVersion = 0x0502
+
+// Principal is a Kerberos principal name
+type Principal struct {
+	NameType   int32
+	Components []string
+	Realm      string
+}
+
+// String returns the principal in the usual name/instance@REALM form
+func (p Principal) String() string {
+	return strings.Join(p.Components, "/") + "@" + p.Realm
+}
+
+// Equal reports whether the principals have the same name and realm. Name types aren't compared.
+func (p Principal) Equal(other Principal) bool {
+	if p.Realm != other.Realm || len(p.Components) != len(other.Components) {
+		return false
+	}
+	for i, component := range p.Components {
+		if component != other.Components[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// KeytabEntry is a key of a principal
+type KeytabEntry struct {
+	Principal Principal
+	Timestamp time.Time
+	KVNO      uint32
+	Key       EncryptionKey
+}
+
+// Keytab holds the keys of service principals
+type Keytab struct {
+	Entries []KeytabEntry
+}
+
+// LoadKeytab reads the keytab file
+func LoadKeytab(path string) (*Keytab, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeytab(data)
+}
+
+// ParseKeytab parses a keytab in the MIT format version 2
+func ParseKeytab(data []byte) (*Keytab, error) {
+	if len(data) < 2 || binary.BigEndian.Uint16(data) != keytabVersion {
+		return nil, errors.New("keytab is not in a supported format")
+	}
+	keytab := &Keytab{}
+	r := bytes.NewReader(data[2:])
+	for r.Len() > 0 {
+		var size int32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, errors.New("keytab is truncated")
+		}
+		// Deleted entries leave holes
+		if size < 0 {
+			if _, err := r.Seek(int64(-size), 1); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if int(size) > r.Len() {
+			return nil, errors.New("keytab is truncated")
+		}
+		record := make([]byte, size)
+		if _, err := r.Read(record); err != nil {
+			return nil, err
+		}
+		entry, err := parseKeytabEntry(record)
+		if err != nil {
+			return nil, err
+		}
+		keytab.Entries = append(keytab.Entries, *entry)
+	}
+	return keytab, nil
+}
+
+func parseKeytabEntry(record []byte) (*KeytabEntry, error) {
+	r := bytes.NewReader(record)
+	read := func(v interface{}) error {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return errors.New("keytab entry is truncated")
+		}
+		return nil
+	}
+	readString := func() ([]byte, error) {
+		var size uint16
+		if err := read(&size); err != nil {
+			return nil, err
+		}
+		if int(size) > r.Len() {
+			return nil, errors.New("keytab entry is truncated")
+		}
+		value := make([]byte, size)
+		_, err := r.Read(value)
+		return value, err
+	}
+	entry := &KeytabEntry{}
+	var components uint16
+	if err := read(&components); err != nil {
+		return nil, err
+	}
+	realm, err := readString()
+	if err != nil {
+		return nil, err
+	}
+	entry.Principal.Realm = string(realm)
+	for i := 0; i < int(components); i++ {
+		component, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		entry.Principal.Components = append(entry.Principal.Components, string(component))
+	}
+	var timestamp uint32
+	var kvno uint8
+	var keyType uint16
+	if err = read(&entry.Principal.NameType); err != nil {
+		return nil, err
+	}
+	if err = read(&timestamp); err != nil {
+		return nil, err
+	}
+	entry.Timestamp = time.Unix(int64(timestamp), 0)
+	if err = read(&kvno); err != nil {
+		return nil, err
+	}
+	entry.KVNO = uint32(kvno)
+	if err = read(&keyType); err != nil {
+		return nil, err
+	}
+	entry.Key.Type = int32(keyType)
+	if entry.Key.Value, err = readString(); err != nil {
+		return nil, err
+	}
+	// Newer keytabs follow the key with the full key version number
+	if r.Len() >= 4 {
+		var kvno32 uint32
+		if err = read(&kvno32); err != nil {
+			return nil, err
+		}
+		if kvno32 != 0 {
+			entry.KVNO = kvno32
+		}
+	}
+	return entry, nil
+}
+
+// Marshal encodes the keytab in the MIT format version 2
+func (k *Keytab) Marshal() []byte {
+	buf := &bytes.Buffer{}
+	write := func(v interface{}) {
+		// Writes to a buffer don't fail
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	write(uint16(keytabVersion))
+	for _, entry := range k.Entries {
+		record := &bytes.Buffer{}
+		writeRecord := func(v interface{}) {
+			binary.Write(record, binary.BigEndian, v)
+		}
+		writeString := func(value []byte) {
+			writeRecord(uint16(len(value)))
+			record.Write(value)
+		}
+		writeRecord(uint16(len(entry.Principal.Components)))
+		writeString([]byte(entry.Principal.Realm))
+		for _, component := range entry.Principal.Components {
+			writeString([]byte(component))
+		}
+		writeRecord(entry.Principal.NameType)
+		writeRecord(uint32(entry.Timestamp.Unix()))
+		writeRecord(uint8(entry.KVNO))
+		writeRecord(uint16(entry.Key.Type))
+		writeString(entry.Key.Value)
+		writeRecord(entry.KVNO)
+		write(int32(record.Len()))
+		buf.Write(record.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// key returns the principal's key of the encryption type. The highest key version is used when the version is 0.
+func (k *Keytab) key(principal Principal, etype int32, kvno uint32) (EncryptionKey, error) {
+	var found *KeytabEntry
+	for j, entry := range k.Entries {
+		if !entry.Principal.Equal(principal) || entry.Key.Type != etype {
+			continue
+		}
+		if kvno != 0 && entry.KVNO != kvno {
+			continue
+		}
+		if found == nil || entry.KVNO > found.KVNO {
+			found = &k.Entries[j]
+		}
+	}
+	if found == nil {
+		return EncryptionKey{}, fmt.Errorf("keytab does not contain a key for %s with encryption type %d and version %d",
+			principal, etype, kvno)
+	}
+	return found.Key, nil
+}
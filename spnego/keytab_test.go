@@ -0,0 +1,67 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spnego
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeytab(t *testing.T) {
+	service := Principal{NameType: NameTypeServiceHost, Components: []string{"HTTP", "idp.example.com"},
+		Realm: "EXAMPLE.COM"}
+	keytab := &Keytab{}
+	for kvno := uint32(1); kvno <= 300; kvno += 299 {
+		for _, etype := range []int32{AES128CTSHMACSHA196, AES256CTSHMACSHA196} {
+			key, err := NewEncryptionKey(etype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keytab.Entries = append(keytab.Entries, KeytabEntry{Principal: service, Timestamp: time.Unix(1571500000, 0),
+				KVNO: kvno, Key: key})
+		}
+	}
+	data := keytab.Marshal()
+	// Add a hole left by a deleted entry
+	data = append(data, 0xff, 0xff, 0xff, 0xfe, 0, 0)
+	parsed, err := ParseKeytab(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, keytab, parsed)
+	assert.Equal(t, "HTTP/idp.example.com@EXAMPLE.COM", parsed.Entries[0].Principal.String())
+
+	// Versions above 255 come from the 32 bit version number
+	key, err := parsed.key(service, AES256CTSHMACSHA196, 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, keytab.Entries[3].Key, key)
+	}
+	key, err = parsed.key(service, AES256CTSHMACSHA196, 1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, keytab.Entries[1].Key, key)
+	}
+	_, err = parsed.key(service, AES256CTSHMACSHA196, 2)
+	assert.Error(t, err)
+	_, err = parsed.key(Principal{Components: []string{"HTTP", "other.example.com"}, Realm: "EXAMPLE.COM"},
+		AES256CTSHMACSHA196, 0)
+	assert.Error(t, err)
+
+	_, err = ParseKeytab([]byte{5, 1})
+	assert.Error(t, err)
+	_, err = ParseKeytab(data[:len(data)-20])
+	assert.Error(t, err)
+}
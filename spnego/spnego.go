@@ -0,0 +1,330 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spnego implements the acceptor side of SPNEGO with Kerberos 5 needed for integrated Windows
+// authentication. Service tickets are decrypted with keys from a keytab. Only the AES encryption types are supported.
+package spnego
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/amdonov/lite-idp/store"
+)
+
+// AcceptCompleted is the negTokenResp sent in the WWW-Authenticate header to tell the client it was authenticated
+const AcceptCompleted = "oRQwEqADCgEAoQsGCSqGSIb3EgECAg=="
+
+var (
+	spnegoOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	krb5OID   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	// Older Windows clients identify Kerberos with this OID
+	msKrb5OID = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+)
+
+// ErrNotKerberos is returned for tokens that use another mechanism such as NTLM
+var ErrNotKerberos = errors.New("token does not use Kerberos")
+
+const (
+	// Token ID of a Kerberos AP-REQ in a GSS-API token
+	tokenAPReq   = 0x0100
+	msgTypeAPReq = 14
+	// Ticket flag marking postdated tickets that haven't been validated
+	flagInvalid = 7
+)
+
+type negTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	ReqFlags    asn1.BitString          `asn1:"optional,explicit,tag:1"`
+	MechToken   []byte                  `asn1:"optional,explicit,tag:2"`
+	MechListMIC []byte                  `asn1:"optional,explicit,tag:3"`
+}
+
+type principalName struct {
+	NameType   int32    `asn1:"explicit,tag:0"`
+	NameString []string `asn1:"explicit,tag:1"`
+}
+
+func (p principalName) principal(realm string) Principal {
+	return Principal{NameType: p.NameType, Components: p.NameString, Realm: realm}
+}
+
+type encryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+type apReq struct {
+	PVNO          int            `asn1:"explicit,tag:0"`
+	MsgType       int            `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  `asn1:"explicit,tag:3"`
+	Authenticator encryptedData  `asn1:"explicit,tag:4"`
+}
+
+type ticket struct {
+	TktVNO  int           `asn1:"explicit,tag:0"`
+	Realm   string        `asn1:"explicit,tag:1"`
+	SName   principalName `asn1:"explicit,tag:2"`
+	EncPart encryptedData `asn1:"explicit,tag:3"`
+}
+
+type transitedEncoding struct {
+	Type     int32  `asn1:"explicit,tag:0"`
+	Contents []byte `asn1:"explicit,tag:1"`
+}
+
+type encTicketPart struct {
+	Flags             asn1.BitString    `asn1:"explicit,tag:0"`
+	Key               EncryptionKey     `asn1:"explicit,tag:1"`
+	CRealm            string            `asn1:"explicit,tag:2"`
+	CName             principalName     `asn1:"explicit,tag:3"`
+	Transited         transitedEncoding `asn1:"explicit,tag:4"`
+	AuthTime          time.Time         `asn1:"generalized,explicit,tag:5"`
+	StartTime         time.Time         `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime           time.Time         `asn1:"generalized,explicit,tag:7"`
+	RenewTill         time.Time         `asn1:"generalized,optional,explicit,tag:8"`
+	CAddr             asn1.RawValue     `asn1:"optional,explicit,tag:9"`
+	AuthorizationData asn1.RawValue     `asn1:"optional,explicit,tag:10"`
+}
+
+type authenticator struct {
+	AuthenticatorVNO  int           `asn1:"explicit,tag:0"`
+	CRealm            string        `asn1:"explicit,tag:1"`
+	CName             principalName `asn1:"explicit,tag:2"`
+	Cksum             asn1.RawValue `asn1:"optional,explicit,tag:3"`
+	Cusec             int           `asn1:"explicit,tag:4"`
+	CTime             time.Time     `asn1:"generalized,explicit,tag:5"`
+	SubKey            asn1.RawValue `asn1:"optional,explicit,tag:6"`
+	SeqNumber         int64         `asn1:"optional,explicit,tag:7"`
+	AuthorizationData asn1.RawValue `asn1:"optional,explicit,tag:8"`
+}
+
+// Acceptor authenticates clients that send service tickets for principals in its keytab
+type Acceptor struct {
+	keytab *Keytab
+	replay store.Cache
+	skew   time.Duration
+	now    func() time.Time
+}
+
+// NewAcceptor returns an acceptor using keys from the keytab. Authenticators are remembered in the cache to detect
+// replays, so entries must live longer than the allowed clock skew.
+func NewAcceptor(keytab *Keytab, replay store.Cache, skew time.Duration) *Acceptor {
+	return &Acceptor{keytab: keytab, replay: replay, skew: skew, now: time.Now}
+}
+
+// Accept validates the SPNEGO token sent by a client and returns the client's principal
+func (a *Acceptor) Accept(token []byte) (*Principal, error) {
+	mechToken, err := kerberosToken(token)
+	if err != nil {
+		return nil, err
+	}
+	req := &apReq{}
+	if _, err = asn1.UnmarshalWithParams(mechToken, req, fmt.Sprintf("application,explicit,tag:%d", msgTypeAPReq)); err != nil {
+		return nil, fmt.Errorf("malformed AP-REQ: %s", err)
+	}
+	if req.PVNO != 5 || req.MsgType != msgTypeAPReq {
+		return nil, errors.New("token is not a Kerberos 5 AP-REQ")
+	}
+	tkt := &ticket{}
+	// Raw values keep their explicit tag, so the ticket is its content
+	if _, err = asn1.UnmarshalWithParams(req.Ticket.Bytes, tkt, "application,explicit,tag:1"); err != nil {
+		return nil, fmt.Errorf("malformed ticket: %s", err)
+	}
+	service := tkt.SName.principal(tkt.Realm)
+	key, err := a.keytab.key(service, tkt.EncPart.EType, uint32(tkt.EncPart.KVNO))
+	if err != nil {
+		return nil, err
+	}
+	data, err := key.decrypt(usageTicket, tkt.EncPart.Cipher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt ticket for %s: %s", service, err)
+	}
+	part := &encTicketPart{}
+	if _, err = asn1.UnmarshalWithParams(data, part, "application,explicit,tag:3"); err != nil {
+		return nil, fmt.Errorf("malformed ticket: %s", err)
+	}
+	now := a.now()
+	start := part.StartTime
+	if start.IsZero() {
+		start = part.AuthTime
+	}
+	if now.Add(a.skew).Before(start) {
+		return nil, errors.New("ticket is not valid yet")
+	}
+	if !now.Add(-a.skew).Before(part.EndTime) {
+		return nil, errors.New("ticket has expired")
+	}
+	if part.Flags.At(flagInvalid) != 0 {
+		return nil, errors.New("ticket is marked invalid")
+	}
+	client := part.CName.principal(part.CRealm)
+	// The authenticator proves the client knows the session key
+	if data, err = part.Key.decrypt(usageAuthenticator, req.Authenticator.Cipher); err != nil {
+		return nil, fmt.Errorf("failed to decrypt authenticator: %s", err)
+	}
+	auth := &authenticator{}
+	if _, err = asn1.UnmarshalWithParams(data, auth, "application,explicit,tag:2"); err != nil {
+		return nil, fmt.Errorf("malformed authenticator: %s", err)
+	}
+	if !auth.CName.principal(auth.CRealm).Equal(client) {
+		return nil, errors.New("authenticator is for another client")
+	}
+	if auth.CTime.Before(now.Add(-a.skew)) || auth.CTime.After(now.Add(a.skew)) {
+		return nil, errors.New("authenticator time is outside the allowed clock skew")
+	}
+	sum := sha256.Sum256(req.Authenticator.Cipher)
+	replayKey := "krb-authenticator:" + hex.EncodeToString(sum[:])
+	added, err := a.replay.Add(replayKey, []byte{})
+	if err != nil {
+		return nil, err
+	}
+	if !added {
+		return nil, errors.New("authenticator has already been used")
+	}
+	return &client, nil
+}
+
+// kerberosToken returns the Kerberos AP-REQ in a SPNEGO token. Raw Kerberos GSS-API tokens are accepted too.
+func kerberosToken(token []byte) ([]byte, error) {
+	oid, inner, err := unwrapGSSToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if oid.Equal(spnegoOID) {
+		init := &negTokenInit{}
+		if _, err = asn1.UnmarshalWithParams(inner, init, "explicit,tag:0"); err != nil {
+			return nil, fmt.Errorf("malformed SPNEGO token: %s", err)
+		}
+		// The optimistic token is for the client's preferred mechanism
+		if len(init.MechTypes) == 0 || len(init.MechToken) == 0 ||
+			!(init.MechTypes[0].Equal(krb5OID) || init.MechTypes[0].Equal(msKrb5OID)) {
+			return nil, ErrNotKerberos
+		}
+		if oid, inner, err = unwrapGSSToken(init.MechToken); err != nil {
+			return nil, err
+		}
+	}
+	if !oid.Equal(krb5OID) && !oid.Equal(msKrb5OID) {
+		return nil, ErrNotKerberos
+	}
+	if len(inner) < 2 || int(inner[0])<<8|int(inner[1]) != tokenAPReq {
+		return nil, errors.New("Kerberos token is not an AP-REQ")
+	}
+	return inner[2:], nil
+}
+
+// unwrapGSSToken returns the mechanism and inner token of a GSS-API initial context token
+func unwrapGSSToken(token []byte) (asn1.ObjectIdentifier, []byte, error) {
+	var outer asn1.RawValue
+	rest, err := asn1.Unmarshal(token, &outer)
+	if err != nil || len(rest) > 0 || outer.Class != asn1.ClassApplication || outer.Tag != 0 || !outer.IsCompound {
+		return nil, nil, errors.New("token is not a GSS-API initial context token")
+	}
+	var oid asn1.ObjectIdentifier
+	inner, err := asn1.Unmarshal(outer.Bytes, &oid)
+	if err != nil {
+		return nil, nil, errors.New("token is not a GSS-API initial context token")
+	}
+	return oid, inner, nil
+}
+
+// wrapGSSToken returns a GSS-API initial context token with the inner token
+func wrapGSSToken(oid asn1.ObjectIdentifier, inner []byte) ([]byte, error) {
+	data, err := asn1.Marshal(oid)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true,
+		Bytes: append(data, inner...)})
+}
+
+// NewToken returns a SPNEGO token for the client as if the KDC had issued it a ticket for the service. The service
+// key is the key from the service's keytab. It's meant for tests and tools since real clients get tickets from the
+// KDC.
+func NewToken(client, service Principal, serviceKey EncryptionKey, kvno uint32, now time.Time) ([]byte, error) {
+	sessionKey, err := NewEncryptionKey(serviceKey.Type)
+	if err != nil {
+		return nil, err
+	}
+	flags := asn1.BitString{Bytes: make([]byte, 4), BitLength: 32}
+	part, err := asn1.MarshalWithParams(encTicketPart{
+		Flags:     flags,
+		Key:       sessionKey,
+		CRealm:    client.Realm,
+		CName:     principalName{NameType: client.NameType, NameString: client.Components},
+		Transited: transitedEncoding{Contents: []byte{}},
+		AuthTime:  now.UTC(),
+		EndTime:   now.Add(10 * time.Hour).UTC(),
+	}, "application,explicit,tag:3")
+	if err != nil {
+		return nil, err
+	}
+	encPart, err := serviceKey.encrypt(usageTicket, part)
+	if err != nil {
+		return nil, err
+	}
+	tkt, err := asn1.MarshalWithParams(ticket{
+		TktVNO:  5,
+		Realm:   service.Realm,
+		SName:   principalName{NameType: service.NameType, NameString: service.Components},
+		EncPart: encryptedData{EType: serviceKey.Type, KVNO: int(kvno), Cipher: encPart},
+	}, "application,explicit,tag:1")
+	if err != nil {
+		return nil, err
+	}
+	auth, err := asn1.MarshalWithParams(authenticator{
+		AuthenticatorVNO: 5,
+		CRealm:           client.Realm,
+		CName:            principalName{NameType: client.NameType, NameString: client.Components},
+		Cusec:            now.Nanosecond() / 1000,
+		CTime:            now.UTC().Truncate(time.Second),
+	}, "application,explicit,tag:2")
+	if err != nil {
+		return nil, err
+	}
+	encAuth, err := sessionKey.encrypt(usageAuthenticator, auth)
+	if err != nil {
+		return nil, err
+	}
+	req, err := asn1.MarshalWithParams(apReq{
+		PVNO:      5,
+		MsgType:   msgTypeAPReq,
+		APOptions: flags,
+		// Raw values are marshaled as they are, so the value includes the explicit tag
+		Ticket:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: tkt},
+		Authenticator: encryptedData{EType: sessionKey.Type, Cipher: encAuth},
+	}, fmt.Sprintf("application,explicit,tag:%d", msgTypeAPReq))
+	if err != nil {
+		return nil, err
+	}
+	mechToken, err := wrapGSSToken(krb5OID, append([]byte{tokenAPReq >> 8, tokenAPReq & 0xff}, req...))
+	if err != nil {
+		return nil, err
+	}
+	init, err := asn1.MarshalWithParams(negTokenInit{
+		MechTypes: []asn1.ObjectIdentifier{krb5OID},
+		MechToken: mechToken,
+	}, "explicit,tag:0")
+	if err != nil {
+		return nil, err
+	}
+	return wrapGSSToken(spnegoOID, init)
+}
@@ -0,0 +1,194 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spnego
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mapCache is a store.Cache that keeps entries forever
+type mapCache map[string][]byte
+
+func (c mapCache) Set(key string, entry []byte) error {
+	c[key] = entry
+	return nil
+}
+
+func (c mapCache) Get(key string) ([]byte, error) {
+	entry, ok := c[key]
+	if !ok {
+		return nil, errors.New("entry not found")
+	}
+	return entry, nil
+}
+
+func (c mapCache) Delete(key string) error {
+	delete(c, key)
+	return nil
+}
+
+func (c mapCache) Add(key string, entry []byte) (bool, error) {
+	if _, ok := c[key]; ok {
+		return false, nil
+	}
+	c[key] = entry
+	return true, nil
+}
+
+func (c mapCache) Take(key string) ([]byte, error) {
+	entry, err := c.Get(key)
+	delete(c, key)
+	return entry, err
+}
+
+func (c mapCache) Append(key string, entry []byte) error {
+	return errors.New("lists are not supported")
+}
+
+func (c mapCache) List(key string) ([][]byte, error) {
+	return nil, errors.New("lists are not supported")
+}
+
+func TestAcceptor_Accept(t *testing.T) {
+	service := Principal{NameType: NameTypeServiceHost, Components: []string{"HTTP", "idp.example.com"},
+		Realm: "EXAMPLE.COM"}
+	client := Principal{NameType: NameTypePrincipal, Components: []string{"jdoe"}, Realm: "EXAMPLE.COM"}
+	key, err := NewEncryptionKey(AES256CTSHMACSHA196)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keytab := &Keytab{Entries: []KeytabEntry{{Principal: service, KVNO: 2, Key: key}}}
+	acceptor := NewAcceptor(keytab, mapCache{}, 5*time.Minute)
+	now := time.Now()
+
+	token, err := NewToken(client, service, key, 2, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := acceptor.Accept(token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "jdoe@EXAMPLE.COM", principal.String())
+	}
+	// Authenticators can only be used once
+	_, err = acceptor.Accept(token)
+	assert.EqualError(t, err, "authenticator has already been used")
+
+	// Tickets must be encrypted with the key in the keytab
+	other, err := NewEncryptionKey(AES256CTSHMACSHA196)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = NewToken(client, service, other, 2, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acceptor.Accept(token)
+	assert.Error(t, err)
+
+	// Tickets for unknown key versions or services are rejected
+	token, err = NewToken(client, service, key, 3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acceptor.Accept(token)
+	assert.Error(t, err)
+	token, err = NewToken(client, Principal{Components: []string{"HTTP", "other.example.com"}, Realm: "EXAMPLE.COM"},
+		key, 2, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acceptor.Accept(token)
+	assert.Error(t, err)
+
+	// Old and expired tickets are rejected
+	token, err = NewToken(client, service, key, 2, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acceptor.Accept(token)
+	assert.EqualError(t, err, "authenticator time is outside the allowed clock skew")
+	acceptor.now = func() time.Time {
+		return now.Add(11 * time.Hour)
+	}
+	token, err = NewToken(client, service, key, 2, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acceptor.Accept(token)
+	assert.EqualError(t, err, "ticket has expired")
+}
+
+func Test_kerberosToken(t *testing.T) {
+	// A SPNEGO token from a client that prefers NTLM
+	ntlm, err := wrapGSSToken(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}, []byte("NTLMSSP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	init, err := asn1.MarshalWithParams(negTokenInit{
+		MechTypes: []asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}, krb5OID},
+		MechToken: ntlm,
+	}, "explicit,tag:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := wrapGSSToken(spnegoOID, init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kerberosToken(token)
+	assert.Equal(t, ErrNotKerberos, err)
+
+	// Raw NTLM tokens aren't GSS-API tokens
+	_, err = kerberosToken([]byte("NTLMSSP\x00\x01\x00\x00\x00"))
+	assert.Error(t, err)
+
+	// The response completing authentication is a negTokenResp selecting Kerberos
+	data, err := base64.StdEncoding.DecodeString(AcceptCompleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		NegState      asn1.Enumerated       `asn1:"explicit,tag:0"`
+		SupportedMech asn1.ObjectIdentifier `asn1:"explicit,tag:1"`
+	}
+	if _, err = asn1.UnmarshalWithParams(data, &resp, "explicit,tag:1"); assert.NoError(t, err) {
+		assert.Equal(t, asn1.Enumerated(0), resp.NegState)
+		assert.True(t, resp.SupportedMech.Equal(krb5OID))
+	}
+}
+
+func Test_generalString(t *testing.T) {
+	// Realms and names are sent as GeneralString
+	generalString := func(value string) asn1.RawValue {
+		return asn1.RawValue{Tag: asn1.TagGeneralString, Bytes: []byte(value)}
+	}
+	data, err := asn1.Marshal(struct {
+		NameType   int32           `asn1:"explicit,tag:0"`
+		NameString []asn1.RawValue `asn1:"explicit,tag:1"`
+	}{NameTypePrincipal, []asn1.RawValue{generalString("jdoe")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := principalName{}
+	if _, err = asn1.Unmarshal(data, &name); assert.NoError(t, err) {
+		assert.Equal(t, []string{"jdoe"}, name.NameString)
+	}
+}
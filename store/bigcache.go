@@ -15,11 +15,25 @@
 package store
 
 import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+
 	"github.com/allegro/bigcache"
 )
 
 type bigcacheStore struct {
-	cache *bigcache.BigCache
+	cache    *bigcache.BigCache
+	duration time.Duration
+	// Guards entries that are added or taken and lists, which are read and written back as a whole
+	lock sync.Mutex
+}
+
+// listEntry is an entry of a list along with when it was appended
+type listEntry struct {
+	Value []byte
+	Time  time.Time
 }
 
 func (b *bigcacheStore) Set(key string, entry []byte) error {
@@ -40,3 +54,88 @@ func (b *bigcacheStore) Get(key string) ([]byte, error) {
 func (b *bigcacheStore) Delete(key string) error {
 	return b.Set(key, []byte("DELETED"))
 }
+
+func (b *bigcacheStore) Add(key string, entry []byte) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, err := b.Get(key); err == nil {
+		return false, nil
+	} else if err != bigcache.ErrEntryNotFound {
+		return false, err
+	}
+	if err := b.cache.Set(key, entry); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *bigcacheStore) Take(key string) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.Delete(key); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (b *bigcacheStore) Append(key string, entry []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entries, err := b.list(key)
+	if err != nil {
+		return err
+	}
+	kept := []listEntry{}
+	for _, e := range entries {
+		if !bytes.Equal(e.Value, entry) {
+			kept = append(kept, e)
+		}
+	}
+	// The list itself lives as long as its newest entry
+	data, err := json.Marshal(append(kept, listEntry{Value: entry, Time: time.Now()}))
+	if err != nil {
+		return err
+	}
+	return b.cache.Set(key, data)
+}
+
+func (b *bigcacheStore) List(key string) ([][]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entries, err := b.list(key)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(entries))
+	for i, e := range entries {
+		values[i] = e.Value
+	}
+	return values, nil
+}
+
+// list returns the unexpired entries of a list
+func (b *bigcacheStore) list(key string) ([]listEntry, error) {
+	data, err := b.Get(key)
+	if err == bigcache.ErrEntryNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []listEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-b.duration)
+	unexpired := entries[:0]
+	for _, e := range entries {
+		if e.Time.After(cutoff) {
+			unexpired = append(unexpired, e)
+		}
+	}
+	return unexpired, nil
+}
@@ -24,6 +24,15 @@ type Cache interface {
 	Set(key string, entry []byte) error
 	Get(key string) ([]byte, error)
 	Delete(key string) error
+	// Add atomically stores the entry unless the key is already set and reports whether it was stored
+	Add(key string, entry []byte) (bool, error)
+	// Take atomically gets and deletes the entry, so only one caller receives it
+	Take(key string) ([]byte, error)
+	// Append atomically adds the entry to the list stored under the key. Each entry expires on its own, and
+	// appending an entry that's already in the list starts its lifetime again.
+	Append(key string, entry []byte) error
+	// List returns the unexpired entries of the list stored under the key, oldest first
+	List(key string) ([][]byte, error)
 }
 
 // Default to a big cache implementation
@@ -32,5 +41,5 @@ func New(duration time.Duration) (Cache, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &bigcacheStore{cache}, nil
+	return &bigcacheStore{cache: cache, duration: duration}, nil
 }
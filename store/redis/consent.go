@@ -0,0 +1,58 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"encoding/json"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/go-redis/redis"
+)
+
+// NewConsentStore returns a consent store shared by every instance using the Redis server. Decisions don't expire.
+func NewConsentStore() (idp.ConsentStore, error) {
+	return &consentStore{newClient()}, nil
+}
+
+type consentStore struct {
+	client *redis.Client
+}
+
+func decisionKey(spEntityID, userName string) string {
+	return "consent-decision:" + spEntityID + ":" + userName
+}
+
+func (s *consentStore) Decision(spEntityID, userName string) (*idp.ConsentDecision, error) {
+	data, err := s.client.Get(decisionKey(spEntityID, userName)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decision := &idp.ConsentDecision{}
+	if err = json.Unmarshal(data, decision); err != nil {
+		return nil, err
+	}
+	return decision, nil
+}
+
+func (s *consentStore) Save(decision *idp.ConsentDecision) error {
+	data, err := json.Marshal(decision)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(decisionKey(decision.SPEntityID, decision.UserName), data, 0).Err()
+}
@@ -0,0 +1,58 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConsentStore(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	store, err := NewConsentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, err := store.Decision("https://sp.example.com/", "joe")
+	assert.NoError(t, err)
+	assert.Nil(t, decision)
+	if err = store.Save(&idp.ConsentDecision{SPEntityID: "https://sp.example.com/", UserName: "joe",
+		AttributesHash: "abc", Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance sees the decision
+	other, err := NewConsentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, err = other.Decision("https://sp.example.com/", "joe")
+	if assert.NoError(t, err) && assert.NotNil(t, decision) {
+		assert.Equal(t, "abc", decision.AttributesHash)
+	}
+	decision, err = other.Decision("https://other.example.com/", "joe")
+	assert.NoError(t, err)
+	assert.Nil(t, decision)
+}
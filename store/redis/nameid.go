@@ -0,0 +1,91 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"encoding/json"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/go-redis/redis"
+)
+
+// saveLink stores the link under its identifier and points the user at it while it's active. A terminated link only
+// removes the user's pointer when the pointer is to the terminated identifier.
+var saveLink = redis.NewScript(`
+redis.call('SET', KEYS[1], ARGV[1])
+if ARGV[3] == '1' then
+	if redis.call('GET', KEYS[2]) == ARGV[2] then
+		redis.call('DEL', KEYS[2])
+	end
+else
+	redis.call('SET', KEYS[2], ARGV[2])
+end
+return 1`)
+
+// NewNameIDStore returns a name identifier store shared by every instance using the Redis server. Links don't expire.
+func NewNameIDStore() (idp.NameIDStore, error) {
+	return &nameIDStore{newClient()}, nil
+}
+
+type nameIDStore struct {
+	client *redis.Client
+}
+
+func linkValueKey(spEntityID, value string) string {
+	return "nameid-value:" + spEntityID + ":" + value
+}
+
+func linkUserKey(spEntityID, userName string) string {
+	return "nameid-user:" + spEntityID + ":" + userName
+}
+
+func (s *nameIDStore) LinkForUser(spEntityID, userName string) (*idp.NameIDLink, error) {
+	value, err := s.client.Get(linkUserKey(spEntityID, userName)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.LinkForValue(spEntityID, value)
+}
+
+func (s *nameIDStore) LinkForValue(spEntityID, value string) (*idp.NameIDLink, error) {
+	data, err := s.client.Get(linkValueKey(spEntityID, value)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	link := &idp.NameIDLink{}
+	if err = json.Unmarshal(data, link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (s *nameIDStore) Save(link *idp.NameIDLink) error {
+	data, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	terminated := "0"
+	if link.Terminated {
+		terminated = "1"
+	}
+	return saveLink.Run(s.client, []string{linkValueKey(link.SPEntityID, link.Value),
+		linkUserKey(link.SPEntityID, link.UserName)}, data, link.Value, terminated).Err()
+}
@@ -0,0 +1,71 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewNameIDStore(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	store, err := NewNameIDStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &idp.NameIDLink{SPEntityID: "https://sp.example.com/", UserName: "joe", Value: "abc"}
+	if err = store.Save(link); err != nil {
+		t.Fatal(err)
+	}
+	link.SPProvidedID = "joe@sp"
+	if err = store.Save(link); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance sees the link
+	other, err := NewNameIDStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := other.LinkForUser("https://sp.example.com/", "joe")
+	if assert.NoError(t, err) && assert.NotNil(t, found) {
+		assert.Equal(t, "abc", found.Value)
+		assert.Equal(t, "joe@sp", found.SPProvidedID)
+	}
+	found, err = other.LinkForValue("https://other.example.com/", "abc")
+	assert.NoError(t, err)
+	assert.Nil(t, found, "identifiers belong to a single service provider")
+
+	link.Terminated = true
+	if err = store.Save(link); err != nil {
+		t.Fatal(err)
+	}
+	found, err = other.LinkForUser("https://sp.example.com/", "joe")
+	assert.NoError(t, err)
+	assert.Nil(t, found, "terminated links aren't active")
+	found, err = other.LinkForValue("https://sp.example.com/", "abc")
+	if assert.NoError(t, err) && assert.NotNil(t, found) {
+		assert.True(t, found.Terminated)
+	}
+}
@@ -15,6 +15,7 @@
 package redis
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/amdonov/lite-idp/store"
@@ -23,11 +24,14 @@ import (
 )
 
 func New(duration time.Duration) (store.Cache, error) {
-	redisdb := redis.NewClient(&redis.Options{
+	return &cache{newClient(), duration}, nil
+}
+
+func newClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
 		Addr:     viper.GetString("redis.address"),
 		Password: viper.GetString("redis.password"),
 	})
-	return &cache{redisdb, duration}, nil
 }
 
 type cache struct {
@@ -49,6 +53,56 @@ func (c *cache) Delete(key string) error {
 	return c.client.Del(key).Err()
 }
 
+func (c *cache) Add(key string, entry []byte) (bool, error) {
+	return c.client.SetNX(key, entry, c.duration).Result()
+}
+
+func (c *cache) Take(key string) ([]byte, error) {
+	var get *redis.StringCmd
+	_, err := c.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(key)
+		pipe.Del(key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return get.Bytes()
+}
+
+// Lists are sorted sets scored by when each entry was appended in milliseconds. Expired entries are removed when
+// new ones are appended.
+func (c *cache) Append(key string, entry []byte) error {
+	now := time.Now()
+	_, err := c.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(key, redis.Z{Score: float64(milliseconds(now)), Member: entry})
+		pipe.ZRemRangeByScore(key, "-inf", strconv.FormatInt(milliseconds(now.Add(-c.duration)), 10))
+		pipe.Expire(key, c.duration)
+		return nil
+	})
+	return err
+}
+
+func (c *cache) List(key string) ([][]byte, error) {
+	cutoff := milliseconds(time.Now().Add(-c.duration))
+	members, err := c.client.ZRangeByScore(key, redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(cutoff, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, len(members))
+	for i, member := range members {
+		entries[i] = []byte(member)
+	}
+	return entries, nil
+}
+
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 func init() {
 	viper.SetDefault("redis.address", "127.0.0.1:6379")
 	viper.SetDefault("redis.password", "")
@@ -49,3 +49,74 @@ func TestNew(t *testing.T) {
 		t.Fatal("should not have returned value")
 	}
 }
+
+func TestCache_Append(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	cache, err := New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := cache.List("list")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	for _, entry := range []string{"a", "b", "a"} {
+		if err = cache.Append("list", []byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err = cache.List("list")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.True(t, s.Exists("list"))
+	assert.Equal(t, time.Minute, s.TTL("list"))
+}
+
+func TestCache_Take(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	cache, err := New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Set("ticket", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := cache.Take("ticket")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), res)
+	assert.False(t, s.Exists("ticket"))
+	_, err = cache.Take("ticket")
+	assert.Error(t, err)
+}
+
+func TestCache_Add(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	cache, err := New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := cache.Add("request", []byte("first"))
+	assert.NoError(t, err)
+	assert.True(t, added)
+	added, err = cache.Add("request", []byte("second"))
+	assert.NoError(t, err)
+	assert.False(t, added)
+	res, err := cache.Get("request")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), res)
+	assert.Equal(t, time.Minute, s.TTL("request"))
+}
@@ -41,3 +41,74 @@ func TestDelete(t *testing.T) {
 		t.Fatal("should not have returned value")
 	}
 }
+
+func TestAppend(t *testing.T) {
+	cache, err := New(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Append("list", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	cache.Append("list", []byte("b"))
+	cache.Append("list", []byte("b"))
+	entries, err := cache.List("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || string(entries[0]) != "a" || string(entries[1]) != "b" {
+		t.Fatalf("unexpected entries %q", entries)
+	}
+	// Expired entries are dropped while newer ones remain
+	time.Sleep(600 * time.Millisecond)
+	entries, err = cache.List("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0]) != "b" {
+		t.Fatalf("unexpected entries %q", entries)
+	}
+}
+
+func TestTake(t *testing.T) {
+	cache, err := New(5 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("ticket", []byte("content"))
+	data, err := cache.Take("ticket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content" {
+		t.Fatal("data did not match expected value")
+	}
+	if _, err = cache.Take("ticket"); err == nil {
+		t.Fatal("entry was taken twice")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	cache, err := New(5 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := cache.Add("request", []byte("first"))
+	if err != nil || !added {
+		t.Fatal("entry was not added")
+	}
+	added, err = cache.Add("request", []byte("second"))
+	if err != nil || added {
+		t.Fatal("entry was added twice")
+	}
+	data, err := cache.Get("request")
+	if err != nil || string(data) != "first" {
+		t.Fatal("entry was replaced")
+	}
+	// Deleted entries can be added again
+	cache.Delete("request")
+	if added, err = cache.Add("request", []byte("third")); err != nil || !added {
+		t.Fatal("deleted entry was not added")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wsfed contains the messages and metadata of the WS-Federation passive requestor profile
+package wsfed
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/amdonov/lite-idp/saml"
+)
+
+const (
+	// SignIn is the wa parameter of sign in requests and responses
+	SignIn = "wsignin1.0"
+	// SignOut is the wa parameter of sign out requests
+	SignOut = "wsignout1.0"
+	// SignOutCleanup is the wa parameter of requests to clean up a session after signing out elsewhere
+	SignOutCleanup = "wsignoutcleanup1.0"
+
+	// RequestTypeIssue is the request type of issued tokens
+	RequestTypeIssue = "http://schemas.xmlsoap.org/ws/2005/02/trust/Issue"
+	// KeyTypeBearer is the key type of tokens without a proof key
+	KeyTypeBearer = "http://schemas.xmlsoap.org/ws/2005/05/identity/NoProofKey"
+	// TokenTypeSAML11 is the token type of SAML 1.1 assertions
+	TokenTypeSAML11 = "urn:oasis:names:tc:SAML:1.0:assertion"
+	// TokenTypeSAML20 is the token type of SAML 2.0 assertions
+	TokenTypeSAML20 = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	// Federation is the WS-Federation protocol namespace
+	Federation = "http://docs.oasis-open.org/wsfed/federation/200706"
+)
+
+type RequestSecurityTokenResponse struct {
+	XMLName                xml.Name `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust RequestSecurityTokenResponse"`
+	Lifetime               *Lifetime
+	AppliesTo              *AppliesTo
+	RequestedSecurityToken RequestedSecurityToken
+	TokenType              string `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust TokenType"`
+	RequestType            string `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust RequestType"`
+	KeyType                string `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust KeyType"`
+}
+
+type Lifetime struct {
+	XMLName xml.Name  `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust Lifetime"`
+	Created time.Time `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd Created"`
+	Expires time.Time `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd Expires"`
+}
+
+type AppliesTo struct {
+	XMLName           xml.Name `xml:"http://schemas.xmlsoap.org/ws/2004/09/policy AppliesTo"`
+	EndpointReference EndpointReference
+}
+
+// NewAppliesTo returns the scope of a token issued for the address
+func NewAppliesTo(address string) *AppliesTo {
+	return &AppliesTo{EndpointReference: EndpointReference{Address: address}}
+}
+
+type EndpointReference struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/08/addressing EndpointReference"`
+	Address string   `xml:"http://www.w3.org/2005/08/addressing Address"`
+}
+
+type RequestedSecurityToken struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust RequestedSecurityToken"`
+	// The signed assertion, which must not be serialized again
+	Token string `xml:",innerxml"`
+}
+
+type EntityDescriptor struct {
+	saml.EntityDescriptor
+	RoleDescriptor SecurityTokenServiceDescriptor
+}
+
+// SecurityTokenServiceDescriptor is the role descriptor of a WS-Federation security token service
+type SecurityTokenServiceDescriptor struct {
+	XMLName                      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata RoleDescriptor"`
+	FedNamespace                 string   `xml:"xmlns:fed,attr"`
+	XSINamespace                 string   `xml:"xmlns:xsi,attr"`
+	Type                         string   `xml:"xsi:type,attr"`
+	ProtocolSupportEnumeration   string   `xml:"protocolSupportEnumeration,attr"`
+	KeyDescriptor                []saml.KeyDescriptor
+	TokenTypesOffered            TokenTypesOffered
+	SecurityTokenServiceEndpoint EndpointReferenceContainer `xml:"http://docs.oasis-open.org/wsfed/federation/200706 SecurityTokenServiceEndpoint"`
+	PassiveRequestorEndpoint     EndpointReferenceContainer `xml:"http://docs.oasis-open.org/wsfed/federation/200706 PassiveRequestorEndpoint"`
+}
+
+// NewSecurityTokenServiceDescriptor returns a role descriptor for a security token service
+func NewSecurityTokenServiceDescriptor() SecurityTokenServiceDescriptor {
+	return SecurityTokenServiceDescriptor{
+		FedNamespace:               Federation,
+		XSINamespace:               "http://www.w3.org/2001/XMLSchema-instance",
+		Type:                       "fed:SecurityTokenServiceType",
+		ProtocolSupportEnumeration: Federation,
+	}
+}
+
+type TokenTypesOffered struct {
+	XMLName   xml.Name    `xml:"http://docs.oasis-open.org/wsfed/federation/200706 TokenTypesOffered"`
+	TokenType []TokenType `xml:"http://docs.oasis-open.org/wsfed/federation/200706 TokenType"`
+}
+
+type TokenType struct {
+	URI string `xml:"Uri,attr"`
+}
+
+type EndpointReferenceContainer struct {
+	EndpointReference EndpointReference
+}
@@ -0,0 +1,189 @@
+// Copyright © 2019 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wstrust contains the WS-Trust 1.3 messages used to issue SAML tokens to web service clients
+package wstrust
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/wsfed"
+	"github.com/amdonov/xmlsig"
+)
+
+const (
+	// Namespace is the WS-Trust 1.3 namespace
+	Namespace = "http://docs.oasis-open.org/ws-sx/ws-trust/200512"
+	// Addressing is the WS-Addressing namespace
+	Addressing = "http://www.w3.org/2005/08/addressing"
+
+	// RequestTypeIssue is the request type of requests for new tokens
+	RequestTypeIssue = "http://docs.oasis-open.org/ws-sx/ws-trust/200512/Issue"
+	// ActionIssueFinal is the action of the final response to an issue request
+	ActionIssueFinal = "http://docs.oasis-open.org/ws-sx/ws-trust/200512/RSTRC/IssueFinal"
+
+	// KeyTypeBearer is the key type of tokens without a proof key
+	KeyTypeBearer = "http://docs.oasis-open.org/ws-sx/ws-trust/200512/Bearer"
+	// KeyTypePublicKey is the key type of tokens confirmed with the requestor's public key
+	KeyTypePublicKey = "http://docs.oasis-open.org/ws-sx/ws-trust/200512/PublicKey"
+	// KeyTypeSymmetricKey is the key type of tokens confirmed with a shared secret
+	KeyTypeSymmetricKey = "http://docs.oasis-open.org/ws-sx/ws-trust/200512/SymmetricKey"
+
+	// TokenTypeSAML20 is the WS-Security token type of SAML 2.0 assertions
+	TokenTypeSAML20 = "http://docs.oasis-open.org/wss/oasis-wss-saml-token-profile-1.1#SAMLV2.0"
+	// KeyIdentifierSAMLID is the value type of references to SAML 2.0 assertions by ID
+	KeyIdentifierSAMLID = "http://docs.oasis-open.org/wss/oasis-wss-saml-token-profile-1.1#SAMLID"
+	// PasswordText is the type of UsernameToken passwords sent in the clear
+	PasswordText = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordText"
+)
+
+// Fault codes, which are qualified with the wst prefix
+const (
+	FaultInvalidRequest       = "wst:InvalidRequest"
+	FaultFailedAuthentication = "wst:FailedAuthentication"
+	FaultRequestFailed        = "wst:RequestFailed"
+	FaultBadRequest           = "wst:BadRequest"
+)
+
+type RequestSecurityTokenEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Header  *RequestHeader
+	Body    RequestBody
+}
+
+// RequestHeader contains the header blocks a client may send along with a request
+type RequestHeader struct {
+	XMLName   xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Header"`
+	Security  *Security
+	MessageID string `xml:"http://www.w3.org/2005/08/addressing MessageID"`
+	// Other header blocks including the rest of the WS-Addressing headers
+	Other []saml.SOAPHeaderBlock `xml:",any"`
+}
+
+type Security struct {
+	XMLName       xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd Security"`
+	UsernameToken *UsernameToken
+}
+
+type UsernameToken struct {
+	XMLName  xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd UsernameToken"`
+	Username string   `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd Username"`
+	Password *Password
+}
+
+type Password struct {
+	XMLName xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd Password"`
+	Type    string   `xml:",attr"`
+	Value   string   `xml:",chardata"`
+}
+
+type RequestBody struct {
+	XMLName              xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	RequestSecurityToken RequestSecurityToken
+}
+
+type RequestSecurityToken struct {
+	XMLName     xml.Name `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 RequestSecurityToken"`
+	Context     string   `xml:",attr"`
+	TokenType   string   `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 TokenType"`
+	RequestType string   `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 RequestType"`
+	AppliesTo   *wsfed.AppliesTo
+	KeyType     string `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 KeyType"`
+	UseKey      *UseKey
+}
+
+// UseKey is the key the requestor wants a holder-of-key token confirmed with
+type UseKey struct {
+	XMLName xml.Name `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 UseKey"`
+	KeyInfo *xmlsig.KeyInfo
+}
+
+type RequestSecurityTokenResponseEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Header  *ResponseHeader
+	Body    ResponseBody
+}
+
+// ResponseHeader contains the WS-Addressing headers of a response
+type ResponseHeader struct {
+	XMLName   xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Header"`
+	Action    string   `xml:"http://www.w3.org/2005/08/addressing Action"`
+	RelatesTo string   `xml:"http://www.w3.org/2005/08/addressing RelatesTo"`
+}
+
+type ResponseBody struct {
+	XMLName                                xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	RequestSecurityTokenResponseCollection RequestSecurityTokenResponseCollection
+}
+
+type RequestSecurityTokenResponseCollection struct {
+	XMLName                      xml.Name `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 RequestSecurityTokenResponseCollection"`
+	RequestSecurityTokenResponse []RequestSecurityTokenResponse
+}
+
+type RequestSecurityTokenResponse struct {
+	XMLName                      xml.Name `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 RequestSecurityTokenResponse"`
+	Context                      string   `xml:",attr,omitempty"`
+	TokenType                    string   `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 TokenType"`
+	RequestedSecurityToken       RequestedSecurityToken
+	AppliesTo                    *wsfed.AppliesTo
+	RequestedAttachedReference   *RequestedReference `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 RequestedAttachedReference"`
+	RequestedUnattachedReference *RequestedReference `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 RequestedUnattachedReference"`
+	Lifetime                     *Lifetime
+	KeyType                      string `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 KeyType"`
+}
+
+type RequestedSecurityToken struct {
+	XMLName xml.Name `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 RequestedSecurityToken"`
+	// The signed assertion, which must not be serialized again
+	Token string `xml:",innerxml"`
+}
+
+type Lifetime struct {
+	XMLName xml.Name  `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 Lifetime"`
+	Created time.Time `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd Created"`
+	Expires time.Time `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd Expires"`
+}
+
+// RequestedReference tells the requestor how to refer to the issued token
+type RequestedReference struct {
+	SecurityTokenReference SecurityTokenReference
+}
+
+// NewSAMLReference returns a reference to the SAML 2.0 assertion with the ID
+func NewSAMLReference(id string) *RequestedReference {
+	return &RequestedReference{
+		SecurityTokenReference: SecurityTokenReference{
+			TokenType: TokenTypeSAML20,
+			KeyIdentifier: KeyIdentifier{
+				ValueType: KeyIdentifierSAMLID,
+				Value:     id,
+			},
+		},
+	}
+}
+
+type SecurityTokenReference struct {
+	XMLName       xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd SecurityTokenReference"`
+	TokenType     string   `xml:"http://docs.oasis-open.org/wss/oasis-wss-wssecurity-secext-1.1.xsd TokenType,attr"`
+	KeyIdentifier KeyIdentifier
+}
+
+type KeyIdentifier struct {
+	XMLName   xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd KeyIdentifier"`
+	ValueType string   `xml:",attr"`
+	Value     string   `xml:",chardata"`
+}